@@ -0,0 +1,134 @@
+package msgauth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+var (
+	// armorFlag is a flag for printing the wire messages hash creates as ASCII-armored blocks
+	armorFlag = flags.Bool("armor", false, "Print the wire messages created by hash as ASCII-armored blocks, which survive line wrapping in emails and tickets")
+	// keyIDFlag is a flag for naming the shared secret in the Key-ID header of armored messages
+	keyIDFlag = flags.String("key-id", "", "An identifier of the shared secret for the Key-ID header of armored messages, which verify checks if both sides set it")
+)
+
+const (
+	armorBegin = "-----BEGIN AUTH MESSAGE-----"
+	armorEnd   = "-----END AUTH MESSAGE-----"
+	// armorWidth is the length of the body lines, like in PEM
+	armorWidth = 64
+)
+
+// ArmoredMessage is a wire message in an ASCII-armored block. The block consists of the BEGIN line, "Name: value"
+// headers, an empty line, the base64-encoded wire message wrapped at 64 characters, and the END line
+type ArmoredMessage struct {
+	// Headers are e.g. the Algorithm of the MAC and the Key-ID of the shared secret
+	Headers map[string]string
+	// WireMessage is the string-encoded message over the wire
+	WireMessage string
+}
+
+// NewArmoredMessage creates an armored block for the wire message, with the algorithm header and the key ID
+// header if keyID isn't empty
+func NewArmoredMessage(wm *WireMessage, algorithm, keyID string) *ArmoredMessage {
+	am := &ArmoredMessage{
+		Headers:     map[string]string{"Algorithm": algorithm},
+		WireMessage: wm.String(),
+	}
+	if keyID != "" {
+		am.Headers["Key-ID"] = keyID
+	}
+	return am
+}
+
+// headerNames returns the names of the headers in alphabetical order
+func (am *ArmoredMessage) headerNames() []string {
+	names := make([]string, 0, len(am.Headers))
+	for name := range am.Headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// String returns the armored block, without a trailing newline
+func (am *ArmoredMessage) String() string {
+	lines := []string{armorBegin}
+	for _, name := range am.headerNames() {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, am.Headers[name]))
+	}
+	lines = append(lines, "")
+	body := base64.StdEncoding.EncodeToString([]byte(am.WireMessage))
+	for len(body) > armorWidth {
+		lines = append(lines, body[:armorWidth])
+		body = body[armorWidth:]
+	}
+	lines = append(lines, body, armorEnd)
+	return strings.Join(lines, "\n")
+}
+
+// isArmored returns whether the text contains an armored block
+func isArmored(text string) bool {
+	return strings.Contains(text, armorBegin)
+}
+
+// armorLine returns a line of an armored block without the "> " quoting of emails and of the printf() output,
+// and without surrounding whitespace
+func armorLine(line string) string {
+	return strings.TrimSpace(strings.TrimLeft(line, "> \t"))
+}
+
+// ParseArmoredMessage returns the armored message in the text, which may also contain text around the block.
+// It tolerates quoting, surrounding whitespace, CRLF line endings and the body being wrapped differently
+// ParseArmoredMessage DOES NOT verify the authenticity of the message
+func ParseArmoredMessage(text string) (*ArmoredMessage, error) {
+	am := &ArmoredMessage{Headers: map[string]string{}}
+	body := ""
+	begun, ended := false, false
+	for _, line := range strings.Split(text, "\n") {
+		line = armorLine(line)
+		switch {
+		case !begun:
+			begun = line == armorBegin
+		case line == armorEnd:
+			ended = true
+		case line == "":
+		case body == "" && strings.Contains(line, ":"):
+			// The base64 alphabet has no colons, so this is a header
+			parts := strings.SplitN(line, ":", 2)
+			am.Headers[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+		default:
+			body += strings.Join(strings.Fields(line), "")
+		}
+		if ended {
+			break
+		}
+	}
+	if !begun {
+		return nil, fmt.Errorf("expected an armored message starting with %q", armorBegin)
+	}
+	if !ended {
+		return nil, fmt.Errorf("the armored message has no %q line", armorEnd)
+	}
+
+	wirestr, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, fmt.Errorf("the body of the armored message is not base64-encoded: %v", err)
+	}
+	am.WireMessage = string(wirestr)
+	return am, nil
+}
+
+// checkHeaders returns an error if the headers don't match the algorithm and key ID this side uses. An empty key ID
+// on either side isn't checked
+func (am *ArmoredMessage) checkHeaders(algorithm, keyID string) error {
+	if algo, ok := am.Headers["Algorithm"]; ok && !strings.EqualFold(algo, algorithm) {
+		return fmt.Errorf("the message was hashed with %s, but --algorithm is %s", algo, algorithm)
+	}
+	if id := am.Headers["Key-ID"]; id != "" && keyID != "" && id != keyID {
+		return fmt.Errorf("the message was hashed with the secret %q, but --key-id is %q", id, keyID)
+	}
+	return nil
+}
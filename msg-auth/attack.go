@@ -0,0 +1,98 @@
+package msgauth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"hash"
+
+	"github.com/luxas/random-schoolwork/pkg/hashing"
+)
+
+// lengthExtension describes how a Merkle–Damgård hash pads its input, and how its state is marshaled by the Go
+// implementation, which is what a length-extension attack needs to continue hashing from a digest
+type lengthExtension struct {
+	newHash   func() hash.Hash
+	blockSize int
+	// lengthSize is how many bytes the length of the input, in bits, takes at the end of the padding
+	lengthSize int
+	// magic begins the marshaled state of the hash
+	magic string
+}
+
+// lengthExtensions are the algorithms the demo attacks. MD5 and SHA-1 are vulnerable too, while SHA-3 isn't, as
+// its digest is only part of its state
+var lengthExtensions = map[hashing.HashAlgorithm]lengthExtension{
+	hashing.SHA2_256: {newHash: sha256.New, blockSize: sha256.BlockSize, lengthSize: 8, magic: "sha\x03"},
+	hashing.SHA2_512: {newHash: sha512.New, blockSize: sha512.BlockSize, lengthSize: 16, magic: "sha\x07"},
+}
+
+// padding returns the padding the hash appends to an input of n bytes: a 1 bit, 0 bits up to the length, and the
+// length in bits
+func (le lengthExtension) padding(n int) []byte {
+	p := []byte{0x80}
+	for (n+len(p))%le.blockSize != le.blockSize-le.lengthSize {
+		p = append(p, 0)
+	}
+	length := make([]byte, le.lengthSize)
+	binary.BigEndian.PutUint64(length[le.lengthSize-8:], uint64(n)*8)
+	return append(p, length...)
+}
+
+// extend returns the message with the padding of H(secret + message) and the extension appended, and its digest
+// with the same secret, computed from the digest of the message alone. It only needs the length of the secret
+func (le lengthExtension) extend(digest []byte, secretLen int, message, extension string) (string, []byte, error) {
+	padding := le.padding(secretLen + len(message))
+	processed := secretLen + len(message) + len(padding)
+
+	// The digest is the state of the hash after the padded input, so hashing can go on from it
+	state := append([]byte(le.magic), digest...)
+	state = append(state, make([]byte, le.blockSize)...)
+	state = append(state, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(state[len(state)-8:], uint64(processed))
+	h := le.newHash()
+	if err := h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return "", nil, err
+	}
+	_, _ = h.Write([]byte(extension))
+	return message + string(padding) + extension, h.Sum(nil), nil
+}
+
+// AttackDemo forges a wire message that ends with the extension from a wire message, without knowing the secret,
+// and shows it verifying. Real attackers try the secret lengths against the receiver, this demo verifies locally
+func AttackDemo(args []string) error {
+	le, ok := lengthExtensions[hashing.HashAlgorithm(*hashAlgorithm)]
+	if !ok {
+		return fmt.Errorf("the demo attacks %s and %s, choose one of them with --algorithm. %s and %s are vulnerable too, sha3 isn't",
+			hashing.SHA2_256, hashing.SHA2_512, hashing.MD5_128, hashing.SHA1_160)
+	}
+	wm, err := ParseWireMessage(args[0], globalHasher.Size())
+	if err != nil {
+		return err
+	}
+	extension := args[1]
+	printf("Extending %q with %q, using only its MAC %x\n", wm.Message, extension, wm.Hash)
+
+	for secretLen := 1; ; secretLen++ {
+		message, digest, err := le.extend(wm.Hash, secretLen, wm.Message, extension)
+		if err != nil {
+			return err
+		}
+		if len(message) > 0xff {
+			return fmt.Errorf("no forgery for secrets of up to %d bytes verifies, and longer ones don't fit the 1-byte length header", secretLen-1)
+		}
+		forged := &WireMessage{Length: uint8(len(message)), Message: message, Hash: digest}
+		if !forged.Verify(globalHasher) {
+			continue
+		}
+		printf("Guessing that the secret is %d bytes long, after %d wrong guesses, the forged message verifies:\n", secretLen, secretLen-1)
+		printf("Message: %q\n", forged.Message)
+		// The padding isn't printable, so the wire message is quoted too
+		printf("Wire message: %q\n", forged.String())
+		printf("Message verified! The receiver trusts the forged message, as %s(secret + message) can be extended\n", *hashAlgorithm)
+		printf("HMACs, as in --openssl mode, and sha3 algorithms, like the default %s, aren't vulnerable\n", hashing.SHA3_512)
+		return nil
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package msgauth
 
 import (
 	"bufio"
@@ -22,8 +22,10 @@ func CLIHandler(fn cliFunc, args []string, desc string) cliHandler {
 
 func printf(format string, args ...interface{}) {
 	fmt.Printf("> "+format, args...)
+	transcript.output(fmt.Sprintf(format, args...))
 }
 
+// HandleCommandLoop runs the commands the user enters, until quit, exit or the end of the input
 func HandleCommandLoop(cmds CLIHandlers) {
 	cmdHelp(cmds)
 
@@ -31,17 +33,24 @@ func HandleCommandLoop(cmds CLIHandlers) {
 	scanner := bufio.NewScanner(os.Stdin)
 	for {
 		fmt.Printf("$ ")
-		scanner.Scan()
-		if scanner.Err() != nil {
-			printf("Scanner experienced errors: %v\n", scanner.Err())
-			os.Exit(1)
+		if !scanner.Scan() {
+			if scanner.Err() != nil {
+				logger.Fatalf("Scanner experienced errors: %v", scanner.Err())
+			}
+			// Ctrl+D quits too
+			fmt.Println()
+			return
 		}
 
 		parts := strings.Split(scanner.Text(), ",")
+		// An argument beginning an armored block goes on over the following lines, to the end of the block
+		if last := len(parts) - 1; last > 0 && armorLine(parts[last]) == armorBegin {
+			parts[last] = scanArmoredBlock(scanner, parts[last])
+		}
 		command := parts[0]
 		switch command {
 		case "quit", "exit":
-			os.Exit(0)
+			return
 		case "help":
 			cmdHelp(cmds)
 			continue
@@ -69,6 +78,15 @@ func HandleCommandLoop(cmds CLIHandlers) {
 	}
 }
 
+// scanArmoredBlock returns the armored block beginning with the first line, up to and including its END line
+func scanArmoredBlock(scanner *bufio.Scanner, first string) string {
+	lines := []string{first}
+	for armorLine(lines[len(lines)-1]) != armorEnd && scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return strings.Join(lines, "\n")
+}
+
 func cmdHelp(commands CLIHandlers) {
 	printf("Usage:\n")
 	for cmd, handler := range commands {
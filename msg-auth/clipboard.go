@@ -0,0 +1,83 @@
+package msgauth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+var (
+	// copyFlag is a flag for placing the wire messages hash creates on the system clipboard
+	copyFlag = flags.Bool("copy", false, "Copy the wire messages created by hash to the system clipboard")
+	// pasteFlag is a flag for making verify read the wire message from the system clipboard
+	pasteFlag = flags.Bool("paste", false, "Make verify read the wire message from the system clipboard, instead of taking it as an argument")
+)
+
+// clipboardTool is a command line tool for copying to and pasting from the system clipboard
+type clipboardTool struct {
+	copy  []string
+	paste []string
+}
+
+// clipboardTools returns the clipboard tools of the platform, in the order of preference
+func clipboardTools() []clipboardTool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{{copy: []string{"pbcopy"}, paste: []string{"pbpaste"}}}
+	case "windows":
+		return []clipboardTool{{copy: []string{"clip"}, paste: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard"}}}
+	}
+	tools := []clipboardTool{
+		{copy: []string{"xclip", "-selection", "clipboard"}, paste: []string{"xclip", "-selection", "clipboard", "-o"}},
+		{copy: []string{"xsel", "--clipboard", "--input"}, paste: []string{"xsel", "--clipboard", "--output"}},
+	}
+	if os.Getenv("WAYLAND_DISPLAY") != "" {
+		tools = append([]clipboardTool{{copy: []string{"wl-copy"}, paste: []string{"wl-paste", "--no-newline"}}}, tools...)
+	}
+	return tools
+}
+
+// findClipboardTool returns the first clipboard tool that is installed
+func findClipboardTool() (*clipboardTool, error) {
+	names := []string{}
+	for _, tool := range clipboardTools() {
+		if _, err := exec.LookPath(tool.copy[0]); err == nil {
+			return &tool, nil
+		}
+		names = append(names, tool.copy[0])
+	}
+	return nil, fmt.Errorf("no clipboard tool found, install one of: %s", strings.Join(names, ", "))
+}
+
+// copyToClipboard places the text on the system clipboard
+func copyToClipboard(text string) error {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(tool.copy[0], tool.copy[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", tool.copy[0], err, out)
+	}
+	return nil
+}
+
+// pasteFromClipboard returns the text on the system clipboard, without surrounding whitespace
+func pasteFromClipboard() (string, error) {
+	tool, err := findClipboardTool()
+	if err != nil {
+		return "", err
+	}
+	stderr := &bytes.Buffer{}
+	cmd := exec.Command(tool.paste[0], tool.paste[1:]...)
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", tool.paste[0], err, stderr)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,12 @@
+// Command msg-auth is the standalone binary of msg-auth, which is also the msg-auth subcommand of the schoolwork binary
+package main
+
+import (
+	"os"
+
+	msgauth "github.com/luxas/random-schoolwork/msg-auth"
+)
+
+func main() {
+	msgauth.Main(os.Args[1:])
+}
@@ -0,0 +1,63 @@
+package msgauth
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// secretKeychain is a flag for loading the shared secret from the OS keychain instead of --secret
+var secretKeychain = flags.String("secret-keychain", "", "Load the shared secret from the entry with this name in the OS keychain instead of --secret: the macOS Keychain, the Secret Service on Linux, or a DPAPI-protected file on Windows")
+
+// keychainService is the service of the keychain entries, which the names are the accounts of
+const keychainService = "msg-auth"
+
+// keychainCommand returns the command that prints the secret of the keychain entry, and how to get the command if
+// it isn't found
+func keychainCommand(name string) (*exec.Cmd, string) {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("security", "find-generic-password", "-s", keychainService, "-a", name, "-w"), "it's part of macOS"
+	case "windows":
+		// Windows has no keychain CLI, so the secret is in a file encrypted with DPAPI for the current user. The path is
+		// given in the environment, so that it isn't parsed as PowerShell
+		cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command",
+			"$s = Get-Content -LiteralPath $env:MSG_AUTH_KEYCHAIN_FILE | ConvertTo-SecureString; "+
+				"[Runtime.InteropServices.Marshal]::PtrToStringBSTR([Runtime.InteropServices.Marshal]::SecureStringToBSTR($s))")
+		cmd.Env = append(os.Environ(), "MSG_AUTH_KEYCHAIN_FILE="+keychainFile(name))
+		return cmd, "install PowerShell"
+	}
+	return exec.Command("secret-tool", "lookup", "service", keychainService, "account", name), "install it, e.g. from the libsecret-tools package"
+}
+
+// keychainFile is the DPAPI-protected file of the keychain entry on Windows
+func keychainFile(name string) string {
+	return filepath.Join(os.Getenv("APPDATA"), keychainService, name+".dpapi")
+}
+
+// loadKeychainSecret returns the secret of the keychain entry with the name
+func loadKeychainSecret(name string) (string, error) {
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return "", fmt.Errorf("--secret-keychain must be a name, not a path")
+	}
+	cmd, hint := keychainCommand(name)
+	if _, err := exec.LookPath(cmd.Path); err != nil {
+		return "", fmt.Errorf("%s not found, %s", filepath.Base(cmd.Path), hint)
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("couldn't load the secret %q from the keychain: %s failed: %v: %s", name, filepath.Base(cmd.Path), err, strings.TrimSpace(stderr.String()))
+	}
+	// The tools end the secret with a newline, which isn't part of it
+	secret := strings.TrimRight(string(out), "\r\n")
+	if secret == "" {
+		return "", fmt.Errorf("the secret %q in the keychain is empty", name)
+	}
+	return secret, nil
+}
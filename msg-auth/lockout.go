@@ -0,0 +1,93 @@
+package msgauth
+
+import (
+	"fmt"
+	"time"
+)
+
+var (
+	// maxFailures is a flag for locking verification after that many consecutive failures, 0 disables the guard
+	maxFailures = flags.Int("max-failures", 0, "Lock verification for --lockout after this many consecutive failed verifications, and delay every failure. 0 disables it")
+	// failureDelay is a flag for the delay after the first failed verification, which doubles with every failure
+	failureDelay = flags.Duration("failure-delay", 500*time.Millisecond, "How long to delay the first failed verification, doubling with every consecutive failure")
+	// lockoutDuration is a flag for how long verification is locked after --max-failures failures
+	lockoutDuration = flags.Duration("lockout", time.Minute, "How long verification is locked after --max-failures consecutive failures")
+)
+
+// maxFailureDelay caps the doubling delay of failed verifications
+const maxFailureDelay = 10 * time.Second
+
+// verificationGuard slows down and locks out repeated failed verifications in a session, so that the verify
+// commands can't be used as an oracle for forging MACs by trial and error. A nil guard allows everything
+type verificationGuard struct {
+	maxFailures int
+	delay       time.Duration
+	lockout     time.Duration
+	// failures counts the consecutive failed verifications
+	failures    int
+	lockedUntil time.Time
+}
+
+// guard is set if --max-failures is
+var guard *verificationGuard
+
+func newVerificationGuard(maxFailures int, delay, lockout time.Duration) *verificationGuard {
+	return &verificationGuard{maxFailures: maxFailures, delay: delay, lockout: lockout}
+}
+
+// check returns an error if verification is locked
+func (g *verificationGuard) check() error {
+	if g == nil {
+		return nil
+	}
+	if left := time.Until(g.lockedUntil); left > 0 {
+		return fmt.Errorf("verification is locked for %v after %d failed verifications", left.Round(time.Second), g.maxFailures)
+	}
+	return nil
+}
+
+// failed logs a failed verification, delays it, and locks verification after too many
+func (g *verificationGuard) failed() {
+	if g == nil {
+		return
+	}
+	g.failures++
+	logger.Warnf("Failed verification, %d of %d before lockout", g.failures, g.maxFailures)
+
+	delay := g.delay << uint(g.failures-1)
+	if delay > maxFailureDelay || delay <= 0 {
+		delay = maxFailureDelay
+	}
+	time.Sleep(delay)
+
+	if g.failures >= g.maxFailures {
+		logger.Warnf("Locking verification for %v after %d failed verifications", g.lockout, g.failures)
+		g.lockedUntil = time.Now().Add(g.lockout)
+		g.failures = 0
+	}
+}
+
+// succeeded resets the count of consecutive failures
+func (g *verificationGuard) succeeded() {
+	if g == nil {
+		return
+	}
+	g.failures = 0
+}
+
+// verifyGuarded runs a verification through the guard. A verification fails on an error or a mismatch
+func verifyGuarded(verify func() (bool, error)) (bool, error) {
+	if err := guard.check(); err != nil {
+		return false, err
+	}
+	ok, err := verify()
+	if err == nil {
+		transcript.verified(ok)
+	}
+	if err != nil || !ok {
+		guard.failed()
+	} else {
+		guard.succeeded()
+	}
+	return ok, err
+}
@@ -1,62 +1,146 @@
-package main
+package msgauth
 
 import (
 	"flag"
 	"fmt"
-	"log"
+	"os"
+	"strings"
+
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/hashing"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
 )
 
+// flags are the flags of msg-auth, separate from the ones of the other programs in the schoolwork binary
+var flags = flag.NewFlagSet("msg-auth", flag.ExitOnError)
+
 // sharedSecret is a flag containing the secret which is shared between both the sender and receiver.
 // It is used during the hashing process so that the hash part of the message is: H(secret + message).
-var sharedSecret = flag.String("secret", "", "Shared secret")
+var sharedSecret = flags.String("secret", "", "Shared secret")
 
 // hashAlgorithm is a flag for selecting what hashing algorithm to use
-var hashAlgorithm = flag.String("algorithm", string(SHA3_512), fmt.Sprintf("The hashing algorithm to use. Options are: %v", SupportedHashAlgorithms()))
+var hashAlgorithm = flags.String("algorithm", string(hashing.SHA3_512), fmt.Sprintf("The hashing algorithm to use. Options are: %v", hashing.SupportedHashAlgorithms()))
+
+// versionFlag is a flag for printing the version information and exiting
+var versionFlag = version.RegisterFlag(flags)
+
+// logger is used for diagnostic messages, while the interactive output is written with printf()
+var logger = logging.New(os.Stderr, "msg-auth")
 
 // globalHasher is the Hasher instance used by the program at runtime. It uses a certain algorithm, and
 // computes the hash digests as needed
-var globalHasher Hasher
+var globalHasher hashing.Hasher
 
-// main is the entrypoint of the program, it only invokes run()
-func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
+// Main is the entrypoint of the program, given the command line arguments without the program name. It only
+// invokes run()
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Fatalf("%v", err)
 	}
 }
 
-func run() error {
-	// Parse the --secret flag
-	flag.Parse()
+func run(args []string) error {
+	// Parse the flags, which may also be given as MSG_AUTH_* environment variables or in a config file
+	logger.RegisterFlags(flags)
+	if err := config.Parse(flags, "MSG_AUTH", args); err != nil {
+		return err
+	}
+
+	if *versionFlag {
+		version.Print("msg-auth")
+		return nil
+	}
 
-	// Require the shared secret to be given
-	if len(*sharedSecret) == 0 {
-		return fmt.Errorf("--secret must be set")
+	// Print the shell completion script if asked to, e.g. "msg-auth completion bash"
+	if flags.Arg(0) == "completion" {
+		cmd := completion.NewCommand("msg-auth", flags, completion.Subcommand())
+		return completion.Generate(os.Stdout, flags.Arg(1), cmd)
 	}
 
-	// Validate that the specified algorithm is supported
-	algo := HashAlgorithm(*hashAlgorithm)
-	if _, ok := hashers[algo]; !ok {
-		return fmt.Errorf("hash algorithm %s is not supported; %v are", hashAlgorithm, SupportedHashAlgorithms())
+	// Print a strong secret to share instead, if asked to
+	if *generateSecret {
+		secret, err := newSecret(*secretEncoding)
+		if err != nil {
+			return err
+		}
+		fmt.Println(secret)
+		return nil
+	}
+
+	// Require the shared secret to be given, or to be in the keychain, and one that isn't easy to guess
+	if *secretKeychain != "" {
+		if len(*sharedSecret) != 0 {
+			return fmt.Errorf("--secret and --secret-keychain can't be used together")
+		}
+		secret, err := loadKeychainSecret(*secretKeychain)
+		if err != nil {
+			return err
+		}
+		*sharedSecret = secret
+	}
+	if len(*sharedSecret) == 0 {
+		return fmt.Errorf("--secret or --secret-keychain must be set")
+	}
+	if err := checkSecret(*sharedSecret); err != nil {
+		return err
 	}
 
-	// Create the hasher object using the specified algorithm
+	// Create the hasher object using the specified algorithm, which fails if the algorithm isn't supported
 	var err error
-	globalHasher, err = NewHasher(algo)
+	globalHasher, err = hashing.NewHasher(hashing.HashAlgorithm(*hashAlgorithm))
 	if err != nil {
-		return err
+		return fmt.Errorf("hash algorithm %s is not supported; %v are", *hashAlgorithm, hashing.SupportedHashAlgorithms())
 	}
 	// Write the shared secret into the hasher as the prefix for all successive .Hash() calls
 	globalHasher.Write([]byte(*sharedSecret))
 
-	// Provide two commands for the CLI-based "user-interface", hash and verify, both handled by
-	// the referenced Hash() and Verify() functions below
+	// Slow down and lock out repeated failed verifications, if asked to
+	if *maxFailures < 0 {
+		return fmt.Errorf("--max-failures must not be negative")
+	}
+	if *maxFailures > 0 {
+		guard = newVerificationGuard(*maxFailures, *failureDelay, *lockoutDuration)
+	}
+
+	// Provide the commands for the CLI-based "user-interface", hash, verify, inspect and version, handled by
+	// the referenced Hash(), Verify(), Inspect() and Version() functions below
+	verifyArgs := []string{"message-on-the-wire"}
+	if *pasteFlag {
+		// The wire message is read from the clipboard instead
+		verifyArgs = nil
+	}
 	commands := CLIHandlers{
-		"hash":   CLIHandler(Hash, []string{"message"}, "Hash the message that should be transferred to the receiver"),
-		"verify": CLIHandler(Verify, []string{"message-on-the-wire"}, "Verify if the message received may be trusted"),
+		"hash":    CLIHandler(Hash, []string{"message"}, "Hash the message that should be transferred to the receiver"),
+		"verify":  CLIHandler(Verify, verifyArgs, "Verify if the message received may be trusted"),
+		"inspect": CLIHandler(Inspect, []string{"message-on-the-wire"}, "Show the fields of a message, without verifying it, to debug malformed messages"),
+		"version": CLIHandler(Version, nil, "Show the version information of this program"),
+		// The name has a space, so it's entered as "attack demo,<message-on-the-wire>,<extension>"
+		"attack demo": CLIHandler(AttackDemo, []string{"message-on-the-wire", "extension"}, "Forge a message ending with the extension from a sha2 wire message, without the secret, to show why H(secret + message) is weak"),
+	}
+
+	// OpenSSL mode has its own commands, for HMACs without the wire message framing
+	if *opensslMode {
+		if *copyFlag || *pasteFlag || *armorFlag {
+			return fmt.Errorf("--copy, --paste and --armor are only supported for wire messages, not with --openssl")
+		}
+		if commands, err = opensslCommands(); err != nil {
+			return err
+		}
+	}
+
+	// Record the operations of the session, if asked to
+	if *transcriptFlag != "" {
+		if transcript, err = openTranscript(*transcriptFlag); err != nil {
+			return fmt.Errorf("couldn't open the transcript: %v", err)
+		}
+		transcript.wrap(commands, "hash", "verify", "hash-file", "verify-file")
 	}
 
-	// Start the listen/command loop for the user
+	// Start the listen/command loop for the user, and summarize the session once the user quits
 	HandleCommandLoop(commands)
+	transcript.close()
 	return nil
 }
 
@@ -67,27 +151,119 @@ func Hash(args []string) error {
 	// Create a new WireMessage object for the given message, and hasher, which knows the shared secret
 	wm := NewWireMessage(message, globalHasher)
 
-	// Print the string-format of this message-over-the-wire
+	// Print the string-format of this message-over-the-wire, or the armored block of it
+	out := wm.String()
+	if *armorFlag {
+		out = NewArmoredMessage(wm, *hashAlgorithm, *keyIDFlag).String()
+	}
 	printf("Message to send:\n")
-	printf("%s\n", wm.String())
+	for _, line := range strings.Split(out, "\n") {
+		printf("%s\n", line)
+	}
+
+	// Place it on the clipboard, to paste it on the receiver-side
+	if *copyFlag {
+		if err := copyToClipboard(out); err != nil {
+			return err
+		}
+		printf("Copied to the clipboard\n")
+	}
 	return nil
 }
 
 // Verify checks if a given string-encoded message over the wire a) is valid, b) can be trusted
 func Verify(args []string) error {
-	wiremessage := args[0]
+	var wiremessage string
+	if *pasteFlag {
+		var err error
+		if wiremessage, err = pasteFromClipboard(); err != nil {
+			return err
+		}
+	} else {
+		wiremessage = args[0]
+	}
+
+	ok, err := verifyGuarded(func() (bool, error) {
+		// Unwrap armored messages, which must be for the same algorithm and secret
+		if isArmored(wiremessage) {
+			am, err := ParseArmoredMessage(wiremessage)
+			if err != nil {
+				return false, err
+			}
+			if err := am.checkHeaders(*hashAlgorithm, *keyIDFlag); err != nil {
+				return false, err
+			}
+			wiremessage = am.WireMessage
+		}
+
+		// Parse the message over the wire into the struct, which is easy to use
+		wm, err := ParseWireMessage(wiremessage, globalHasher.Size())
+		if err != nil {
+			return false, err
+		}
 
-	// Parse the message over the wire into the struct, which is easy to use
-	wm, err := ParseWireMessage(wiremessage, globalHasher.Size())
+		// Verify the authenticity of the message using the hasher which knows the shared secret
+		return wm.Verify(globalHasher), nil
+	})
 	if err != nil {
 		return err
 	}
-
-	// Verify the authenticity of the message using the hasher which knows the shared secret
-	if wm.Verify(globalHasher) {
+	if ok {
 		printf("Message verified! You can trust this message\n")
 	} else {
 		printf("Message has been tampered with! Don't trust this message!!\n")
 	}
 	return nil
 }
+
+// Inspect prints the fields of a string-encoded message over the wire, and what is wrong with it, if anything.
+// The message isn't verified
+func Inspect(args []string) error {
+	wiremessage := args[0]
+	if isArmored(wiremessage) {
+		am, err := ParseArmoredMessage(wiremessage)
+		if err != nil {
+			return err
+		}
+		for _, name := range am.headerNames() {
+			printf("Armor header %s: %s\n", name, am.Headers[name])
+		}
+		if err := am.checkHeaders(*hashAlgorithm, *keyIDFlag); err != nil {
+			printf("Problem: %v\n", err)
+		}
+		wiremessage = am.WireMessage
+	}
+	wi := InspectWireMessage(wiremessage, globalHasher.Size())
+
+	length := "invalid"
+	if wi.Length != nil {
+		length = fmt.Sprintf("%d", *wi.Length)
+	}
+	macBytes := "not hex-encoded"
+	if wi.MACBytes == nil && len(wi.MAC) == 0 {
+		macBytes = "missing"
+	} else if wi.MACBytes != nil {
+		macBytes = fmt.Sprintf("%d bytes, expected %d for %s", *wi.MACBytes, globalHasher.Size(), *hashAlgorithm)
+	}
+	printf("Length header: %q (%s)\n", wi.LengthHeader, length)
+	printf("Message: %q (%d characters)\n", wi.Message, len(wi.Message))
+	printf("MAC: %s (%s)\n", wi.MAC, macBytes)
+	if len(wi.Algorithms) != 0 {
+		printf("Algorithms with this MAC length: %v\n", wi.Algorithms)
+	}
+	// The wire format has no other fields
+	printf("Version, algorithm, key ID, nonce, timestamp: not part of the wire format\n")
+	if len(wi.Problems) == 0 {
+		printf("The message is well-formed\n")
+	}
+	for _, p := range wi.Problems {
+		printf("Problem: %s\n", p)
+	}
+	return nil
+}
+
+// Version prints the version information of this program
+func Version(_ []string) error {
+	printf("msg-auth %s\n", version.Get())
+	return nil
+}
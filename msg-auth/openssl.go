@@ -0,0 +1,129 @@
+package msgauth
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+
+	"github.com/luxas/random-schoolwork/pkg/hashing"
+)
+
+// opensslMode is a flag for producing and consuming MACs like "openssl dgst -hmac" does, instead of wire messages
+var opensslMode = flags.Bool("openssl", false, "Compute HMACs in the format of \"openssl dgst -<algorithm> -hmac <secret>\" instead of wire messages")
+
+// opensslNames are the names OpenSSL uses for the hash algorithms in its digest output
+var opensslNames = map[hashing.HashAlgorithm]string{
+	hashing.MD5_128:  "MD5",
+	hashing.SHA1_160: "SHA1",
+	hashing.SHA2_256: "SHA2-256",
+	hashing.SHA2_512: "SHA2-512",
+	hashing.SHA3_256: "SHA3-256",
+	hashing.SHA3_512: "SHA3-512",
+}
+
+// opensslDigest matches the digest lines of "openssl dgst", e.g. "SHA2-256(stdin)= <hex>", the
+// "HMAC-SHA256(file)= <hex>" form of files and older versions, and the "<hex> *file" form of "openssl dgst -r"
+var (
+	opensslDigest        = regexp.MustCompile(`^[A-Za-z0-9-]*\(.*\)= ?([0-9a-fA-F]+)$`)
+	opensslReverseDigest = regexp.MustCompile(`^([0-9a-fA-F]+) \*.*$`)
+)
+
+// opensslHasher is the Hasher instance computing HMACs with the shared secret in OpenSSL mode
+var opensslHasher hashing.Hasher
+
+// opensslCommands returns the commands of OpenSSL mode, where the MACs are HMACs without any framing
+func opensslCommands() (CLIHandlers, error) {
+	var err error
+	opensslHasher, err = hashing.NewHMAC(hashing.HashAlgorithm(*hashAlgorithm), []byte(*sharedSecret))
+	if err != nil {
+		return nil, err
+	}
+	return CLIHandlers{
+		"hash":        CLIHandler(OpenSSLHash, []string{"message"}, "Compute the HMAC of the message, like \"openssl dgst\" does for it on stdin"),
+		"verify":      CLIHandler(OpenSSLVerify, []string{"message", "hmac"}, "Verify the HMAC of the message, as a \"openssl dgst\" line or plain hex"),
+		"hash-file":   CLIHandler(OpenSSLHashFile, []string{"path"}, "Compute the HMAC of the file, like \"openssl dgst\" does for it"),
+		"verify-file": CLIHandler(OpenSSLVerifyFile, []string{"path", "hmac"}, "Verify the HMAC of the file, as a \"openssl dgst\" line or plain hex"),
+		"version":     CLIHandler(Version, nil, "Show the version information of this program"),
+	}, nil
+}
+
+// parseOpenSSLDigest returns the digest of a "openssl dgst" output line, or of plain hex
+func parseOpenSSLDigest(line string) ([]byte, error) {
+	line = strings.TrimSpace(line)
+	if m := opensslDigest.FindStringSubmatch(line); m != nil {
+		line = m[1]
+	} else if m := opensslReverseDigest.FindStringSubmatch(line); m != nil {
+		line = m[1]
+	}
+	digest, err := hex.DecodeString(line)
+	if err != nil {
+		return nil, fmt.Errorf("expected a \"openssl dgst\" line or a hex-encoded HMAC: %v", err)
+	}
+	if len(digest) != int(opensslHasher.Size()) {
+		return nil, fmt.Errorf("the HMAC is %d bytes long, expected %d for %s", len(digest), opensslHasher.Size(), *hashAlgorithm)
+	}
+	return digest, nil
+}
+
+func printOpenSSLResult(ok bool) {
+	if ok {
+		printf("HMAC verified! You can trust this data\n")
+	} else {
+		printf("HMAC mismatch! Don't trust this data!!\n")
+	}
+}
+
+// OpenSSLHash prints the HMAC of the message like "printf '%s' <message> | openssl dgst -<algorithm> -hmac <secret>"
+func OpenSSLHash(args []string) error {
+	printf("%s(stdin)= %x\n", opensslNames[hashing.HashAlgorithm(*hashAlgorithm)], opensslHasher.Hash([]byte(args[0])))
+	return nil
+}
+
+// OpenSSLVerify verifies the HMAC of the message
+func OpenSSLVerify(args []string) error {
+	ok, err := verifyGuarded(func() (bool, error) {
+		digest, err := parseOpenSSLDigest(args[1])
+		if err != nil {
+			return false, err
+		}
+		return hmac.Equal(digest, opensslHasher.Hash([]byte(args[0]))), nil
+	})
+	if err != nil {
+		return err
+	}
+	printOpenSSLResult(ok)
+	return nil
+}
+
+// OpenSSLHashFile prints the HMAC of the file like "openssl dgst -<algorithm> -hmac <secret> <path>"
+func OpenSSLHashFile(args []string) error {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	printf("HMAC-%s(%s)= %x\n", opensslNames[hashing.HashAlgorithm(*hashAlgorithm)], args[0], opensslHasher.Hash(data))
+	return nil
+}
+
+// OpenSSLVerifyFile verifies the HMAC of the file
+func OpenSSLVerifyFile(args []string) error {
+	data, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	ok, err := verifyGuarded(func() (bool, error) {
+		digest, err := parseOpenSSLDigest(args[1])
+		if err != nil {
+			return false, err
+		}
+		return hmac.Equal(digest, opensslHasher.Hash(data)), nil
+	})
+	if err != nil {
+		return err
+	}
+	printOpenSSLResult(ok)
+	return nil
+}
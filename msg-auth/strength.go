@@ -0,0 +1,286 @@
+package msgauth
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strings"
+	"unicode"
+)
+
+var (
+	// weakSecret is a flag for what to do with a secret that is easy to guess
+	weakSecret = flags.String("weak-secret", "warn", "What to do if the secret is estimated to be weaker than --min-secret-bits: warn, or refuse to start")
+	// minSecretBits is a flag for the estimated strength a secret needs not to be weak
+	minSecretBits = flags.Float64("min-secret-bits", 64, "How many bits of entropy the secret is estimated to need, not to be weak")
+	// generateSecret is a flag for printing a strong random secret and exiting
+	generateSecret = flags.Bool("generate-secret", false, "Print a random 256-bit secret in the --secret-encoding and exit")
+	// secretEncoding is a flag for the encoding of the secrets --generate-secret prints
+	secretEncoding = flags.String("secret-encoding", "hex", "The encoding of the secret --generate-secret prints: hex, base64 or base64url")
+)
+
+// generatedSecretBytes is how many random bytes --generate-secret encodes, as many as the sha3-512 security level
+// needs
+const generatedSecretBytes = 32
+
+// newSecret returns generatedSecretBytes random bytes in the encoding
+func newSecret(encoding string) (string, error) {
+	var encode func([]byte) string
+	switch encoding {
+	case "hex":
+		encode = hex.EncodeToString
+	case "base64":
+		encode = base64.StdEncoding.EncodeToString
+	case "base64url":
+		encode = base64.RawURLEncoding.EncodeToString
+	default:
+		return "", fmt.Errorf("--secret-encoding must be hex, base64 or base64url, not %q", encoding)
+	}
+	b := make([]byte, generatedSecretBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// checkSecret estimates the strength of the secret, and warns about it or refuses it, as --weak-secret says, if it's
+// weaker than --min-secret-bits
+func checkSecret(secret string) error {
+	if *weakSecret != "warn" && *weakSecret != "refuse" {
+		return fmt.Errorf("--weak-secret must be warn or refuse, not %q", *weakSecret)
+	}
+	est := estimateStrength(secret)
+	if est.bits >= *minSecretBits {
+		return nil
+	}
+	msg := fmt.Sprintf("the secret is weak, its strength is estimated at %.0f bits, less than --min-secret-bits %v", est.bits, *minSecretBits)
+	if len(est.patterns) != 0 {
+		msg += fmt.Sprintf(", as it consists of %s", strings.Join(est.patterns, ", "))
+	}
+	msg += ". Use --generate-secret for a strong one"
+	if *weakSecret == "refuse" {
+		return fmt.Errorf("%s, or --weak-secret warn to use it anyway", msg)
+	}
+	logger.Warnf("%s", strings.ToUpper(msg[:1])+msg[1:])
+	return nil
+}
+
+// strengthEstimate is how many guesses an attacker who knows how people choose secrets needs for a secret, in bits,
+// and the patterns the secret was found to consist of
+type strengthEstimate struct {
+	bits     float64
+	patterns []string
+}
+
+// secretMatch is a part of a secret that matches a guessable pattern, from i up to j inclusive
+type secretMatch struct {
+	i, j    int
+	guesses float64
+	pattern string
+}
+
+// commonSecrets are some of the most common passwords and words in them, in order of popularity. An attacker tries
+// them first, so a match costs its rank in guesses
+var commonSecrets = []string{
+	"password", "123456", "qwerty", "secret", "letmein", "admin", "welcome", "monkey", "dragon", "master", "login",
+	"abc123", "football", "baseball", "iloveyou", "trustno1", "sunshine", "princess", "shadow", "superman", "michael",
+	"hello", "freedom", "whatever", "starwars", "passw0rd", "test", "root", "changeme", "default", "guest", "love",
+	"summer", "winter", "spring", "autumn", "mysecret", "shared", "key", "pass", "the", "team", "company",
+	"message", "auth", "token", "private", "access", "server", "client", "user", "demo", "example", "hunter",
+}
+
+// keyboardRows are the rows of a QWERTY keyboard, as runs along them are easy to type and to guess
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// leetSubstitutions undo the common substitutions of letters in words
+var leetSubstitutions = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+// estimateStrength estimates the strength of the secret like zxcvbn does: it finds the parts of it that match
+// common words, keyboard runs, sequences, repeats and years, and picks the way of covering the secret with them and
+// with brute-forced characters in between that needs the fewest guesses
+func estimateStrength(secret string) strengthEstimate {
+	runes := []rune(secret)
+	n := len(runes)
+	if n == 0 {
+		return strengthEstimate{}
+	}
+	matches := findSecretMatches(runes)
+	bruteForce := float64(charsetSize(runes))
+
+	// best[k] is the fewest guesses for the first k runes, and last[k] the match ending the way to them, if any
+	best := make([]float64, n+1)
+	last := make([]*secretMatch, n+1)
+	best[0] = 1
+	for k := 1; k <= n; k++ {
+		best[k] = best[k-1] * bruteForce
+		for idx := range matches {
+			m := &matches[idx]
+			if m.j == k-1 && best[m.i]*m.guesses < best[k] {
+				best[k] = best[m.i] * m.guesses
+				last[k] = m
+			}
+		}
+	}
+
+	est := strengthEstimate{bits: math.Log2(best[n])}
+	for k := n; k > 0; {
+		if m := last[k]; m != nil {
+			est.patterns = append([]string{m.pattern}, est.patterns...)
+			k = m.i
+			continue
+		}
+		// Collect the brute-forced runes, which are reported together
+		count := 0
+		for ; k > 0 && last[k] == nil; k-- {
+			count++
+		}
+		pattern := fmt.Sprintf("%d random characters", count)
+		if count == 1 {
+			pattern = "1 random character"
+		}
+		est.patterns = append([]string{pattern}, est.patterns...)
+	}
+	return est
+}
+
+// findSecretMatches returns the parts of the secret that match guessable patterns
+func findSecretMatches(runes []rune) []secretMatch {
+	lowerRunes := make([]rune, len(runes))
+	for k, r := range runes {
+		lowerRunes[k] = unicode.ToLower(r)
+	}
+	matches := []secretMatch{}
+
+	// Common secrets and words, also reversed, capitalized or with substituted letters
+	for i := range lowerRunes {
+		for j := i + 2; j < len(lowerRunes); j++ {
+			part := string(lowerRunes[i : j+1])
+			original := string(runes[i : j+1])
+			for rank, word := range commonSecrets {
+				guesses := float64(rank + 1)
+				pattern := fmt.Sprintf("the common word %q", word)
+				switch word {
+				case part:
+				case leetSubstitutions.Replace(part):
+					guesses *= 4
+					pattern += " with substituted letters"
+				case reverse(part):
+					guesses *= 2
+					pattern += " reversed"
+				default:
+					continue
+				}
+				if original != part {
+					// Upper case letters only add a little, as they're mostly at the start or everywhere
+					guesses *= 2
+				}
+				matches = append(matches, secretMatch{i: i, j: j, guesses: guesses, pattern: pattern})
+			}
+		}
+	}
+
+	// Runs of at least 3 of the same character, of characters in order, or of keys next to each other
+	for i := range lowerRunes {
+		for j := i + 2; j < len(lowerRunes); j++ {
+			part := string(lowerRunes[i : j+1])
+			length := float64(j - i + 1)
+			if isRepeat(lowerRunes[i : j+1]) {
+				matches = append(matches, secretMatch{i: i, j: j, guesses: float64(charsetSize(runes[i:i+1])) * length,
+					pattern: fmt.Sprintf("%d repeated %q", j-i+1, runes[i])})
+			}
+			if step := sequenceStep(lowerRunes[i : j+1]); step != 0 {
+				guesses := 26 * length
+				if step < 0 {
+					guesses *= 2
+				}
+				matches = append(matches, secretMatch{i: i, j: j, guesses: guesses, pattern: fmt.Sprintf("the sequence %q", part)})
+			}
+			for _, row := range keyboardRows {
+				if strings.Contains(row, part) || strings.Contains(row, reverse(part)) {
+					matches = append(matches, secretMatch{i: i, j: j, guesses: 40 * length, pattern: fmt.Sprintf("the keyboard run %q", part)})
+				}
+			}
+		}
+	}
+
+	// Years, which are as popular as they are recent
+	for i := 0; i+4 <= len(lowerRunes); i++ {
+		part := string(lowerRunes[i : i+4])
+		if (strings.HasPrefix(part, "19") || strings.HasPrefix(part, "20")) && isDigits(part) {
+			matches = append(matches, secretMatch{i: i, j: i + 3, guesses: 200, pattern: fmt.Sprintf("the year %s", part)})
+		}
+	}
+	return matches
+}
+
+// charsetSize is how many characters a brute-force attack tries for every character of the secret, given the kinds
+// of characters it contains
+func charsetSize(runes []rune) int {
+	var lower, upper, digits, symbols, other bool
+	for _, r := range runes {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digits = true
+		case r < unicode.MaxASCII:
+			symbols = true
+		default:
+			other = true
+		}
+	}
+	size := 0
+	for _, kind := range []struct {
+		present bool
+		size    int
+	}{{lower, 26}, {upper, 26}, {digits, 10}, {symbols, 33}, {other, 100}} {
+		if kind.present {
+			size += kind.size
+		}
+	}
+	return size
+}
+
+func isRepeat(runes []rune) bool {
+	for _, r := range runes {
+		if r != runes[0] {
+			return false
+		}
+	}
+	return true
+}
+
+// sequenceStep returns 1 or -1 if the runes are consecutive letters or digits, like "abc" or "987", or 0
+func sequenceStep(runes []rune) int {
+	step := int(runes[1]) - int(runes[0])
+	if step != 1 && step != -1 {
+		return 0
+	}
+	for k := 1; k < len(runes); k++ {
+		if int(runes[k])-int(runes[k-1]) != step || !unicode.IsLetter(runes[k]) && !unicode.IsDigit(runes[k]) {
+			return 0
+		}
+	}
+	return step
+}
+
+func isDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
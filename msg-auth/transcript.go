@@ -0,0 +1,154 @@
+package msgauth
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/version"
+)
+
+// transcriptFlag is a flag for recording the hash and verify operations of the session to a file
+var transcriptFlag = flags.String("transcript", "", "Append the hash and verify operations of the session to this file as JSON lines, with their inputs, outputs, results and times, and print a summary of them at exit. The secret isn't recorded")
+
+// Results of the operations in the transcript
+const (
+	resultOK       = "ok"
+	resultVerified = "verified"
+	resultMismatch = "mismatch"
+	resultError    = "error"
+)
+
+// transcriptEntry is a line of the transcript. The first line of a session has the "start" command, with the mode,
+// algorithm and version, and the last one the "end" command, with the summary
+type transcriptEntry struct {
+	Time      time.Time `json:"time"`
+	Command   string    `json:"command"`
+	Algorithm string    `json:"algorithm,omitempty"`
+	Mode      string    `json:"mode,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Args      []string  `json:"args,omitempty"`
+	// Output is what the command printed, without the "> " prompts
+	Output  string             `json:"output,omitempty"`
+	Result  string             `json:"result,omitempty"`
+	Error   string             `json:"error,omitempty"`
+	Summary *transcriptSummary `json:"summary,omitempty"`
+}
+
+// transcriptSummary counts the operations of a session by their result
+type transcriptSummary struct {
+	Hashed   int `json:"hashed"`
+	Verified int `json:"verified"`
+	Mismatch int `json:"mismatch"`
+	Errors   int `json:"errors"`
+}
+
+// sessionTranscript records the operations of the session. A nil transcript records nothing
+type sessionTranscript struct {
+	path    string
+	f       *os.File
+	enc     *json.Encoder
+	summary transcriptSummary
+	// current is the operation that is running, which collects the output
+	current *transcriptEntry
+}
+
+// transcript is set if --transcript is
+var transcript *sessionTranscript
+
+// openTranscript opens the transcript file for appending, and records the start of the session
+func openTranscript(path string) (*sessionTranscript, error) {
+	// The messages may be confidential, even if the secret isn't recorded
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &sessionTranscript{path: path, f: f, enc: json.NewEncoder(f)}
+	mode := "wire"
+	if *opensslMode {
+		mode = "openssl"
+	} else if *armorFlag {
+		mode = "armor"
+	}
+	t.write(&transcriptEntry{Time: time.Now(), Command: "start", Algorithm: *hashAlgorithm, Mode: mode, Version: version.Get().String()})
+	return t, nil
+}
+
+// wrap makes the named commands record themselves in the transcript, if they exist
+func (t *sessionTranscript) wrap(commands CLIHandlers, names ...string) {
+	for _, name := range names {
+		handler, ok := commands[name]
+		if !ok {
+			continue
+		}
+		name, fn := name, handler.fn
+		handler.fn = func(args []string) error {
+			t.current = &transcriptEntry{Time: time.Now(), Command: name, Algorithm: *hashAlgorithm, Args: args, Result: resultOK}
+			err := fn(args)
+			t.finish(err)
+			return err
+		}
+		commands[name] = handler
+	}
+}
+
+// output collects the output of the running operation
+func (t *sessionTranscript) output(s string) {
+	if t == nil || t.current == nil {
+		return
+	}
+	t.current.Output += s
+}
+
+// verified records the result of the verification of the running operation
+func (t *sessionTranscript) verified(ok bool) {
+	if t == nil || t.current == nil {
+		return
+	}
+	t.current.Result = resultMismatch
+	if ok {
+		t.current.Result = resultVerified
+	}
+}
+
+// finish records the running operation, which failed if err is set
+func (t *sessionTranscript) finish(err error) {
+	e := t.current
+	t.current = nil
+	if err != nil {
+		e.Result, e.Error = resultError, err.Error()
+	}
+	switch e.Result {
+	case resultOK:
+		t.summary.Hashed++
+	case resultVerified:
+		t.summary.Verified++
+	case resultMismatch:
+		t.summary.Mismatch++
+	case resultError:
+		t.summary.Errors++
+	}
+	e.Output = strings.TrimSuffix(e.Output, "\n")
+	t.write(e)
+}
+
+func (t *sessionTranscript) write(e *transcriptEntry) {
+	if err := t.enc.Encode(e); err != nil {
+		logger.Warnf("Couldn't write to the transcript %s: %v", t.path, err)
+	}
+}
+
+// close records the end of the session with the summary, and prints the summary
+func (t *sessionTranscript) close() {
+	if t == nil {
+		return
+	}
+	s := t.summary
+	t.write(&transcriptEntry{Time: time.Now(), Command: "end", Summary: &s})
+	if err := t.f.Close(); err != nil {
+		logger.Warnf("Couldn't close the transcript %s: %v", t.path, err)
+	}
+	printf("Session summary: %d hashed, %d verified, %d mismatched, %d failed with an error\n", s.Hashed, s.Verified, s.Mismatch, s.Errors)
+	printf("Transcript written to %s\n", t.path)
+}
@@ -1,14 +1,16 @@
-package main
+package msgauth
 
 import (
-	"bytes"
+	"crypto/hmac"
 	"encoding/hex"
 	"fmt"
 	"strconv"
+
+	"github.com/luxas/random-schoolwork/pkg/hashing"
 )
 
 // NewWireMessage creates a new message that may be sent over the wire, and is verifiable at the receiver's end
-func NewWireMessage(message string, h Hasher) *WireMessage {
+func NewWireMessage(message string, h hashing.Hasher) *WireMessage {
 	return &WireMessage{
 		Length:  uint8(len(message)),
 		Message: message,
@@ -22,6 +24,9 @@ func NewWireMessage(message string, h Hasher) *WireMessage {
 // and returns the WireMessage struct if valid
 // ParseWireMessage DOES NOT verify the authenticity of the message
 func ParseWireMessage(wirestr string, hashlen uint8) (*WireMessage, error) {
+	if len(wirestr) < 2 {
+		return nil, fmt.Errorf("the message is %d characters long, too short for the 2-character length header", len(wirestr))
+	}
 	// Parse the hex-encoded uint8 in the beginning describing the length of the plaintext message
 	messagelen64, err := strconv.ParseUint(wirestr[:2], 16, 8)
 	if err != nil {
@@ -53,6 +58,75 @@ func ParseWireMessage(wirestr string, hashlen uint8) (*WireMessage, error) {
 	}, nil
 }
 
+// WireInspection is what could be decoded from a wire message, which may be malformed
+type WireInspection struct {
+	// LengthHeader is the hex-encoded length header, and Length its value if it could be parsed
+	LengthHeader string
+	Length       *uint8
+	// Message is the plaintext message, as far as it could be found
+	Message string
+	// MAC is the hex-encoded MAC after the message, and MACBytes its length in bytes if it could be decoded
+	MAC      string
+	MACBytes *int
+	// Algorithms are the supported hash algorithms whose digests are as long as the MAC
+	Algorithms []hashing.HashAlgorithm
+	// Problems describe why the message is malformed, in the order they were found
+	Problems []string
+}
+
+// InspectWireMessage decodes as much as possible of a string sent "on-the-wire", for debugging malformed messages.
+// The MAC is expected to be hashlen bytes long. Unlike ParseWireMessage, it doesn't stop at the first problem
+// InspectWireMessage DOES NOT verify the authenticity of the message
+func InspectWireMessage(wirestr string, hashlen uint8) *WireInspection {
+	wi := &WireInspection{}
+	problemf := func(format string, args ...interface{}) {
+		wi.Problems = append(wi.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(wirestr) < 2 {
+		wi.LengthHeader = wirestr
+		problemf("the message is %d characters long, too short for the 2-character length header", len(wirestr))
+		return wi
+	}
+	wi.LengthHeader = wirestr[:2]
+	rest := wirestr[2:]
+	messagelen := len(rest)
+	if length, err := strconv.ParseUint(wi.LengthHeader, 16, 8); err != nil {
+		problemf("the length header %q is not a hex-encoded byte", wi.LengthHeader)
+		// Assume that the MAC is as long as expected, to still show the message
+		messagelen -= 2 * int(hashlen)
+	} else {
+		l := uint8(length)
+		wi.Length = &l
+		messagelen = int(l)
+	}
+	if messagelen < 0 {
+		messagelen = 0
+	}
+	if messagelen > len(rest) {
+		problemf("the message is %d characters long, but the length header says %d", len(rest), messagelen)
+		messagelen = len(rest)
+	}
+	wi.Message, wi.MAC = rest[:messagelen], rest[messagelen:]
+
+	mac, err := hex.DecodeString(wi.MAC)
+	if err != nil {
+		problemf("the MAC is not hex-encoded: %v", err)
+	} else {
+		n := len(mac)
+		wi.MACBytes = &n
+		if n != int(hashlen) {
+			problemf("the MAC is %d bytes long, expected %d", n, hashlen)
+		}
+		for _, algo := range hashing.SupportedHashAlgorithms() {
+			if h, err := hashing.NewHasher(algo); err == nil && int(h.Size()) == n {
+				wi.Algorithms = append(wi.Algorithms, algo)
+			}
+		}
+	}
+	return wi
+}
+
 // WireMessage represent a message sent over the network, which can be verified through a shared secret by the receiver
 type WireMessage struct {
 	// Length describes the length of the Message field
@@ -69,7 +143,7 @@ func (wm *WireMessage) String() string {
 }
 
 // Verify returns true if the message can be successfully verified with the same shared secret the given hasher
-// is set to use.
-func (wm *WireMessage) Verify(hasher Hasher) bool {
-	return bytes.Equal(wm.Hash, hasher.Hash([]byte(wm.Message)))
+// is set to use. The comparison takes constant time, so that it doesn't leak how much of the hash was right
+func (wm *WireMessage) Verify(hasher hashing.Hasher) bool {
+	return hmac.Equal(wm.Hash, hasher.Hash([]byte(wm.Message)))
 }
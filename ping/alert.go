@@ -0,0 +1,35 @@
+package ping
+
+import (
+	"fmt"
+	"os"
+)
+
+var (
+	audibleFlag     = flags.Bool("a", false, "Ring the terminal bell on every reply")
+	alertOnLossFlag = flags.Bool("alert-on-loss", false, "Ring the terminal bell on every lost request, for watching a flaky link while doing other work")
+)
+
+// bell makes the terminal beep, or flash if it's set to a visual bell
+const bell = "\a"
+
+func alertReply() {
+	if *audibleFlag {
+		ringBell()
+	}
+}
+
+func alertLoss() {
+	if *alertOnLossFlag {
+		ringBell()
+	}
+}
+
+// ringBell rings the bell on stdout like ping -a, or on stderr in the JSON output, which it would break
+func ringBell() {
+	if jsonOutput() {
+		fmt.Fprint(os.Stderr, bell)
+		return
+	}
+	fmt.Print(bell)
+}
@@ -0,0 +1,161 @@
+package ping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// timestampNonStandard is set in timestamps that aren't milliseconds since midnight UT
+	timestampNonStandard = 1 << 31
+	msPerDay             = 24 * 60 * 60 * 1000
+)
+
+var timestampsFlag = flags.Bool("timestamps", false, "Also send ICMP timestamp requests, and estimate the forward and return path delays from them. Only IPv4")
+
+// delayAnalysis estimates the one-way delays to and from the target, from ICMP timestamp replies. The forward
+// delay is the remote receive time minus the originate time, and the return delay our receive time minus the
+// remote transmit time. Both are off by the clock offset of the target, in opposite directions
+type delayAnalysis struct {
+	mux *sync.Mutex
+	// id is the ICMP ID of all timestamp requests
+	id int
+	// sent are the sequence numbers of the requests that haven't been answered
+	sent map[int]bool
+	// forward and back are the estimated delays of the answered requests
+	forward []time.Duration
+	back    []time.Duration
+	// nonStandard counts the replies with timestamps that can't be compared to ours
+	nonStandard int
+}
+
+func newDelayAnalysis() *delayAnalysis {
+	return &delayAnalysis{
+		mux:  &sync.Mutex{},
+		id:   rand.Intn(0xffff),
+		sent: map[int]bool{},
+	}
+}
+
+// msSinceMidnight returns the time as an ICMP timestamp, milliseconds since midnight UT
+func msSinceMidnight(t time.Time) uint32 {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return uint32(t.Sub(midnight) / time.Millisecond)
+}
+
+// msBetween returns b-a for timestamps, across midnight if needed
+func msBetween(a, b uint32) time.Duration {
+	diff := int64(b) - int64(a)
+	if diff > msPerDay/2 {
+		diff -= msPerDay
+	} else if diff < -msPerDay/2 {
+		diff += msPerDay
+	}
+	return time.Duration(diff) * time.Millisecond
+}
+
+// request returns a timestamp request with the sequence number, originating now
+func (a *delayAnalysis) request(seq int) ([]byte, error) {
+	a.mux.Lock()
+	a.sent[seq] = true
+	a.mux.Unlock()
+
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint16(data[0:], uint16(a.id))
+	binary.BigEndian.PutUint16(data[2:], uint16(seq))
+	binary.BigEndian.PutUint32(data[4:], msSinceMidnight(time.Now()))
+	return (&icmp.Message{
+		Type: ipv4.ICMPTypeTimestamp, Code: 0,
+		Body: &icmp.RawBody{Data: data},
+	}).Marshal(nil)
+}
+
+// reply records a timestamp reply received at the given time. Replies to other pingers are ignored
+func (a *delayAnalysis) reply(m *icmp.Message, received time.Time) error {
+	body, ok := m.Body.(*icmp.RawBody)
+	if !ok || len(body.Data) < 16 {
+		return fmt.Errorf("invalid timestamp reply body: %v", m.Body)
+	}
+	id := int(binary.BigEndian.Uint16(body.Data[0:]))
+	seq := int(binary.BigEndian.Uint16(body.Data[2:]))
+	originate := binary.BigEndian.Uint32(body.Data[4:])
+	receive := binary.BigEndian.Uint32(body.Data[8:])
+	transmit := binary.BigEndian.Uint32(body.Data[12:])
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	if id != a.id || !a.sent[seq] {
+		return nil
+	}
+	delete(a.sent, seq)
+	if receive&timestampNonStandard != 0 || transmit&timestampNonStandard != 0 {
+		a.nonStandard++
+		return nil
+	}
+	a.forward = append(a.forward, msBetween(originate, receive))
+	a.back = append(a.back, msBetween(transmit, msSinceMidnight(received)))
+	return nil
+}
+
+// delaySummary is the delay analysis in the JSON output
+type delaySummary struct {
+	Replies     int     `json:"replies"`
+	NonStandard int     `json:"non_standard,omitempty"`
+	ForwardMs   float64 `json:"forward_avg_ms"`
+	ReturnMs    float64 `json:"return_avg_ms"`
+}
+
+// summary returns the averages of the analysis
+func (a *delayAnalysis) summary() *delaySummary {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	s := &delaySummary{Replies: len(a.forward), NonStandard: a.nonStandard}
+	if len(a.forward) != 0 {
+		s.ForwardMs, s.ReturnMs = ms(average(a.forward)), ms(average(a.back))
+	}
+	return s
+}
+
+func average(ds []time.Duration) time.Duration {
+	sum := time.Duration(0)
+	for _, d := range ds {
+		sum += d
+	}
+	return sum / time.Duration(len(ds))
+}
+
+// print prints the analysis section, comparing to the average RTT of the echo requests
+func (a *delayAnalysis) print(echoRTT time.Duration) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	fmt.Println("--- one-way delay analysis ---")
+	if a.nonStandard != 0 {
+		fmt.Printf("%d replies had non-standard timestamps, and were left out\n", a.nonStandard)
+	}
+	if len(a.forward) == 0 {
+		fmt.Println("no timestamp replies, the host may not answer ICMP timestamp requests")
+		return
+	}
+	forward, back := average(a.forward), average(a.back)
+	fmt.Printf("%d timestamp replies, forward avg %.3f ms, return avg %.3f ms, echo rtt avg %.3f ms\n", len(a.forward),
+		ms(forward), ms(back), ms(echoRTT))
+	switch {
+	case forward < 0 || back < 0:
+		fmt.Println("a negative delay means that the clock of the host is off by more than the delay")
+	case forward > back:
+		fmt.Printf("the forward path looks %.3f ms slower than the return path\n", ms(forward-back))
+	case back > forward:
+		fmt.Printf("the return path looks %.3f ms slower than the forward path\n", ms(back-forward))
+	default:
+		fmt.Println("the paths look symmetric")
+	}
+	fmt.Println("note: the clock offset of the host shifts both delays by the same amount in opposite directions, and the timestamps only have millisecond resolution")
+}
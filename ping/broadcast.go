@@ -0,0 +1,106 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+var allowBroadcastFlag = flags.Bool("allow-broadcast", false, "Allow pinging a broadcast or multicast address, and report the replies of every host that answers")
+
+// responders counts the replies by source, if the target is a broadcast or multicast address
+var responders *responderSet
+
+// validateBroadcast returns whether the target is a broadcast or multicast address, which needs --allow-broadcast
+func validateBroadcast(target net.IP) (bool, error) {
+	if !target.IsMulticast() && !isBroadcast(target) {
+		return false, nil
+	}
+	switch {
+	case !*allowBroadcastFlag:
+		return false, fmt.Errorf("%s is a broadcast or multicast address, ping it with --allow-broadcast", target)
+	case *tcpFlag != "", *httpFlag != "":
+		return false, fmt.Errorf("--tcp and --http connect to a single host, they can't be used with a broadcast or multicast address")
+	case *adaptiveFlag, *floodFlag, *pmtuFlag, *agentsFlag != "":
+		return false, fmt.Errorf("--allow-broadcast doesn't support --adaptive, --flood, --pmtu or --agents, which expect one reply per request")
+	}
+	responders = &responderSet{mux: &sync.Mutex{}, counts: map[string]int{}}
+	return true, nil
+}
+
+// isBroadcast returns whether ip is the limited broadcast address, or the broadcast address of a subnet of a local
+// interface. IPv6 has no broadcast, only multicast
+func isBroadcast(ip net.IP) bool {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return false
+	}
+	if ip4.Equal(net.IPv4bcast) {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || len(ipnet.Mask) != net.IPv4len {
+			continue
+		}
+		bcast := make(net.IP, net.IPv4len)
+		for i := range bcast {
+			bcast[i] = ipnet.IP.To4()[i] | ^ipnet.Mask[i]
+		}
+		// A /31 or /32 has no broadcast address
+		if ones, _ := ipnet.Mask.Size(); ones < 31 && bcast.Equal(ip4) {
+			return true
+		}
+	}
+	return false
+}
+
+// responderSet counts the replies to broadcast requests by the host that sent them
+type responderSet struct {
+	mux    *sync.Mutex
+	counts map[string]int
+}
+
+func (r *responderSet) record(ip net.IP) {
+	if r == nil {
+		return
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.counts[ip.String()]++
+}
+
+// summary returns the counts by host, for the JSON output
+func (r *responderSet) summary() map[string]int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	counts := make(map[string]int, len(r.counts))
+	for ip, n := range r.counts {
+		counts[ip] = n
+	}
+	return counts
+}
+
+// print prints how many replies every host sent, the most first
+func (r *responderSet) print() {
+	counts := r.summary()
+	ips := make([]string, 0, len(counts))
+	for ip := range counts {
+		ips = append(ips, ip)
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		if counts[ips[i]] != counts[ips[j]] {
+			return counts[ips[i]] > counts[ips[j]]
+		}
+		return ips[i] < ips[j]
+	})
+	fmt.Printf("--- %d hosts responded ---\n", len(ips))
+	for _, ip := range ips {
+		fmt.Printf("%s%s: %d replies\n", ip, geoip.annotate(net.ParseIP(ip)), counts[ip])
+	}
+}
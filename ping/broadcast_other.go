@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// setBroadcast permits the socket to send to broadcast addresses
+func setBroadcast(fd uintptr) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1))
+}
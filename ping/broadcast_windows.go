@@ -0,0 +1,11 @@
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// setBroadcast permits the socket to send to broadcast addresses
+func setBroadcast(fd uintptr) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1))
+}
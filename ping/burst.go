@@ -0,0 +1,104 @@
+package ping
+
+import (
+	"fmt"
+	"sync"
+)
+
+var burstFlag = flags.Int("burst", 1, "How many requests to send back-to-back every interval, to detect policers that drop bursts")
+
+// burstStats records the outcome of every request by its position in its burst, and how many requests of every
+// burst were lost. Loss that grows with the position points to a policer, which lets single requests through
+type burstStats struct {
+	mux  *sync.Mutex
+	size int
+	// received and lost count the requests by their position in the burst
+	received []int
+	lost     []int
+	// outcomes counts the received and lost requests of every burst, by burst number
+	outcomes map[int]*burstOutcome
+}
+
+type burstOutcome struct {
+	received int
+	lost     int
+}
+
+// burstSummary is the burst loss pattern in the JSON output
+type burstSummary struct {
+	Size int `json:"size"`
+	// LossPercent is the loss by position in the burst
+	LossPercent []float64 `json:"loss_percent"`
+	Answered    int       `json:"answered"`
+	PartlyLost  int       `json:"partly_lost"`
+	Lost        int       `json:"lost"`
+}
+
+func newBurstStats(size int) *burstStats {
+	return &burstStats{
+		mux:      &sync.Mutex{},
+		size:     size,
+		received: make([]int, size),
+		lost:     make([]int, size),
+		outcomes: map[int]*burstOutcome{},
+	}
+}
+
+// record records the outcome of the request with the sequence number. Bursts start at sequence number 0
+func (b *burstStats) record(seq int, received bool) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	pos, n := seq%b.size, seq/b.size
+	o, ok := b.outcomes[n]
+	if !ok {
+		o = &burstOutcome{}
+		b.outcomes[n] = o
+	}
+	if received {
+		b.received[pos]++
+		o.received++
+	} else {
+		b.lost[pos]++
+		o.lost++
+	}
+}
+
+// summary returns the loss by position, and counts the bursts that were answered, partly lost and lost
+func (b *burstStats) summary() *burstSummary {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	s := &burstSummary{Size: b.size, LossPercent: make([]float64, b.size)}
+	for pos := range b.received {
+		if sent := b.received[pos] + b.lost[pos]; sent != 0 {
+			s.LossPercent[pos] = 100 * float64(b.lost[pos]) / float64(sent)
+		}
+	}
+	for _, o := range b.outcomes {
+		switch {
+		case o.lost == 0:
+			s.Answered++
+		case o.received == 0:
+			s.Lost++
+		default:
+			s.PartlyLost++
+		}
+	}
+	return s
+}
+
+// print prints the burst loss pattern section
+func (b *burstStats) print() {
+	s := b.summary()
+	fmt.Printf("--- burst loss pattern, %d requests per burst ---\n", s.Size)
+	for pos, loss := range s.LossPercent {
+		line := fmt.Sprintf("%.0f%% loss", loss)
+		if loss > 0 {
+			line = paint(colorRed, line)
+		}
+		fmt.Printf("request %d of the burst: %s\n", pos+1, line)
+	}
+	fmt.Printf("%d bursts answered, %d partly lost, %d lost\n", s.Answered, s.PartlyLost, s.Lost)
+	if first, last := s.LossPercent[0], s.LossPercent[s.Size-1]; last > first {
+		fmt.Println("the loss grows within the bursts, which suggests that a policer drops them")
+	}
+}
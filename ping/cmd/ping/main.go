@@ -0,0 +1,12 @@
+// Command ping is the standalone binary of ping, which is also the ping subcommand of the schoolwork binary
+package main
+
+import (
+	"os"
+
+	"github.com/luxas/random-schoolwork/ping"
+)
+
+func main() {
+	ping.Main(os.Args[1:])
+}
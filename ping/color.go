@@ -0,0 +1,61 @@
+package ping
+
+import (
+	"os"
+	"time"
+)
+
+var (
+	noColorFlag = flags.Bool("no-color", false, "Don't color the output. Only terminals get colored output, unless NO_COLOR is set")
+	highRTTFlag = flags.Duration("high-rtt", 200*time.Millisecond, "RTTs above this are highlighted in the colored output")
+
+	// colorOutput is whether the output is colored, as decided by setupColor
+	colorOutput = false
+)
+
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+)
+
+// targetColors tell the targets apart in multi-target output. Red and yellow are left out, they mark the status
+var targetColors = []string{"\x1b[36m", "\x1b[34m", "\x1b[35m", "\x1b[32m", "\x1b[96m", "\x1b[94m", "\x1b[95m", "\x1b[92m"}
+
+// setupColor colors the output if stdout is a terminal, and neither --no-color nor NO_COLOR is set
+func setupColor() {
+	if *noColorFlag || os.Getenv("NO_COLOR") != "" {
+		return
+	}
+	fi, err := os.Stdout.Stat()
+	colorOutput = err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// paint returns s in the color, if the output is colored
+func paint(color, s string) string {
+	if !colorOutput {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// paintTarget returns s in the color of the i:th target
+func paintTarget(i int, s string) string {
+	return paint(targetColors[i%len(targetColors)], s)
+}
+
+// paintLoss returns s in red if not all requests were answered
+func paintLoss(received, sent uint64, s string) string {
+	if received < sent {
+		return paint(colorRed, s)
+	}
+	return s
+}
+
+// paintRTT returns s in yellow if the RTT is higher than --high-rtt
+func paintRTT(rtt time.Duration, s string) string {
+	if rtt > *highRTTFlag {
+		return paint(colorYellow, s)
+	}
+	return s
+}
@@ -0,0 +1,484 @@
+package ping
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	agentsFlag     = flags.String("agents", "", "Comma-separated addresses of ping agents (see ping agent) to probe the target from at the same time as this instance, for triangulating where requests are lost. Needs -c")
+	agentTokenFlag = flags.String("agent-token", "", "The shared token that the agents and the instance coordinating them authenticate with. Better given as PING_AGENT_TOKEN")
+)
+
+const (
+	// agentTimeout bounds connecting to an agent and the handshake
+	agentTimeout = 5 * time.Second
+	// agentStartDelay is how long after the handshakes the instances start, for the probe requests to reach the agents
+	agentStartDelay = time.Second
+	// agentMaxWait is how far in the future an agent accepts the start of a probe
+	agentMaxWait = time.Minute
+)
+
+// The types of the messages of the control protocol. The coordinator sends a hello with the token, which the agent
+// answers with a hello with its clock. Then the coordinator sends the probe, and the agent a result per request and
+// done. An error ends the session, in a done message if the agent has one
+const (
+	agentHello  = "hello"
+	agentProbe  = "probe"
+	agentResult = "result"
+	agentDone   = "done"
+)
+
+// agentMessage is a message of the control protocol, one JSON object per line over TCP
+type agentMessage struct {
+	Type  string `json:"type"`
+	Token string `json:"token,omitempty"`
+	// Time is the clock of the agent in its hello, in Unix nanoseconds
+	Time int64 `json:"time,omitempty"`
+	// The probe: the target IP, the request parameters, and when to start in the clock of the agent
+	Target   string        `json:"target,omitempty"`
+	Count    int           `json:"count,omitempty"`
+	Interval time.Duration `json:"interval_ns,omitempty"`
+	MaxRTT   time.Duration `json:"max_rtt_ns,omitempty"`
+	Size     int           `json:"size,omitempty"`
+	Start    int64         `json:"start,omitempty"`
+	// The result of a request
+	Seq   int           `json:"seq,omitempty"`
+	Lost  bool          `json:"lost,omitempty"`
+	RTT   time.Duration `json:"rtt_ns,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// dist is set if --agents is
+var dist *distributedProbe
+
+// distributedProbe probes the target from this instance and the agents at the same time, with the same sequence
+// numbers. A request lost by every instance points to loss near the target, and one lost by some to loss on their
+// own paths
+type distributedProbe struct {
+	target    string
+	count     int
+	instances []*probeInstance
+}
+
+// probeInstance is the outcome of the requests of this instance, or an agent
+type probeInstance struct {
+	name string
+	// offset is how far ahead the clock of the agent is, estimated from the hello like NTP
+	offset time.Duration
+	mux    *sync.Mutex
+	rtts   map[int]time.Duration
+	lost   map[int]bool
+	err    error
+	conn   net.Conn
+	done   chan struct{}
+}
+
+// distributedSummary is the distributed probe in the JSON output
+type distributedSummary struct {
+	Instances  []instanceSummary `json:"instances"`
+	LostByAll  []int             `json:"lost_by_all"`
+	LostBySome int               `json:"lost_by_some"`
+}
+
+type instanceSummary struct {
+	Instance      string  `json:"instance"`
+	Transmitted   int     `json:"transmitted"`
+	Received      int     `json:"received"`
+	LossPercent   float64 `json:"loss_percent"`
+	AvgRTTMs      float64 `json:"avg_rtt_ms"`
+	ClockOffsetMs float64 `json:"clock_offset_ms,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// validateAgents checks that the requests of this instance can be matched with those of the agents
+func validateAgents() error {
+	if *agentsFlag == "" {
+		return nil
+	}
+	switch {
+	case *agentTokenFlag == "":
+		return fmt.Errorf("--agents needs --agent-token")
+	case *countFlag == 0:
+		return fmt.Errorf("--agents needs -c, so that every instance sends the same requests")
+	case *warmupFlag != 0, *burstFlag != 1, *adaptiveFlag, *floodFlag, *sweepFlag != "":
+		return fmt.Errorf("--agents doesn't support --warmup, --burst, --adaptive, --flood or --sweep, every instance sends the same requests --interval apart")
+	}
+	return nil
+}
+
+func newProbeInstance(name string) *probeInstance {
+	return &probeInstance{
+		name: name,
+		mux:  &sync.Mutex{},
+		rtts: map[int]time.Duration{},
+		lost: map[int]bool{},
+		done: make(chan struct{}),
+	}
+}
+
+// record records the requests of this instance, as a recorder
+func (i *probeInstance) record(p *probe) error {
+	i.add(p.seq, p.lost, p.rtt)
+	return nil
+}
+
+func (i *probeInstance) Close() error {
+	return nil
+}
+
+func (i *probeInstance) add(seq int, lost bool, rtt time.Duration) {
+	// It's not known which request a TTL exceeded error without the original request was for
+	if seq < 0 {
+		return
+	}
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	if lost {
+		i.lost[seq] = true
+	} else {
+		i.rtts[seq] = rtt
+	}
+}
+
+// startAgents connects to the agents, and has them probe the target with the same requests as this instance. It
+// returns when the instances start, which agents that failed don't hold back
+func startAgents(target net.IP, count int, interval, maxRTT time.Duration, size int) (time.Time, error) {
+	d := &distributedProbe{target: target.String(), count: count}
+	local := newProbeInstance("local")
+	close(local.done)
+	d.instances = append(d.instances, local)
+	recorders = append(recorders, local)
+
+	wg := &sync.WaitGroup{}
+	for _, addr := range strings.Split(*agentsFlag, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		i := newProbeInstance(addr)
+		d.instances = append(d.instances, i)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i.err = i.handshake(); i.err != nil {
+				close(i.done)
+			}
+		}()
+	}
+	wg.Wait()
+	if len(d.instances) == 1 {
+		return time.Time{}, fmt.Errorf("--agents has no agents")
+	}
+
+	start := time.Now().Add(agentStartDelay)
+	// The results must arrive by the time the last request has timed out, with the same slack as the handshake
+	end := start.Add(time.Duration(count)*interval + maxRTT + agentTimeout)
+	for _, i := range d.instances[1:] {
+		if i.err != nil {
+			logger.Warnf("Agent %s left out: %v", i.name, i.err)
+			continue
+		}
+		req := &agentMessage{
+			Type: agentProbe, Target: target.String(), Count: count, Interval: interval, MaxRTT: maxRTT, Size: size,
+			Start: start.Add(i.offset).UnixNano(),
+		}
+		if err := json.NewEncoder(i.conn).Encode(req); err != nil {
+			i.err = err
+			i.conn.Close()
+			close(i.done)
+			continue
+		}
+		_ = i.conn.SetDeadline(end)
+		go i.receive()
+	}
+	dist = d
+	return start, nil
+}
+
+// handshake connects to the agent, authenticates, and estimates its clock offset
+func (i *probeInstance) handshake() error {
+	conn, err := net.DialTimeout("tcp", i.name, agentTimeout)
+	if err != nil {
+		return err
+	}
+	_ = conn.SetDeadline(time.Now().Add(agentTimeout))
+	sent := time.Now()
+	if err := json.NewEncoder(conn).Encode(&agentMessage{Type: agentHello, Token: *agentTokenFlag}); err != nil {
+		conn.Close()
+		return err
+	}
+	// A decoder would buffer the results that receive reads
+	reply := &agentMessage{}
+	if err := readAgentMessage(conn, reply); err != nil {
+		conn.Close()
+		return err
+	}
+	received := time.Now()
+	if reply.Type != agentHello {
+		conn.Close()
+		return fmt.Errorf("unexpected %q message from the agent", reply.Type)
+	}
+	// The agent read its clock about halfway through the round trip
+	i.offset = time.Unix(0, reply.Time).Sub(sent.Add(received.Sub(sent) / 2))
+	i.conn = conn
+	return nil
+}
+
+// receive reads the results of the agent until it's done
+func (i *probeInstance) receive() {
+	defer close(i.done)
+	defer i.conn.Close()
+	dec := json.NewDecoder(i.conn)
+	for {
+		m := &agentMessage{}
+		if err := dec.Decode(m); err != nil {
+			i.err = err
+			return
+		}
+		if m.Error != "" {
+			i.err = fmt.Errorf("%s", m.Error)
+			return
+		}
+		switch m.Type {
+		case agentResult:
+			i.add(m.Seq, m.Lost, m.RTT)
+		case agentDone:
+			return
+		}
+	}
+}
+
+// readAgentMessage reads a single message, byte by byte up to its newline, so that nothing after it is consumed
+func readAgentMessage(conn net.Conn, m *agentMessage) error {
+	line := []byte{}
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return err
+		}
+		if b[0] == '\n' {
+			break
+		}
+		line = append(line, b[0])
+	}
+	if err := json.Unmarshal(line, m); err != nil {
+		return err
+	}
+	if m.Error != "" {
+		return fmt.Errorf("%s", m.Error)
+	}
+	return nil
+}
+
+// wait waits for the results of every agent
+func (d *distributedProbe) wait() {
+	for _, i := range d.instances {
+		<-i.done
+	}
+}
+
+// summary returns the outcome of every instance, and which requests were lost by all or some of them. Only the
+// instances that completed, and the requests that every one of them has an outcome for, are compared
+func (d *distributedProbe) summary() *distributedSummary {
+	s := &distributedSummary{LostByAll: []int{}}
+	complete := []*probeInstance{}
+	for _, i := range d.instances {
+		i.mux.Lock()
+		is := instanceSummary{Instance: i.name, Transmitted: len(i.rtts) + len(i.lost), Received: len(i.rtts)}
+		if i != d.instances[0] {
+			is.ClockOffsetMs = ms(i.offset)
+		}
+		if is.Transmitted != 0 {
+			is.LossPercent = 100 * float64(len(i.lost)) / float64(is.Transmitted)
+		}
+		if len(i.rtts) != 0 {
+			sum := time.Duration(0)
+			for _, rtt := range i.rtts {
+				sum += rtt
+			}
+			is.AvgRTTMs = ms(sum / time.Duration(len(i.rtts)))
+		}
+		if i.err != nil {
+			is.Error = i.err.Error()
+		} else {
+			complete = append(complete, i)
+		}
+		i.mux.Unlock()
+		s.Instances = append(s.Instances, is)
+	}
+	if len(complete) < 2 {
+		return s
+	}
+
+	for seq := 0; seq < d.count; seq++ {
+		lost, known := 0, 0
+		for _, i := range complete {
+			i.mux.Lock()
+			if _, ok := i.rtts[seq]; ok {
+				known++
+			} else if i.lost[seq] {
+				known++
+				lost++
+			}
+			i.mux.Unlock()
+		}
+		switch {
+		case known != len(complete) || lost == 0:
+		case lost == known:
+			s.LostByAll = append(s.LostByAll, seq)
+		default:
+			s.LostBySome++
+		}
+	}
+	return s
+}
+
+// print prints the distributed probe section of the statistics
+func (d *distributedProbe) print() {
+	s := d.summary()
+	fmt.Printf("--- distributed probe of %s from %d instances ---\n", d.target, len(s.Instances))
+	for _, is := range s.Instances {
+		if is.Error != "" {
+			fmt.Println(paint(colorRed, fmt.Sprintf("%s: failed: %s", is.Instance, is.Error)))
+			continue
+		}
+		offset := ""
+		if is.Instance != "local" {
+			offset = fmt.Sprintf(", clock offset %+.3f ms", is.ClockOffsetMs)
+		}
+		fmt.Printf("%s: %s, rtt avg %.3f ms%s\n", is.Instance, paintLoss(uint64(is.Received), uint64(is.Transmitted),
+			fmt.Sprintf("%d/%d received, %.0f%% loss", is.Received, is.Transmitted, is.LossPercent)), is.AvgRTTMs, offset)
+	}
+	if len(s.LostByAll) != 0 {
+		seqs := make([]string, 0, len(s.LostByAll))
+		for _, seq := range s.LostByAll {
+			seqs = append(seqs, fmt.Sprint(seq))
+		}
+		fmt.Printf("%d requests lost by every instance (icmp_seq %s), which points to loss near the target\n",
+			len(s.LostByAll), strings.Join(seqs, ", "))
+	}
+	if s.LostBySome != 0 {
+		fmt.Printf("%d requests lost by some instances only, which points to loss on their own paths\n", s.LostBySome)
+	}
+}
+
+// runAgent serves probe requests of coordinating instances on the address, one probe at a time
+func runAgent(addr string) error {
+	if *agentTokenFlag == "" {
+		return fmt.Errorf("--agent-token must be set, so that only the coordinating instances can make the agent ping")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	logger.Infof("Waiting for probe requests on %s", l.Addr())
+	// busy has room for the probe that's running, as the statistics and recorders are shared
+	busy := make(chan struct{}, 1)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			done := &agentMessage{Type: agentDone}
+			if err := serveProbe(conn, busy); err != nil {
+				logger.Warnf("Probe of %s failed: %v", conn.RemoteAddr(), err)
+				done.Error = err.Error()
+			}
+			_ = json.NewEncoder(conn).Encode(done)
+		}()
+	}
+}
+
+// serveProbe authenticates the coordinator, and sends it the results of the probe it requests
+func serveProbe(conn net.Conn, busy chan struct{}) error {
+	_ = conn.SetDeadline(time.Now().Add(agentTimeout))
+	enc := json.NewEncoder(conn)
+	hello := &agentMessage{}
+	if err := readAgentMessage(conn, hello); err != nil {
+		return err
+	}
+	if hello.Type != agentHello || !hmac.Equal([]byte(hello.Token), []byte(*agentTokenFlag)) {
+		return fmt.Errorf("invalid token")
+	}
+	select {
+	case busy <- struct{}{}:
+		defer func() { <-busy }()
+	default:
+		return fmt.Errorf("the agent is busy with another probe")
+	}
+	if err := enc.Encode(&agentMessage{Type: agentHello, Time: time.Now().UnixNano()}); err != nil {
+		return err
+	}
+
+	req := &agentMessage{}
+	if err := readAgentMessage(conn, req); err != nil {
+		return err
+	}
+	target := net.ParseIP(req.Target)
+	start := time.Unix(0, req.Start)
+	switch {
+	case req.Type != agentProbe:
+		return fmt.Errorf("unexpected %q message", req.Type)
+	case target == nil:
+		return fmt.Errorf("invalid target %q", req.Target)
+	case req.Count < 1 || req.Interval <= 0 || req.MaxRTT <= 0:
+		return fmt.Errorf("the count, interval and max RTT must be positive")
+	case req.Size < defaultSize || req.Size > maxSize:
+		return fmt.Errorf("the size must be between %d and %d", defaultSize, maxSize)
+	case time.Until(start) > agentMaxWait:
+		return fmt.Errorf("the probe starts more than %v from now, are the clocks in sync?", agentMaxWait)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	logger.Infof("Probing %s for %s", target, conn.RemoteAddr())
+
+	p, err := NewPinger(req.Interval, 0, req.MaxRTT, req.Count, 1, req.Size, *debugFlag, listenAddress(), sourceIface, *ttl, target.To4() == nil, *unprivileged, false, false, handler)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+	r := &agentRecorder{enc: enc}
+	recorders = append(recorders, r)
+	defer func() { recorders = recorders[:len(recorders)-1] }()
+
+	// The coordinator closing the connection stops the probe
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_, _ = conn.Read(make([]byte, 1))
+		cancel()
+	}()
+	select {
+	case <-time.After(time.Until(start)):
+	case <-ctx.Done():
+		return fmt.Errorf("the coordinator disconnected")
+	}
+	if err := p.Ping(ctx, req.Target, net.IPAddr{IP: target}); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("the coordinator disconnected")
+		}
+		return err
+	}
+	return nil
+}
+
+// agentRecorder sends the results of the requests to the coordinator as they come
+type agentRecorder struct {
+	enc *json.Encoder
+}
+
+func (r *agentRecorder) record(p *probe) error {
+	return r.enc.Encode(&agentMessage{Type: agentResult, Seq: p.seq, Lost: p.lost, RTT: p.rtt})
+}
+
+func (r *agentRecorder) Close() error {
+	return nil
+}
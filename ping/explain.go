@@ -0,0 +1,221 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var explainFlag = flags.Bool("explain", false, "Check the configuration, and print what ping would do, e.g. the socket, the resolved targets, the intervals and the timeouts, without sending any requests")
+
+// explain prints what the run with the pinger would do. The pinger's socket has been opened, which tells whether
+// it's permitted, but nothing has been sent
+func explain(host string, target net.IPAddr, p *Pinger, tos int, histogramEdges []time.Duration) {
+	lines := []string{}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+
+	family := "IPv4"
+	if p.ipv6 {
+		family = "IPv6"
+	}
+	if host == target.IP.String() {
+		add("ping %s over %s", target.IP, family)
+	} else {
+		add("resolve %s to %s, and ping it over %s", host, target.IP, family)
+	}
+	add("use %s", socketDescription(p.ipv6, p.unprivileged))
+	if source := describeSource(); source != "" {
+		add("%s", source)
+	}
+
+	requests := "send requests until interrupted"
+	if p.pmtu != nil {
+		requests = "send requests until the path MTU is found"
+	}
+	if p.count != 0 {
+		requests = fmt.Sprintf("send %d requests", p.count-*warmupFlag)
+	}
+	if *warmupFlag != 0 {
+		requests += fmt.Sprintf(", after %d warm-up requests that are left out of the statistics", *warmupFlag)
+	}
+	add("%s", requests)
+	switch {
+	case *floodFlag:
+		add("flood: send the next request as soon as the previous one is answered, %v to %v apart", p.minInterval, p.interval)
+	case p.minInterval != 0:
+		add("send the next request as soon as the previous one is answered, %v to %v apart", p.minInterval, p.interval)
+	default:
+		add("send a request every %v", p.interval)
+	}
+	if p.burst > 1 {
+		add("send the requests in bursts of %d back-to-back", p.burst)
+	}
+	switch {
+	case p.pmtu != nil:
+		add("set the Don't Fragment bit, and binary-search the largest payload from %d to %d bytes that gets through, to find the path MTU", defaultSize, maxSize)
+	case p.sweep != nil:
+		add("sweep the payload size from %d to %d bytes in steps of %d", p.sweep.min, p.sweep.max, p.sweep.step)
+	default:
+		add("send %d-byte payloads", p.size)
+	}
+	if p.broadcast {
+		add("report the replies of every host to the broadcast or multicast address, and count a request as lost if no host answers it within %v", p.maxRTT)
+	} else {
+		add("count a request as lost if it isn't answered within %v", p.maxRTT)
+	}
+	if *deadlineFlag != 0 {
+		add("stop after %v", *deadlineFlag)
+	}
+	ttlTOS := fmt.Sprintf("send the requests with a TTL of %d", *ttl)
+	if tos != -1 {
+		ttlTOS += fmt.Sprintf(" and a TOS of %#02x", tos)
+	}
+	add("%s", ttlTOS)
+	if p.delays != nil {
+		add("also send an ICMP timestamp request with every echo request")
+	}
+	lines = append(lines, explainReporting(histogramEdges)...)
+
+	fmt.Println("The configuration is valid. Without --explain, ping would:")
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+// explainTCP prints what the run with --tcp would do
+func explainTCP(host string, target net.IPAddr, count int, interval time.Duration, histogramEdges []time.Duration) {
+	addr := &net.TCPAddr{IP: target.IP, Port: tcpPort, Zone: target.Zone}
+	lines := []string{}
+	if host == target.IP.String() {
+		lines = append(lines, fmt.Sprintf("connect to %s over TCP", addr))
+	} else {
+		lines = append(lines, fmt.Sprintf("resolve %s to %s, and connect to %s over TCP", host, target.IP, addr))
+	}
+	connects := "connect until interrupted"
+	if count != 0 {
+		connects = fmt.Sprintf("connect %d times", count-*warmupFlag)
+	}
+	if *warmupFlag != 0 {
+		connects += fmt.Sprintf(", after %d warm-up connects that are left out of the statistics", *warmupFlag)
+	}
+	lines = append(lines, connects, fmt.Sprintf("connect every %v, and close the connection once it's established", interval),
+		fmt.Sprintf("count a connect as lost if it's refused, or not established within %v", *maxRTTFlag))
+	if *deadlineFlag != 0 {
+		lines = append(lines, fmt.Sprintf("stop after %v", *deadlineFlag))
+	}
+	lines = append(lines, explainReporting(histogramEdges)...)
+
+	fmt.Println("The configuration is valid. Without --explain, ping would:")
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+// explainHTTP prints what the run with --http would do
+func explainHTTP(target net.IPAddr, count int, interval time.Duration, histogramEdges []time.Duration) {
+	lines := []string{fmt.Sprintf("resolve %s to %s, and send %s %s to it over a new connection every time",
+		httpURL.Hostname(), target.IP, *httpMethodFlag, httpURL)}
+	requests := "send requests until interrupted"
+	if count != 0 {
+		requests = fmt.Sprintf("send %d requests", count-*warmupFlag)
+	}
+	if *warmupFlag != 0 {
+		requests += fmt.Sprintf(", after %d warm-up requests that are left out of the statistics", *warmupFlag)
+	}
+	lines = append(lines, requests, fmt.Sprintf("send a request every %v, without following redirects", interval),
+		fmt.Sprintf("count a request as received whatever its status, and as lost if it fails, or has no response within %v", *maxRTTFlag),
+		"print how many responses had every status code")
+	if *deadlineFlag != 0 {
+		lines = append(lines, fmt.Sprintf("stop after %v", *deadlineFlag))
+	}
+	lines = append(lines, explainReporting(histogramEdges)...)
+
+	fmt.Println("The configuration is valid. Without --explain, ping would:")
+	for _, line := range lines {
+		fmt.Printf("  %s\n", line)
+	}
+}
+
+// explainReporting describes the output, and where else the outcomes of the requests go
+func explainReporting(histogramEdges []time.Duration) []string {
+	lines := []string{}
+	add := func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	output := fmt.Sprintf("print %s output", *outputFlag)
+	if signer != nil {
+		output += fmt.Sprintf(", signed with %s HMACs", *signAlgorithmFlag)
+	}
+	add("%s", output)
+	if *timestampFlag {
+		add("prefix every reply, timeout and error with a %s timestamp", *timestampFormatFlag)
+	}
+	if histogramEdges != nil {
+		add("print an RTT histogram with the buckets %s", durations(histogramEdges))
+	}
+	if slo != nil {
+		names := []string{}
+		for _, o := range slo.objectives {
+			names = append(names, o.name)
+		}
+		add("track the objectives %s over %v windows", strings.Join(names, ", "), slo.window)
+	}
+	if geoip != nil {
+		add("annotate the responders from %s", *geoipFlag)
+	}
+	if rdns != nil {
+		add("look up the names of the responders with reverse DNS")
+	}
+	if *recordFlag != "" {
+		add("append a CSV row per request to %s", *recordFlag)
+	}
+	if *metricsAddrFlag != "" {
+		add("serve Prometheus metrics on %s", *metricsAddrFlag)
+	}
+	if *agentsFlag != "" {
+		add("probe the target at the same time from the agents %s", *agentsFlag)
+	}
+	return lines
+}
+
+// explainFleet prints what the fleet run would do, and which hosts can't be resolved
+func explainFleet(hosts []*fleetHost, s *fleetScheduler) {
+	fmt.Println("The configuration is valid. Without --explain, ping would:")
+	fmt.Printf("  use %s\n", socketDescription(false, false))
+	fmt.Printf("  send %d requests to each of %d hosts, %v apart, at most %d hosts at once\n", s.count, len(hosts), s.interval, s.concurrency)
+	fmt.Printf("  count a request as lost if it isn't answered within %v\n", s.maxRTT)
+	for _, h := range hosts {
+		if h.err != nil {
+			fmt.Printf("  report %s as unreachable, as it can't be resolved: %v\n", h.name, h.err)
+			continue
+		}
+		fmt.Printf("  ping %s at %s\n", h.name, h.ip)
+	}
+}
+
+// socketDescription describes the socket of a pinger, and the privileges it needs
+func socketDescription(ipv6, datagram bool) string {
+	network, datagramNetwork := "ip4:icmp", "udp4"
+	if ipv6 {
+		network, datagramNetwork = "ip6:ipv6-icmp", "udp6"
+	}
+	switch {
+	case !datagram:
+		return fmt.Sprintf("a raw ICMP socket (%s), which needs root or CAP_NET_RAW, and is permitted", network)
+	case *unprivileged:
+		return fmt.Sprintf("an ICMP datagram socket (%s), as --unprivileged is set", datagramNetwork)
+	}
+	return fmt.Sprintf("an ICMP datagram socket (%s), as raw sockets aren't permitted", datagramNetwork)
+}
+
+// durations formats the durations as a comma-separated list
+func durations(ds []time.Duration) string {
+	s := make([]string, 0, len(ds))
+	for _, d := range ds {
+		s = append(s, d.String())
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,305 @@
+package ping
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	// fleetResolvers is how many hosts of a fleet are resolved at once
+	fleetResolvers = 32
+	// maxFleetHosts is how many hosts a fleet can have, as every host gets its own ICMP echo ID
+	maxFleetHosts = 0xffff
+)
+
+var (
+	fleetFlag      = flags.String("fleet", "", "Ping every host listed in this file, one per line or - for stdin, and report which are reachable")
+	fleetCountFlag = flags.Int("fleet-count", 1, "How many echo requests to send to each host in --fleet mode, --interval apart")
+)
+
+// fleetHost is a host of the fleet, and the outcome of pinging it
+type fleetHost struct {
+	name string
+	ip   net.IP
+	// id is the echo ID of the requests to the host
+	id int
+	// err is set if the host couldn't be resolved
+	err   error
+	stats *rtt.Stats
+	// sent are the send times of the echo requests that haven't been answered, by sequence number
+	sent map[int]time.Time
+	// replies gets a value for every answered echo request
+	replies chan struct{}
+}
+
+// readFleet reads the hosts of a fleet, one per line. Empty lines and lines starting with # are skipped
+func readFleet(r io.Reader) ([]*fleetHost, error) {
+	hosts := []*fleetHost{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hosts = append(hosts, &fleetHost{name: line, stats: &rtt.Stats{}, sent: map[int]time.Time{}})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("the fleet has no hosts")
+	}
+	if len(hosts) > maxFleetHosts {
+		return nil, fmt.Errorf("the fleet can have at most %d hosts, got %d", maxFleetHosts, len(hosts))
+	}
+	return hosts, nil
+}
+
+// resolveFleet looks up the IPv4 address of every host, fleetResolvers at a time
+func resolveFleet(hosts []*fleetHost) {
+	work := make(chan *fleetHost)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < fleetResolvers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range work {
+				h.ip, h.err = resolveIPv4(h.name)
+			}
+		}()
+	}
+	for _, h := range hosts {
+		work <- h
+	}
+	close(work)
+	wg.Wait()
+}
+
+func resolveIPv4(host string) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.To4() == nil {
+			return nil, fmt.Errorf("only IPv4 is supported")
+		}
+		return ip.To4(), nil
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("cannot resolve: %v", err)
+	}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			return ip.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("cannot resolve: no IPv4 address")
+}
+
+// runFleet pings every host of the fleet in the file, prints a report, and returns a noRepliesError if any host is
+// unreachable, so that scripts can use the exit status
+func runFleet(path string) error {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	hosts, err := readFleet(r)
+	if err != nil {
+		return err
+	}
+	if *fleetCountFlag < 1 {
+		return fmt.Errorf("--fleet-count must be at least 1")
+	}
+	if *sizeFlag < defaultSize || *sizeFlag > maxSize {
+		return fmt.Errorf("--size must be between %d and %d", defaultSize, maxSize)
+	}
+	if *unprivileged {
+		return fmt.Errorf("--unprivileged is not supported in --fleet mode, which tells the hosts apart by echo ID")
+	}
+	if jsonOutput() {
+		return fmt.Errorf("--output %s is not supported in --fleet mode", outputJSON)
+	}
+	if *recordFlag != "" {
+		return fmt.Errorf("--record is not supported in --fleet mode")
+	}
+	if *sloFlag != "" {
+		return fmt.Errorf("--slo is not supported in --fleet mode")
+	}
+	if *agentsFlag != "" {
+		return fmt.Errorf("--agents is not supported in --fleet mode")
+	}
+	if *sweepFlag != "" {
+		return fmt.Errorf("--sweep is not supported in --fleet mode")
+	}
+	if *pmtuFlag {
+		return fmt.Errorf("--pmtu is not supported in --fleet mode")
+	}
+	if *allowBroadcastFlag {
+		return fmt.Errorf("--allow-broadcast is not supported in --fleet mode")
+	}
+	if *resolveFlag {
+		return fmt.Errorf("--resolve is not supported in --fleet mode")
+	}
+	if *timestampFlag {
+		return fmt.Errorf("-D is not supported in --fleet mode, which prints no line per reply")
+	}
+	if *tcpFlag != "" || *httpFlag != "" {
+		return fmt.Errorf("--tcp and --http are not supported in --fleet mode")
+	}
+	tos, err := validateTOS()
+	if err != nil {
+		return err
+	}
+	if err := setupGeoIP(); err != nil {
+		return err
+	}
+	if *fleetConcurrencyFlag < 1 {
+		return fmt.Errorf("--fleet-concurrency must be at least 1")
+	}
+
+	conn, err := listenICMP("ip4:icmp", listenAddress(), false, sourceOptions())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.IPv4PacketConn().SetTTL(*ttl)
+	if tos != -1 {
+		if err := setTOS(conn, false, tos); err != nil {
+			return fmt.Errorf("couldn't set the TOS: %v", err)
+		}
+	}
+
+	resolveFleet(hosts)
+	s := &fleetScheduler{
+		count:       *fleetCountFlag,
+		interval:    *intervalFlag,
+		maxRTT:      *maxRTTFlag,
+		concurrency: *fleetConcurrencyFlag,
+	}
+	if *explainFlag {
+		explainFleet(hosts, s)
+		return nil
+	}
+	start := time.Now()
+	pingFleet(conn, hosts, s)
+	return printFleetReport(hosts, time.Since(start))
+}
+
+// pingFleet probes every resolved host with the scheduler, and records the replies. Every host gets its own
+// echo ID, so that the replies can be matched to it
+func pingFleet(conn packetConn, hosts []*fleetHost, s *fleetScheduler) {
+	s.conn, s.mux = conn, &sync.Mutex{}
+	baseID := rand.Intn(0xffff)
+	byID := map[int]*fleetHost{}
+	resolved := []*fleetHost{}
+	for i, h := range hosts {
+		if h.err == nil {
+			h.id = (baseID + i) % 0xffff
+			h.replies = make(chan struct{}, s.count)
+			byID[h.id] = h
+			resolved = append(resolved, h)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		receiveFleet(conn, s.mux, byID)
+	}()
+
+	s.run(resolved, *fleetProgressFlag)
+
+	// The receiver stops at the read deadline
+	_ = conn.SetReadDeadline(time.Now())
+	<-done
+}
+
+func sendEcho(conn packetConn, id, seq int, ip net.IP) error {
+	b, err := (&icmp.Message{
+		Type: ipv4.ICMPTypeEcho, Code: 0,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: echoPayload(time.Now(), *sizeFlag)},
+	}).Marshal(nil)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteTo(b, &net.IPAddr{IP: ip})
+	return err
+}
+
+// receiveFleet records the echo replies of the fleet until reading fails, e.g. at the read deadline
+func receiveFleet(conn packetConn, mux *sync.Mutex, byID map[int]*fleetHost) {
+	buf := make([]byte, *sizeFlag+recvOverhead)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		m, err := icmp.ParseMessage(ProtocolICMP, buf[:n])
+		if err != nil || m.Type != ipv4.ICMPTypeEchoReply {
+			continue
+		}
+		echo, ok := m.Body.(*icmp.Echo)
+		if !ok {
+			continue
+		}
+
+		mux.Lock()
+		h, ok := byID[echo.ID]
+		if ok && addr.String() == h.ip.String() {
+			if sent, ok := h.sent[echo.Seq]; ok {
+				h.stats.PacketReceived(received.Sub(sent))
+				delete(h.sent, echo.Seq)
+				select {
+				case h.replies <- struct{}{}:
+				default:
+				}
+			}
+		}
+		mux.Unlock()
+	}
+}
+
+// printFleetReport prints which hosts are reachable, in the order of the fleet file, and returns an error if
+// any host is unreachable
+func printFleetReport(hosts []*fleetHost, took time.Duration) error {
+	divider := float64(1000000)
+	fmt.Printf("--- fleet reachability of %d hosts ---\n", len(hosts))
+	reachable := 0
+	unreachable := paint(colorRed, "unreachable")
+	for i, h := range hosts {
+		name := paintTarget(i, h.name)
+		if h.err != nil {
+			fmt.Printf("%s %s: %v\n", unreachable, name, h.err)
+			continue
+		}
+		s := h.stats.Calculate()
+		received := paintLoss(s.NumReceived, s.NumPackets, fmt.Sprintf("%d/%d received", s.NumReceived, s.NumPackets))
+		if s.NumReceived == 0 {
+			fmt.Printf("%s %s (%s)%s: %s\n", unreachable, name, h.ip, geoip.annotate(h.ip), received)
+			continue
+		}
+		reachable++
+		fmt.Printf("reachable   %s (%s)%s: %s, %s\n", name, h.ip, geoip.annotate(h.ip), received,
+			paintRTT(s.AvgRTT, fmt.Sprintf("rtt avg %.3f ms", float64(s.AvgRTT.Nanoseconds())/divider)))
+	}
+	fmt.Printf("%d of %d hosts reachable, time %.0f ms\n", reachable, len(hosts), float64(took.Nanoseconds())/divider)
+	if reachable != len(hosts) {
+		return &noRepliesError{msg: fmt.Sprintf("%d of %d hosts are unreachable", len(hosts)-reachable, len(hosts))}
+	}
+	return nil
+}
@@ -0,0 +1,32 @@
+package ping
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var floodFlag = flags.Bool("flood", false, "Root only. Send the next request as soon as the previous one is answered, and at least 100 times per second, printing a dot per request and a backspace per reply")
+
+const (
+	// floodInterval is the longest time between the requests of a flood, like in ping -f
+	floodInterval = 10 * time.Millisecond
+	// floodMinInterval keeps a flood at up to 10000 requests per second, even if the replies come back faster
+	floodMinInterval = 100 * time.Microsecond
+)
+
+// validateFlood returns an error if a flood isn't allowed
+func validateFlood() error {
+	if os.Geteuid() != 0 {
+		return fmt.Errorf("--flood is only allowed for root, as it may overwhelm the network")
+	}
+	if *adaptiveFlag {
+		return fmt.Errorf("--flood and --adaptive can't be used together, --flood is adaptive already")
+	}
+	return nil
+}
+
+// floodOutput returns whether requests and replies are shown as dots and backspaces
+func floodOutput() bool {
+	return *floodFlag && !jsonOutput()
+}
@@ -0,0 +1,87 @@
+package ping
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+var geoipFlag = flags.String("geoip-db", "", "Comma-separated MaxMind DB files, e.g. GeoLite2-ASN.mmdb,GeoLite2-Country.mmdb, to annotate the responders and hops with their AS and country")
+
+// geoip is set if --geoip-db is
+var geoip *geoAnnotator
+
+// geoAnnotator annotates IPs with what the databases know about them. The annotations are cached, as the same few
+// responders keep replying
+type geoAnnotator struct {
+	dbs   []*mmdb
+	mux   *sync.Mutex
+	cache map[string]string
+}
+
+func newGeoAnnotator(paths string) (*geoAnnotator, error) {
+	g := &geoAnnotator{mux: &sync.Mutex{}, cache: map[string]string{}}
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		db, err := openMMDB(path)
+		if err != nil {
+			return nil, err
+		}
+		g.dbs = append(g.dbs, db)
+	}
+	return g, nil
+}
+
+// setupGeoIP opens the databases of --geoip-db, if it's set
+func setupGeoIP() error {
+	if *geoipFlag == "" {
+		return nil
+	}
+	var err error
+	geoip, err = newGeoAnnotator(*geoipFlag)
+	return err
+}
+
+// annotate returns e.g. " [AS13335 Cloudflare, Inc., US]" for the IP, or nothing if no database knows it or there's
+// no annotator
+func (g *geoAnnotator) annotate(ip net.IP) string {
+	if g == nil {
+		return ""
+	}
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	if a, ok := g.cache[ip.String()]; ok {
+		return a
+	}
+
+	parts := []string{}
+	for _, db := range g.dbs {
+		data, err := db.lookup(ip)
+		if err != nil {
+			logger.Debugf("Failed to look up %s: %v", ip, err)
+			continue
+		}
+		// The fields of the GeoLite2 ASN, and the GeoLite2 Country and City databases
+		if asn, ok := data["autonomous_system_number"].(uint64); ok {
+			as := fmt.Sprintf("AS%d", asn)
+			if org, ok := data["autonomous_system_organization"].(string); ok {
+				as += " " + org
+			}
+			parts = append(parts, as)
+		}
+		if country, ok := data["country"].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok {
+				parts = append(parts, code)
+			}
+		}
+	}
+	a := ""
+	if len(parts) != 0 {
+		a = fmt.Sprintf(" [%s]", strings.Join(parts, ", "))
+	}
+	g.cache[ip.String()] = a
+	return a
+}
@@ -1,5 +1,15 @@
 module github.com/luxas/random-schoolwork/ping
 
-go 1.14
+go 1.18
 
-require golang.org/x/net v0.0.0-20200320220750-118fecf932d8
+require (
+	github.com/luxas/random-schoolwork/pkg v0.0.0
+	golang.org/x/net v0.17.0
+)
+
+require (
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
+
+replace github.com/luxas/random-schoolwork/pkg => ../pkg
@@ -0,0 +1,90 @@
+package ping
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+)
+
+var (
+	histogramFlag        = flags.Bool("histogram", false, "Print a histogram of the RTTs at exit, to show e.g. bimodal links and tail latency")
+	histogramBucketsFlag = flags.String("histogram-buckets", "1ms,2ms,5ms,10ms,20ms,50ms,100ms,200ms,500ms,1s", "Comma-separated upper bounds of the --histogram buckets, in increasing order")
+)
+
+// histogramWidth is how many characters wide the bar of the largest bucket is
+const histogramWidth = 40
+
+// histogramBucket is a bucket of the RTT histogram in the JSON output
+type histogramBucket struct {
+	// MaxRTTMs is the upper bound of the bucket, unset for the last bucket, which has none
+	MaxRTTMs *float64 `json:"max_rtt_ms,omitempty"`
+	Count    uint64   `json:"count"`
+}
+
+// validateHistogram returns the upper bounds of the histogram buckets, or nil if --histogram isn't set
+func validateHistogram() ([]time.Duration, error) {
+	if !*histogramFlag {
+		return nil, nil
+	}
+	edges := []time.Duration{}
+	for _, s := range strings.Split(*histogramBucketsFlag, ",") {
+		edge, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid --histogram-buckets: %v", err)
+		}
+		if edge <= 0 || (len(edges) != 0 && edge <= edges[len(edges)-1]) {
+			return nil, fmt.Errorf("--histogram-buckets must be positive and in increasing order")
+		}
+		edges = append(edges, edge)
+	}
+	return edges, nil
+}
+
+// histogramSummary returns the buckets of the histogram for the JSON output
+func histogramSummary(h *rtt.Histogram) []histogramBucket {
+	buckets := make([]histogramBucket, len(h.Counts))
+	for i, n := range h.Counts {
+		buckets[i].Count = n
+		if i < len(h.Edges) {
+			edge := ms(h.Edges[i])
+			buckets[i].MaxRTTMs = &edge
+		}
+	}
+	return buckets
+}
+
+// printHistogram prints the histogram section, a bar per bucket scaled to the largest one
+func printHistogram(h *rtt.Histogram) {
+	labels := make([]string, len(h.Counts))
+	labelWidth := 0
+	for i := range h.Counts {
+		if i < len(h.Edges) {
+			labels[i] = fmt.Sprintf("<= %v", h.Edges[i])
+		} else {
+			labels[i] = fmt.Sprintf("> %v", h.Edges[len(h.Edges)-1])
+		}
+		// Like the widths of fmt, in runes, as durations may be in µs
+		if n := utf8.RuneCountInString(labels[i]); n > labelWidth {
+			labelWidth = n
+		}
+	}
+	largest, total := uint64(0), h.Total()
+	for _, n := range h.Counts {
+		if n > largest {
+			largest = n
+		}
+	}
+
+	fmt.Println("--- rtt histogram ---")
+	for i, n := range h.Counts {
+		bar := ""
+		if n != 0 {
+			// Every non-empty bucket gets at least one character, so that rare outliers show
+			bar = strings.Repeat("#", int((n*histogramWidth+largest-1)/largest))
+		}
+		fmt.Printf("%*s |%-*s %d (%.0f%%)\n", labelWidth, labels[i], histogramWidth, bar, n, 100*float64(n)/float64(total))
+	}
+}
@@ -0,0 +1,209 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	httpFlag       = flags.String("http", "", "Probe with HTTP(S) requests to this URL instead of ICMP echo requests, e.g. https://example.com/healthz. The RTT is the time until the response headers, over a new connection every time")
+	httpMethodFlag = flags.String("http-method", http.MethodHead, "The method of the --http requests, HEAD or GET")
+)
+
+// httpURL is set if --http is
+var httpURL *url.URL
+
+// statuses counts the status codes of the responses with --http
+var statuses *statusCodes
+
+// validateHTTP parses the URL of --http, and checks that the other flags only apply to ICMP
+func validateHTTP() error {
+	if *httpFlag == "" {
+		return nil
+	}
+	u, err := url.Parse(*httpFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --http URL: %v", err)
+	}
+	switch {
+	case u.Scheme != "http" && u.Scheme != "https", u.Hostname() == "":
+		return fmt.Errorf("--http must be an http:// or https:// URL, e.g. https://example.com")
+	case *httpMethodFlag != http.MethodHead && *httpMethodFlag != http.MethodGet:
+		return fmt.Errorf("--http-method must be HEAD or GET")
+	case len(flags.Args()) != 0:
+		return fmt.Errorf("--http pings the host of the URL, don't give another one")
+	case *tcpFlag != "":
+		return fmt.Errorf("--http and --tcp can't be used together")
+	case *burstFlag != 1, *adaptiveFlag, *floodFlag, *sweepFlag != "", *pmtuFlag, *agentsFlag != "", *timestampsFlag:
+		return fmt.Errorf("--http doesn't support --burst, --adaptive, --flood, --sweep, --pmtu, --agents or --timestamps, which need ICMP")
+	case *sizeFlag != defaultSize, *tosFlag != -1, *dscpFlag != -1, *unprivileged:
+		return fmt.Errorf("--http doesn't support --size, --tos, --dscp or --unprivileged, which only apply to ICMP")
+	}
+	httpURL = u
+	statuses = &statusCodes{mux: &sync.Mutex{}, counts: map[int]int{}}
+	return nil
+}
+
+// HTTPPinger probes a URL with HTTP requests, and reports them like a Pinger does its echo requests. Every response
+// counts as received, whatever its status, while a request that fails or times out counts as lost
+type HTTPPinger struct {
+	url      *url.URL
+	method   string
+	interval time.Duration
+	// count is how many requests to send before stopping, or 0 to go on until stopped
+	count  int
+	client *http.Client
+	// mux serializes the outcomes of the requests, which run concurrently
+	mux      *sync.Mutex
+	callback ReceiveFunc
+	drain    chan struct{}
+}
+
+// NewHTTPPinger creates a pinger that requests u with the method every interval. The connections go to target
+// instead of the addresses the host of u resolves to, from localIP and through iface, those of them that are set. A
+// request times out after maxRTT
+func NewHTTPPinger(u *url.URL, method string, target net.IPAddr, localIP net.IP, iface string, interval, maxRTT time.Duration, count int, callback ReceiveFunc) *HTTPPinger {
+	d := newSourceDialer(localIP, iface, maxRTT)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			_, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			return d.DialContext(ctx, network, net.JoinHostPort(target.String(), port))
+		},
+		// Every request measures the whole way to the response, including the handshakes
+		DisableKeepAlives: true,
+	}
+	return &HTTPPinger{
+		url:      u,
+		method:   method,
+		interval: interval,
+		count:    count,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   maxRTT,
+			// A redirect is a response like any other
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		mux:      &sync.Mutex{},
+		callback: callback,
+		drain:    make(chan struct{}, 1),
+	}
+}
+
+// Ping requests the URL until ctx is done, or the requests of a pinger with a count are done. Like Pinger.Ping, it
+// returns ctx.Err() if ctx is done first. The requests that are still going on then aren't counted
+func (p *HTTPPinger) Ping(ctx context.Context, host string, target net.IPAddr) error {
+	printHeader(host, target.IP, 0)
+	return probeEvery(ctx, p.interval, p.count, p.drain, func(seq int) {
+		p.request(ctx, host, target, seq)
+	})
+}
+
+// request sends the request with the sequence number, and records its outcome
+func (p *HTTPPinger) request(ctx context.Context, host string, target net.IPAddr, seq int) {
+	req, err := http.NewRequest(p.method, p.url.String(), nil)
+	if err != nil {
+		// The URL was parsed already
+		panic(err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "ping")
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	rtt := time.Since(start)
+	if err == nil {
+		resp.Body.Close()
+	}
+	if probeCancelled(ctx, err) {
+		return
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	var neterr net.Error
+	switch {
+	case err == nil:
+		p.callback(&response{host: host, addr: target, rtt: rtt, seq: seq, status: resp.StatusCode}, nil)
+	case errors.As(err, &neterr) && neterr.Timeout():
+		recordLost(host, seq, 0)
+		printTimeout(host, target.IP, seq)
+	default:
+		recordLost(host, seq, 0)
+		// The URL error repeats the method and the URL
+		var urlerr *url.Error
+		if errors.As(err, &urlerr) {
+			err = urlerr.Err
+		}
+		printRecvError(host, fmt.Errorf("From %s%s http_seq=%d %v", target.IP, geoip.annotate(target.IP), seq, err))
+	}
+}
+
+// Drain makes Ping stop sending, and return once the outstanding requests are done
+func (p *HTTPPinger) Drain() {
+	select {
+	case p.drain <- struct{}{}:
+	default:
+	}
+}
+
+// statusCodes counts the responses by their status code
+type statusCodes struct {
+	mux    *sync.Mutex
+	counts map[int]int
+}
+
+func (s *statusCodes) record(status int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.counts[status]++
+}
+
+// summary returns the counts by status code, for the JSON output
+func (s *statusCodes) summary() map[int]int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	counts := make(map[int]int, len(s.counts))
+	for status, n := range s.counts {
+		counts[status] = n
+	}
+	return counts
+}
+
+// print prints the share of every status code of the responses, a line per status code, if there were any
+func (s *statusCodes) print() {
+	counts := s.summary()
+	if len(counts) == 0 {
+		return
+	}
+	codes := make([]int, 0, len(counts))
+	total := 0
+	for status, n := range counts {
+		codes = append(codes, status)
+		total += n
+	}
+	sort.Ints(codes)
+	fmt.Println("--- http status codes ---")
+	for _, status := range codes {
+		name := strconv.Itoa(status)
+		if text := http.StatusText(status); text != "" {
+			name += " " + text
+		}
+		line := fmt.Sprintf("%s: %d (%.0f%%)", name, counts[status], 100*float64(counts[status])/float64(total))
+		if status >= 500 {
+			line = paint(colorRed, line)
+		}
+		fmt.Println(line)
+	}
+}
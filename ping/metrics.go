@@ -0,0 +1,118 @@
+package ping
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/diagnostics"
+)
+
+var metricsAddrFlag = flags.String("metrics-addr", "", "If set, serve Prometheus metrics on /metrics at this address, e.g. :9115")
+var debugAddrFlag = diagnostics.RegisterFlag(flags)
+
+// rttBuckets are the upper bounds of the RTT histogram buckets, in seconds
+var rttBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+// pingMetrics counts the requests to the target and their RTTs, and serves them in the Prometheus text format.
+// Like the statistics, they don't cover the warm-up requests. All methods are no-ops on a nil *pingMetrics
+type pingMetrics struct {
+	mux      *sync.Mutex
+	host     string
+	sent     uint64
+	received uint64
+	lost     uint64
+	// buckets counts the RTTs up to the bound of every bucket, not cumulatively
+	buckets []uint64
+	// rttSum is the sum of all RTTs in seconds
+	rttSum float64
+}
+
+func newPingMetrics(host string) *pingMetrics {
+	return &pingMetrics{
+		mux:     &sync.Mutex{},
+		host:    host,
+		buckets: make([]uint64, len(rttBuckets)),
+	}
+}
+
+func (m *pingMetrics) packetSent() {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.sent++
+}
+
+func (m *pingMetrics) packetReceived(rtt time.Duration) {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.received++
+	m.rttSum += rtt.Seconds()
+	for i, bound := range rttBuckets {
+		if rtt.Seconds() <= bound {
+			m.buckets[i]++
+			break
+		}
+	}
+}
+
+func (m *pingMetrics) packetLost() {
+	if m == nil {
+		return
+	}
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.lost++
+}
+
+// serve serves /metrics on the address in the background
+func (m *pingMetrics) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	go func() {
+		logger.Infof("Serving metrics on %s", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			logger.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+}
+
+func (m *pingMetrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	host := fmt.Sprintf("host=%q", m.host)
+	b := &strings.Builder{}
+	for _, c := range []struct {
+		name, help string
+		value      uint64
+	}{
+		{"ping_packets_sent_total", "Echo requests sent", m.sent},
+		{"ping_packets_received_total", "Echo replies received", m.received},
+		{"ping_packets_lost_total", "Echo requests that timed out or weren't delivered", m.lost},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n%s{%s} %d\n", c.name, c.help, c.name, c.name, host, c.value)
+	}
+
+	fmt.Fprintf(b, "# HELP ping_rtt_seconds Round-trip times of the echo requests\n# TYPE ping_rtt_seconds histogram\n")
+	count := uint64(0)
+	for i, bound := range rttBuckets {
+		count += m.buckets[i]
+		fmt.Fprintf(b, "ping_rtt_seconds_bucket{%s,le=%q} %d\n", host, strconv.FormatFloat(bound, 'g', -1, 64), count)
+	}
+	fmt.Fprintf(b, "ping_rtt_seconds_bucket{%s,le=\"+Inf\"} %d\n", host, m.received)
+	fmt.Fprintf(b, "ping_rtt_seconds_sum{%s} %g\n", host, m.rttSum)
+	fmt.Fprintf(b, "ping_rtt_seconds_count{%s} %d\n", host, m.received)
+	slo.writeMetrics(b, host)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,253 @@
+package ping
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+)
+
+const (
+	// mmdbDataSeparator is the 16 zero bytes between the search tree and the data section
+	mmdbDataSeparator = 16
+	// mmdbMaxDepth limits the nesting of maps, arrays and pointers, so that a corrupt file can't recurse forever
+	mmdbMaxDepth = 32
+)
+
+// mmdbMetadataMarker precedes the metadata at the end of the file
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// mmdb reads MaxMind DB files, e.g. the GeoLite2 ASN and country databases. It only supports what the annotations
+// need, looking up the data of an IP, see https://maxmind.github.io/MaxMind-DB/
+type mmdb struct {
+	buf        []byte
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	// data decodes the data section, which starts after the search tree and the separator
+	data *mmdbDecoder
+	// ipv4Start is the node IPv4 addresses start from in an IPv6 tree, after 96 zero bits
+	ipv4Start uint
+}
+
+func openMMDB(path string) (*mmdb, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i == -1 {
+		return nil, fmt.Errorf("%s isn't a MaxMind DB file", path)
+	}
+	metadata, _, err := (&mmdbDecoder{buf: buf[i+len(mmdbMetadataMarker):]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata in %s: %v", path, err)
+	}
+	meta, _ := metadata.(map[string]interface{})
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	if recordSize != 24 && recordSize != 28 && recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d in %s", recordSize, path)
+	}
+	if ipVersion != 4 && ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d in %s", ipVersion, path)
+	}
+	treeSize := recordSize * 2 / 8 * nodeCount
+	if treeSize+mmdbDataSeparator > uint64(i) {
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+
+	db := &mmdb{
+		buf:        buf,
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+		data:       &mmdbDecoder{buf: buf[treeSize+mmdbDataSeparator : i]},
+	}
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+// record returns the left (bit 0) or right (bit 1) record of the node
+func (db *mmdb) record(node, bit uint) uint {
+	b := db.buf
+	switch db.recordSize {
+	case 24:
+		off := node*6 + bit*3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		off := node * 7
+		if bit == 0 {
+			return uint(b[off+3]&0xf0)<<20 | uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+		}
+		return uint(b[off+3]&0x0f)<<24 | uint(b[off+4])<<16 | uint(b[off+5])<<8 | uint(b[off+6])
+	default:
+		off := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(b[off : off+4]))
+	}
+}
+
+// lookup returns the data of the network the IP is in, or nil if it's in none
+func (db *mmdb) lookup(ip net.IP) (map[string]interface{}, error) {
+	addr, node := ip.To16(), uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		addr = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if db.ipVersion == 4 {
+		return nil, nil
+	}
+	for i := uint(0); i < uint(len(addr))*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(addr[i/8]>>(7-i%8))&1)
+	}
+	// A record equal to the node count means that there's no data
+	if node <= db.nodeCount {
+		return nil, nil
+	}
+	v, _, err := db.data.decode(node-db.nodeCount-mmdbDataSeparator, 0)
+	if err != nil {
+		return nil, err
+	}
+	data, _ := v.(map[string]interface{})
+	return data, nil
+}
+
+// mmdbDecoder decodes the data fields of a MaxMind DB. Pointers are offsets into buf
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// next returns the n bytes at offset
+func (d *mmdbDecoder) next(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) {
+		return nil, fmt.Errorf("field at offset %d is out of bounds", offset)
+	}
+	return d.buf[offset : offset+n], nil
+}
+
+// uintFrom returns the big-endian unsigned integer in b
+func uintFrom(b []byte) uint64 {
+	v := uint64(0)
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+// decode returns the field at offset, and the offset after it. Maps are map[string]interface{}, arrays
+// []interface{}, strings string, unsigned integers up to 64 bits uint64, and 128-bit ones []byte
+func (d *mmdbDecoder) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, fmt.Errorf("fields are nested too deep")
+	}
+	b, err := d.next(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	ctrl := b[0]
+	offset++
+	typ := uint(ctrl >> 5)
+	if typ == 1 {
+		// A pointer has the size of the pointer in the control byte instead of a size
+		size := uint(ctrl>>3&0x3) + 1
+		b, err := d.next(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		pointer := uint64(0)
+		switch size {
+		case 1:
+			pointer = uint64(ctrl&0x7)<<8 | uintFrom(b)
+		case 2:
+			pointer = 2048 + (uint64(ctrl&0x7)<<16 | uintFrom(b))
+		case 3:
+			pointer = 526336 + (uint64(ctrl&0x7)<<24 | uintFrom(b))
+		default:
+			pointer = uintFrom(b)
+		}
+		v, _, err := d.decode(uint(pointer), depth+1)
+		return v, offset + size, err
+	}
+	if typ == 0 {
+		// The type of an extended field is in the next byte
+		if b, err = d.next(offset, 1); err != nil {
+			return nil, 0, err
+		}
+		typ = 7 + uint(b[0])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if b, err = d.next(offset, n); err != nil {
+			return nil, 0, err
+		}
+		size = []uint{29, 285, 65821}[n-1] + uint(uintFrom(b))
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			k, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key at offset %d isn't a string", offset)
+			}
+			if m[key], offset, err = d.decode(next, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]interface{}, size)
+		for i := range a {
+			if a[i], offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, offset, nil
+	case 14: // boolean, which has its value as the size
+		return size != 0, offset, nil
+	}
+
+	if b, err = d.next(offset, size); err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case 2: // UTF-8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 4: // bytes
+		return b, offset, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		return uintFrom(b), offset, nil
+	case 10: // uint128
+		return b, offset, nil
+	case 8: // int32
+		return int32(uintFrom(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported field type %d at offset %d", typ, offset)
+}
@@ -0,0 +1,326 @@
+package ping
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+	"github.com/luxas/random-schoolwork/pkg/version"
+)
+
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+var outputFlag = flags.String("output", outputText, "The output format: text, or json for one JSON object per reply, timeout and error, and a final summary object")
+
+// pingEvent is a reply, timeout or receive error in the JSON output
+type pingEvent struct {
+	Type  string   `json:"type"`
+	Host  string   `json:"host"`
+	Addr  string   `json:"addr,omitempty"`
+	Seq   *int     `json:"seq,omitempty"`
+	RTTMs *float64 `json:"rtt_ms,omitempty"`
+	// JitterMs is set with --verbose
+	JitterMs *float64 `json:"jitter_ms,omitempty"`
+	TTL      *int     `json:"ttl,omitempty"`
+	Bytes    int      `json:"bytes,omitempty"`
+	Warmup   bool     `json:"warmup,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	// Port is set with --tcp
+	Port int `json:"port,omitempty"`
+	// Status is set with --http
+	Status int `json:"status,omitempty"`
+	// Extra is set for the replies to a broadcast request after the first one, which don't count in the statistics
+	Extra bool `json:"extra,omitempty"`
+	// Name is the reverse DNS name of Addr with --resolve, if it has one
+	Name string `json:"name,omitempty"`
+	// Time is set with -D, in seconds since the epoch, or as an RFC 3339 string with --timestamp-format rfc3339
+	Time interface{} `json:"time,omitempty"`
+}
+
+// pingSummary is the last object of the JSON output, with the statistics of the run
+type pingSummary struct {
+	Type        string  `json:"type"`
+	Host        string  `json:"host"`
+	Addr        string  `json:"addr"`
+	Transmitted uint64  `json:"transmitted"`
+	Received    uint64  `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	TimeMs      float64 `json:"time_ms"`
+	MinRTTMs    float64 `json:"min_rtt_ms"`
+	AvgRTTMs    float64 `json:"avg_rtt_ms"`
+	MaxRTTMs    float64 `json:"max_rtt_ms"`
+	SdevRTTMs   float64 `json:"sdev_rtt_ms"`
+	JitterMs    float64 `json:"jitter_ms"`
+	P50RTTMs    float64 `json:"p50_rtt_ms"`
+	P90RTTMs    float64 `json:"p90_rtt_ms"`
+	P95RTTMs    float64 `json:"p95_rtt_ms"`
+	P99RTTMs    float64 `json:"p99_rtt_ms"`
+	// Histogram is set with --histogram
+	Histogram []histogramBucket `json:"histogram,omitempty"`
+	Warmup    int               `json:"warmup,omitempty"`
+	Delays    *delaySummary     `json:"delays,omitempty"`
+	Burst     *burstSummary     `json:"burst,omitempty"`
+	// SLO is set with --slo
+	SLO []sloSummary `json:"slo,omitempty"`
+	// Sweep is set with --sweep
+	Sweep []sweepSize `json:"sweep,omitempty"`
+	// Distributed is set with --agents
+	Distributed *distributedSummary `json:"distributed,omitempty"`
+	// PMTU is set with --pmtu
+	PMTU *pmtuSummary `json:"pmtu,omitempty"`
+	// StatusCodes counts the responses by status code with --http
+	StatusCodes map[int]int `json:"status_codes,omitempty"`
+	// Responders counts the replies by host with a broadcast or multicast target
+	Responders map[string]int `json:"responders,omitempty"`
+	Version    version.Info   `json:"version"`
+}
+
+func validateOutput() error {
+	if *outputFlag != outputText && *outputFlag != outputJSON {
+		return fmt.Errorf("invalid --output %q, expected %s or %s", *outputFlag, outputText, outputJSON)
+	}
+	return nil
+}
+
+func jsonOutput() bool {
+	return *outputFlag == outputJSON
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / float64(time.Millisecond)
+}
+
+// printJSON writes the object on its own line, signed if there's a signer. A failed write can't be reported
+// anywhere better than the log
+func printJSON(v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		logger.Errorf("Failed to write the JSON output: %v", err)
+		return
+	}
+	if signer != nil {
+		b = signer.sign(b)
+	}
+	if _, err := os.Stdout.Write(append(b, '\n')); err != nil {
+		logger.Errorf("Failed to write the JSON output: %v", err)
+	}
+}
+
+func printHeader(host string, addr net.IP, size int) {
+	if jsonOutput() {
+		return
+	}
+	if tcpPort != 0 {
+		fmt.Printf("TCP PING %s (%s): port %d\n", host, addr, tcpPort)
+		return
+	}
+	if httpURL != nil {
+		fmt.Printf("HTTP PING %s (%s): %s %s\n", host, addr, *httpMethodFlag, httpURL)
+		return
+	}
+	if sweep != nil {
+		fmt.Printf("PING %s (%s): (%d ... %d) data bytes\n", host, addr, sweep.min, sweep.max)
+		return
+	}
+	if pmtu != nil {
+		fmt.Printf("PING %s (%s): path MTU discovery, (%d ... %d) data bytes\n", host, addr, defaultSize, maxSize)
+		return
+	}
+	fmt.Printf("PING %s (%s): %d data bytes\n", host, addr, size)
+}
+
+// printSent shows a sent request as a dot in flood mode, which the reply erases
+func printSent() {
+	if floodOutput() {
+		fmt.Print(".")
+	}
+}
+
+func printReply(resp *response) {
+	if floodOutput() {
+		fmt.Print("\b")
+		return
+	}
+	if jsonOutput() {
+		rtt := ms(resp.rtt)
+		event := &pingEvent{
+			Type: "reply", Host: resp.host, Addr: resp.addr.IP.String(), Seq: &resp.seq, RTTMs: &rtt, TTL: &resp.ttl,
+			Bytes: resp.bytelen, Warmup: !inStats(resp.seq), Port: resp.port, Status: resp.status,
+			Extra: resp.extra, Time: eventTime(),
+		}
+		if resp.port != 0 || resp.status != 0 {
+			// TCP connects and HTTP requests have no TTL
+			event.TTL = nil
+		} else {
+			event.Name = rdns.name(resp.addr.IP)
+		}
+		if verboseReply(resp.seq) {
+			jitter := ms(ps.Jitter())
+			event.JitterMs = &jitter
+		}
+		printJSON(event)
+		return
+	}
+	jitter := ""
+	if verboseReply(resp.seq) {
+		jitter = fmt.Sprintf(" jitter=%v", ps.Jitter().Round(time.Microsecond))
+	}
+	switch {
+	case resp.port != 0:
+		fmt.Printf("%sConnected to %s%s: tcp_seq=%d %s%s%s\n", timestampPrefix(), &net.TCPAddr{IP: resp.addr.IP, Port: resp.port, Zone: resp.addr.Zone},
+			geoip.annotate(resp.addr.IP), resp.seq, paintRTT(resp.rtt, fmt.Sprintf("time=%v", resp.rtt)), jitter, warmupSuffix(resp.seq))
+		return
+	case resp.status != 0:
+		status := fmt.Sprintf("status=%d", resp.status)
+		if resp.status >= 500 {
+			status = paint(colorRed, status)
+		}
+		fmt.Printf("%sResponse from %s%s: http_seq=%d %s %s%s%s\n", timestampPrefix(), resp.addr.IP, geoip.annotate(resp.addr.IP), resp.seq, status,
+			paintRTT(resp.rtt, fmt.Sprintf("time=%v", resp.rtt)), jitter, warmupSuffix(resp.seq))
+		return
+	}
+	fmt.Printf("%s%d bytes from %s%s: icmp_seq=%d ttl=%d %s%s%s\n", timestampPrefix(), resp.bytelen, rdns.label(resp.addr.IP), geoip.annotate(resp.addr.IP),
+		resp.seq, resp.ttl, paintRTT(resp.rtt, fmt.Sprintf("time=%v", resp.rtt)), jitter, warmupSuffix(resp.seq))
+}
+
+// verboseReply returns whether the jitter is shown with the reply. The warm-up replies don't count in the jitter
+func verboseReply(seq int) bool {
+	return *verboseFlag && inStats(seq)
+}
+
+func printTimeout(host string, addr net.IP, seq int) {
+	if floodOutput() {
+		// The dot of the request stays
+		return
+	}
+	if jsonOutput() {
+		printJSON(&pingEvent{Type: "timeout", Host: host, Addr: addr.String(), Seq: &seq, Warmup: !inStats(seq),
+			Error: "request timeout", Time: eventTime()})
+		return
+	}
+	switch {
+	case tcpPort != 0:
+		fmt.Println(timestampPrefix() + paint(colorRed, fmt.Sprintf("Connect Timeout for tcp_seq=%d%s", seq, warmupSuffix(seq))))
+		return
+	case httpURL != nil:
+		fmt.Println(timestampPrefix() + paint(colorRed, fmt.Sprintf("Request Timeout for http_seq=%d%s", seq, warmupSuffix(seq))))
+		return
+	}
+	fmt.Println(timestampPrefix() + paint(colorRed, fmt.Sprintf("Request Timeout for icmp_seq=%d%s", seq, warmupSuffix(seq))))
+}
+
+func printRecvError(host string, err error) {
+	if jsonOutput() {
+		printJSON(&pingEvent{Type: "error", Host: host, Error: err.Error(), Time: eventTime()})
+		return
+	}
+	fmt.Printf("%sError when receiving: %v\n", timestampPrefix(), err)
+}
+
+func printSendError(host string, err error) {
+	if jsonOutput() {
+		printJSON(&pingEvent{Type: "error", Host: host, Error: err.Error(), Time: eventTime()})
+		return
+	}
+	fmt.Println(timestampPrefix() + paint(colorRed, fmt.Sprintf("Error when sending: %v", err)))
+}
+
+// printInterim prints a line of the statistics so far to stderr, like iputils ping on SIGQUIT, so that it doesn't
+// get in the way of the JSON output
+func printInterim() {
+	psMux.Lock()
+	s := ps.Calculate()
+	psMux.Unlock()
+	fmt.Fprintf(os.Stderr, "%d/%d packets, %.0f%% loss, min/avg/max = %.3f/%.3f/%.3f ms\n",
+		s.NumReceived, s.NumPackets, s.Loss(), ms(s.MinRTT), ms(s.AvgRTT), ms(s.MaxRTT))
+}
+
+// printSummary prints the statistics of the run, and the RTT histogram, delay analysis, burst loss pattern, SLO
+// compliance, RTTs by payload size and distributed probe if there are ones
+func printSummary(host string, addr net.IP, s *rtt.Summary, hist *rtt.Histogram, delays *delayAnalysis, bursts *burstStats) {
+	if jsonOutput() {
+		summary := &pingSummary{
+			Type: "summary", Host: host, Addr: addr.String(),
+			Transmitted: s.NumPackets, Received: s.NumReceived, LossPercent: s.Loss(), TimeMs: ms(s.TotalDuration),
+			MinRTTMs: ms(s.MinRTT), AvgRTTMs: ms(s.AvgRTT), MaxRTTMs: ms(s.MaxRTT), SdevRTTMs: ms(s.SdevRTT),
+			JitterMs: ms(s.Jitter),
+			P50RTTMs: ms(s.P50RTT), P90RTTMs: ms(s.P90RTT), P95RTTMs: ms(s.P95RTT), P99RTTMs: ms(s.P99RTT),
+			Warmup:  *warmupFlag,
+			Version: version.Get(),
+		}
+		if hist != nil {
+			summary.Histogram = histogramSummary(hist)
+		}
+		if delays != nil {
+			summary.Delays = delays.summary()
+		}
+		if bursts != nil {
+			summary.Burst = bursts.summary()
+		}
+		if slo != nil {
+			summary.SLO = slo.summary()
+		}
+		if sweep != nil {
+			summary.Sweep = sweep.summary()
+		}
+		if dist != nil {
+			summary.Distributed = dist.summary()
+		}
+		if pmtu != nil {
+			summary.PMTU = pmtu.summary()
+		}
+		if statuses != nil {
+			summary.StatusCodes = statuses.summary()
+		}
+		if responders != nil {
+			summary.Responders = responders.summary()
+		}
+		printJSON(summary)
+		return
+	}
+
+	fmt.Println()
+	if *warmupFlag != 0 {
+		fmt.Printf("--- %s ping statistics, excluding %d warm-up requests ---\n", host, *warmupFlag)
+	} else {
+		fmt.Printf("--- %s ping statistics ---\n", host)
+	}
+	fmt.Printf("%d packets transmitted, %d received, %.0f%% packet loss, time %.0f ms\n",
+		s.NumPackets, s.NumReceived, s.Loss(), ms(s.TotalDuration))
+	fmt.Printf("rtt min/avg/max/sdev = %.3f/%.3f/%.3f/%.3f ms, p50/p90/p95/p99 = %.3f/%.3f/%.3f/%.3f ms\n",
+		ms(s.MinRTT), ms(s.AvgRTT), ms(s.MaxRTT), ms(s.SdevRTT), ms(s.P50RTT), ms(s.P90RTT), ms(s.P95RTT), ms(s.P99RTT))
+	fmt.Printf("rtt jitter = %.3f ms\n", ms(s.Jitter))
+	if hist != nil && s.NumReceived != 0 {
+		printHistogram(hist)
+	}
+	if delays != nil {
+		delays.print(s.AvgRTT)
+	}
+	if bursts != nil {
+		bursts.print()
+	}
+	if slo != nil {
+		slo.print()
+	}
+	if sweep != nil {
+		sweep.print()
+	}
+	if dist != nil {
+		dist.print()
+	}
+	if pmtu != nil {
+		pmtu.print(host)
+	}
+	if statuses != nil {
+		statuses.print()
+	}
+	if responders != nil {
+		responders.print()
+	}
+}
@@ -1,9 +1,10 @@
-package main
+package ping
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"log"
 	"math/big"
 	"math/rand"
 	"net"
@@ -13,115 +14,480 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/crash"
+	"github.com/luxas/random-schoolwork/pkg/diagnostics"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+	"github.com/luxas/random-schoolwork/pkg/version"
 	"golang.org/x/net/icmp"
 	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 const (
 	ProtocolICMP   = 1
+	ProtocolICMPv6 = 58
 	MaxSendRetries = 5
 
 	defaultMaxRTT   = 1 * time.Second
 	defaultInterval = 1 * time.Second
 	defaultTTL      = 64
+	// defaultMinInterval is the floor of the adaptive interval, like the one ping -A has for unprivileged users
+	defaultMinInterval = 200 * time.Millisecond
+	// defaultSize is the size of the send timestamp, which is the smallest payload
+	defaultSize = 8
+	// maxSize is the largest echo payload that fits in an IPv4 packet
+	maxSize = 65507
+	// recvOverhead is how much bigger than the echo payload the receive buffer is, for the ICMP header and the
+	// original packets that ICMP errors carry
+	recvOverhead = 1500
+
+	// drainInterval is how often a pinger with a fixed count checks whether its last requests are done
+	drainInterval = 10 * time.Millisecond
+	// expireInterval is how often the outstanding requests are checked for having timed out
+	expireInterval = 10 * time.Millisecond
+	// recvBuffer is how many received packets may wait for processing, so that a flood of replies doesn't have to
+	// wait in the socket buffer
+	recvBuffer = 1024
 )
 
 var (
-	maxRTTFlag   = flag.Duration("max-rtt", defaultMaxRTT, "The maximum time for a single roundtrip")
-	intervalFlag = flag.Duration("interval", defaultInterval, "The interval time between sending requests")
-	debugFlag    = flag.Bool("debug", false, "Whether to show debug information or not")
-	listenAddr   = flag.String("listen-address", "0.0.0.0", "What IP address to listen to")
-	ttl          = flag.Int("ttl", defaultTTL, "The maximum amount of network hops allowed")
+	// flags are the flags of ping, separate from the ones of the other programs in the schoolwork binary
+	flags = flag.NewFlagSet("ping", flag.ExitOnError)
+
+	maxRTTFlag   = flags.Duration("max-rtt", defaultMaxRTT, "The maximum time for a single roundtrip")
+	intervalFlag = flags.Duration("interval", defaultInterval, "The interval time between sending requests")
+	adaptiveFlag = flags.Bool("adaptive", false, "Send the next request as soon as the previous one is answered, --min-interval apart at the least and --interval apart at the most")
+	minInterval  = flags.Duration("min-interval", defaultMinInterval, "The minimum time between requests in --adaptive mode")
+	countFlag    = flags.Int("c", 0, "Stop after sending this many requests and receiving their replies, 0 to ping until interrupted")
+	deadlineFlag = flags.Duration("deadline", 0, "Stop after this long regardless of -c, 0 for no deadline")
+	unprivileged = flags.Bool("unprivileged", false, "Use an ICMP datagram socket, which doesn't need raw socket privileges. Used automatically if raw sockets aren't permitted")
+	sizeFlag     = flags.Int("size", defaultSize, "The size of the echo payload in bytes, the send timestamp is padded with a 0x08, 0x09, ... pattern up to it")
+	warmupFlag   = flags.Int("warmup", 0, "How many initial requests to leave out of the statistics, e.g. while ARP and route caches warm up")
+	debugFlag    = flags.Bool("debug", false, "Whether to show debug information or not")
+	verboseFlag  = flags.Bool("verbose", false, "Also show the jitter of the RTTs so far with every reply, as defined for RTP in RFC 3550")
+	listenAddr   = flags.String("listen-address", "", "Deprecated, use -I with the IP address")
+	ipv4Flag     = flags.Bool("4", false, "Only use IPv4")
+	ipv6Flag     = flags.Bool("6", false, "Only use IPv6")
+	ttl          = flags.Int("ttl", defaultTTL, "The maximum amount of network hops allowed")
+	versionFlag  = version.RegisterFlag(flags)
+
+	ps = &rtt.Stats{}
+	// psMux guards ps, as the interim statistics of SIGQUIT are read while the process loop records
+	psMux = &sync.Mutex{}
+	// bs is set in burst mode
+	bs *burstStats
+	// metrics is set if --metrics-addr is
+	metrics *pingMetrics
 
-	ps = &PingStats{}
+	logger = logging.New(os.Stderr, "ping")
+	// crashes turns the panics of the receive and process loops into errors of Ping
+	crashes = crash.NewHandler(logger)
 )
 
-func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
+func init() {
+	flags.DurationVar(deadlineFlag, "w", 0, "Shorthand for --deadline")
+	flags.BoolVar(verboseFlag, "v", false, "Shorthand for --verbose")
+}
+
+// Main runs ping with the command line arguments, without the program name. Like iputils ping, the exit status is 0
+// if any request was answered, 1 if none was, and 2 on other errors, e.g. if the host can't be resolved
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Errorf("%v", err)
+		os.Exit(exitStatus(err))
 	}
 }
 
-func run() error {
-	flag.Parse()
-	log.SetFlags(0)
+// noRepliesError is returned when no request was answered, for the exit status to tell it from other errors
+type noRepliesError struct {
+	msg string
+}
+
+func (e *noRepliesError) Error() string {
+	return e.msg
+}
+
+// exitStatus returns the exit status of the error run returned
+func exitStatus(err error) int {
+	var noReplies *noRepliesError
+	if errors.As(err, &noReplies) {
+		return 1
+	}
+	return 2
+}
+
+func run(args []string) error {
+	logger.RegisterFlags(flags)
+	if err := config.Parse(flags, "PING", args); err != nil {
+		return err
+	}
+	if *debugFlag {
+		logger.SetLevel(logging.DebugLevel)
+	}
+	setupColor()
+	if *versionFlag || flags.Arg(0) == "version" {
+		version.Print("ping")
+		return nil
+	}
+	if flags.Arg(0) == "completion" {
+		cmd := completion.NewCommand("ping", flags, completion.NewCommand("version", nil), completion.NewCommand("verify-log", nil), completion.NewCommand("agent", nil), completion.Subcommand())
+		return completion.Generate(os.Stdout, flags.Arg(1), cmd)
+	}
+	if flags.Arg(0) == "verify-log" {
+		if flags.NArg() != 2 {
+			return fmt.Errorf("Usage: ping --sign-secret <secret> verify-log <file>")
+		}
+		return verifyLog(flags.Arg(1))
+	}
+	if err := validateSource(); err != nil {
+		return err
+	}
+	if flags.Arg(0) == "agent" {
+		if flags.NArg() != 2 {
+			return fmt.Errorf("Usage: ping --agent-token <token> agent <listen address>")
+		}
+		return runAgent(flags.Arg(1))
+	}
+
+	if *debugAddrFlag != "" {
+		if err := diagnostics.Serve(*debugAddrFlag, logger); err != nil {
+			return err
+		}
+	}
+	if *fleetFlag != "" {
+		return runFleet(*fleetFlag)
+	}
 
-	if len(flag.Args()) < 1 {
+	if len(flags.Args()) < 1 && *httpFlag == "" {
 		return fmt.Errorf("Usage: ping [hostname or IP address]")
 	}
-	host := flag.Arg(0)
-	if host == "" {
+	host := flags.Arg(0)
+	if host == "" && *httpFlag == "" {
 		return fmt.Errorf("host is empty!")
 	}
+	if *ipv4Flag && *ipv6Flag {
+		return fmt.Errorf("-4 and -6 can't be used together")
+	}
+	if *countFlag < 0 {
+		return fmt.Errorf("-c must not be negative")
+	}
+	if *warmupFlag < 0 {
+		return fmt.Errorf("--warmup must not be negative")
+	}
+	if *deadlineFlag < 0 {
+		return fmt.Errorf("--deadline must not be negative")
+	}
+	if *sizeFlag < defaultSize || *sizeFlag > maxSize {
+		return fmt.Errorf("--size must be between %d and %d", defaultSize, maxSize)
+	}
+	if err := validateOutput(); err != nil {
+		return err
+	}
+	if err := validateTimestamp(); err != nil {
+		return err
+	}
+	if *signSecretFlag != "" {
+		if !jsonOutput() {
+			return fmt.Errorf("--sign-secret signs the JSON output, and requires --output %s", outputJSON)
+		}
+		var err error
+		if signer, err = newRecordSigner(); err != nil {
+			return err
+		}
+	}
+	histogramEdges, err := validateHistogram()
+	if err != nil {
+		return err
+	}
+	tos, err := validateTOS()
+	if err != nil {
+		return err
+	}
+	if err := setupGeoIP(); err != nil {
+		return err
+	}
+	setupResolve()
+	if err := setupSLO(); err != nil {
+		return err
+	}
+	if err := validateAgents(); err != nil {
+		return err
+	}
+	if sweep, err = validateSweep(); err != nil {
+		return err
+	}
+	if err := validatePMTU(); err != nil {
+		return err
+	}
+	if err := validateTCP(); err != nil {
+		return err
+	}
+	if err := validateHTTP(); err != nil {
+		return err
+	}
+	if httpURL != nil {
+		host = httpURL.Hostname()
+	}
+	if *burstFlag < 1 {
+		return fmt.Errorf("--burst must be at least 1")
+	}
+	// A zero minimum interval makes the pinger send at a fixed interval
+	adaptiveInterval := time.Duration(0)
+	if *adaptiveFlag {
+		if *minInterval <= 0 || *minInterval > *intervalFlag {
+			return fmt.Errorf("--min-interval must be positive and not longer than --interval")
+		}
+		adaptiveInterval = *minInterval
+	}
+	interval := *intervalFlag
+	if *floodFlag {
+		if err := validateFlood(); err != nil {
+			return err
+		}
+		interval, adaptiveInterval = floodInterval, floodMinInterval
+	}
+	if *pmtuFlag {
+		// Every payload size depends on the outcome of the previous request, so the next request goes out once
+		// the previous one is done, and --interval after it times out at the latest
+		interval, adaptiveInterval = *maxRTTFlag+*intervalFlag, *minInterval
+	}
 
-	p, err := NewPinger(*intervalFlag, *maxRTTFlag, *debugFlag, *listenAddr, *ttl, handler)
+	target, err := resolveTarget(host, *ipv4Flag, *ipv6Flag)
 	if err != nil {
 		return err
 	}
+	broadcast, err := validateBroadcast(target.IP)
+	if err != nil {
+		return err
+	}
+	// A sweep is done once by default, and the pinger's size is its largest, for the receive buffer
+	count, size := *countFlag, *sizeFlag
+	if sweep != nil {
+		if count == 0 {
+			count = sweep.sizes()
+		}
+		size = sweep.max
+	}
+	if *pmtuFlag {
+		pmtu = newPMTUSearch(target.IP.To4() == nil)
+		size = maxSize
+	}
+	// The warm-up requests come on top of the counted ones
+	if count != 0 {
+		count += *warmupFlag
+	}
+	// pinger sends the requests, which are TCP connects with --tcp
+	var pinger interface {
+		Ping(ctx context.Context, host string, target net.IPAddr) error
+		Drain()
+	}
+	var delays *delayAnalysis
+	switch {
+	case tcpPort != 0:
+		if *explainFlag {
+			explainTCP(host, target, count, interval, histogramEdges)
+			return nil
+		}
+		pinger = NewTCPPinger(tcpPort, sourceIP, sourceIface, interval, *maxRTTFlag, count, handler)
+	case httpURL != nil:
+		if *explainFlag {
+			explainHTTP(target, count, interval, histogramEdges)
+			return nil
+		}
+		pinger = NewHTTPPinger(httpURL, *httpMethodFlag, target, sourceIP, sourceIface, interval, *maxRTTFlag, count, handler)
+	default:
+		p, err := NewPinger(interval, adaptiveInterval, *maxRTTFlag, count, *burstFlag, size, *debugFlag, listenAddress(), sourceIface, *ttl, target.IP.To4() == nil, *unprivileged, *pmtuFlag, broadcast, handler)
+		if err != nil {
+			return err
+		}
+		p.sweep, p.pmtu = sweep, pmtu
+		if tos != -1 {
+			if err := setTOS(p.conn, p.ipv6, tos); err != nil {
+				return fmt.Errorf("couldn't set the TOS: %v", err)
+			}
+		}
+		if *timestampsFlag {
+			if p.unprivileged {
+				return fmt.Errorf("--timestamps needs a raw socket, ICMP datagram sockets only support echo requests")
+			}
+			if target.IP.To4() == nil {
+				return fmt.Errorf("--timestamps is only supported over IPv4, ICMPv6 has no timestamp requests")
+			}
+			p.delays = newDelayAnalysis()
+		}
+		if *explainFlag {
+			defer p.conn.Close()
+			explain(host, target, p, tos, histogramEdges)
+			return nil
+		}
+		pinger, delays = p, p.delays
+	}
+
+	if *burstFlag > 1 {
+		bs = newBurstStats(*burstFlag)
+	}
+	if *metricsAddrFlag != "" {
+		metrics = newPingMetrics(host)
+		metrics.serve(*metricsAddrFlag)
+	}
+	if *recordFlag != "" {
+		r, err := newCSVRecorder(*recordFlag)
+		if err != nil {
+			return fmt.Errorf("couldn't open the --record file: %v", err)
+		}
+		recorders = append(recorders, r)
+		defer closeRecorders()
+	}
+
+	if *agentsFlag != "" {
+		start, err := startAgents(target.IP, count, interval, *maxRTTFlag, *sizeFlag)
+		if err != nil {
+			return err
+		}
+		time.Sleep(time.Until(start))
+	}
 
 	ps.Start()
+	slo.start()
 
+	// Pinging is stopped by a signal, or at the deadline
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
 	c := make(chan os.Signal, 1)
 	signal.Notify(c,
 		// https://www.gnu.org/software/libc/manual/html_node/Termination-Signals.html
 		syscall.SIGTERM, // "the normal way to politely ask a program to terminate"
 		syscall.SIGINT,  // Ctrl+C
-		syscall.SIGQUIT, // Ctrl-\
 		syscall.SIGHUP,  // "terminal is disconnected"
 	)
-	var pingErr error
+	// Like iputils ping, Ctrl-\ (SIGQUIT) shows the statistics so far, and pinging goes on
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGQUIT)
+	defer signal.Stop(quit)
+	go func() {
+		for range quit {
+			printInterim()
+		}
+	}()
 	go func() {
-		pingErr = p.Ping(host)
-		c <- syscall.SIGTERM
+		<-c
+		// A flood has many requests in flight, wait for them so that they aren't counted as lost. Another
+		// signal stops right away
+		if *floodFlag {
+			pinger.Drain()
+			<-c
+		}
+		stop()
 	}()
-	<-c
-	p.Stop()
-	if pingErr != nil {
-		return fmt.Errorf("error: %v", pingErr)
+	if *deadlineFlag != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *deadlineFlag)
+		defer cancel()
+	}
+
+	err = pinger.Ping(ctx, host, target)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("error: %v", err)
+	}
+	if dist != nil {
+		dist.wait()
 	}
-	fmt.Println()
-	log.Printf("--- %s ping statistics ---", host)
 	s := ps.Calculate()
-	divider := float64(1000000)
-	log.Printf(
-		"%d packets transmitted, %d received, %.0f%% packet loss, time %.0f ms",
-		s.NumPackets,
-		s.NumReceived,
-		(float64(s.NumPackets-s.NumReceived)/float64(s.NumPackets))*100,
-		float64(s.TotalDuration.Nanoseconds())/divider)
-
-	log.Printf(
-		"rtt min/avg/max/sdev = %.3f/%.3f/%.3f/%.3f ms",
-		float64(s.MinRTT.Nanoseconds())/divider,
-		float64(s.AvgRTT.Nanoseconds())/divider,
-		float64(s.MaxRTT.Nanoseconds())/divider,
-		float64(s.SdevRTT.Nanoseconds())/divider,
-	)
+	var hist *rtt.Histogram
+	if histogramEdges != nil {
+		hist = ps.Histogram(histogramEdges)
+	}
+	printSummary(host, target.IP, s, hist, delays, bs)
+	// Let scripts know that the host didn't answer
+	if s.NumReceived == 0 {
+		return &noRepliesError{msg: fmt.Sprintf("no replies from %s", host)}
+	}
 	return nil
 }
 
 func handler(resp *response, err error) {
-	log.Printf("%d bytes from %s: icmp_seq=%d ttl=%d time=%v", resp.bytelen, resp.addr.IP, resp.seq, resp.ttl, resp.rtt)
+	// Record the reply first, so that the verbose output has the jitter including it
+	recordReceived(resp)
+	printReply(resp)
+	alertReply()
+}
+
+// recordReceived records an answered request in the statistics and the recorders, unless it's a warm-up request
+func recordReceived(resp *response) {
+	responders.record(resp.addr.IP)
+	if !inStats(resp.seq) || resp.extra {
+		return
+	}
+	psMux.Lock()
 	ps.PacketReceived(resp.rtt)
+	psMux.Unlock()
+	metrics.packetReceived(resp.rtt)
+	slo.record(resp.rtt, false)
+	if bs != nil {
+		bs.record(resp.seq, true)
+	}
+	if sweep != nil {
+		sweep.record(resp.size, resp.rtt, true)
+	}
+	if pmtu != nil {
+		pmtu.record(resp.size, true)
+	}
+	if statuses != nil {
+		statuses.record(resp.status)
+	}
+	recordProbe(&probe{time: time.Now(), target: resp.host, seq: resp.seq, rtt: resp.rtt, ttl: resp.ttl})
+}
+
+// recordLost records a lost request to host with a payload of size in the statistics and the recorders, unless it's
+// a warm-up request. A negative seq means that it's not known which request was lost
+func recordLost(host string, seq, size int) {
+	// The link is flaky during the warm-up too
+	alertLoss()
+	if seq >= 0 && !inStats(seq) {
+		return
+	}
+	psMux.Lock()
+	ps.PacketLost()
+	psMux.Unlock()
+	metrics.packetLost()
+	slo.record(0, true)
+	if bs != nil && seq >= 0 {
+		bs.record(seq, false)
+	}
+	if sweep != nil && seq >= 0 {
+		sweep.record(size, 0, false)
+	}
+	if pmtu != nil && seq >= 0 {
+		pmtu.record(size, false)
+	}
+	recordProbe(&probe{time: time.Now(), target: host, seq: seq, lost: true})
 }
 
-type context struct {
-	// stop is a message from the "owner" of a process to stop its execution
-	stop chan bool
-	// done is the "return value" from a process that's been executing
-	done chan error
+// inStats returns whether the request with the sequence number counts in the statistics, which the warm-up
+// requests don't
+func inStats(seq int) bool {
+	return seq >= *warmupFlag
 }
 
-func newContext() *context {
-	return &context{
-		stop: make(chan bool, 1),
-		done: make(chan error, 1),
+// warmupSuffix marks the output about warm-up requests
+func warmupSuffix(seq int) string {
+	if inStats(seq) {
+		return ""
 	}
+	return " (warm-up)"
 }
 
 type packet struct {
 	bytes []byte
 	addr  net.Addr
+	// ttl is the TTL or hop limit the packet arrived with, or 0 if the kernel didn't tell
+	ttl int
+	// received is when the packet was read from the socket, which the RTT is measured to, as packets may wait
+	// for the process loop
+	received time.Time
 }
 
 type task struct {
@@ -129,142 +495,412 @@ type task struct {
 	seq      int
 	sendTime time.Time
 	addr     net.IPAddr
+	// size is the size of the echo payload
+	size int
+	// replied is the sources that replied to a broadcast request, which stays queued for more replies until it
+	// times out
+	replied map[string]bool
 }
 
 type response struct {
+	host    string
 	addr    net.IPAddr
 	rtt     time.Duration
 	seq     int
 	bytelen int
 	ttl     int
+	// size is the size of the echo payload of the request
+	size int
+	// port is the port of a TCP connect, or 0 for an echo reply
+	port int
+	// status is the status code of an HTTP response, or 0 for an echo reply
+	status int
+	// extra is set for the replies to a broadcast request after the first one, which don't count in the statistics
+	extra bool
+}
+
+// packetConn is the socket of a pinger, an *icmp.PacketConn unless options like the Don't Fragment bit are set
+type packetConn interface {
+	net.PacketConn
+	IPv4PacketConn() *ipv4.PacketConn
+	IPv6PacketConn() *ipv6.PacketConn
 }
 
 type Pinger struct {
-	conn       *icmp.PacketConn
-	maxRTT     time.Duration
-	interval   time.Duration
-	mux        *sync.Mutex
-	debug      bool
-	recvCh     chan *packet
-	mainCtx    *context
-	recvCtx    *context
-	processCtx *context
-	ticker     *time.Ticker
-	queue      map[int]task
-	callback   ReceiveFunc
-	seq        int
+	conn packetConn
+	// id is the echo ID of the requests, which are told apart by their sequence numbers
+	id int
+	// ipv6 tells whether conn is an ICMPv6 socket
+	ipv6 bool
+	// unprivileged tells whether conn is an ICMP datagram socket instead of a raw one. The kernel sets the
+	// echo IDs of its requests, so the replies are matched by sequence number instead
+	unprivileged bool
+	maxRTT       time.Duration
+	interval     time.Duration
+	// minInterval is set if the pinger is adaptive, and sends the next requests as soon as the previous ones are
+	// done, but not sooner than minInterval after them
+	minInterval time.Duration
+	// idle is signalled when no requests are outstanding, if the pinger is adaptive
+	idle chan struct{}
+	// count is how many requests to send before stopping, or 0 to send until stopped
+	count int
+	// burst is how many requests are sent back-to-back every interval
+	burst int
+	// size is the size of the echo payloads, the largest one if there's a sweep
+	size int
+	// sweep is set if the payload size is swept
+	sweep *sizeSweep
+	// pmtu is set if the path MTU is searched for, which picks the payload sizes
+	pmtu *pmtuSearch
+	// broadcast is set if the target is a broadcast or multicast address, which many hosts may answer
+	broadcast bool
+	// host is the name of the target, for the output
+	host string
+	// delays is set if timestamp requests are sent along with the echo requests
+	delays    *delayAnalysis
+	mux       *sync.Mutex
+	debug     bool
+	recvCh    chan *packet
+	sendTimer *time.Timer
+	queue     map[int]task
+	callback  ReceiveFunc
+	seq       int
+	// drain makes Ping stop sending, and return once the outstanding requests are done
+	drain chan struct{}
 }
 
 type ReceiveFunc func(resp *response, err error)
 
-func NewPinger(interval, maxRTT time.Duration, debug bool, listenAddr string, ttl int, callback ReceiveFunc) (*Pinger, error) {
-	conn, err := icmp.ListenPacket("ip4:icmp", listenAddr)
+// NewPinger creates a pinger with an ICMP socket, or an ICMPv6 socket if useIPv6 is set. An empty listenAddr
+// listens to all addresses of the address family, and a non-empty iface binds the socket to that interface. An
+// unprivileged pinger uses an ICMP datagram socket, which is also used if a raw socket isn't permitted. A non-zero
+// count makes Ping return once that many requests have been answered or timed out. A non-zero minInterval makes the
+// pinger adaptive, so that interval is only the longest time between requests. A dontFragment pinger sets the Don't
+// Fragment bit, which needs a raw socket. A broadcast pinger may send to broadcast addresses, and waits for the
+// replies of all hosts until the requests time out
+func NewPinger(interval, minInterval, maxRTT time.Duration, count, burst, size int, debug bool, listenAddr, iface string, ttl int, useIPv6, unprivileged, dontFragment, broadcast bool, callback ReceiveFunc) (*Pinger, error) {
+	network, datagramNetwork := "ip4:icmp", "udp4"
+	if useIPv6 {
+		network, datagramNetwork = "ip6:ipv6-icmp", "udp6"
+	}
+	if unprivileged {
+		network = datagramNetwork
+	}
+	var options []socketOption
+	if dontFragment {
+		options = append(options, func(fd uintptr) error {
+			return setDontFragment(fd, useIPv6)
+		})
+	}
+	if iface != "" {
+		options = append(options, func(fd uintptr) error {
+			return bindToDevice(fd, iface)
+		})
+	}
+	if broadcast && !useIPv6 {
+		// IPv6 has no broadcast, and sending to multicast addresses needs no permission
+		options = append(options, setBroadcast)
+	}
+	conn, err := listenICMP(network, listenAddr, useIPv6, options)
+	if err != nil && dontFragment {
+		return nil, fmt.Errorf("couldn't open a raw socket with the Don't Fragment bit set: %v", err)
+	}
+	if err != nil && !unprivileged && errors.Is(err, os.ErrPermission) {
+		logger.Infof("Raw sockets aren't permitted, falling back to an unprivileged ICMP datagram socket")
+		unprivileged = true
+		conn, err = listenICMP(datagramNetwork, listenAddr, useIPv6, options)
+		if err != nil {
+			return nil, fmt.Errorf("%v, allow ICMP datagram sockets for your group with the net.ipv4.ping_group_range sysctl, or run as root", err)
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
-	conn.IPv4PacketConn().SetTTL(ttl)
+	if useIPv6 {
+		conn.IPv6PacketConn().SetControlMessage(ipv6.FlagHopLimit, true)
+		conn.IPv6PacketConn().SetHopLimit(ttl)
+	} else {
+		conn.IPv4PacketConn().SetControlMessage(ipv4.FlagTTL, true)
+		conn.IPv4PacketConn().SetTTL(ttl)
+	}
+	var idle chan struct{}
+	if minInterval != 0 {
+		idle = make(chan struct{}, 1)
+	}
 	return &Pinger{
-		conn:       conn,
-		maxRTT:     maxRTT,
-		interval:   interval,
-		mux:        &sync.Mutex{},
-		debug:      debug,
-		recvCh:     make(chan *packet),
-		mainCtx:    newContext(),
-		recvCtx:    newContext(),
-		processCtx: newContext(),
-		ticker:     nil,
-		queue:      make(map[int]task),
-		callback:   callback,
-		seq:        0,
+		conn:         conn,
+		id:           rand.Intn(0xffff),
+		ipv6:         useIPv6,
+		unprivileged: unprivileged,
+		broadcast:    broadcast,
+		maxRTT:       maxRTT,
+		interval:     interval,
+		minInterval:  minInterval,
+		idle:         idle,
+		count:        count,
+		burst:        burst,
+		size:         size,
+		mux:          &sync.Mutex{},
+		debug:        debug,
+		recvCh:       make(chan *packet, recvBuffer),
+		sendTimer:    nil,
+		drain:        make(chan struct{}, 1),
+		queue:        make(map[int]task),
+		callback:     callback,
+		seq:          0,
 	}, nil
 }
 
-func (p *Pinger) Ping(host string) error {
+// resolveTarget returns the address to ping host at. IPv4 is preferred, unless only6 is set or the host only
+// has IPv6 addresses
+func resolveTarget(host string, only4, only6 bool) (net.IPAddr, error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		var err error
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return net.IPAddr{}, err
+		}
+	}
+
+	var ip4, ip6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if ip4 == nil {
+				ip4 = ip.To4()
+			}
+		} else if ip6 == nil {
+			ip6 = ip
+		}
+	}
+	switch {
+	case ip4 != nil && !only6:
+		return net.IPAddr{IP: ip4}, nil
+	case ip6 != nil && !only4:
+		return net.IPAddr{IP: ip6}, nil
+	case only4:
+		return net.IPAddr{}, fmt.Errorf("ping: cannot resolve %s: no IPv4 address", host)
+	case only6:
+		return net.IPAddr{}, fmt.Errorf("ping: cannot resolve %s: no IPv6 address", host)
+	}
+	return net.IPAddr{}, fmt.Errorf("ping: cannot resolve %s: Unknown host", host)
+}
+
+// Ping pings targetIP until ctx is done, or the requests of a pinger with a count are done. It returns ctx.Err() if
+// ctx is done first, so a cancellation or deadline can be told apart from the requests being done. The receive and
+// process loops have stopped when Ping returns
+func (p *Pinger) Ping(ctx context.Context, host string, targetIP net.IPAddr) error {
+	p.host = host
+	// Look up the name of the target before pinging, as the lookups of --resolve otherwise don't wait for the names
+	rdns.prefetch(targetIP.IP)
+	ctx, cancel := context.WithCancel(ctx)
+	// loopErrs has room for an error from both loops, so they don't block on returning one
+	loopErrs := make(chan error, 2)
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
 	// Start listening for responses
-	go p.receiveLoop()
+	go func() {
+		defer wg.Done()
+		if err := p.receiveLoop(ctx); err != nil {
+			loopErrs <- err
+		}
+	}()
 	// Start processing data from the receive loop
-	go p.processLoop()
+	go func() {
+		defer wg.Done()
+		if err := p.processLoop(ctx); err != nil {
+			loopErrs <- err
+		}
+	}()
 
-	targetIP := net.IPAddr{IP: net.ParseIP(host)}
+	err := p.sendLoop(ctx, host, targetIP, loopErrs)
+	cancel()
+	wg.Wait()
+	logger.Debugf("Ping process has stopped")
+	return err
+}
 
-	if targetIP.IP == nil {
-		targetIPs, err := net.LookupIP(host)
-		if err != nil {
+// sendLoop sends the requests until ctx is done, the receive or process loop fails, or the requests of a pinger with a count
+// are done
+func (p *Pinger) sendLoop(ctx context.Context, host string, targetIP net.IPAddr, loopErrs <-chan error) error {
+	// sendTimer fires when the next requests are due. It's rescheduled after every send, and an adaptive pinger
+	// also reschedules it when the outstanding requests are done
+	p.sendTimer = time.NewTimer(p.interval)
+	defer p.sendTimer.Stop()
+	sending := true
+	lastSend := time.Now()
+	send := func() error {
+		lastSend = time.Now()
+		if err := p.sendBurst(host, targetIP); err != nil {
 			return err
 		}
-		if len(targetIPs) == 0 {
-			return fmt.Errorf("ping: cannot resolve %s: Unknown host", host)
-		}
+		p.scheduleSend(p.interval)
+		return nil
+	}
 
-		for _, ip := range targetIPs {
-			if len(ip) == net.IPv4len {
-				targetIP = net.IPAddr{IP: ip}
-				break
-			}
+	// Once all requests are sent, drainTicker checks whether the outstanding ones have been answered or timed out
+	drainTicker := &time.Ticker{}
+	defer func() {
+		if drainTicker.C != nil {
+			drainTicker.Stop()
+		}
+	}()
+	drain := func() {
+		sending = false
+		p.sendTimer.Stop()
+		if drainTicker.C == nil {
+			drainTicker = time.NewTicker(drainInterval)
+		}
+	}
+	startDraining := func() {
+		if p.sentAll() {
+			drain()
 		}
 	}
 
 	// Send the first ping "manually", without the timer
-	if err := p.sendICMP(host, targetIP); err != nil {
+	if err := send(); err != nil {
 		return err
 	}
-
-	p.ticker = time.NewTicker(p.interval)
-	defer p.ticker.Stop()
+	startDraining()
 
 	for {
 		select {
-		case sendErr := <-p.mainCtx.done:
-			p.debugf("Ping(): <-p.mainCtx.done: err == %v", sendErr)
-			p.recvCtx.stop <- true
-			recvErr := <-p.recvCtx.done
-			p.debugf("Ping(): <-p.recvCtx.done: err == %v", recvErr)
-			p.processCtx.stop <- true
-			log.Println("Ping process has stopped")
-			// no error handling/shutdown code for the process loop
-			return sendErr
-		case recvErr := <-p.recvCtx.done:
-			p.debugf("Ping(): <-p.recvCtx.done: err == %v", recvErr)
-			return recvErr
-		case processErr := <-p.processCtx.done:
-			p.debugf("Ping(): <-p.processCtx.done: err == %v", processErr)
-			return processErr
-		case <-p.ticker.C:
+		case <-ctx.Done():
+			p.debugf("Ping(): <-ctx.Done(): err == %v", ctx.Err())
+			return ctx.Err()
+		case loopErr := <-loopErrs:
+			p.debugf("Ping(): <-loopErrs: err == %v", loopErr)
+			return loopErr
+		case <-p.sendTimer.C:
 			p.debugf("Run(): call sendICMP()")
-			if err := p.sendICMP(host, targetIP); err != nil {
-				p.mainCtx.done <- err
+			if err := send(); err != nil {
+				return err
+			}
+			startDraining()
+		case <-p.idle:
+			if !sending || p.outstanding() != 0 {
+				continue
 			}
+			// Send right away, unless the previous requests went out less than minInterval ago
+			wait := p.minInterval - time.Since(lastSend)
+			p.debugf("Ping(): no requests are outstanding, sending the next in %v", wait)
+			p.scheduleSend(wait)
+		case <-p.drain:
+			p.debugf("Ping(): draining the %d outstanding requests", p.outstanding())
+			drain()
+		case <-drainTicker.C:
+			if p.outstanding() == 0 {
+				p.debugf("Ping(): all %d requests are done", p.seq)
+				return nil
+			}
+		}
+	}
+}
+
+// Drain makes Ping stop sending, and return once the outstanding requests have been answered or timed out
+func (p *Pinger) Drain() {
+	select {
+	case p.drain <- struct{}{}:
+	default:
+	}
+}
+
+// sentAll returns whether all requests have been sent, if the pinger only sends a fixed number of them, or whether
+// the path MTU has been found
+func (p *Pinger) sentAll() bool {
+	if p.pmtu.done() {
+		return true
+	}
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return p.count != 0 && p.seq >= p.count
+}
+
+// outstanding returns how many requests haven't been answered or timed out yet
+func (p *Pinger) outstanding() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	return len(p.queue)
+}
+
+// scheduleSend makes sendTimer fire after d instead of when it was going to
+func (p *Pinger) scheduleSend(d time.Duration) {
+	if !p.sendTimer.Stop() {
+		select {
+		case <-p.sendTimer.C:
+		default:
 		}
 	}
+	p.sendTimer.Reset(d)
+}
+
+// signalIdle lets an adaptive pinger know if no requests are outstanding. It's called once the outcome of a request
+// has been recorded, so that e.g. the path MTU search picks the next payload size knowing it
+func (p *Pinger) signalIdle() {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.signalIfIdle()
+}
+
+// signalIfIdle is signalIdle with mux held
+func (p *Pinger) signalIfIdle() {
+	if len(p.queue) != 0 {
+		return
+	}
+	select {
+	case p.idle <- struct{}{}:
+	default:
+	}
 }
 
-func (p *Pinger) Stop() {
-	p.mainCtx.done <- nil
+// sendBurst sends burst requests back-to-back, or fewer if that's all that is left to send
+func (p *Pinger) sendBurst(host string, target net.IPAddr) error {
+	for i := 0; i < p.burst && !p.sentAll(); i++ {
+		if err := p.sendICMP(host, target); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (p *Pinger) sendICMP(host string, target net.IPAddr) error {
-	id := rand.Intn(0xffff)
 	timestamp := time.Now()
 
 	p.mux.Lock()
 	seq := p.seq
 	p.seq++
-	p.queue[id] = task{
-		id:       id,
+	size := p.size
+	if p.sweep != nil {
+		size = p.sweep.size(seq)
+	}
+	if p.pmtu != nil {
+		size = p.pmtu.next()
+	}
+	t := task{
+		id:       p.id,
 		seq:      seq,
 		sendTime: timestamp,
 		addr:     target,
+		size:     size,
+	}
+	if p.broadcast {
+		t.replied = map[string]bool{}
 	}
+	p.queue[p.queueKey(seq)] = t
 	p.mux.Unlock()
 
+	var echoType icmp.Type = ipv4.ICMPTypeEcho
+	if p.ipv6 {
+		// The kernel computes the checksum of ICMPv6 messages
+		echoType = ipv6.ICMPTypeEchoRequest
+	}
 	bytes, err := (&icmp.Message{
-		Type: ipv4.ICMPTypeEcho, Code: 0,
+		Type: echoType, Code: 0,
 		Body: &icmp.Echo{
-			ID: id, Seq: seq,
-			Data: timeToBytes(timestamp),
+			ID: p.id, Seq: seq,
+			Data: echoPayload(timestamp, size),
 		},
 	}).Marshal(nil)
 	if err != nil {
@@ -272,51 +908,68 @@ func (p *Pinger) sendICMP(host string, target net.IPAddr) error {
 	}
 
 	if seq == 0 {
-		log.Printf("PING %s (%s): %d data bytes", host, target.IP, len(bytes))
+		printHeader(host, target.IP, p.size)
+	}
+	printSent()
+	p.debugf("Send: ID %d, Seq: %d, Bytes: %d %x", p.id, seq, len(bytes), bytes)
+	if inStats(seq) {
+		metrics.packetSent()
 	}
-	p.debugf("Send: ID %d, Seq: %d, Bytes: %d %x", id, seq, len(bytes), bytes)
 
 	retries := 0
 	for {
-		if _, err := p.conn.WriteTo(bytes, &target); err != nil {
+		if _, err := p.conn.WriteTo(bytes, p.destination(target)); err != nil {
 			if neterr, ok := err.(*net.OpError); ok {
 				if neterr.Err == syscall.ENOBUFS {
 					retries++
 					if retries == MaxSendRetries {
-						log.Printf("Failed to ping %s for seq=%d", target.IP, seq)
+						logger.Warnf("Failed to ping %s for seq=%d", target.IP, seq)
 						break
 					}
 					continue
 				}
 			}
+			if errors.Is(err, syscall.EMSGSIZE) {
+				p.tooBigLocally(seq)
+			}
 		}
 		break
 	}
 
+	if p.delays != nil {
+		bytes, err := p.delays.request(seq)
+		if err != nil {
+			return err
+		}
+		if _, err := p.conn.WriteTo(bytes, &target); err != nil {
+			logger.Warnf("Failed to send a timestamp request to %s for seq=%d: %v", target.IP, seq, err)
+		}
+	}
 	return nil
 }
 
-func (p *Pinger) receiveLoop() {
+// receiveLoop passes the received packets to the process loop until ctx is done, or reading fails
+func (p *Pinger) receiveLoop(ctx context.Context) (err error) {
+	defer crashes.RecoverError("receive loop", &err)
 	for {
 		select {
-		case <-p.recvCtx.stop:
-			p.debugf("receiveLoop(): <-p.recvCtx.stop")
-			p.recvCtx.done <- nil
-			return
+		case <-ctx.Done():
+			p.debugf("receiveLoop(): <-ctx.Done()")
+			return nil
 		default:
 		}
 
 		_ = p.conn.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
-		buf := make([]byte, 64, 512)
-		_, addr, err := p.conn.ReadFrom(buf)
+		buf := make([]byte, p.size+recvOverhead)
+		n, ttl, addr, err := p.readFrom(buf)
+		received := time.Now()
 		if err != nil {
 			if neterr, ok := err.(*net.OpError); ok {
 				if neterr.Timeout() {
 					continue
 				} else {
 					p.debugf("receiveLoop(): OpError happen %v", err)
-					p.recvCtx.done <- err
-					return
+					return err
 				}
 			}
 		}
@@ -324,32 +977,60 @@ func (p *Pinger) receiveLoop() {
 		p.debugf("Received package from addr: %s", addr.String())
 
 		select {
-		case p.recvCh <- &packet{bytes: buf, addr: addr}:
-		case <-p.recvCtx.stop:
-			log.Println("receiveLoop(): <-p.recvCtx.stop")
-			return
+		case p.recvCh <- &packet{bytes: buf[:n], addr: addr, ttl: ttl, received: received}:
+		case <-ctx.Done():
+			p.debugf("receiveLoop(): <-ctx.Done()")
+			return nil
 		}
 	}
 }
 
-func (p *Pinger) processLoop() {
+// readFrom reads a packet like ReadFrom of the connection, and returns the TTL or hop limit it arrived with from
+// its control message, which NewPinger has enabled
+func (p *Pinger) readFrom(buf []byte) (n, ttl int, addr net.Addr, err error) {
+	if p.ipv6 {
+		var cm *ipv6.ControlMessage
+		n, cm, addr, err = p.conn.IPv6PacketConn().ReadFrom(buf)
+		if cm != nil {
+			ttl = cm.HopLimit
+		}
+		return n, ttl, addr, err
+	}
+	var cm *ipv4.ControlMessage
+	n, cm, addr, err = p.conn.IPv4PacketConn().ReadFrom(buf)
+	if cm != nil {
+		ttl = cm.TTL
+	}
+	return n, ttl, addr, err
+}
+
+// processLoop processes the received packets, and times out the outstanding requests, until ctx is done. It only
+// returns an error if it panics
+func (p *Pinger) processLoop(ctx context.Context) (err error) {
+	defer crashes.RecoverError("process loop", &err)
+	expireTicker := time.NewTicker(expireInterval)
+	defer expireTicker.Stop()
 	for {
 		select {
-		case <-p.processCtx.stop:
-			p.debugf("processLoop(): <-p.processCtx.stop")
-			return
+		case <-ctx.Done():
+			p.debugf("processLoop(): <-ctx.Done()")
+			return nil
 		case r := <-p.recvCh:
 			p.debugf("processLoop(): <-p.recvCh")
 			if err := p.processRecv(r); err != nil {
-				log.Printf("Error when receiving: %v\n", err)
+				printRecvError(p.host, err)
 			}
-		default:
+		case <-expireTicker.C:
 			p.mux.Lock()
 			for id, t := range p.queue {
 				if time.Now().After(t.sendTime.Add(p.maxRTT)) {
-					ps.PacketLost()
-					log.Printf("Request Timeout for icmp_seq=%d", t.seq)
+					// A broadcast request is only lost if no host replied
+					if len(t.replied) == 0 {
+						recordLost(p.host, t.seq, t.size)
+						printTimeout(p.host, t.addr.IP, t.seq)
+					}
 					delete(p.queue, id)
+					p.signalIfIdle()
 				}
 			}
 
@@ -359,6 +1040,9 @@ func (p *Pinger) processLoop() {
 }
 
 func (p *Pinger) processRecv(recv *packet) error {
+	// The outcome of the request has been recorded by the time processRecv returns
+	defer p.signalIdle()
+
 	var ipaddr net.IPAddr
 	switch adr := recv.addr.(type) {
 	case *net.IPAddr:
@@ -369,92 +1053,246 @@ func (p *Pinger) processRecv(recv *packet) error {
 		return fmt.Errorf("Got unknown type of received packet: %v", adr)
 	}
 
-	m, err := icmp.ParseMessage(ProtocolICMP, recv.bytes)
+	proto := ProtocolICMP
+	if p.ipv6 {
+		proto = ProtocolICMPv6
+	}
+	m, err := icmp.ParseMessage(proto, recv.bytes)
 	if err != nil {
 		return fmt.Errorf("%v: %x", err, recv.bytes)
 	}
 
 	switch m.Type {
-	case ipv4.ICMPTypeEchoReply:
+	case ipv4.ICMPTypeEchoReply, ipv6.ICMPTypeEchoReply:
 		// no-op
-	case ipv4.ICMPTypeTimeExceeded:
-		// Mention we lost a packet, regardless of exit here
-		defer ps.PacketLost()
-
-		newBuf := recv.bytes[len(recv.bytes)-16:]
-		origMsg, err := icmp.ParseMessage(ProtocolICMP, newBuf)
+	case ipv4.ICMPTypeTimestampReply:
+		if p.delays == nil {
+			return fmt.Errorf("invalid reply type %v", m.Type)
+		}
+		return p.delays.reply(m, recv.received)
+	case ipv4.ICMPTypeTimeExceeded, ipv6.ICMPTypeTimeExceeded:
+		t, ours, err := p.erroredRequest(proto, m)
+		if !ours {
+			p.debugf("Ignoring Time Exceeded for someone else's request")
+			return nil
+		}
+		// Mention we lost a packet, unless it's known to be a warm-up request
+		recordLost(p.host, t.seq, t.size)
 		if err != nil {
-			return fmt.Errorf("From %s Time to live exceeded", ipaddr.IP)
+			return err
+		}
+		if t.seq < 0 {
+			return fmt.Errorf("From %s%s Time to live exceeded", rdns.label(ipaddr.IP), geoip.annotate(ipaddr.IP))
 		}
-		pkt, ok := origMsg.Body.(*icmp.Echo)
+		return fmt.Errorf("From %s%s icmp_seq=%d Time To Live exceeded", rdns.label(ipaddr.IP), geoip.annotate(ipaddr.IP), t.seq)
+	case ipv4.ICMPTypeDestinationUnreachable, ipv6.ICMPTypePacketTooBig:
+		mtu, ok := fragNeededMTU(m, recv.bytes)
 		if !ok {
-			return fmt.Errorf("From %s Time to live exceeded", ipaddr.IP)
+			return fmt.Errorf("invalid reply type %v", m.Type)
 		}
-
-		// Remove the specified packet from the queue
-		if _, err := p.unqueuePkt(pkt.ID); err != nil {
+		t, ours, err := p.erroredRequest(proto, m)
+		if !ours {
+			p.debugf("Ignoring %v for someone else's request", m.Type)
+			return nil
+		}
+		if p.pmtu != nil {
+			p.pmtu.fragNeeded(mtu)
+		}
+		recordLost(p.host, t.seq, t.size)
+		if err != nil {
 			return err
 		}
-
-		return fmt.Errorf("From %s icmp_seq=%d Time To Live exceeded", ipaddr.IP, pkt.Seq)
+		seq := ""
+		if t.seq >= 0 {
+			seq = fmt.Sprintf(" icmp_seq=%d", t.seq)
+		}
+		if p.ipv6 {
+			return fmt.Errorf("From %s%s%s Packet too big: mtu=%d", rdns.label(ipaddr.IP), geoip.annotate(ipaddr.IP), seq, mtu)
+		}
+		return fmt.Errorf("From %s%s%s Frag needed and DF set (mtu = %d)", rdns.label(ipaddr.IP), geoip.annotate(ipaddr.IP), seq, mtu)
 	default:
+		if p.ipv6 {
+			// An ICMPv6 socket also gets e.g. neighbor discovery messages, and our own requests on loopback
+			p.debugf("Ignoring ICMPv6 message of type %v", m.Type)
+			return nil
+		}
 		return fmt.Errorf("invalid reply type %v", m.Type)
 	}
 
 	p.debugf("Type: %d. Code: %d. Len: %d. Payload: %x", m.Type, m.Code, len(recv.bytes), recv.bytes)
 	var t task
 	var rtt time.Duration
+	// extra is set for the replies of other hosts to a broadcast request that has been answered
+	var extra bool
 	switch pkt := m.Body.(type) {
 	case *icmp.Echo:
-		t, err = p.unqueuePkt(pkt.ID)
+		if !p.ours(pkt.ID) {
+			// A raw socket also gets the replies to other processes
+			p.debugf("Ignoring echo reply with ID %d", pkt.ID)
+			return nil
+		}
+		if p.broadcast {
+			t, extra, err = p.broadcastReply(p.queueKey(pkt.Seq), ipaddr.IP)
+		} else {
+			t, err = p.unqueuePkt(p.queueKey(pkt.Seq))
+		}
 		if err != nil {
 			return err
 		}
 
-		if pkt.Seq == t.seq {
-			rtt = time.Since(t.sendTime)
+		if pkt.Seq == t.seq&0xffff {
+			rtt = recv.received.Sub(t.sendTime)
 		}
 
 	default:
 		return fmt.Errorf("invalid reply body type: %v", pkt)
 	}
 
-	if ipaddr.IP.String() != t.addr.IP.String() {
+	if !p.broadcast && ipaddr.IP.String() != t.addr.IP.String() {
 		return fmt.Errorf("Did not expect packet from host: %v", ipaddr.String())
 	}
 
 	if p.callback != nil {
 		p.callback(&response{
+			host:    p.host,
 			addr:    ipaddr,
 			rtt:     rtt,
 			seq:     t.seq,
 			bytelen: len(recv.bytes),
-			ttl:     0,
+			ttl:     recv.ttl,
+			size:    t.size,
+			extra:   extra,
 		}, nil)
 	}
 
 	return nil
 }
 
-func (p *Pinger) unqueuePkt(id int) (task, error) {
+// queueKey returns the key of a request in the queue, its sequence number as on the wire, where it wraps around
+// at 16 bits
+func (p *Pinger) queueKey(seq int) int {
+	return seq & 0xffff
+}
+
+// ours returns whether a reply with the echo ID is to one of our requests. The kernel sets the IDs of datagram sockets,
+// and only passes them the replies to their own requests
+func (p *Pinger) ours(id int) bool {
+	return p.unprivileged || id == p.id
+}
+
+// destination returns the address to send requests to target at, which is a UDP address for datagram sockets
+func (p *Pinger) destination(target net.IPAddr) net.Addr {
+	if p.unprivileged {
+		return &net.UDPAddr{IP: target.IP, Zone: target.Zone}
+	}
+	return &target
+}
+
+func (p *Pinger) unqueuePkt(key int) (task, error) {
 	p.mux.Lock()
 	defer p.mux.Unlock()
 
-	t, ok := p.queue[id]
+	t, ok := p.queue[key]
 	if !ok {
-		p.mux.Unlock()
-		return task{}, fmt.Errorf("Invalid ID: didn't send any request with id %v", id)
+		return task{}, fmt.Errorf("Invalid sequence number: didn't send any outstanding request with icmp_seq=%v", key)
 	}
 
-	delete(p.queue, id)
+	delete(p.queue, key)
 
 	return t, nil
 }
 
+// broadcastReply records the source of a reply to a broadcast request, which stays queued for the replies of other
+// hosts. extra is set if another host has replied already
+func (p *Pinger) broadcastReply(key int, src net.IP) (t task, extra bool, err error) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	t, ok := p.queue[key]
+	if !ok {
+		return task{}, false, fmt.Errorf("Invalid sequence number: didn't send any outstanding request with icmp_seq=%v", key)
+	}
+	if t.replied[src.String()] {
+		return task{}, false, fmt.Errorf("From %s%s icmp_seq=%d Duplicate reply", rdns.label(src), geoip.annotate(src), t.seq)
+	}
+	extra = len(t.replied) != 0
+	t.replied[src.String()] = true
+	return t, extra, nil
+}
+
+// erroredRequest removes the request that an ICMP error is about from the queue. ours is false if it's someone else's
+// request, and the seq of the returned task is -1 if it's not known which request it is
+func (p *Pinger) erroredRequest(proto int, m *icmp.Message) (t task, ours bool, err error) {
+	unknown := task{seq: -1}
+	origMsg, err := originalMessage(proto, m)
+	if err != nil {
+		return unknown, true, nil
+	}
+	pkt, ok := origMsg.Body.(*icmp.Echo)
+	if !ok {
+		return unknown, true, nil
+	}
+	if !p.ours(pkt.ID) {
+		return unknown, false, nil
+	}
+	if t, err = p.unqueuePkt(p.queueKey(pkt.Seq)); err != nil {
+		return unknown, true, err
+	}
+	return t, true, nil
+}
+
+// tooBigLocally records a request that couldn't be sent, as its payload exceeds the MTU of the outgoing interface
+// and may not be fragmented
+func (p *Pinger) tooBigLocally(seq int) {
+	t, err := p.unqueuePkt(p.queueKey(seq))
+	if err != nil {
+		return
+	}
+	recordLost(p.host, t.seq, t.size)
+	printSendError(p.host, fmt.Errorf("Local error icmp_seq=%d Message too long for the outgoing interface", t.seq))
+	p.signalIdle()
+}
+
 func (p *Pinger) debugf(format string, v ...interface{}) {
 	if p.debug {
-		log.Printf(format, v...)
+		logger.Debugf(format, v...)
+	}
+}
+
+// originalMessage parses the echo request an ICMP error is about, from the original packet the error carries
+func originalMessage(proto int, m *icmp.Message) (*icmp.Message, error) {
+	var data []byte
+	switch body := m.Body.(type) {
+	case *icmp.TimeExceeded:
+		data = body.Data
+	case *icmp.DstUnreach:
+		data = body.Data
+	case *icmp.PacketTooBig:
+		data = body.Data
+	default:
+		return nil, fmt.Errorf("invalid ICMP error body: %v", m.Body)
+	}
+	headerLen := ipv6.HeaderLen
+	if proto == ProtocolICMP {
+		if len(data) == 0 {
+			return nil, fmt.Errorf("no original packet")
+		}
+		headerLen = int(data[0]&0x0f) * 4
+	}
+	if len(data) < headerLen {
+		return nil, fmt.Errorf("truncated original packet")
+	}
+	return icmp.ParseMessage(proto, data[headerLen:])
+}
+
+// echoPayload returns the payload of an echo request: the send time, padded up to size bytes with every byte
+// being its offset in the payload, so that the padding is recognizable in packet captures
+func echoPayload(t time.Time, size int) []byte {
+	b := timeToBytes(t)
+	for i := len(b); i < size; i++ {
+		b = append(b, byte(i))
 	}
+	return b
 }
 
 func timeToBytes(t time.Time) []byte {
@@ -0,0 +1,159 @@
+package ping
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var pmtuFlag = flags.Bool("pmtu", false, "Discover the path MTU to the host: send the requests with the Don't Fragment bit set, and binary-search the largest echo payload that gets through. Needs a raw socket")
+
+// pmtu is set if --pmtu is
+var pmtu *pmtuSearch
+
+// pmtuSearch binary-searches the largest echo payload that reaches the target unfragmented. A reply means that the
+// payload fits. A "fragmentation needed" error, a local "message too long" error or a timeout means that it's too
+// big, and the MTU of a "fragmentation needed" error is tried next
+type pmtuSearch struct {
+	mux *sync.Mutex
+	// headerLen is the size of the IP and ICMP headers of the requests
+	headerLen int
+	// fits is the largest payload that was answered, or defaultSize-1 if none was
+	fits int
+	// tooBig is the smallest payload that was too big, or maxSize+1 if none was
+	tooBig int
+	// hint is the payload that the MTU of the last "fragmentation needed" error allows, or 0
+	hint   int
+	probes int
+}
+
+// pmtuSummary is the outcome of the search in the JSON output
+type pmtuSummary struct {
+	// MTU is the path MTU, or 0 if no payload was answered
+	MTU int `json:"mtu"`
+	// MaxMTU is the smallest MTU that was too big, which equals MTU if the search is done
+	MaxMTU int  `json:"max_mtu"`
+	Probes int  `json:"probes"`
+	Done   bool `json:"done"`
+}
+
+// validatePMTU checks that the other flags leave the search in charge of the requests
+func validatePMTU() error {
+	if !*pmtuFlag {
+		return nil
+	}
+	switch {
+	case *unprivileged:
+		return fmt.Errorf("--pmtu needs a raw socket, ICMP datagram sockets don't get the \"fragmentation needed\" errors")
+	case *countFlag != 0, *warmupFlag != 0, *burstFlag != 1, *adaptiveFlag, *floodFlag, *sweepFlag != "", *agentsFlag != "":
+		return fmt.Errorf("--pmtu doesn't support -c, --warmup, --burst, --adaptive, --flood, --sweep or --agents, the search sends one request at a time until it's done")
+	case *minInterval <= 0 || *minInterval > *intervalFlag:
+		return fmt.Errorf("--min-interval must be positive and not longer than --interval")
+	}
+	return nil
+}
+
+func newPMTUSearch(useIPv6 bool) *pmtuSearch {
+	headerLen := ipv4.HeaderLen + 8
+	if useIPv6 {
+		headerLen = ipv6.HeaderLen + 8
+	}
+	return &pmtuSearch{mux: &sync.Mutex{}, headerLen: headerLen, fits: defaultSize - 1, tooBig: maxSize + 1}
+}
+
+// next returns the payload size of the next request. The first request has the largest payload, which often fails
+// right away on the MTU of the outgoing interface
+func (s *pmtuSearch) next() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.probes++
+	if s.hint > s.fits && s.hint < s.tooBig {
+		size := s.hint
+		s.hint = 0
+		return size
+	}
+	if s.probes == 1 {
+		return maxSize
+	}
+	return s.fits + (s.tooBig-s.fits)/2
+}
+
+// done returns whether the search has found the largest payload, or that even the smallest one doesn't fit
+func (s *pmtuSearch) done() bool {
+	if s == nil {
+		return false
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.tooBig-s.fits <= 1
+}
+
+// record records whether a request with the payload size was answered
+func (s *pmtuSearch) record(size int, fits bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch {
+	case fits && size >= s.tooBig:
+		// A request of that size was lost rather than too big, start over above this one
+		s.fits, s.tooBig = size, maxSize+1
+	case fits && size > s.fits:
+		s.fits = size
+	case !fits && size < s.tooBig && size > s.fits:
+		s.tooBig = size
+	}
+}
+
+// fragNeeded records the MTU of a "fragmentation needed" error, so that the payload that it allows is tried next
+func (s *pmtuSearch) fragNeeded(mtu int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.hint = mtu - s.headerLen
+}
+
+func (s *pmtuSearch) summary() *pmtuSummary {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	summary := &pmtuSummary{MaxMTU: s.tooBig - 1 + s.headerLen, Probes: s.probes, Done: s.tooBig-s.fits <= 1}
+	if s.fits >= defaultSize {
+		summary.MTU = s.fits + s.headerLen
+	}
+	return summary
+}
+
+// print prints the path MTU, or the range it's known to be in if the search was stopped
+func (s *pmtuSearch) print(host string) {
+	summary := s.summary()
+	fmt.Println("--- path mtu ---")
+	switch {
+	case summary.MTU == 0 && summary.Done:
+		fmt.Println(paint(colorRed, fmt.Sprintf("no request to %s was answered, not even with a payload of %d bytes", host, defaultSize)))
+	case summary.MTU == 0:
+		fmt.Printf("no request to %s was answered before the search was stopped, the path MTU is at most %d bytes\n", host, summary.MaxMTU)
+	case summary.Done:
+		fmt.Printf("path MTU to %s is %d bytes, the largest echo payload that fits is %d bytes, found with %d requests\n",
+			host, summary.MTU, summary.MTU-s.headerLen, summary.Probes)
+	default:
+		fmt.Printf("the search was stopped, the path MTU to %s is %d to %d bytes\n", host, summary.MTU, summary.MaxMTU)
+	}
+}
+
+// fragNeededMTU returns the next-hop MTU of a "fragmentation needed" or "packet too big" error, from the ICMP message
+// and its raw bytes, or false if the message is another error
+func fragNeededMTU(m *icmp.Message, b []byte) (int, bool) {
+	switch body := m.Body.(type) {
+	case *icmp.PacketTooBig:
+		return body.MTU, true
+	case *icmp.DstUnreach:
+		// The next-hop MTU of RFC 1191 is in the lower half of the unused field, which the body doesn't keep. Old
+		// routers leave it 0
+		if m.Code != 4 || len(b) < 8 {
+			return 0, false
+		}
+		return int(binary.BigEndian.Uint16(b[6:8])), true
+	}
+	return 0, false
+}
@@ -0,0 +1,15 @@
+package ping
+
+import (
+	"os"
+	"syscall"
+)
+
+// setDontFragment makes the socket set the Don't Fragment bit, and fail with EMSGSIZE instead of fragmenting. The
+// probe mode also ignores the path MTU the kernel has learned, so that every request tests the path again
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	if ipv6 {
+		return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MTU_DISCOVER, syscall.IPV6_PMTUDISC_PROBE))
+	}
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MTU_DISCOVER, syscall.IP_PMTUDISC_PROBE))
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package ping
+
+import "fmt"
+
+// The Don't Fragment bit is only set on Linux, see pmtu_linux.go
+
+func setDontFragment(fd uintptr, ipv6 bool) error {
+	return fmt.Errorf("--pmtu is only supported on Linux")
+}
@@ -0,0 +1,105 @@
+package ping
+
+import (
+	"encoding/csv"
+	"os"
+	"strconv"
+	"time"
+)
+
+var recordFlag = flags.String("record", "", "Append one CSV row per request to this file: timestamp, seq, target, rtt_ns, lost and ttl")
+
+// csvHeader is the first row of a new --record file
+var csvHeader = []string{"timestamp", "seq", "target", "rtt_ns", "lost", "ttl"}
+
+// recorder records the outcome of every request, e.g. to a file for analyzing long runs later. The recorders get
+// the same requests as the statistics, so not the warm-up ones, and are only used from the process loop
+type recorder interface {
+	record(p *probe) error
+	Close() error
+}
+
+// probe is the outcome of a request
+type probe struct {
+	// time is when the reply arrived, or when the request was found lost
+	time   time.Time
+	target string
+	// seq is -1 if it's not known which request was lost
+	seq  int
+	lost bool
+	// rtt and ttl are only set for replies
+	rtt time.Duration
+	ttl int
+}
+
+// recorders are the recorders of the run
+var recorders []recorder
+
+// recordProbe records the probe with every recorder. A failed write is logged, the statistics are still kept
+func recordProbe(p *probe) {
+	for _, r := range recorders {
+		if err := r.record(p); err != nil {
+			logger.Errorf("Failed to record icmp_seq=%d: %v", p.seq, err)
+		}
+	}
+}
+
+func closeRecorders() {
+	for _, r := range recorders {
+		if err := r.Close(); err != nil {
+			logger.Errorf("Failed to close a recorder: %v", err)
+		}
+	}
+	recorders = nil
+}
+
+// csvRecorder appends the probes to a CSV file, so that the rows of several runs end up in the same table
+type csvRecorder struct {
+	f *os.File
+	w *csv.Writer
+}
+
+func newCSVRecorder(path string) (*csvRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r := &csvRecorder{f: f, w: csv.NewWriter(f)}
+	if info.Size() == 0 {
+		if err := r.write(csvHeader); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *csvRecorder) record(p *probe) error {
+	seq, rtt, ttl := "", "", ""
+	if p.seq >= 0 {
+		seq = strconv.Itoa(p.seq)
+	}
+	if !p.lost {
+		rtt = strconv.FormatInt(p.rtt.Nanoseconds(), 10)
+		ttl = strconv.Itoa(p.ttl)
+	}
+	return r.write([]string{p.time.Format(time.RFC3339Nano), seq, p.target, rtt, strconv.FormatBool(p.lost), ttl})
+}
+
+// write writes the row right away, so that the file is complete up to the last request if ping is killed
+func (r *csvRecorder) write(row []string) error {
+	if err := r.w.Write(row); err != nil {
+		return err
+	}
+	r.w.Flush()
+	return r.w.Error()
+}
+
+func (r *csvRecorder) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,96 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var resolveFlag = flags.Bool("resolve", false, "Look up the names of the responders and hops with reverse DNS, and print them as name (ip), like ping without -n")
+
+// resolveTimeout bounds a reverse lookup
+const resolveTimeout = 2 * time.Second
+
+// rdns is set if --resolve is
+var rdns *reverseResolver
+
+// reverseResolver looks up the names of IPs. The names are cached, also when there are none, as the same few
+// responders keep replying. The lookups run in the background, so that they don't hold up the replies, which are
+// printed with only the IP until the name is known
+type reverseResolver struct {
+	// mux guards cache and pending, but isn't held during the lookups
+	mux   *sync.Mutex
+	cache map[string]string
+	// pending are the IPs being looked up
+	pending map[string]bool
+}
+
+// setupResolve enables the reverse lookups, if --resolve is set
+func setupResolve() {
+	if *resolveFlag {
+		rdns = &reverseResolver{mux: &sync.Mutex{}, cache: map[string]string{}, pending: map[string]bool{}}
+	}
+}
+
+// lookup returns the name of the IP without the trailing dot, or nothing if it has none
+func lookup(ip net.IP) string {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
+	if err != nil {
+		logger.Debugf("No name for %s: %v", ip, err)
+		return ""
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	return strings.TrimSuffix(names[0], ".")
+}
+
+// prefetch looks up the name of the IP and waits for it, e.g. for the target before the first request, so that its
+// replies are printed with the name from the start
+func (r *reverseResolver) prefetch(ip net.IP) {
+	if r == nil {
+		return
+	}
+	name := lookup(ip)
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.cache[ip.String()] = name
+}
+
+// name returns the name of the IP, or nothing if it has none, there's no resolver, or it's still being looked up.
+// It never waits for a lookup, but starts one if the IP hasn't been looked up yet
+func (r *reverseResolver) name(ip net.IP) string {
+	if r == nil {
+		return ""
+	}
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	key := ip.String()
+	if name, ok := r.cache[key]; ok {
+		return name
+	}
+	if !r.pending[key] {
+		r.pending[key] = true
+		go func() {
+			name := lookup(ip)
+			r.mux.Lock()
+			defer r.mux.Unlock()
+			r.cache[key] = name
+			delete(r.pending, key)
+		}()
+	}
+	return ""
+}
+
+// label returns e.g. "one.one.one.one (1.1.1.1)" for the IP if it has a name, and the IP otherwise
+func (r *reverseResolver) label(ip net.IP) string {
+	if name := r.name(ip); name != "" {
+		return fmt.Sprintf("%s (%s)", name, ip)
+	}
+	return ip.String()
+}
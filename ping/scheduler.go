@@ -0,0 +1,108 @@
+package ping
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	fleetConcurrencyFlag = flags.Int("fleet-concurrency", 100, "How many hosts to probe at once in --fleet mode")
+	fleetProgressFlag    = flags.Duration("fleet-progress", 5*time.Second, "How often to log the progress in --fleet mode, 0 to disable")
+)
+
+// fleetScheduler probes the hosts of a fleet with at most concurrency hosts in flight. Every host gets its
+// echo requests interval apart, and is done when all have been answered or maxRTT has passed since the last.
+// All hosts share the same ICMP socket, so probing thousands of hosts doesn't exhaust sockets
+type fleetScheduler struct {
+	conn        packetConn
+	mux         *sync.Mutex
+	count       int
+	interval    time.Duration
+	maxRTT      time.Duration
+	concurrency int
+
+	// total, probed and reachable count the hosts for the progress reports, guarded by mux
+	total     int
+	probed    int
+	reachable int
+}
+
+// run probes the hosts, and logs the progress every progressInterval until it's done
+func (s *fleetScheduler) run(hosts []*fleetHost, progressInterval time.Duration) {
+	s.total = len(hosts)
+	stop := make(chan struct{})
+	if progressInterval > 0 {
+		go s.reportProgress(progressInterval, stop)
+	}
+	defer close(stop)
+
+	work := make(chan *fleetHost)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < s.concurrency && i < len(hosts); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range work {
+				s.probe(h)
+			}
+		}()
+	}
+	for _, h := range hosts {
+		work <- h
+	}
+	close(work)
+	wg.Wait()
+}
+
+// probe sends the echo requests to a host, and waits for the replies
+func (s *fleetScheduler) probe(h *fleetHost) {
+	for seq := 0; seq < s.count; seq++ {
+		if seq != 0 {
+			time.Sleep(s.interval)
+		}
+		s.mux.Lock()
+		h.sent[seq] = time.Now()
+		s.mux.Unlock()
+		if err := sendEcho(s.conn, h.id, seq, h.ip); err != nil {
+			logger.Warnf("Failed to ping %s for seq=%d: %v", h.name, seq, err)
+		}
+	}
+
+	timer := time.NewTimer(s.maxRTT)
+	defer timer.Stop()
+wait:
+	for received := 0; received < s.count; received++ {
+		select {
+		case <-h.replies:
+		case <-timer.C:
+			break wait
+		}
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for range h.sent {
+		h.stats.PacketLost()
+	}
+	// Replies arriving after this are too late
+	h.sent = map[int]time.Time{}
+	s.probed++
+	if h.stats.Calculate().NumReceived != 0 {
+		s.reachable++
+	}
+}
+
+func (s *fleetScheduler) reportProgress(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mux.Lock()
+			logger.Infof("Probed %d of %d hosts, %d reachable", s.probed, s.total, s.reachable)
+			s.mux.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
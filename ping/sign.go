@@ -0,0 +1,113 @@
+package ping
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/luxas/random-schoolwork/pkg/hashing"
+)
+
+var (
+	signSecretFlag    = flags.String("sign-secret", "", "If set, sign every record of the JSON output with an HMAC using this secret, so that the log can be shown to be untampered with verify-log. Better given as PING_SIGN_SECRET")
+	signAlgorithmFlag = flags.String("sign-algorithm", string(hashing.SHA2_256), fmt.Sprintf("The hash algorithm of the HMACs. Options are: %v", hashing.SupportedHashAlgorithms()))
+)
+
+// hmacField is how the HMAC is appended to a record, as its last field
+const hmacField = `,"hmac":"`
+
+// signer is set if the JSON output is signed
+var signer *recordSigner
+
+// recordSigner signs the JSON records, like msg-auth --openssl computes HMACs. Every HMAC covers the hex HMAC of the
+// previous record followed by the record without its hmac field, so records can't be removed or reordered either
+type recordSigner struct {
+	hasher hashing.Hasher
+	prev   []byte
+}
+
+func newRecordSigner() (*recordSigner, error) {
+	hasher, err := hashing.NewHMAC(hashing.HashAlgorithm(*signAlgorithmFlag), []byte(*signSecretFlag))
+	if err != nil {
+		return nil, err
+	}
+	return &recordSigner{hasher: hasher}, nil
+}
+
+// mac returns the hex HMAC of the record, chained to the previous one
+func (s *recordSigner) mac(record []byte) []byte {
+	data := append(append([]byte{}, s.prev...), record...)
+	return []byte(hex.EncodeToString(s.hasher.Hash(data)))
+}
+
+// sign returns the JSON object with its HMAC as the last field
+func (s *recordSigner) sign(record []byte) []byte {
+	mac := s.mac(record)
+	s.prev = mac
+	signed := append([]byte{}, record[:len(record)-1]...)
+	signed = append(append(append(signed, hmacField...), mac...), `"}`...)
+	return signed
+}
+
+// verify checks the HMAC of a signed record, and returns the record without it
+func (s *recordSigner) verify(signed []byte) error {
+	i := bytes.LastIndex(signed, []byte(hmacField))
+	if i == -1 || !bytes.HasSuffix(signed, []byte(`"}`)) {
+		return fmt.Errorf("the record isn't signed")
+	}
+	record := append(append([]byte{}, signed[:i]...), '}')
+	mac := signed[i+len(hmacField) : len(signed)-2]
+	if !hmac.Equal(mac, s.mac(record)) {
+		return fmt.Errorf("HMAC mismatch, the record or one before it has been changed, removed or reordered")
+	}
+	s.prev = mac
+	return nil
+}
+
+// verifyLog verifies the signed JSON output of ping in the file. It's an error if any record doesn't verify, and a
+// warning if the last record isn't the summary, as the end of the log may have been cut off
+func verifyLog(path string) error {
+	if *signSecretFlag == "" {
+		return fmt.Errorf("--sign-secret must be set to verify a log")
+	}
+	s, err := newRecordSigner()
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records := 0
+	last := []byte{}
+	scanner := bufio.NewScanner(f)
+	// A summary with a histogram can be longer than the default limit of a line
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		records++
+		if err := s.verify(line); err != nil {
+			return fmt.Errorf("record %d: %v", records, err)
+		}
+		last = append(last[:0], line...)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if records == 0 {
+		return fmt.Errorf("%s has no records", path)
+	}
+	if !bytes.HasPrefix(last, []byte(`{"type":"summary"`)) {
+		logger.Warnf("The last record isn't the summary, the end of the log may have been cut off")
+	}
+	fmt.Printf("All %d records of %s verified\n", records, path)
+	return nil
+}
@@ -0,0 +1,235 @@
+package ping
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	sloFlag       = flags.String("slo", "", "Comma-separated objectives to track, e.g. \"p95<100ms,loss<1%\". pN<duration is met if at most 100-N% of the replies take the duration or longer, loss<N% if at most N% of the requests are lost")
+	sloWindowFlag = flags.Duration("slo-window", time.Minute, "The length of the windows --slo evaluates the objectives over")
+)
+
+// slo is set if --slo is
+var slo *sloTracker
+
+// sloTracker evaluates the objectives over consecutive windows, and how fast their error budgets burn. Like the
+// statistics, it doesn't cover the warm-up requests. All methods are no-ops on a nil *sloTracker
+type sloTracker struct {
+	mux         *sync.Mutex
+	window      time.Duration
+	windowStart time.Time
+	objectives  []*sloObjective
+}
+
+// sloObjective is an objective, and the requests that were good and bad for it. Its error budget is the fraction
+// of the requests that may be bad, and the burn rate how many times that fraction was bad
+type sloObjective struct {
+	name string
+	// threshold is the RTT that the replies must be below, or 0 for the loss objective
+	threshold time.Duration
+	budget    float64
+	total     uint64
+	bad       uint64
+	// windows counts the completed windows that had requests, and windowsMet the ones the objective was met in
+	windows    uint64
+	windowsMet uint64
+	// windowTotal and windowBad count the requests of the current window
+	windowTotal uint64
+	windowBad   uint64
+	// lastBurnRate is the burn rate of the last completed window
+	lastBurnRate float64
+}
+
+// sloSummary is an objective in the JSON output
+type sloSummary struct {
+	Objective         string  `json:"objective"`
+	Windows           uint64  `json:"windows"`
+	WindowsMet        uint64  `json:"windows_met"`
+	CompliancePercent float64 `json:"compliance_percent"`
+	BurnRate          float64 `json:"burn_rate"`
+}
+
+// setupSLO parses the objectives of --slo, if it's set
+func setupSLO() error {
+	if *sloFlag == "" {
+		return nil
+	}
+	if *sloWindowFlag <= 0 {
+		return fmt.Errorf("--slo-window must be positive")
+	}
+	t := &sloTracker{mux: &sync.Mutex{}, window: *sloWindowFlag}
+	for _, s := range strings.Split(*sloFlag, ",") {
+		o, err := parseObjective(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("invalid --slo objective %q: %v", s, err)
+		}
+		t.objectives = append(t.objectives, o)
+	}
+	slo = t
+	return nil
+}
+
+// parseObjective parses a pN<duration or loss<N% objective
+func parseObjective(s string) (*sloObjective, error) {
+	parts := strings.SplitN(s, "<", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("expected pN<duration or loss<N%%")
+	}
+	name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+	o := &sloObjective{name: fmt.Sprintf("%s<%s", name, value)}
+	switch {
+	case name == "loss":
+		if !strings.HasSuffix(value, "%") {
+			return nil, fmt.Errorf("the loss must be a percentage, e.g. 1%%")
+		}
+		loss, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if err != nil || loss <= 0 || loss >= 100 {
+			return nil, fmt.Errorf("the loss must be between 0%% and 100%%")
+		}
+		o.budget = loss / 100
+	case strings.HasPrefix(name, "p"):
+		p, err := strconv.ParseFloat(strings.TrimPrefix(name, "p"), 64)
+		if err != nil || p <= 0 || p >= 100 {
+			return nil, fmt.Errorf("the percentile must be between 0 and 100, e.g. p99.9")
+		}
+		if o.threshold, err = time.ParseDuration(value); err != nil {
+			return nil, err
+		}
+		if o.threshold <= 0 {
+			return nil, fmt.Errorf("the RTT must be positive")
+		}
+		o.budget = (100 - p) / 100
+	default:
+		return nil, fmt.Errorf("unknown objective %q, expected pN or loss", name)
+	}
+	return o, nil
+}
+
+// start starts the first window
+func (t *sloTracker) start() {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	t.windowStart = time.Now()
+}
+
+// record records a request that was answered after rtt, or lost. Lost requests only count for the loss objectives
+func (t *sloTracker) record(rtt time.Duration, lost bool) {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	// Complete the current window if it has passed. The windows in between had no requests
+	if now := time.Now(); now.Sub(t.windowStart) >= t.window {
+		for _, o := range t.objectives {
+			o.completeWindow()
+		}
+		t.windowStart = t.windowStart.Add(now.Sub(t.windowStart) / t.window * t.window)
+	}
+	for _, o := range t.objectives {
+		if o.threshold != 0 && lost {
+			continue
+		}
+		o.total++
+		o.windowTotal++
+		if lost || (o.threshold != 0 && rtt >= o.threshold) {
+			o.bad++
+			o.windowBad++
+		}
+	}
+}
+
+func (o *sloObjective) completeWindow() {
+	if o.windowTotal == 0 {
+		return
+	}
+	o.windows++
+	if o.met(o.windowBad, o.windowTotal) {
+		o.windowsMet++
+	}
+	o.lastBurnRate = o.burnRate(o.windowBad, o.windowTotal)
+	o.windowTotal, o.windowBad = 0, 0
+}
+
+// met returns whether at most the error budget of the requests were bad
+func (o *sloObjective) met(bad, total uint64) bool {
+	// Allow for the rounding of e.g. 0.01 * 100
+	return float64(bad) <= o.budget*float64(total)+1e-9
+}
+
+// burnRate returns how many times the error budget the bad requests were, 1 meaning that it was used up exactly
+func (o *sloObjective) burnRate(bad, total uint64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / o.budget
+}
+
+// summary returns the compliance of every objective, counting the current window as if it was completed
+func (t *sloTracker) summary() []sloSummary {
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	summaries := make([]sloSummary, 0, len(t.objectives))
+	for _, o := range t.objectives {
+		s := sloSummary{Objective: o.name, Windows: o.windows, WindowsMet: o.windowsMet, BurnRate: o.burnRate(o.bad, o.total)}
+		if o.windowTotal != 0 {
+			s.Windows++
+			if o.met(o.windowBad, o.windowTotal) {
+				s.WindowsMet++
+			}
+		}
+		if s.Windows != 0 {
+			s.CompliancePercent = 100 * float64(s.WindowsMet) / float64(s.Windows)
+		}
+		summaries = append(summaries, s)
+	}
+	return summaries
+}
+
+// print prints the SLO section of the statistics
+func (t *sloTracker) print() {
+	fmt.Printf("--- slo compliance, %v windows ---\n", t.window)
+	for _, s := range t.summary() {
+		line := fmt.Sprintf("%s: met in %d of %d windows (%.1f%%), error budget burn rate %.2f",
+			s.Objective, s.WindowsMet, s.Windows, s.CompliancePercent, s.BurnRate)
+		if s.WindowsMet != s.Windows || s.BurnRate > 1 {
+			line = paint(colorRed, line)
+		}
+		fmt.Println(line)
+	}
+}
+
+// writeMetrics writes the SLO metrics in the Prometheus text format. Unlike the summary, they only cover the
+// completed windows, so that the compliance doesn't jump around within a window
+func (t *sloTracker) writeMetrics(b *strings.Builder, host string) {
+	if t == nil {
+		return
+	}
+	t.mux.Lock()
+	defer t.mux.Unlock()
+	for _, m := range []struct {
+		name, help, typ string
+		value           func(o *sloObjective) string
+	}{
+		{"ping_slo_windows_total", "Completed --slo windows with requests", "counter",
+			func(o *sloObjective) string { return strconv.FormatUint(o.windows, 10) }},
+		{"ping_slo_windows_met_total", "Completed --slo windows the objective was met in", "counter",
+			func(o *sloObjective) string { return strconv.FormatUint(o.windowsMet, 10) }},
+		{"ping_slo_error_budget_burn_rate", "How many times the error budget of the objective the bad requests were, over the whole run", "gauge",
+			func(o *sloObjective) string { return strconv.FormatFloat(o.burnRate(o.bad, o.total), 'g', -1, 64) }},
+		{"ping_slo_window_error_budget_burn_rate", "The burn rate of the error budget in the last completed --slo window", "gauge",
+			func(o *sloObjective) string { return strconv.FormatFloat(o.lastBurnRate, 'g', -1, 64) }},
+	} {
+		fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.typ)
+		for _, o := range t.objectives {
+			fmt.Fprintf(b, "%s{%s,objective=%q} %s\n", m.name, host, o.name, m.value(o))
+		}
+	}
+}
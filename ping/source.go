@@ -0,0 +1,146 @@
+package ping
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+var sourceFlag = flags.String("I", "", "The interface, e.g. eth0, or the source IP address to send the requests from, to test a specific egress path of a multi-homed host. An interface needs Linux")
+
+var (
+	// sourceIP is set if -I is an IP address
+	sourceIP net.IP
+	// sourceIface is set if -I is an interface name
+	sourceIface string
+)
+
+// validateSource sets sourceIP or sourceIface from -I, or from the deprecated --listen-address
+func validateSource() error {
+	source := *sourceFlag
+	if *listenAddr != "" {
+		if source != "" {
+			return fmt.Errorf("-I replaces --listen-address, don't set both")
+		}
+		logger.Warnf("--listen-address is deprecated, use -I %s instead", *listenAddr)
+		if sourceIP = net.ParseIP(*listenAddr); sourceIP == nil {
+			return fmt.Errorf("--listen-address %q is not an IP address", *listenAddr)
+		}
+		return nil
+	}
+	if source == "" {
+		return nil
+	}
+	if sourceIP = net.ParseIP(source); sourceIP != nil {
+		return nil
+	}
+	if _, err := net.InterfaceByName(source); err != nil {
+		return fmt.Errorf("-I %q is neither an IP address nor an interface: %v", source, err)
+	}
+	if err := checkBindToDevice(); err != nil {
+		return err
+	}
+	sourceIface = source
+	return nil
+}
+
+// listenAddress is the address of -I to listen on, or "" for all addresses of the address family
+func listenAddress() string {
+	if sourceIP == nil {
+		return ""
+	}
+	return sourceIP.String()
+}
+
+// describeSource describes where the requests are sent from for --explain, or returns "" if -I isn't set
+func describeSource() string {
+	switch {
+	case sourceIP != nil:
+		return fmt.Sprintf("send from %s", sourceIP)
+	case sourceIface != "":
+		return fmt.Sprintf("send through the interface %s only, whatever the routes say", sourceIface)
+	}
+	return ""
+}
+
+// socketOption sets an option of a socket before it's used
+type socketOption func(fd uintptr) error
+
+// sourceOptions returns the socket options that bind the sockets to the interface of -I, if it's one
+func sourceOptions() []socketOption {
+	if sourceIface == "" {
+		return nil
+	}
+	iface := sourceIface
+	return []socketOption{func(fd uintptr) error {
+		return bindToDevice(fd, iface)
+	}}
+}
+
+// control returns the Control function of a net.ListenConfig or net.Dialer that sets the options
+func control(options []socketOption) func(network, address string, c syscall.RawConn) error {
+	if len(options) == 0 {
+		return nil
+	}
+	return func(_, _ string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			for _, option := range options {
+				if err = option(fd); err != nil {
+					return
+				}
+			}
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
+
+// optionsConn is an ICMP socket that had its options set before it's used, which the sockets of
+// icmp.ListenPacket can't
+type optionsConn struct {
+	net.PacketConn
+	p4 *ipv4.PacketConn
+	p6 *ipv6.PacketConn
+}
+
+func (c *optionsConn) IPv4PacketConn() *ipv4.PacketConn {
+	return c.p4
+}
+
+func (c *optionsConn) IPv6PacketConn() *ipv6.PacketConn {
+	return c.p6
+}
+
+// listenICMP opens an ICMP socket like icmp.ListenPacket, or an ICMPv6 socket if useIPv6 is set, with the options
+// set. Datagram sockets with options are opened with a system call, as the net package only knows UDP ones
+func listenICMP(network, address string, useIPv6 bool, options []socketOption) (packetConn, error) {
+	if len(options) == 0 {
+		c, err := icmp.ListenPacket(network, address)
+		if err != nil {
+			return nil, err
+		}
+		return c, nil
+	}
+	var c net.PacketConn
+	var err error
+	if network == "udp4" || network == "udp6" {
+		c, err = listenDatagramICMP(address, useIPv6, options)
+	} else {
+		lc := &net.ListenConfig{Control: control(options)}
+		c, err = lc.ListenPacket(context.Background(), network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if useIPv6 {
+		return &optionsConn{PacketConn: c, p6: ipv6.NewPacketConn(c)}, nil
+	}
+	return &optionsConn{PacketConn: c, p4: ipv4.NewPacketConn(c)}, nil
+}
@@ -0,0 +1,52 @@
+package ping
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+func checkBindToDevice() error {
+	return nil
+}
+
+// bindToDevice makes the socket send and receive through the interface only, like ping -I does
+func bindToDevice(fd uintptr, iface string) error {
+	return os.NewSyscallError("setsockopt", syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface))
+}
+
+// listenDatagramICMP opens an ICMP datagram socket, or an ICMPv6 one if useIPv6 is set, with the options set before
+// it's bound to the address
+func listenDatagramICMP(address string, useIPv6 bool, options []socketOption) (net.PacketConn, error) {
+	family, proto := syscall.AF_INET, syscall.IPPROTO_ICMP
+	if useIPv6 {
+		family, proto = syscall.AF_INET6, syscall.IPPROTO_ICMPV6
+	}
+	fd, err := syscall.Socket(family, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	f := os.NewFile(uintptr(fd), "icmp")
+	// The net package duplicates the socket
+	defer f.Close()
+	for _, option := range options {
+		if err := option(uintptr(fd)); err != nil {
+			return nil, err
+		}
+	}
+
+	var sa syscall.Sockaddr
+	if useIPv6 {
+		sa6 := &syscall.SockaddrInet6{}
+		copy(sa6.Addr[:], net.ParseIP(address).To16())
+		sa = sa6
+	} else {
+		sa4 := &syscall.SockaddrInet4{}
+		copy(sa4.Addr[:], net.ParseIP(address).To4())
+		sa = sa4
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, os.NewSyscallError("bind", err)
+	}
+	return net.FilePacketConn(f)
+}
@@ -0,0 +1,23 @@
+//go:build !linux
+// +build !linux
+
+package ping
+
+import (
+	"fmt"
+	"net"
+)
+
+// Sockets are only bound to interfaces on Linux, see source_linux.go
+
+func checkBindToDevice() error {
+	return fmt.Errorf("-I with an interface is only supported on Linux, give the source IP address instead")
+}
+
+func bindToDevice(fd uintptr, iface string) error {
+	return checkBindToDevice()
+}
+
+func listenDatagramICMP(address string, useIPv6 bool, options []socketOption) (net.PacketConn, error) {
+	return nil, checkBindToDevice()
+}
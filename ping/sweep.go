@@ -0,0 +1,133 @@
+package ping
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var sweepFlag = flags.String("sweep", "", "Sweep the echo payload size as min:max:step, e.g. 1400:1500:8, one size per request, and report the RTTs by size to spot e.g. fragmentation. Overrides --size. Without -c, the sweep is done once")
+
+// sweep is set if --sweep is
+var sweep *sizeSweep
+
+// sizeSweep is the payload size of every request in sweep mode, and records the outcome of the requests by their
+// size. The warm-up requests have the smallest size
+type sizeSweep struct {
+	min, max, step int
+
+	mux  *sync.Mutex
+	rtts map[int][]time.Duration
+	lost map[int]int
+}
+
+// sweepSize is the outcome of the requests of a size in the JSON output
+type sweepSize struct {
+	Size        int     `json:"size"`
+	Transmitted int     `json:"transmitted"`
+	Received    int     `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	MinRTTMs    float64 `json:"min_rtt_ms"`
+	AvgRTTMs    float64 `json:"avg_rtt_ms"`
+	MaxRTTMs    float64 `json:"max_rtt_ms"`
+}
+
+// validateSweep returns the sweep of --sweep, or nil if it isn't set
+func validateSweep() (*sizeSweep, error) {
+	if *sweepFlag == "" {
+		return nil, nil
+	}
+	parts := strings.Split(*sweepFlag, ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("--sweep must be min:max:step, e.g. 1400:1500:8")
+	}
+	n := make([]int, len(parts))
+	for i, part := range parts {
+		var err error
+		if n[i], err = strconv.Atoi(strings.TrimSpace(part)); err != nil {
+			return nil, fmt.Errorf("invalid --sweep: %v", err)
+		}
+	}
+	s := &sizeSweep{min: n[0], max: n[1], step: n[2], mux: &sync.Mutex{}, rtts: map[int][]time.Duration{}, lost: map[int]int{}}
+	switch {
+	case s.min < defaultSize || s.max > maxSize || s.min > s.max:
+		return nil, fmt.Errorf("the --sweep sizes must be between %d and %d, min first", defaultSize, maxSize)
+	case s.step < 1:
+		return nil, fmt.Errorf("the --sweep step must be at least 1")
+	}
+	return s, nil
+}
+
+// sizes returns how many sizes a sweep has
+func (s *sizeSweep) sizes() int {
+	return (s.max-s.min)/s.step + 1
+}
+
+// size returns the payload size of the request with the sequence number. The sizes start over after the largest
+func (s *sizeSweep) size(seq int) int {
+	i := seq - *warmupFlag
+	if i < 0 {
+		i = 0
+	}
+	return s.min + i%s.sizes()*s.step
+}
+
+// record records the outcome of a request of the size
+func (s *sizeSweep) record(size int, rtt time.Duration, received bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if received {
+		s.rtts[size] = append(s.rtts[size], rtt)
+	} else {
+		s.lost[size]++
+	}
+}
+
+// summary returns the outcome of the requests of every size that was sent, from the smallest
+func (s *sizeSweep) summary() []sweepSize {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	summaries := []sweepSize{}
+	for size := s.min; size <= s.max; size += s.step {
+		rtts := s.rtts[size]
+		ss := sweepSize{Size: size, Transmitted: len(rtts) + s.lost[size], Received: len(rtts)}
+		if ss.Transmitted == 0 {
+			continue
+		}
+		ss.LossPercent = 100 * float64(s.lost[size]) / float64(ss.Transmitted)
+		if len(rtts) != 0 {
+			min, max, sum := rtts[0], rtts[0], time.Duration(0)
+			for _, rtt := range rtts {
+				if rtt < min {
+					min = rtt
+				}
+				if rtt > max {
+					max = rtt
+				}
+				sum += rtt
+			}
+			ss.MinRTTMs, ss.AvgRTTMs, ss.MaxRTTMs = ms(min), ms(sum/time.Duration(len(rtts))), ms(max)
+		}
+		summaries = append(summaries, ss)
+	}
+	return summaries
+}
+
+// print prints the RTTs by payload size, a line per size
+func (s *sizeSweep) print() {
+	summaries := s.summary()
+	width := len(strconv.Itoa(s.max))
+	fmt.Println("--- rtt by payload size ---")
+	for _, ss := range summaries {
+		received := paintLoss(uint64(ss.Received), uint64(ss.Transmitted),
+			fmt.Sprintf("%d/%d received, %.0f%% loss", ss.Received, ss.Transmitted, ss.LossPercent))
+		if ss.Received == 0 {
+			fmt.Printf("%*d bytes: %s\n", width, ss.Size, received)
+			continue
+		}
+		fmt.Printf("%*d bytes: %s, rtt min/avg/max = %.3f/%.3f/%.3f ms\n", width, ss.Size, received,
+			ss.MinRTTMs, ss.AvgRTTMs, ss.MaxRTTMs)
+	}
+}
@@ -0,0 +1,175 @@
+package ping
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var tcpFlag = flags.String("tcp", "", "Probe with TCP connects to this port, e.g. :443, instead of ICMP echo requests, for hosts that drop ICMP. The RTT is the time the handshake takes")
+
+// tcpPort is set if --tcp is
+var tcpPort int
+
+// validateTCP parses the port of --tcp, and checks that the other flags only apply to ICMP
+func validateTCP() error {
+	if *tcpFlag == "" {
+		return nil
+	}
+	port, err := strconv.Atoi(strings.TrimPrefix(*tcpFlag, ":"))
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("--tcp must be a port, e.g. :443")
+	}
+	switch {
+	case *burstFlag != 1, *adaptiveFlag, *floodFlag, *sweepFlag != "", *pmtuFlag, *agentsFlag != "", *timestampsFlag:
+		return fmt.Errorf("--tcp doesn't support --burst, --adaptive, --flood, --sweep, --pmtu, --agents or --timestamps, which need ICMP")
+	case *sizeFlag != defaultSize, *tosFlag != -1, *dscpFlag != -1, *unprivileged:
+		return fmt.Errorf("--tcp doesn't support --size, --tos, --dscp or --unprivileged, TCP connects carry no payload and need no privileges")
+	}
+	tcpPort = port
+	return nil
+}
+
+// TCPPinger probes a port of the target with TCP connects, and reports them like a Pinger does its echo requests. A
+// connect that is refused or fails otherwise counts as lost, like one that times out
+type TCPPinger struct {
+	port int
+	// dialer connects from the source of -I, if it's set
+	dialer   *net.Dialer
+	interval time.Duration
+	// count is how many connects to make before stopping, or 0 to go on until stopped
+	count int
+	// mux serializes the outcomes of the connects, which run concurrently
+	mux      *sync.Mutex
+	callback ReceiveFunc
+	drain    chan struct{}
+}
+
+// NewTCPPinger creates a pinger that connects to port every interval. A connect times out after maxRTT
+func NewTCPPinger(port int, localIP net.IP, iface string, interval, maxRTT time.Duration, count int, callback ReceiveFunc) *TCPPinger {
+	return &TCPPinger{
+		port:     port,
+		dialer:   newSourceDialer(localIP, iface, maxRTT),
+		interval: interval,
+		count:    count,
+		mux:      &sync.Mutex{},
+		callback: callback,
+		drain:    make(chan struct{}, 1),
+	}
+}
+
+// newSourceDialer returns a dialer that connects from localIP and through iface, those of them that are set, and
+// times out after maxRTT
+func newSourceDialer(localIP net.IP, iface string, maxRTT time.Duration) *net.Dialer {
+	d := &net.Dialer{Timeout: maxRTT}
+	if localIP != nil {
+		d.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	if iface != "" {
+		d.Control = control([]socketOption{func(fd uintptr) error {
+			return bindToDevice(fd, iface)
+		}})
+	}
+	return d
+}
+
+// Ping connects to the port of target until ctx is done, or the connects of a pinger with a count are done. Like
+// Pinger.Ping, it returns ctx.Err() if ctx is done first. The connects that are still going on then aren't counted
+func (p *TCPPinger) Ping(ctx context.Context, host string, target net.IPAddr) error {
+	addr := &net.TCPAddr{IP: target.IP, Port: p.port, Zone: target.Zone}
+	printHeader(host, target.IP, 0)
+	return probeEvery(ctx, p.interval, p.count, p.drain, func(seq int) {
+		p.connect(ctx, host, addr, seq)
+	})
+}
+
+// probeEvery starts a probe every interval, which runs concurrently with the others, until ctx is done, count
+// probes have been started, or drain is signalled. It returns once the started probes are done, with ctx.Err()
+func probeEvery(ctx context.Context, interval time.Duration, count int, drain <-chan struct{}, probe func(seq int)) error {
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for seq := 0; count == 0 || seq < count; seq++ {
+		if seq != 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-drain:
+				wg.Wait()
+				return nil
+			case <-ticker.C:
+			}
+			// The tick and ctx may be done at the same time, and select picks either
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+		}
+		if inStats(seq) {
+			metrics.packetSent()
+		}
+		wg.Add(1)
+		go func(seq int) {
+			defer wg.Done()
+			probe(seq)
+		}(seq)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+// probeCancelled returns whether a probe ended, or failed, because ctx is done, so that it isn't counted. Dialers fail
+// with a timeout at the deadline of ctx, which may be before ctx.Err() is set
+func probeCancelled(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	deadline, ok := ctx.Deadline()
+	return ok && err != nil && !time.Now().Before(deadline)
+}
+
+// connect makes the connect with the sequence number, and records its outcome
+func (p *TCPPinger) connect(ctx context.Context, host string, addr *net.TCPAddr, seq int) {
+	start := time.Now()
+	conn, err := p.dialer.DialContext(ctx, "tcp", addr.String())
+	rtt := time.Since(start)
+	if err == nil {
+		conn.Close()
+	}
+	if probeCancelled(ctx, err) {
+		return
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	var neterr net.Error
+	switch {
+	case err == nil:
+		p.callback(&response{host: host, addr: net.IPAddr{IP: addr.IP, Zone: addr.Zone}, rtt: rtt, seq: seq, port: p.port}, nil)
+	case errors.As(err, &neterr) && neterr.Timeout():
+		recordLost(host, seq, 0)
+		printTimeout(host, addr.IP, seq)
+	default:
+		recordLost(host, seq, 0)
+		// The syscall error tells e.g. "connection refused" without repeating the address
+		var syserr *os.SyscallError
+		if errors.As(err, &syserr) {
+			err = syserr.Err
+		}
+		printRecvError(host, fmt.Errorf("From %s%s tcp_seq=%d %v", addr, geoip.annotate(addr.IP), seq, err))
+	}
+}
+
+// Drain makes Ping stop connecting, and return once the outstanding connects are done
+func (p *TCPPinger) Drain() {
+	select {
+	case p.drain <- struct{}{}:
+	default:
+	}
+}
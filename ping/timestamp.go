@@ -0,0 +1,53 @@
+package ping
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	timestampUnix    = "unix"
+	timestampRFC3339 = "rfc3339"
+)
+
+var (
+	timestampFlag       = flags.Bool("D", false, "Prefix every reply, timeout and error with the wall-clock time it was handled at, to correlate a capture with the logs of other systems")
+	timestampFormatFlag = flags.String("timestamp-format", timestampUnix, "The format of the -D timestamps: unix, in seconds with microseconds like iputils ping, or rfc3339")
+)
+
+func validateTimestamp() error {
+	if *timestampFormatFlag != timestampUnix && *timestampFormatFlag != timestampRFC3339 {
+		return fmt.Errorf("invalid --timestamp-format %q, expected %s or %s", *timestampFormatFlag, timestampUnix, timestampRFC3339)
+	}
+	return nil
+}
+
+// formatTimestamp formats t in the --timestamp-format
+func formatTimestamp(t time.Time) string {
+	if *timestampFormatFlag == timestampRFC3339 {
+		return t.Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+	return strconv.FormatFloat(float64(t.UnixNano())/float64(time.Second), 'f', 6, 64)
+}
+
+// timestampPrefix returns the prefix of a reply, timeout or error line with -D, like "[1612345678.123456] "
+func timestampPrefix() string {
+	if !*timestampFlag {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", formatTimestamp(time.Now()))
+}
+
+// eventTime returns the time of a JSON event with -D, a number in the unix format so that it can be compared
+func eventTime() interface{} {
+	if !*timestampFlag {
+		return nil
+	}
+	ts := formatTimestamp(time.Now())
+	if *timestampFormatFlag == timestampRFC3339 {
+		return ts
+	}
+	return json.Number(ts)
+}
@@ -0,0 +1,38 @@
+package ping
+
+import (
+	"fmt"
+)
+
+var (
+	tosFlag  = flags.Int("tos", -1, "Set the IPv4 TOS byte, or the IPv6 traffic class, of the requests (0-255), for checking the QoS treatment of marked traffic")
+	dscpFlag = flags.Int("dscp", -1, "Set the DSCP of the requests (0-63), e.g. 46 for expedited forwarding. The same as --tos with the DSCP in the upper 6 bits")
+)
+
+// validateTOS returns the TOS byte of --tos or --dscp, or -1 if neither is set
+func validateTOS() (int, error) {
+	switch {
+	case *tosFlag != -1 && *dscpFlag != -1:
+		return 0, fmt.Errorf("--tos and --dscp can't be used together")
+	case *tosFlag != -1:
+		if *tosFlag < 0 || *tosFlag > 0xff {
+			return 0, fmt.Errorf("--tos must be between 0 and 255")
+		}
+		return *tosFlag, nil
+	case *dscpFlag != -1:
+		if *dscpFlag < 0 || *dscpFlag > 0x3f {
+			return 0, fmt.Errorf("--dscp must be between 0 and 63")
+		}
+		// The lower 2 bits are ECN, which is left to the kernel
+		return *dscpFlag << 2, nil
+	}
+	return -1, nil
+}
+
+// setTOS sets the TOS byte, or the traffic class over IPv6, of the packets sent on the connection
+func setTOS(conn packetConn, ipv6 bool, tos int) error {
+	if ipv6 {
+		return conn.IPv6PacketConn().SetTrafficClass(tos)
+	}
+	return conn.IPv4PacketConn().SetTOS(tos)
+}
@@ -0,0 +1,153 @@
+// Package completion generates shell completion scripts for the binaries in this repository, from their
+// subcommands and flag sets.
+package completion
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Shells are the shells completion scripts can be generated for
+var Shells = []string{"bash", "zsh", "fish"}
+
+// Command describes a binary, or one of its subcommands, for completion
+type Command struct {
+	// Name is the name of the binary or subcommand
+	Name string
+	// Flags are the flags accepted by the command. May be nil
+	Flags *flag.FlagSet
+	// Subcommands are the subcommands of the command, if any
+	Subcommands []*Command
+}
+
+// NewCommand is a shorthand for creating a Command
+func NewCommand(name string, flags *flag.FlagSet, subcommands ...*Command) *Command {
+	return &Command{Name: name, Flags: flags, Subcommands: subcommands}
+}
+
+// Subcommand returns the completion subcommand itself, to be added to the root command
+func Subcommand() *Command {
+	subs := make([]*Command, 0, len(Shells))
+	for _, shell := range Shells {
+		subs = append(subs, NewCommand(shell, nil))
+	}
+	return NewCommand("completion", nil, subs...)
+}
+
+// Generate writes the completion script for the given shell, and the root command of a binary, to w
+func Generate(w io.Writer, shell string, root *Command) error {
+	switch shell {
+	case "bash":
+		return generateBash(w, root)
+	case "zsh":
+		// zsh can run bash completion functions through bashcompinit
+		if _, err := fmt.Fprintf(w, "#compdef %s\nautoload -U +X bashcompinit && bashcompinit\n", root.Name); err != nil {
+			return err
+		}
+		return generateBash(w, root)
+	case "fish":
+		return generateFish(w, root)
+	default:
+		return fmt.Errorf("unsupported shell %q, expected one of %v", shell, Shells)
+	}
+}
+
+// flagNames returns the flags of the command as "--name" words
+func (c *Command) flagNames() []string {
+	names := []string{}
+	if c.Flags != nil {
+		c.Flags.VisitAll(func(f *flag.Flag) {
+			names = append(names, "--"+f.Name)
+		})
+	}
+	return names
+}
+
+// walk calls fn for the command and all its subcommands, with the path of names leading to each command
+func (c *Command) walk(path []string, fn func(path []string, c *Command)) {
+	path = append(path[:len(path):len(path)], c.Name)
+	fn(path, c)
+	for _, sub := range c.Subcommands {
+		sub.walk(path, fn)
+	}
+}
+
+var nonIdentifier = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func generateBash(w io.Writer, root *Command) error {
+	funcName := "_" + nonIdentifier.ReplaceAllString(root.Name, "_") + "_completion"
+
+	// Map each subcommand path to the words that may follow it
+	transitions := []string{}
+	words := map[string][]string{}
+	root.walk(nil, func(path []string, c *Command) {
+		key := strings.Join(path, " ")
+		for _, sub := range c.Subcommands {
+			transitions = append(transitions, fmt.Sprintf("%q", key+" "+sub.Name))
+			words[key] = append(words[key], sub.Name)
+		}
+		words[key] = append(words[key], c.flagNames()...)
+	})
+	keys := make([]string, 0, len(words))
+	for key := range words {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# bash completion for %s\n", root.Name)
+	fmt.Fprintf(&sb, "%s() {\n", funcName)
+	sb.WriteString("    local cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	fmt.Fprintf(&sb, "    local path=%q i\n", root.Name)
+	sb.WriteString("    for ((i = 1; i < COMP_CWORD; i++)); do\n")
+	sb.WriteString("        case \"$path ${COMP_WORDS[i]}\" in\n")
+	if len(transitions) > 0 {
+		fmt.Fprintf(&sb, "            %s) path=\"$path ${COMP_WORDS[i]}\" ;;\n", strings.Join(transitions, "|"))
+	}
+	sb.WriteString("        esac\n")
+	sb.WriteString("    done\n")
+	sb.WriteString("    case \"$path\" in\n")
+	for _, key := range keys {
+		fmt.Fprintf(&sb, "        %q) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", key, strings.Join(words[key], " "))
+	}
+	sb.WriteString("    esac\n")
+	sb.WriteString("}\n")
+	fmt.Fprintf(&sb, "complete -o default -F %s %s\n", funcName, root.Name)
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func generateFish(w io.Writer, root *Command) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# fish completion for %s\n", root.Name)
+	root.walk(nil, func(path []string, c *Command) {
+		// The root command's words are completed until a subcommand has been given, the subcommands'
+		// words after it has been seen
+		condition := "__fish_use_subcommand"
+		if len(path) > 1 {
+			condition = "__fish_seen_subcommand_from " + c.Name
+		}
+		for _, sub := range c.Subcommands {
+			fmt.Fprintf(&sb, "complete -c %s -n %q -f -a %q\n", root.Name, condition, sub.Name)
+		}
+		if c.Flags != nil {
+			c.Flags.VisitAll(func(f *flag.Flag) {
+				fmt.Fprintf(&sb, "complete -c %s -n %q -l %s -d %s\n", root.Name, condition, f.Name, fishQuote(f.Usage))
+			})
+		}
+	})
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// fishQuote quotes s in single quotes, which fish doesn't expand anything within
+func fishQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
@@ -0,0 +1,244 @@
+// Package config gives all binaries in this repository the same precedence for their options:
+// command-line flags override environment variables, which override the config file, which overrides the defaults.
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ConfigFlagName is the name of the flag pointing to the config file
+const ConfigFlagName = "config"
+
+// Parse registers the --config flag in fs, and parses args. Options not given as flags are then read from
+// environment variables named <envPrefix>_<FLAG_NAME>, and after that from the config file, if any.
+// The config file path itself may also be given using the <envPrefix>_CONFIG environment variable.
+func Parse(fs *flag.FlagSet, envPrefix string, args []string) error {
+	RegisterFlag(fs, envPrefix)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	return Apply(fs, envPrefix)
+}
+
+// RegisterFlag registers the --config flag in fs, unless it's already registered
+func RegisterFlag(fs *flag.FlagSet, envPrefix string) {
+	if fs.Lookup(ConfigFlagName) == nil {
+		fs.String(ConfigFlagName, "", fmt.Sprintf("Path to a JSON config file with flag names as keys. Options may also be set using %s_* environment variables", envPrefix))
+	}
+}
+
+// Apply sets the flags in the already-parsed fs that weren't given on the command line, from environment
+// variables and then from the config file given by the --config flag. Flags registered under several names, like
+// -w and --deadline, are one option: if any of the names was given on the command line, the environment variables
+// and the config file don't apply to it, and an environment variable of any of the names overrides the config file.
+func Apply(fs *flag.FlagSet, envPrefix string) error {
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	setFlags = withAliases(fs, setFlags)
+
+	// The config file path is layered like any other option, but has to be resolved first
+	if !setFlags[ConfigFlagName] {
+		if path, ok := os.LookupEnv(EnvName(envPrefix, ConfigFlagName)); ok && fs.Lookup(ConfigFlagName) != nil {
+			if err := fs.Set(ConfigFlagName, path); err != nil {
+				return err
+			}
+		}
+	}
+	fileValues := map[string]string{}
+	if f := fs.Lookup(ConfigFlagName); f != nil && f.Value.String() != "" {
+		var err error
+		fileValues, err = readFile(fs, f.Value.String())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, group := range aliasGroups(fs) {
+		if setFlags[group[0].Name] || group[0].Name == ConfigFlagName {
+			continue
+		}
+		if err := applyGroup(fs, envPrefix, group, fileValues); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyGroup sets the option registered under the names of group from the environment, or else the config file
+func applyGroup(fs *flag.FlagSet, envPrefix string, group []*flag.Flag, fileValues map[string]string) error {
+	for _, f := range group {
+		envName := EnvName(envPrefix, f.Name)
+		if value, ok := os.LookupEnv(envName); ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				return fmt.Errorf("invalid value %q for environment variable %s: %v", value, envName, err)
+			}
+			return nil
+		}
+	}
+	for _, f := range group {
+		if value, ok := fileValues[f.Name]; ok {
+			if err := fs.Set(f.Name, value); err != nil {
+				return fmt.Errorf("invalid value %q for %q in the config file: %v", value, f.Name, err)
+			}
+			return nil
+		}
+	}
+	return nil
+}
+
+// aliasGroups returns the flags of fs grouped by the variable they set, so that the names of a flag registered
+// several times, e.g. as a shorthand, are in the same group. Flags are in the order of fs.VisitAll
+func aliasGroups(fs *flag.FlagSet) [][]*flag.Flag {
+	groups := [][]*flag.Flag{}
+	index := map[uintptr]int{}
+	fs.VisitAll(func(f *flag.Flag) {
+		v := reflect.ValueOf(f.Value)
+		if v.Kind() != reflect.Ptr || v.IsNil() || v.Type().Elem().Size() == 0 {
+			// Only flags that set the same variable through a pointer can be told apart as aliases, zero-size
+			// variables may share their address
+			groups = append(groups, []*flag.Flag{f})
+			return
+		}
+		if i, ok := index[v.Pointer()]; ok {
+			groups[i] = append(groups[i], f)
+			return
+		}
+		index[v.Pointer()] = len(groups)
+		groups = append(groups, []*flag.Flag{f})
+	})
+	return groups
+}
+
+// withAliases returns the set of flag names with all aliases of the names in it added
+func withAliases(fs *flag.FlagSet, names map[string]bool) map[string]bool {
+	all := map[string]bool{}
+	for _, group := range aliasGroups(fs) {
+		set := false
+		for _, f := range group {
+			set = set || names[f.Name]
+		}
+		for _, f := range group {
+			all[f.Name] = set
+		}
+	}
+	return all
+}
+
+// Reload returns the values the given flags of the already-parsed fs should have after reading the environment
+// variables and the config file again, for programs that reload their config while running. Flags given in
+// args, the command line, keep their value and are left out. Flags no longer set in the environment or the
+// config file get their default value. The caller applies the values with fs.Set.
+func Reload(fs *flag.FlagSet, envPrefix string, args []string, names []string) (map[string]string, error) {
+	cmdline, err := commandLineFlags(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	cmdline = withAliases(fs, cmdline)
+
+	path := ""
+	if f := fs.Lookup(ConfigFlagName); f != nil {
+		if cmdline[ConfigFlagName] {
+			path = f.Value.String()
+		} else {
+			path = os.Getenv(EnvName(envPrefix, ConfigFlagName))
+		}
+	}
+	fileValues := map[string]string{}
+	if path != "" {
+		fileValues, err = readFile(fs, path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	values := map[string]string{}
+	for _, name := range names {
+		f := fs.Lookup(name)
+		if f == nil {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		if cmdline[name] {
+			continue
+		}
+		if value, ok := os.LookupEnv(EnvName(envPrefix, name)); ok {
+			values[name] = value
+		} else if value, ok := fileValues[name]; ok {
+			values[name] = value
+		} else {
+			values[name] = f.DefValue
+		}
+	}
+	return values, nil
+}
+
+// commandLineFlags returns the names of the flags of fs given in args, without changing the flags of fs
+func commandLineFlags(fs *flag.FlagSet, args []string) (map[string]bool, error) {
+	scratch := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+	scratch.SetOutput(ioutil.Discard)
+	fs.VisitAll(func(f *flag.Flag) {
+		isBool := false
+		if bf, ok := f.Value.(interface{ IsBoolFlag() bool }); ok {
+			isBool = bf.IsBoolFlag()
+		}
+		scratch.Var(discardValue(isBool), f.Name, f.Usage)
+	})
+	if err := scratch.Parse(args); err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	scratch.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set, nil
+}
+
+// discardValue is a flag.Value which ignores what it's set to
+type discardValue bool
+
+func (v discardValue) String() string     { return "" }
+func (v discardValue) Set(_ string) error { return nil }
+func (v discardValue) IsBoolFlag() bool   { return bool(v) }
+
+// EnvName returns the environment variable name for a flag, e.g. PING_MAX_RTT for the flag max-rtt
+func EnvName(envPrefix, flagName string) string {
+	return envPrefix + "_" + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
+
+// readFile reads a JSON object mapping flag names to strings, numbers or booleans
+func readFile(fs *flag.FlagSet, path string) (map[string]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	obj := map[string]interface{}{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, fmt.Errorf("couldn't parse config file %s: %v", path, err)
+	}
+
+	values := make(map[string]string, len(obj))
+	for key, value := range obj {
+		if fs.Lookup(key) == nil {
+			return nil, fmt.Errorf("unknown option %q in config file %s", key, path)
+		}
+		switch v := value.(type) {
+		case string:
+			values[key] = v
+		case float64:
+			values[key] = strconv.FormatFloat(v, 'f', -1, 64)
+		case bool:
+			values[key] = strconv.FormatBool(v)
+		default:
+			return nil, fmt.Errorf("option %q in config file %s must be a string, number or boolean", key, path)
+		}
+	}
+	return values, nil
+}
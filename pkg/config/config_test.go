@@ -0,0 +1,73 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newAliasedFlags returns a flag set with --deadline and its shorthand -w, like ping has
+func newAliasedFlags() (*flag.FlagSet, *time.Duration) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	deadline := fs.Duration("deadline", 0, "")
+	fs.DurationVar(deadline, "w", 0, "Shorthand for --deadline")
+	return fs, deadline
+}
+
+func TestParseAliases(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		want time.Duration
+	}{
+		{"shorthand over env of long name", []string{"-w", "1s"}, map[string]string{"TEST_DEADLINE": "4s"}, "", time.Second},
+		{"long name over env of shorthand", []string{"--deadline", "1s"}, map[string]string{"TEST_W": "4s"}, "", time.Second},
+		{"shorthand over file of long name", []string{"-w", "1s"}, nil, `{"deadline": "4s"}`, time.Second},
+		{"env of shorthand over file of long name", nil, map[string]string{"TEST_W": "2s"}, `{"deadline": "4s"}`, 2 * time.Second},
+		{"env of long name over file of shorthand", nil, map[string]string{"TEST_DEADLINE": "2s"}, `{"w": "4s"}`, 2 * time.Second},
+		{"file of shorthand", nil, nil, `{"w": "4s"}`, 4 * time.Second},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := tt.args
+			if tt.file != "" {
+				if err := ioutil.WriteFile(file, []byte(tt.file), 0600); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"--config", file}, args...)
+			}
+			fs, deadline := newAliasedFlags()
+			if err := Parse(fs, "TEST", args); err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if *deadline != tt.want {
+				t.Fatalf("deadline = %s, want %s", *deadline, tt.want)
+			}
+		})
+	}
+}
+
+func TestReloadAliases(t *testing.T) {
+	t.Setenv("TEST_DEADLINE", "4s")
+	fs, _ := newAliasedFlags()
+	args := []string{"-w", "1s"}
+	if err := Parse(fs, "TEST", args); err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	values, err := Reload(fs, "TEST", args, []string{"deadline", "w"})
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if len(values) != 0 {
+		t.Fatalf("Reload = %v, want no values, as -w was given on the command line", values)
+	}
+}
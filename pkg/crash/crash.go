@@ -0,0 +1,78 @@
+// Package crash recovers panics in long-running goroutines, and logs crash reports of them. It's shared by all
+// the binaries in this repository, so that a bug in e.g. one connection handler doesn't take the others down with
+// it, and so that the crashes which do end a process are logged like its other messages.
+package crash
+
+import (
+	"fmt"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
+)
+
+// Handler logs crash reports of the panics it recovers. It's safe for concurrent use
+type Handler struct {
+	logger *logging.Logger
+	// count is shared between a Handler and all handlers derived from it using With()
+	count *int64
+}
+
+// NewHandler creates a Handler logging its crash reports to logger at ErrorLevel
+func NewHandler(logger *logging.Logger) *Handler {
+	return &Handler{logger: logger, count: new(int64)}
+}
+
+// With returns a Handler which attaches the given key-value pair to its crash reports, e.g. the address of the
+// client a connection handler serves
+func (h *Handler) With(key string, value interface{}) *Handler {
+	return &Handler{logger: h.logger.With(key, value), count: h.count}
+}
+
+// Count returns how many panics the Handler, and the handlers derived from it, have recovered
+func (h *Handler) Count() int64 {
+	return atomic.LoadInt64(h.count)
+}
+
+// Recover recovers a panic of the goroutine, and logs a crash report of it. It must be deferred directly, e.g.
+// defer h.Recover("connection handler"). The goroutine then returns normally, so the process keeps running. That's
+// only safe if the goroutine doesn't leave shared state half-updated when it panics: locks it holds, and other
+// cleanup, have to be released in deferred calls too
+func (h *Handler) Recover(goroutine string) {
+	if r := recover(); r != nil {
+		h.report(goroutine, r)
+	}
+}
+
+// RecoverError is like Recover, but for a function with a named error result, which it sets to an error describing
+// the panic. The caller then handles the panic like any other error
+func (h *Handler) RecoverError(goroutine string, err *error) {
+	if r := recover(); r != nil {
+		h.report(goroutine, r)
+		*err = fmt.Errorf("%s panicked: %v", goroutine, r)
+	}
+}
+
+// Fatal is like Recover, but exits the process with exit code 2 after logging the crash report, like an unrecovered
+// panic does. It's for goroutines the process can't work without
+func (h *Handler) Fatal(goroutine string) {
+	if r := recover(); r != nil {
+		h.report(goroutine, r)
+		os.Exit(2)
+	}
+}
+
+// report logs the crash report of a panic, with the stack of the goroutine which panicked. The version is included
+// so that the stack can be matched with the source it came from
+func (h *Handler) report(goroutine string, r interface{}) {
+	atomic.AddInt64(h.count, 1)
+	h.logger.
+		With("goroutine", goroutine).
+		With("panic", fmt.Sprint(r)).
+		With("version", version.Get().Version).
+		With("stack", strings.TrimSuffix(string(debug.Stack()), "\n")).
+		Errorf("Recovered a panic in the %s", goroutine)
+}
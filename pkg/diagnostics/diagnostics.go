@@ -0,0 +1,67 @@
+// Package diagnostics serves pprof profiles, goroutine dumps and expvar counters over HTTP, for diagnosing e.g. CPU
+// spins and leaking goroutines in the binaries of this repository while they run. It's opt-in with --debug-addr, as
+// the endpoints expose the internals of the process and profiling slows it down.
+package diagnostics
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	runtimepprof "runtime/pprof"
+
+	"github.com/luxas/random-schoolwork/pkg/logging"
+)
+
+// index lists the endpoints on /debug/
+const index = `/debug/pprof/      pprof profiles, e.g. go tool pprof http://<addr>/debug/pprof/profile
+/debug/goroutines  the stacks of all goroutines
+/debug/vars        expvar counters, as JSON
+`
+
+// RegisterFlag registers the --debug-addr flag in the flag set
+func RegisterFlag(fs *flag.FlagSet) *string {
+	return fs.String("debug-addr", "", "If set, serve pprof profiles, goroutine dumps and expvar counters on /debug/ at this address, e.g. localhost:6060")
+}
+
+// Handler returns the handler of the diagnostics endpoints, all under /debug/
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, index)
+	})
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/goroutines", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		// debug=2 writes the stacks in the format of an unrecovered panic
+		_ = runtimepprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// Serve serves the diagnostics endpoints at addr in the background. It only returns an error if it can't listen
+// on addr, later errors are logged
+func Serve(addr string, logger *logging.Logger) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("couldn't serve the diagnostics endpoints: %v", err)
+	}
+	logger.Infof("Serving diagnostics on http://%s/debug/", ln.Addr())
+	go func() {
+		if err := http.Serve(ln, Handler()); err != nil {
+			logger.Errorf("Diagnostics server stopped: %v", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,7 @@
+module github.com/luxas/random-schoolwork/pkg
+
+go 1.18
+
+require golang.org/x/crypto v0.0.0-20200320181102-891825fb96df
+
+require golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
@@ -1,6 +1,8 @@
-package main
+// Package hashing hashes possibly prefixed data with a choice of algorithms
+package hashing
 
 import (
+	"crypto/hmac"
 	"crypto/md5"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -43,7 +45,7 @@ var hashers = map[HashAlgorithm]CreateHashFunc{
 	SHA3_512: sha3.New512,
 }
 
-// SupportedHashAlgorithms returns the supported hash algorithms for this program
+// SupportedHashAlgorithms returns the supported hash algorithms
 func SupportedHashAlgorithms() (algos []HashAlgorithm) {
 	for algo := range hashers {
 		algos = append(algos, algo)
@@ -72,7 +74,7 @@ type Hasher interface {
 func NewHasher(algo HashAlgorithm) (Hasher, error) {
 	initFn, ok := hashers[algo]
 	if !ok {
-		return nil, fmt.Errorf("hash type does not exist: %d", algo)
+		return nil, fmt.Errorf("hash type does not exist: %s", algo)
 	}
 
 	return &hasher{
@@ -111,3 +113,18 @@ func (h *hasher) Hash(suffix []byte) []byte {
 func (h *hasher) Size() uint8 {
 	return uint8(h.initFn().Size())
 }
+
+// NewHMAC returns a new Hasher computing the HMAC of the data with the given key, using the given algorithm.
+// The returned hash is HMAC(key, prefix + suffix), like e.g. "openssl dgst -hmac" computes it
+func NewHMAC(algo HashAlgorithm, key []byte) (Hasher, error) {
+	initFn, ok := hashers[algo]
+	if !ok {
+		return nil, fmt.Errorf("hash type does not exist: %s", algo)
+	}
+
+	return &hasher{
+		initFn: func() hash.Hash { return hmac.New(initFn, key) },
+		algo:   algo,
+		prefix: nil,
+	}, nil
+}
@@ -0,0 +1,273 @@
+// Package logging provides leveled, optionally JSON-formatted logs with component fields. It's shared by all
+// the binaries in this repository, so that they log in a consistent way.
+package logging
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message
+type Level int
+
+const (
+	// DebugLevel is for verbose information only useful when debugging
+	DebugLevel Level = iota
+	// InfoLevel is for normal operational messages
+	InfoLevel
+	// WarnLevel is for errors the program recovers from
+	WarnLevel
+	// ErrorLevel is for errors the user should act upon
+	ErrorLevel
+)
+
+var levelNames = map[Level]string{
+	DebugLevel: "debug",
+	InfoLevel:  "info",
+	WarnLevel:  "warn",
+	ErrorLevel: "error",
+}
+
+// String returns the lowercase name of the level
+func (l Level) String() string {
+	if name, ok := levelNames[l]; ok {
+		return name
+	}
+	return fmt.Sprintf("level(%d)", l)
+}
+
+// ParseLevel parses a level name, as returned by Level.String()
+func ParseLevel(s string) (Level, error) {
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, expected one of debug, info, warn or error", s)
+}
+
+// Format is the output format of the log messages
+type Format string
+
+const (
+	// TextFormat writes human-readable lines, e.g. "2020/03/20 12:00:00 INFO server: message key=value"
+	TextFormat Format = "text"
+	// JSONFormat writes one JSON object per line
+	JSONFormat Format = "json"
+)
+
+// ParseFormat parses a format name
+func ParseFormat(s string) (Format, error) {
+	switch f := Format(strings.ToLower(s)); f {
+	case TextFormat, JSONFormat:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown log format %q, expected text or json", s)
+	}
+}
+
+// field is a key-value pair attached to every message of a Logger
+type field struct {
+	key   string
+	value interface{}
+}
+
+// output is shared between a Logger and all loggers derived from it using With()
+type output struct {
+	w      io.Writer
+	level  Level
+	format Format
+	mux    *sync.Mutex
+}
+
+// New creates a Logger writing to w, logging messages at InfoLevel and above as text. All messages are
+// tagged with the given component, e.g. the name of the binary
+func New(w io.Writer, component string) *Logger {
+	return &Logger{
+		out: &output{
+			w:      w,
+			level:  InfoLevel,
+			format: TextFormat,
+			mux:    &sync.Mutex{},
+		},
+		component: component,
+	}
+}
+
+// Logger writes leveled log messages. It's safe for concurrent use
+type Logger struct {
+	out       *output
+	component string
+	fields    []field
+}
+
+// With returns a Logger which attaches the given key-value pair to all messages. The returned Logger
+// shares the writer, level and format with its parent
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	return &Logger{
+		out:       l.out,
+		component: l.component,
+		fields:    append(fields, field{key, value}),
+	}
+}
+
+// SetLevel sets the minimum level of messages that are written
+func (l *Logger) SetLevel(level Level) {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	l.out.level = level
+}
+
+// SetFormat sets the output format
+func (l *Logger) SetFormat(format Format) {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	l.out.format = format
+}
+
+// Enabled returns whether messages of the given level are written
+func (l *Logger) Enabled(level Level) bool {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+	return level >= l.out.level
+}
+
+// RegisterFlags registers the --log-level and --log-format flags in the flag set
+func (l *Logger) RegisterFlags(fs *flag.FlagSet) {
+	fs.Var(&levelFlag{l}, "log-level", "The minimum level of log messages to show: debug, info, warn or error")
+	fs.Var(&formatFlag{l}, "log-format", "The format of log messages: text or json")
+}
+
+// Debugf logs a message at DebugLevel
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.logf(DebugLevel, format, args...)
+}
+
+// Infof logs a message at InfoLevel
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.logf(InfoLevel, format, args...)
+}
+
+// Warnf logs a message at WarnLevel
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.logf(WarnLevel, format, args...)
+}
+
+// Errorf logs a message at ErrorLevel
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.logf(ErrorLevel, format, args...)
+}
+
+// Fatalf logs a message at ErrorLevel, and exits the program with exit code 1
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.logf(ErrorLevel, format, args...)
+	os.Exit(1)
+}
+
+func (l *Logger) logf(level Level, format string, args ...interface{}) {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+
+	now := time.Now()
+	msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+	var line []byte
+	if l.out.format == JSONFormat {
+		line = l.jsonLine(now, level, msg)
+	} else {
+		line = l.textLine(now, level, msg)
+	}
+	_, _ = l.out.w.Write(line)
+}
+
+func (l *Logger) textLine(now time.Time, level Level, msg string) []byte {
+	var sb strings.Builder
+	sb.WriteString(now.Format("2006/01/02 15:04:05 "))
+	fmt.Fprintf(&sb, "%-5s ", strings.ToUpper(level.String()))
+	if l.component != "" {
+		sb.WriteString(l.component + ": ")
+	}
+	sb.WriteString(msg)
+	for _, f := range l.fields {
+		fmt.Fprintf(&sb, " %s=%v", f.key, f.value)
+	}
+	sb.WriteString("\n")
+	return []byte(sb.String())
+}
+
+func (l *Logger) jsonLine(now time.Time, level Level, msg string) []byte {
+	obj := map[string]interface{}{
+		"time":  now.Format(time.RFC3339Nano),
+		"level": level.String(),
+		"msg":   msg,
+	}
+	if l.component != "" {
+		obj["component"] = l.component
+	}
+	for _, f := range l.fields {
+		// errors don't marshal to anything meaningful by default
+		if err, ok := f.value.(error); ok {
+			obj[f.key] = err.Error()
+		} else {
+			obj[f.key] = f.value
+		}
+	}
+	b, err := json.Marshal(obj)
+	if err != nil {
+		b, _ = json.Marshal(map[string]string{"level": "error", "msg": fmt.Sprintf("couldn't marshal log message: %v", err)})
+	}
+	return append(b, '\n')
+}
+
+// levelFlag implements flag.Value for setting the level of a Logger
+type levelFlag struct {
+	l *Logger
+}
+
+func (f *levelFlag) String() string {
+	if f.l == nil {
+		return InfoLevel.String()
+	}
+	return f.l.out.level.String()
+}
+
+func (f *levelFlag) Set(s string) error {
+	level, err := ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	f.l.SetLevel(level)
+	return nil
+}
+
+// formatFlag implements flag.Value for setting the format of a Logger
+type formatFlag struct {
+	l *Logger
+}
+
+func (f *formatFlag) String() string {
+	if f.l == nil {
+		return string(TextFormat)
+	}
+	return string(f.l.out.format)
+}
+
+func (f *formatFlag) Set(s string) error {
+	format, err := ParseFormat(s)
+	if err != nil {
+		return err
+	}
+	f.l.SetFormat(format)
+	return nil
+}
@@ -0,0 +1,185 @@
+// Package rtt collects round-trip times, and summarizes them with the statistics ping prints. It's shared by
+// ping and the socket-chat client, which measures the RTT of its heartbeats.
+package rtt
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Stats records the outcome of every probe. It's not safe for concurrent use
+type Stats struct {
+	startTime time.Time
+	packets   []packetStat
+	// jitter is the RFC 3550 interarrival jitter in nanoseconds, updated with every received probe
+	jitter float64
+	// lastRTT is the RTT of the previous received probe, if there's one, for the jitter
+	lastRTT *time.Duration
+}
+
+type packetStat struct {
+	successful bool
+	rtt        *time.Duration
+}
+
+// Summary is what Stats.Calculate returns. The RTT statistics only cover the received probes
+type Summary struct {
+	NumPackets    uint64
+	NumReceived   uint64
+	TotalDuration time.Duration
+	MinRTT        time.Duration
+	AvgRTT        time.Duration
+	MaxRTT        time.Duration
+	SdevRTT       time.Duration
+	// Jitter is the mean deviation of the differences between consecutive RTTs, as in RFC 3550
+	Jitter time.Duration
+	// P50RTT, P90RTT, P95RTT and P99RTT are the exact percentiles of the RTTs, by the nearest-rank method
+	P50RTT time.Duration
+	P90RTT time.Duration
+	P95RTT time.Duration
+	P99RTT time.Duration
+}
+
+// Start sets the start of the measurement, for the total duration
+func (s *Stats) Start() {
+	s.startTime = time.Now()
+}
+
+// Calculate summarizes the probes recorded so far
+func (s *Stats) Calculate() *Summary {
+	ps := &Summary{}
+
+	if len(s.packets) == 0 {
+		return ps
+	}
+
+	ps.TotalDuration = time.Since(s.startTime)
+	ps.Jitter = s.Jitter()
+
+	rttsum := int64(0)
+	rtts := []time.Duration{}
+	for _, p := range s.packets {
+		ps.NumPackets++
+		if !p.successful || p.rtt == nil {
+			continue
+		}
+		ps.NumReceived++
+		rtts = append(rtts, *p.rtt)
+		rttsum += p.rtt.Nanoseconds()
+		if ps.NumReceived == 1 {
+			ps.MinRTT = *p.rtt
+			ps.MaxRTT = *p.rtt
+		} else {
+			ps.MinRTT = processDurations(math.Min, ps.MinRTT, *p.rtt)
+			ps.MaxRTT = processDurations(math.Max, ps.MaxRTT, *p.rtt)
+		}
+	}
+	if ps.NumReceived == 0 {
+		return ps
+	}
+	ps.AvgRTT = time.Duration(rttsum / int64(ps.NumReceived))
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	ps.P50RTT = percentile(rtts, 50)
+	ps.P90RTT = percentile(rtts, 90)
+	ps.P95RTT = percentile(rtts, 95)
+	ps.P99RTT = percentile(rtts, 99)
+
+	// The sample standard deviation needs at least two RTTs
+	if ps.NumReceived < 2 {
+		return ps
+	}
+	rttdiffsum := float64(0)
+	for _, p := range s.packets {
+		if p.rtt == nil {
+			continue
+		}
+		val := math.Pow(ms(*p.rtt)-ms(ps.AvgRTT), 2)
+		rttdiffsum += val
+	}
+	sd := int64(math.Sqrt(rttdiffsum/float64(ps.NumReceived-1)) * 1000000)
+	ps.SdevRTT = time.Duration(sd)
+
+	return ps
+}
+
+// Loss returns the percentage of the probes that were lost
+func (ps *Summary) Loss() float64 {
+	if ps.NumPackets == 0 {
+		return 0
+	}
+	return float64(ps.NumPackets-ps.NumReceived) / float64(ps.NumPackets) * 100
+}
+
+// Histogram counts the RTTs of the received probes by bucket
+type Histogram struct {
+	// Edges are the upper bounds of the buckets, in increasing order. A bucket includes its upper bound
+	Edges []time.Duration
+	// Counts has one more bucket than Edges, the last one for the RTTs above the last edge
+	Counts []uint64
+}
+
+// Histogram counts the RTTs of the probes recorded so far into buckets with the given upper bounds, which must be
+// in increasing order
+func (s *Stats) Histogram(edges []time.Duration) *Histogram {
+	h := &Histogram{Edges: edges, Counts: make([]uint64, len(edges)+1)}
+	for _, p := range s.packets {
+		if !p.successful || p.rtt == nil {
+			continue
+		}
+		h.Counts[sort.Search(len(edges), func(i int) bool { return *p.rtt <= edges[i] })]++
+	}
+	return h
+}
+
+// Total returns the number of RTTs in the histogram
+func (h *Histogram) Total() uint64 {
+	total := uint64(0)
+	for _, n := range h.Counts {
+		total += n
+	}
+	return total
+}
+
+// Jitter returns the RFC 3550 interarrival jitter of the probes received so far. The RTTs stand in for the transit
+// times, which would need synchronized clocks: J += (|D(i-1,i)| - J) / 16, where D is the difference of the RTTs
+func (s *Stats) Jitter() time.Duration {
+	return time.Duration(s.jitter)
+}
+
+// PacketReceived records a probe that was answered after rtt
+func (s *Stats) PacketReceived(rtt time.Duration) {
+	if s.lastRTT != nil {
+		d := math.Abs(float64(rtt - *s.lastRTT))
+		s.jitter += (d - s.jitter) / 16
+	}
+	s.lastRTT = &rtt
+	s.packets = append(s.packets, packetStat{
+		successful: true,
+		rtt:        &rtt,
+	})
+}
+
+// PacketLost records a probe that wasn't answered
+func (s *Stats) PacketLost() {
+	s.packets = append(s.packets, packetStat{
+		successful: false,
+	})
+}
+
+// percentile returns the smallest of the sorted RTTs that p percent of them are less than or equal to
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Nanoseconds()) / 1000000
+}
+
+func processDurations(fn func(float64, float64) float64, a, b time.Duration) time.Duration {
+	return time.Duration(fn(float64(a.Nanoseconds()), float64(b.Nanoseconds())))
+}
@@ -0,0 +1,79 @@
+// Package version provides the version, commit and build date of the binaries in this repository. They're set
+// at build time using ldflags (see the Makefiles), and fall back to what runtime/debug.ReadBuildInfo knows.
+package version
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// These are set at build time using e.g. -ldflags "-X github.com/luxas/random-schoolwork/pkg/version.gitVersion=v1.0.0"
+var (
+	gitVersion = ""
+	gitCommit  = ""
+	buildDate  = ""
+)
+
+// Info describes the build of a binary
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the build information of the running binary
+func Get() Info {
+	info := Info{
+		Version:   gitVersion,
+		Commit:    gitCommit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && bi.Main.Version != "(devel)" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = s.Value
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "v0.0.0-dev"
+	}
+	if info.Commit == "" {
+		info.Commit = "unknown"
+	}
+	if info.BuildDate == "" {
+		info.BuildDate = "unknown"
+	}
+	return info
+}
+
+// String returns the build information on one line, e.g. "v1.0.0 (commit 5a0cd2b, built 2020-03-20T12:00:00Z, go1.14)"
+func (i Info) String() string {
+	commit := i.Commit
+	if len(commit) > 7 {
+		commit = commit[:7]
+	}
+	return fmt.Sprintf("%s (commit %s, built %s, %s)", i.Version, commit, i.BuildDate, i.GoVersion)
+}
+
+// RegisterFlag registers the --version flag in fs. When it's true after parsing, call Print and exit
+func RegisterFlag(fs *flag.FlagSet) *bool {
+	return fs.Bool("version", false, "Print the version information and exit")
+}
+
+// Print prints the build information of the binary with the given name to stdout
+func Print(name string) {
+	fmt.Printf("%s %s\n", name, Get())
+}
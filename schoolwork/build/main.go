@@ -0,0 +1,265 @@
+// build cross-compiles the binaries of this repository into release archives, one per platform, and writes their
+// SHA256SUMS. The binaries are static, and the archives are reproducible: building the same commit again gives
+// the same bytes. Run it in the schoolwork directory with go run ./build
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/logging"
+)
+
+const versionPkg = "github.com/luxas/random-schoolwork/pkg/version"
+
+var (
+	outDir        = flag.String("o", "dist", "The directory to write the release archives to")
+	versionFlag   = flag.String("version", "", "The version to embed and name the archives after, git describe by default")
+	platformsFlag = flag.String("platforms", strings.Join(defaultPlatforms, ","), "Comma-separated GOOS/GOARCH pairs to build for")
+
+	logger = logging.New(os.Stderr, "build")
+)
+
+// defaultPlatforms are the platforms of a release
+var defaultPlatforms = []string{"linux/amd64", "linux/arm64", "darwin/amd64", "darwin/arm64", "windows/amd64", "windows/arm64"}
+
+// binary is a binary of the release, built from a package of a module in the repository
+type binary struct {
+	name string
+	// module is the directory of the module, relative to the root of the repository
+	module string
+	pkg    string
+}
+
+var binaries = []binary{
+	{"ping", "ping", "./cmd/ping"},
+	{"msg-auth", "msg-auth", "./cmd/msg-auth"},
+	{"chat-server", "socket-chat", "./cmd/server"},
+	{"chat-client", "socket-chat", "./cmd/client"},
+	{"chat-bot", "socket-chat", "./cmd/bot"},
+	{"chat-proxy", "socket-chat", "./cmd/proxy"},
+	{"schoolwork", "schoolwork", "."},
+}
+
+// release is what is embedded in the binaries of a release through the version package
+type release struct {
+	version string
+	commit  string
+	// date is the time of the commit, so that building it again gives the same binaries
+	date time.Time
+}
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+func run() error {
+	root, err := git("rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	rel, err := currentRelease()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		return err
+	}
+
+	archives := []string{}
+	for _, platform := range strings.Split(*platformsFlag, ",") {
+		parts := strings.Split(strings.TrimSpace(platform), "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid platform %q, expected GOOS/GOARCH", platform)
+		}
+		archive, err := buildPlatform(root, rel, parts[0], parts[1])
+		if err != nil {
+			return fmt.Errorf("%s: %v", platform, err)
+		}
+		logger.Infof("Wrote %s", archive)
+		archives = append(archives, archive)
+	}
+	return writeChecksums(archives)
+}
+
+// currentRelease returns the release of the checked out commit. SOURCE_DATE_EPOCH overrides the date, as usual
+// for reproducible builds
+func currentRelease() (*release, error) {
+	rel := &release{version: *versionFlag}
+	var err error
+	if rel.version == "" {
+		if rel.version, err = git("describe", "--tags", "--always", "--dirty"); err != nil {
+			return nil, err
+		}
+	}
+	if rel.commit, err = git("rev-parse", "HEAD"); err != nil {
+		return nil, err
+	}
+	epoch := os.Getenv("SOURCE_DATE_EPOCH")
+	if epoch == "" {
+		if epoch, err = git("show", "-s", "--format=%ct", "HEAD"); err != nil {
+			return nil, err
+		}
+	}
+	secs, err := strconv.ParseInt(epoch, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commit time %q: %v", epoch, err)
+	}
+	rel.date = time.Unix(secs, 0).UTC()
+	return rel, nil
+}
+
+// buildPlatform builds all binaries for the platform, and returns the path of the archive with them
+func buildPlatform(root string, rel *release, goos, goarch string) (string, error) {
+	tmpDir, err := ioutil.TempDir("", "schoolwork-build")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	ldflags := fmt.Sprintf("-s -w -X %s.gitVersion=%s -X %s.gitCommit=%s -X %s.buildDate=%s",
+		versionPkg, rel.version, versionPkg, rel.commit, versionPkg, rel.date.Format(time.RFC3339))
+	files := []string{}
+	for _, b := range binaries {
+		name := b.name
+		if goos == "windows" {
+			name += ".exe"
+		}
+		out := filepath.Join(tmpDir, name)
+		cmd := exec.Command("go", "build", "-trimpath", "-ldflags", ldflags, "-o", out, b.pkg)
+		cmd.Dir = filepath.Join(root, b.module)
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS="+goos, "GOARCH="+goarch)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("building %s failed: %v\n%s", b.name, err, output)
+		}
+		files = append(files, out)
+	}
+
+	base := fmt.Sprintf("schoolwork-%s-%s-%s", rel.version, goos, goarch)
+	if goos == "windows" {
+		archive := filepath.Join(*outDir, base+".zip")
+		return archive, writeZip(archive, base, files, rel.date)
+	}
+	archive := filepath.Join(*outDir, base+".tar.gz")
+	return archive, writeTarGz(archive, base, files, rel.date)
+}
+
+// writeTarGz writes the files into dir in a tar.gz archive. The headers only depend on the names, sizes and date
+func writeTarGz(archive, dir string, files []string, date time.Time) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range sortedFiles(files) {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    dir + "/" + filepath.Base(file),
+			Mode:    0755,
+			Size:    info.Size(),
+			ModTime: date,
+			Format:  tar.FormatPAX,
+		}); err != nil {
+			return err
+		}
+		if err := copyFile(tw, file); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeZip writes the files into dir in a zip archive. The headers only depend on the names and date
+func writeZip(archive, dir string, files []string, date time.Time) error {
+	f, err := os.Create(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	for _, file := range sortedFiles(files) {
+		h := &zip.FileHeader{Name: dir + "/" + filepath.Base(file), Method: zip.Deflate, Modified: date}
+		h.SetMode(0755)
+		w, err := zw.CreateHeader(h)
+		if err != nil {
+			return err
+		}
+		if err := copyFile(w, file); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// writeChecksums writes the SHA256SUMS of the archives, in the format of sha256sum
+func writeChecksums(archives []string) error {
+	b := &strings.Builder{}
+	for _, archive := range sortedFiles(archives) {
+		h := sha256.New()
+		if err := copyFile(h, archive); err != nil {
+			return err
+		}
+		fmt.Fprintf(b, "%x  %s\n", h.Sum(nil), filepath.Base(archive))
+	}
+	sums := filepath.Join(*outDir, "SHA256SUMS")
+	if err := ioutil.WriteFile(sums, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	logger.Infof("Wrote %s", sums)
+	return nil
+}
+
+func sortedFiles(files []string) []string {
+	sorted := append([]string{}, files...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+func copyFile(w io.Writer, file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// git runs git with the args, and returns its output without surrounding whitespace
+func git(args ...string) (string, error) {
+	out, err := exec.Command("git", args...).Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %v", strings.Join(args, " "), err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,23 @@
+module github.com/luxas/random-schoolwork/schoolwork
+
+go 1.18
+
+require (
+	github.com/luxas/random-schoolwork/msg-auth v0.0.0
+	github.com/luxas/random-schoolwork/ping v0.0.0
+	github.com/luxas/random-schoolwork/pkg v0.0.0
+	github.com/luxas/random-schoolwork/socket-chat v0.0.0
+)
+
+require (
+	golang.org/x/crypto v0.14.0 // indirect
+	golang.org/x/net v0.17.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+)
+
+replace (
+	github.com/luxas/random-schoolwork/msg-auth => ../msg-auth
+	github.com/luxas/random-schoolwork/ping => ../ping
+	github.com/luxas/random-schoolwork/pkg => ../pkg
+	github.com/luxas/random-schoolwork/socket-chat => ../socket-chat
+)
@@ -0,0 +1,100 @@
+// schoolwork is all the programs of this repository in one binary, as subcommands. The programs stay buildable
+// as standalone binaries as well
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	msgauth "github.com/luxas/random-schoolwork/msg-auth"
+	"github.com/luxas/random-schoolwork/ping"
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
+	"github.com/luxas/random-schoolwork/socket-chat/bot"
+	"github.com/luxas/random-schoolwork/socket-chat/client"
+	"github.com/luxas/random-schoolwork/socket-chat/proxy"
+	"github.com/luxas/random-schoolwork/socket-chat/server"
+)
+
+var logger = logging.New(os.Stderr, "schoolwork")
+
+type subcommand struct {
+	fn          func(args []string)
+	usage       string
+	description string
+}
+
+const completionUsage = "completion bash|zsh|fish"
+
+// subcommandNames are the subcommands in the order of the usage
+var subcommandNames = []string{"ping", "chat-server", "chat-client", "chat-bot", "chat-proxy", "msg-auth", "certs", "version", "completion"}
+
+// subcommands map the subcommand name to the program it runs, which parses its own flags
+var subcommands = map[string]subcommand{
+	"ping":        {ping.Main, "ping [flags] host", "Send ICMP echo requests to a host"},
+	"chat-server": {server.Main, "chat-server serve|certs|admin|version|completion [flags]", "Run or administer the chat server"},
+	"chat-client": {client.Main, "chat-client [flags]", "Connect to the chat server"},
+	"chat-bot":    {bot.Main, "chat-bot [flags]", "Keep transcripts of chat groups"},
+	"chat-proxy":  {proxy.Main, "chat-proxy [flags]", "Print and record the frames between chat clients and the server"},
+	"msg-auth":    {msgauth.Main, "msg-auth [flags]", "Create and verify authenticated messages"},
+	"certs":       {certsCmd, "certs create-ca|create-server|create-client [flags]", "Create the CA of the chat server, and certificates issued by it"},
+	"version":     {versionCmd, "version", "Print the version information"},
+	"completion":  {completionCmd, completionUsage, "Print the shell completion script"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		logger.Fatalf("no subcommand given")
+	}
+	if os.Args[1] == "--version" {
+		versionCmd(nil)
+		return
+	}
+	cmd, ok := subcommands[os.Args[1]]
+	if !ok {
+		usage()
+		logger.Fatalf("unknown subcommand %q", os.Args[1])
+	}
+	cmd.fn(os.Args[2:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, name := range subcommandNames {
+		cmd := subcommands[name]
+		fmt.Fprintf(os.Stderr, "\tschoolwork %s -- %s\n", cmd.usage, cmd.description)
+	}
+}
+
+// certsCmd is a shorthand for "chat-server certs"
+func certsCmd(args []string) {
+	server.Main(append([]string{"certs"}, args...))
+}
+
+func versionCmd(_ []string) {
+	version.Print("schoolwork")
+}
+
+// completionCmd prints the completion script of the subcommands. The programs complete their own flags with their
+// own completion subcommands
+func completionCmd(args []string) {
+	if len(args) < 1 {
+		logger.Fatalf("usage: schoolwork %s", completionUsage)
+	}
+	rootFlags := flag.NewFlagSet("schoolwork", flag.ExitOnError)
+	version.RegisterFlag(rootFlags)
+
+	subs := []*completion.Command{}
+	for _, name := range subcommandNames {
+		if name != "completion" {
+			subs = append(subs, completion.NewCommand(name, nil))
+		}
+	}
+	subs = append(subs, completion.Subcommand())
+	if err := completion.Generate(os.Stdout, args[0], completion.NewCommand("schoolwork", rootFlags, subs...)); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
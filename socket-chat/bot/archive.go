@@ -0,0 +1,144 @@
+package bot
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// rotatedSuffix is the layout of the time suffix of rotated log files, which sorts them from oldest to newest
+const rotatedSuffix = "20060102T150405.000000000Z"
+
+// entry is a line of a transcript, one JSON object per message
+type entry struct {
+	Time   time.Time `json:"time"`
+	Group  string    `json:"group"`
+	Sender string    `json:"sender"`
+	// Text is set for messages, with the #<id> prefix they were delivered with
+	Text string `json:"text,omitempty"`
+	// DataType and Data are set for data messages, with the payload hex-encoded
+	DataType *int   `json:"data_type,omitempty"`
+	Data     string `json:"data,omitempty"`
+}
+
+// newEntry returns the transcript entry of a message or data message to a group
+func newEntry(msg *socketchat.Message, t time.Time) (*entry, error) {
+	e := &entry{Time: t.UTC(), Group: msg.Receiver, Sender: msg.Sender}
+	if msg.Command != socketchat.CommandData {
+		e.Text = msg.Text()
+		return e, nil
+	}
+	dataType, payload, err := msg.DataPayload()
+	if err != nil {
+		return nil, err
+	}
+	typ := int(dataType)
+	e.DataType, e.Data = &typ, hex.EncodeToString(payload)
+	return e, nil
+}
+
+// rotatingFile is a transcript file that's rotated when it would grow past maxSize. The rotated files get the time
+// of the rotation as suffix, and only the newest maxFiles of them are kept, or all of them if maxFiles is 0
+type rotatingFile struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// open opens the file for appending, so that a restarted bot continues the same transcript
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+// writeEntry writes the entry as a line of JSON. An entry is never split between two files
+func (r *rotatingFile) writeEntry(e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+	if r.size != 0 && r.size+int64(len(b)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := r.f.Write(b)
+	r.size += int64(n)
+	return err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	rotated := r.path + "." + time.Now().UTC().Format(rotatedSuffix)
+	if err := os.Rename(r.path, rotated); err != nil {
+		return err
+	}
+	logger.Infof("Rotated %s to %s", r.path, rotated)
+	if err := r.prune(); err != nil {
+		logger.Warnf("Failed to remove old transcripts of %s: %v", r.path, err)
+	}
+	return r.open()
+}
+
+// prune removes the oldest rotated files, so that maxFiles of them are left
+func (r *rotatingFile) prune() error {
+	if r.maxFiles == 0 {
+		return nil
+	}
+	infos, err := ioutil.ReadDir(filepath.Dir(r.path))
+	if err != nil {
+		return err
+	}
+	prefix := filepath.Base(r.path) + "."
+	rotated := []string{}
+	for _, info := range infos {
+		// The suffix is checked too, as the transcript of another group may have the same prefix
+		if !strings.HasPrefix(info.Name(), prefix) {
+			continue
+		}
+		if _, err := time.Parse(rotatedSuffix, strings.TrimPrefix(info.Name(), prefix)); err == nil {
+			rotated = append(rotated, filepath.Join(filepath.Dir(r.path), info.Name()))
+		}
+	}
+	sort.Strings(rotated)
+	for len(rotated) > r.maxFiles {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
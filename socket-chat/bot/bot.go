@@ -0,0 +1,221 @@
+// Package bot is a transcript bot, which joins groups like any other client and writes their messages to rotating
+// log files, for keeping a record of groups without the server storing anything
+package bot
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+var logger = logging.New(os.Stderr, "bot")
+
+// flags are the flags of the bot, separate from the ones of the other programs in the schoolwork binary
+var flags = flag.NewFlagSet("bot", flag.ExitOnError)
+
+var nameFlag = flags.String("name", "transcript-bot", "The name the bot joins the server with")
+var secure = flags.Bool("secure", true, "Whether to enable TLSv1.3 or not")
+var serverAddress = flags.String("server", socketchat.DefaultServerAddress, "What server address and port to connect to")
+var certFile = flags.String("cert", "", "Client certificate to present to the server, e.g. client-<name>.crt")
+var keyFile = flags.String("key", "", "Private key for the client certificate, e.g. client-<name>.key")
+var serverIdentity = flags.String("server-identity", "", fmt.Sprintf("If set, require the server certificate to carry this URI identity, e.g. %s", socketchat.ServerIdentity))
+var groupsFlag = flags.String("groups", "", "Comma-separated list of the groups to join and keep transcripts of")
+var logDir = flags.String("log-dir", "transcripts", "The directory to write the transcripts to, one <group>.log file per group")
+var maxLogSize = flags.Int64("max-log-size", 10<<20, "How many bytes a transcript may grow to before it's rotated")
+var maxLogFiles = flags.Int("max-log-files", 10, "How many rotated transcripts to keep per group, 0 to keep all")
+var versionFlag = version.RegisterFlag(flags)
+
+// Main runs the bot with the command line arguments, without the program name
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+func run(args []string) error {
+	logger.RegisterFlags(flags)
+	if err := config.Parse(flags, "SOCKET_CHAT_BOT", args); err != nil {
+		return err
+	}
+	if *versionFlag {
+		version.Print("bot")
+		return nil
+	}
+	if flags.Arg(0) == "completion" {
+		cmd := completion.NewCommand("bot", flags, completion.Subcommand())
+		return completion.Generate(os.Stdout, flags.Arg(1), cmd)
+	}
+	if *nameFlag == "" {
+		return fmt.Errorf("name is empty!")
+	}
+	groups, err := parseGroups(*groupsFlag)
+	if err != nil {
+		return err
+	}
+	if *maxLogSize <= 0 {
+		return fmt.Errorf("--max-log-size must be positive")
+	}
+	if *maxLogFiles < 0 {
+		return fmt.Errorf("--max-log-files must not be negative")
+	}
+
+	if err := os.MkdirAll(*logDir, 0700); err != nil {
+		return err
+	}
+	transcripts := map[string]*rotatingFile{}
+	defer func() {
+		for _, f := range transcripts {
+			if err := f.Close(); err != nil {
+				logger.Errorf("Failed to close %s: %v", f.path, err)
+			}
+		}
+	}()
+	for _, group := range groups {
+		f, err := openRotatingFile(filepath.Join(*logDir, group+".log"), *maxLogSize, *maxLogFiles)
+		if err != nil {
+			return err
+		}
+		transcripts[group] = f
+	}
+
+	var tlsConfig *tls.Config
+	if *secure {
+		tlsConfig, err = socketchat.ClientTLSConfig("ca.crt", *certFile, *keyFile, *serverIdentity)
+		if err != nil {
+			return err
+		}
+	}
+	logger.Infof("Launching bot with name %q...", *nameFlag)
+	conn, err := socketchat.Dial(socketchat.DefaultServerProtocol, *serverAddress, tlsConfig, *nameFlag, version.Get().String())
+	if err != nil {
+		return err
+	}
+
+	// The bot is stopped by a signal, which closes the connection
+	stopped := make(chan struct{})
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	go func() {
+		<-c
+		close(stopped)
+		conn.Close()
+	}()
+
+	for _, group := range groups {
+		err := conn.Send(&socketchat.Message{
+			Command: socketchat.CommandJoinChat,
+			Sender:  *nameFlag,
+			Data:    []byte(group),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to join group %s: %v", group, err)
+		}
+	}
+
+	err = receive(conn, transcripts)
+	select {
+	case <-stopped:
+		logger.Infof("Bot shutting down...")
+		return nil
+	default:
+		return err
+	}
+}
+
+// parseGroups returns the groups of --groups. The names become file names, so they can't contain path separators
+func parseGroups(list string) ([]string, error) {
+	groups := []string{}
+	for _, group := range strings.Split(list, ",") {
+		group = strings.TrimSpace(group)
+		if group == "" {
+			continue
+		}
+		if strings.ContainsAny(group, `/\`) || group == "." || group == ".." {
+			return nil, fmt.Errorf("invalid group %q, can't be used as a file name", group)
+		}
+		groups = append(groups, group)
+	}
+	if len(groups) == 0 {
+		return nil, fmt.Errorf("--groups is empty, there's nothing to keep transcripts of")
+	}
+	return groups, nil
+}
+
+// receive writes the messages to the groups to their transcripts, until the connection is closed
+func receive(conn *socketchat.Connection, transcripts map[string]*rotatingFile) error {
+	for {
+		msg, err := conn.Receive()
+		if err == socketchat.UnknownCommandError {
+			logger.Warnf("Ignoring a message with unknown command %d from %s", msg.Command, msg.Sender)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("lost the connection to the server: %v", err)
+		}
+
+		switch msg.Command {
+		case socketchat.CommandVersion:
+			logger.Infof("Server is running version %s", msg.Text())
+		case socketchat.CommandChallenge:
+			if err := solveChallenge(conn, msg); err != nil {
+				return fmt.Errorf("failed to solve the registration challenge: %v", err)
+			}
+		case socketchat.CommandError:
+			e := msg.ErrorPayload()
+			switch e.Code {
+			case socketchat.ErrorCodeNameInvalid, socketchat.ErrorCodeNameReserved, socketchat.ErrorCodeUnauthorized:
+				return fmt.Errorf("the server rejected the bot: %s", e.Message)
+			default:
+				logger.Errorf("Error (%s): %s", e.Code, e.Message)
+			}
+		case socketchat.CommandMessage, socketchat.CommandData:
+			f, ok := transcripts[msg.Receiver]
+			if !ok {
+				logger.Debugf("Ignoring a message to %s from %s", msg.Receiver, msg.Sender)
+				continue
+			}
+			e, err := newEntry(msg, time.Now())
+			if err != nil {
+				logger.Warnf("Invalid data message from %s: %v", msg.Sender, err)
+				continue
+			}
+			if err := f.writeEntry(e); err != nil {
+				// A transcript with gaps isn't a record to rely on
+				return fmt.Errorf("failed to write the transcript of %s: %v", msg.Receiver, err)
+			}
+		default:
+			logger.Debugf("Ignoring a message with command %d from %s", msg.Command, msg.Sender)
+		}
+	}
+}
+
+// solveChallenge solves the registration challenge of the server, and sends the solution
+func solveChallenge(conn *socketchat.Connection, msg *socketchat.Message) error {
+	difficulty, challenge, err := msg.ChallengePayload()
+	if err != nil {
+		return err
+	}
+	logger.Infof("The server requires a proof of work to register, solving a challenge of %d bits...", difficulty)
+	nonce, err := socketchat.SolveChallenge(challenge, difficulty)
+	if err != nil {
+		return err
+	}
+	return conn.Send(&socketchat.Message{
+		Command: socketchat.CommandChallenge,
+		Sender:  *nameFlag,
+		Data:    []byte(strconv.FormatUint(nonce, 10)),
+	})
+}
@@ -0,0 +1,92 @@
+package socketchat
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strconv"
+
+	"github.com/luxas/random-schoolwork/pkg/hashing"
+)
+
+// ChallengeHashAlgorithm is the hash the proof of work of registration challenges is computed with
+const ChallengeHashAlgorithm = hashing.SHA2_256
+
+// MaxChallengeBits is the highest difficulty of a registration challenge, which already takes minutes to solve
+const MaxChallengeBits = 32
+
+// NewChallenge creates a hashcash-style registration challenge with the given difficulty. The data of the
+// CommandChallenge message is "<bits> <challenge>", where the challenge is random hex
+func NewChallenge(sender string, difficulty int) (*Message, string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, "", err
+	}
+	challenge := hex.EncodeToString(b)
+	return &Message{
+		Command: CommandChallenge,
+		Sender:  sender,
+		Data:    []byte(fmt.Sprintf("%d %s", difficulty, challenge)),
+	}, challenge, nil
+}
+
+// ChallengePayload returns the difficulty and the challenge a CommandChallenge message from the server carries
+func (m *Message) ChallengePayload() (int, string, error) {
+	var difficulty int
+	var challenge string
+	if _, err := fmt.Sscanf(m.Text(), "%d %s", &difficulty, &challenge); err != nil {
+		return 0, "", fmt.Errorf("invalid challenge %q: %v", m.Text(), err)
+	}
+	if difficulty < 0 || difficulty > MaxChallengeBits {
+		return 0, "", fmt.Errorf("invalid challenge difficulty %d, expected 0-%d", difficulty, MaxChallengeBits)
+	}
+	return difficulty, challenge, nil
+}
+
+// SolveChallenge finds a nonce for which the hash of the challenge followed by the nonce in decimal starts with
+// difficulty zero bits. It takes about 2^difficulty hashes
+func SolveChallenge(challenge string, difficulty int) (uint64, error) {
+	h, err := challengeHasher(challenge)
+	if err != nil {
+		return 0, err
+	}
+	for nonce := uint64(0); ; nonce++ {
+		if leadingZeroBits(h.Hash([]byte(strconv.FormatUint(nonce, 10)))) >= difficulty {
+			return nonce, nil
+		}
+	}
+}
+
+// VerifyChallenge returns whether the nonce solves the challenge, which takes a single hash
+func VerifyChallenge(challenge string, difficulty int, nonce string) bool {
+	if _, err := strconv.ParseUint(nonce, 10, 64); err != nil {
+		return false
+	}
+	h, err := challengeHasher(challenge)
+	if err != nil {
+		return false
+	}
+	return leadingZeroBits(h.Hash([]byte(nonce))) >= difficulty
+}
+
+// challengeHasher returns a hasher with the challenge as the prefix, so that only the nonce is hashed on top
+func challengeHasher(challenge string) (hashing.Hasher, error) {
+	h, err := hashing.NewHasher(ChallengeHashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = h.Write([]byte(challenge))
+	return h, nil
+}
+
+func leadingZeroBits(digest []byte) int {
+	n := 0
+	for _, b := range digest {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
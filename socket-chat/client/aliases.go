@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var aliasesFile = flags.String("aliases-file", defaultAliasesFile(), "The file the aliases are kept in, empty to not keep them")
+
+// aliases are shortcuts for commands and their first arguments, e.g. g for msg,general. They're kept in a file with
+// one alias per line, in the same <name>,<command> format as the alias command, so that they're there next time
+type aliases struct {
+	path string
+	// builtins are the names of the commands. Aliases can't shadow them, and have to expand to one of them
+	builtins   map[string]bool
+	expansions map[string]string
+}
+
+// defaultAliasesFile returns the aliases file in the user's config directory, or nothing if there's none
+func defaultAliasesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "socket-chat", "aliases")
+}
+
+// loadAliases reads the aliases from path, if it's set and exists. Invalid aliases are skipped with a warning
+func loadAliases(path string, builtins map[string]bool) (*aliases, error) {
+	a := &aliases{path: path, builtins: builtins, expansions: map[string]string{}}
+	if path == "" {
+		return a, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		parts := strings.SplitN(line, ",", 2)
+		if len(parts) != 2 {
+			logger.Warnf("Skipping alias %q in %s: expected <name>,<command>", line, path)
+			continue
+		}
+		if err := a.validate(parts[0], parts[1]); err != nil {
+			logger.Warnf("Skipping alias %q in %s: %v", line, path, err)
+			continue
+		}
+		a.expansions[parts[0]] = parts[1]
+	}
+	return a, scanner.Err()
+}
+
+func (a *aliases) validate(name, expansion string) error {
+	if name == "" || strings.ContainsAny(name, ", \t") {
+		return fmt.Errorf("an alias name can't be empty, or contain commas or spaces")
+	}
+	if strings.Contains(expansion, "\n") {
+		return fmt.Errorf("an alias has to fit on one line")
+	}
+	if a.builtins[name] {
+		return fmt.Errorf("%s is a command, and can't be an alias", name)
+	}
+	if command := strings.SplitN(expansion, ",", 2)[0]; !a.builtins[command] {
+		return fmt.Errorf("an alias has to expand to a command, %q isn't one", command)
+	}
+	return nil
+}
+
+// expand replaces the alias at the start of the input with what it stands for. The expansion isn't expanded again,
+// as aliases can only expand to commands
+func (a *aliases) expand(input string) string {
+	parts := strings.SplitN(input, ",", 2)
+	expansion, ok := a.expansions[parts[0]]
+	if !ok {
+		return input
+	}
+	if len(parts) == 2 {
+		return expansion + "," + parts[1]
+	}
+	return expansion
+}
+
+func (a *aliases) set(name, expansion string) error {
+	if err := a.validate(name, expansion); err != nil {
+		return err
+	}
+	a.expansions[name] = expansion
+	return a.save()
+}
+
+func (a *aliases) remove(name string) error {
+	if _, ok := a.expansions[name]; !ok {
+		return fmt.Errorf("no alias %s", name)
+	}
+	delete(a.expansions, name)
+	return a.save()
+}
+
+func (a *aliases) names() []string {
+	names := make([]string, 0, len(a.expansions))
+	for name := range a.expansions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// save writes all aliases to the file, if there is one. Only the user may read it, like other config files
+func (a *aliases) save() error {
+	if a.path == "" {
+		return nil
+	}
+	b := &strings.Builder{}
+	for _, name := range a.names() {
+		fmt.Fprintf(b, "%s,%s\n", name, a.expansions[name])
+	}
+	if err := os.MkdirAll(filepath.Dir(a.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.path, []byte(b.String()), 0600)
+}
+
+func aliasCmd(c *Client, args []string) error {
+	if err := c.aliases.set(args[0], args[1]); err != nil {
+		return err
+	}
+	fmt.Printf("%s now stands for %s\n", args[0], args[1])
+	return nil
+}
+
+func unaliasCmd(c *Client, args []string) error {
+	return c.aliases.remove(args[0])
+}
+
+func aliasesCmd(c *Client, _ []string) error {
+	names := c.aliases.names()
+	if len(names) == 0 {
+		fmt.Println("No aliases")
+		return nil
+	}
+	for _, name := range names {
+		fmt.Printf("%s -- %s\n", name, c.aliases.expansions[name])
+	}
+	return nil
+}
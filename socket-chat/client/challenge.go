@@ -0,0 +1,28 @@
+package client
+
+import (
+	"strconv"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// solveChallenge solves the registration challenge of the server, and sends the solution
+func (c *Client) solveChallenge(out *transcript, msg *socketchat.Message) error {
+	difficulty, challenge, err := msg.ChallengePayload()
+	if err != nil {
+		return err
+	}
+	out.Printf("The server requires a proof of work to register, solving a challenge of %d bits...", difficulty)
+	start := time.Now()
+	nonce, err := socketchat.SolveChallenge(challenge, difficulty)
+	if err != nil {
+		return err
+	}
+	out.Printf("Solved the challenge in %s", time.Since(start).Round(time.Millisecond))
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandChallenge,
+		Sender:  c.name,
+		Data:    []byte(strconv.FormatUint(nonce, 10)),
+	})
+}
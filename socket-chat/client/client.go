@@ -1,24 +1,40 @@
-package main
+package client
 
 import (
 	"bufio"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
 	socketchat "github.com/luxas/random-schoolwork/socket-chat"
 )
 
-var nameFlag = flag.String("name", "", "Enter your name")
-var secure = flag.Bool("secure", true, "Whether to enable TLSv1.3 or not")
-var serverAddress = flag.String("server", socketchat.DefaultServerAddress, "What server address and port to connect to")
+var logger = logging.New(os.Stderr, "client")
+
+// flags are the flags of the client, separate from the ones of the other programs in the schoolwork binary
+var flags = flag.NewFlagSet("client", flag.ExitOnError)
+
+var nameFlag = flags.String("name", "", "Enter your name")
+var secure = flags.Bool("secure", true, "Whether to enable TLSv1.3 or not")
+var serverAddress = flags.String("server", socketchat.DefaultServerAddress, "What server address and port to connect to, or a comma-separated list of them to connect to the one with the fastest TCP connect time")
+var certFile = flags.String("cert", "", "Client certificate to present to the server, e.g. client-<name>.crt")
+var keyFile = flags.String("key", "", "Private key for the client certificate, e.g. client-<name>.key")
+var versionFlag = version.RegisterFlag(flags)
+var timeFormat = flags.String("time-format", "2006-01-02 15:04:05", "How to format the time of received messages, as a Go time layout, e.g. 15:04 or 2006-01-02T15:04:05Z07:00")
+var timeZone = flags.String("timezone", "Local", "The time zone to show the time of received messages in, e.g. UTC or Europe/Helsinki")
+var rateLimit = flags.Int("rate-limit", 0, "How many bytes per second may be sent to the server, 0 means no limit")
+var heartbeatInterval = flags.Duration("heartbeat-interval", 10*time.Second, "How often to measure the round-trip time to the server, 0 disables it")
+var serverIdentity = flags.String("server-identity", "", fmt.Sprintf("If set, require the server certificate to carry this URI identity, e.g. %s", socketchat.ServerIdentity))
 
 type cliFunc func(c *Client, args []string) error
 type cliHandler struct {
@@ -28,86 +44,187 @@ type cliHandler struct {
 
 // commands map the command name to the cli handler
 var commands = map[string]cliHandler{
-	"msg":         cliHandler{msgCmd, 2},
-	"new-group":   cliHandler{newGroupCmd, 1},
-	"join-group":  cliHandler{joinGroupCmd, 1},
-	"leave-group": cliHandler{leaveGroupCmd, 1},
-	"quit":        cliHandler{cmdQuit, 0},
-	"help":        cliHandler{cmdHelp, 0},
+	"msg":               cliHandler{msgCmd, 2},
+	"ephemeral":         cliHandler{ephemeralCmd, 3},
+	"edit":              cliHandler{editCmd, 1},
+	"drafts":            cliHandler{draftsCmd, 0},
+	"switch":            cliHandler{switchCmd, 1},
+	"focus":             cliHandler{switchCmd, 1},
+	"unread":            cliHandler{unreadCmd, 0},
+	"send-draft":        cliHandler{sendDraftCmd, 1},
+	"new-group":         cliHandler{newGroupCmd, 1},
+	"new-private-group": cliHandler{newPrivateGroupCmd, 1},
+	"invite":            cliHandler{inviteCmd, 2},
+	"join-group":        cliHandler{joinGroupCmd, 1},
+	"join-code":         cliHandler{joinCodeCmd, 1},
+	"leave-group":       cliHandler{leaveGroupCmd, 1},
+	"transfer-group":    cliHandler{transferGroupCmd, 2},
+	"delete-group":      cliHandler{deleteGroupCmd, 1},
+	"retention":         cliHandler{retentionCmd, 2},
+	"announcements":     cliHandler{announcementsCmd, 2},
+	"members":           cliHandler{membersCmd, 1},
+	"pin":               cliHandler{pinCmd, 2},
+	"pins":              cliHandler{pinsCmd, 1},
+	"prefs":             cliHandler{prefsCmd, 1},
+	"add-contact":       cliHandler{addContactCmd, 1},
+	"remove-contact":    cliHandler{removeContactCmd, 1},
+	"contacts":          cliHandler{contactsCmd, 0},
+	"data":              cliHandler{dataCmd, 3},
+	"kick":              cliHandler{kickCmd, 1},
+	"broadcast":         cliHandler{broadcastCmd, 1},
+	"version":           cliHandler{versionCmd, 0},
+	"stats":             cliHandler{statsCmd, 0},
+	"latency":           cliHandler{latencyCmd, 0},
+	"alias":             cliHandler{aliasCmd, 2},
+	"unalias":           cliHandler{unaliasCmd, 1},
+	"aliases":           cliHandler{aliasesCmd, 0},
+	"plugins":           cliHandler{pluginsCmd, 0},
+	"quit":              cliHandler{cmdQuit, 0},
+	"help":              cliHandler{cmdHelp, 0},
 }
 
-func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
+// Main runs the client with the command line arguments, without the program name
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Fatalf("%v", err)
 	}
 }
 
-func run() error {
-	flag.Parse()
+func run(args []string) error {
+	logger.RegisterFlags(flags)
+	if err := config.Parse(flags, "SOCKET_CHAT_CLIENT", args); err != nil {
+		return err
+	}
+	if *versionFlag {
+		version.Print("client")
+		return nil
+	}
+	if flags.Arg(0) == "completion" {
+		cmd := completion.NewCommand("client", flags, completion.Subcommand())
+		return completion.Generate(os.Stdout, flags.Arg(1), cmd)
+	}
 	name := *nameFlag
 	if name == "" {
 		return fmt.Errorf("name is empty!")
 	}
 
-	log.Printf("Launching client with name %q...\n", name)
+	servers := parseServers(*serverAddress)
+	if len(servers) == 0 {
+		return fmt.Errorf("--server is empty!")
+	}
+	if *heartbeatInterval < 0 {
+		return fmt.Errorf("the heartbeat interval can't be negative")
+	}
+	loc, err := time.LoadLocation(*timeZone)
+	if err != nil {
+		return fmt.Errorf("invalid timezone %q: %v", *timeZone, err)
+	}
+
+	builtins := map[string]bool{}
+	for command := range commands {
+		builtins[command] = true
+	}
+	userAliases, err := loadAliases(*aliasesFile, builtins)
+	if err != nil {
+		return fmt.Errorf("couldn't read the aliases: %v", err)
+	}
+	userPlugins, err := loadPlugins(*pluginsFile)
+	if err != nil {
+		return fmt.Errorf("couldn't read the plugins: %v", err)
+	}
+
+	logger.Infof("Launching client with name %q...", name)
 
 	c := NewClient(name)
+	c.aliases = userAliases
+	c.plugins = userPlugins
 
-	if err := c.Connect(socketchat.DefaultServerProtocol, *serverAddress); err != nil {
+	if err := c.connectFastest(socketchat.DefaultServerProtocol, servers); err != nil {
 		return err
 	}
 	defer c.Disconnect()
 
 	// Start streaming messages in the background
-	c.StartStreaming(os.Stdout)
+	c.StartStreaming(newTranscript(os.Stdout, name, *timeFormat, loc))
+	if *heartbeatInterval != 0 {
+		go c.sendHeartbeats(*heartbeatInterval)
+	}
 
 	// Print help text
 	_ = cmdHelp(nil, nil)
 
 	scanner := bufio.NewScanner(os.Stdin)
+	input := ""
 	for scanner.Scan() {
-		parts := strings.Split(scanner.Text(), ",")
+		// A line ending with a backslash continues on the next line, for writing multi-line messages
+		line := scanner.Text()
+		if strings.HasSuffix(line, "\\") {
+			input += strings.TrimSuffix(line, "\\") + "\n"
+			continue
+		}
+		text := c.aliases.expand(input + line)
+		parts := strings.SplitN(text, ",", 2)
+		input = ""
+
 		handler, ok := commands[parts[0]]
 		if !ok {
-			log.Printf("Invalid command %q", parts[0])
+			// Text that isn't a command is a message to the focused conversation
+			if focus := c.conversations.focused(); focus != "" {
+				if err := c.sendComposed(focus, text); err != nil {
+					logger.Errorf("Error when sending to %s: %v", focus, err)
+				}
+				continue
+			}
+			logger.Warnf("Invalid command %q", parts[0])
 			_ = cmdHelp(nil, nil)
 			continue
 		}
-		args := parts[1:]
+		// The last argument is the rest of the input, so that messages may contain commas
+		args := []string{}
+		if len(parts) == 2 {
+			args = strings.SplitN(parts[1], ",", int(handler.numArgs))
+		}
 
 		if len(args) != int(handler.numArgs) {
-			log.Printf("Invalid number of arguments, expected %d", handler.numArgs)
+			logger.Warnf("Invalid number of arguments, expected %d", handler.numArgs)
 			_ = cmdHelp(nil, nil)
 			continue
 		}
 
 		if err := handler.fn(c, args); err != nil {
-			log.Printf("Error when executing command %q: %v\n", parts[0], err)
+			logger.Errorf("Error when executing command %q: %v", parts[0], err)
 			continue
 		}
 	}
 
 	if scanner.Err() != nil {
-		log.Printf("Scanner experienced errors: %v\n", scanner.Err())
+		logger.Errorf("Scanner experienced errors: %v", scanner.Err())
 	}
 
 	return nil
 }
 
 func msgCmd(c *Client, args []string) error {
-	return c.conn.Send(&socketchat.Message{
-		Command:  socketchat.CommandMessage,
-		Sender:   c.name,
-		Receiver: args[0],
-		Data:     args[1],
-	})
+	return c.sendComposed(args[0], args[1])
+}
+
+func dataCmd(c *Client, args []string) error {
+	dataType, err := strconv.ParseUint(args[1], 10, 8)
+	if err != nil {
+		return fmt.Errorf("invalid data type %q: %v", args[1], err)
+	}
+	payload, err := hex.DecodeString(args[2])
+	if err != nil {
+		return fmt.Errorf("payload must be hex-encoded: %v", err)
+	}
+	return c.conn.Send(socketchat.NewDataMessage(c.name, args[0], socketchat.DataType(dataType), payload))
 }
 
 func newGroupCmd(c *Client, args []string) error {
 	return c.conn.Send(&socketchat.Message{
 		Command: socketchat.CommandNewChat,
 		Sender:  c.name,
-		Data:    args[0],
+		Data:    []byte(args[0]),
 	})
 }
 
@@ -115,7 +232,31 @@ func joinGroupCmd(c *Client, args []string) error {
 	return c.conn.Send(&socketchat.Message{
 		Command: socketchat.CommandJoinChat,
 		Sender:  c.name,
-		Data:    args[0],
+		Data:    []byte(args[0]),
+	})
+}
+
+func newPrivateGroupCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandNewPrivateChat,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func inviteCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandInvite,
+		Sender:  c.name,
+		Data:    []byte(args[0] + "," + args[1]),
+	})
+}
+
+func joinCodeCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandJoinCode,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
 	})
 }
 
@@ -123,7 +264,102 @@ func leaveGroupCmd(c *Client, args []string) error {
 	return c.conn.Send(&socketchat.Message{
 		Command: socketchat.CommandLeaveChat,
 		Sender:  c.name,
-		Data:    args[0],
+		Data:    []byte(args[0]),
+	})
+}
+
+func transferGroupCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandTransferChat,
+		Sender:  c.name,
+		Data:    []byte(args[0] + "," + args[1]),
+	})
+}
+
+func deleteGroupCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandDeleteChat,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func retentionCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandRetention,
+		Sender:  c.name,
+		Data:    []byte(args[0] + "," + args[1]),
+	})
+}
+
+func announcementsCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandAnnouncements,
+		Sender:  c.name,
+		Data:    []byte(args[0] + "," + args[1]),
+	})
+}
+
+func membersCmd(c *Client, args []string) error {
+	return c.requestMembers(args[0], 0)
+}
+
+func pinCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandPin,
+		Sender:  c.name,
+		Data:    []byte(args[0] + "," + args[1]),
+	})
+}
+
+func pinsCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandPins,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func prefsCmd(c *Client, args []string) error {
+	// The server evaluates the do-not-disturb hours in our time zone
+	_, offset := time.Now().Zone()
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandPreferences,
+		Sender:  c.name,
+		Data:    []byte(fmt.Sprintf("%s;tz=%d", args[0], offset)),
+	})
+}
+
+func kickCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandKick,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func broadcastCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandBroadcast,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func versionCmd(c *Client, _ []string) error {
+	fmt.Printf("client %s\n", version.Get())
+	// The server's version is printed when its reply arrives
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandVersion,
+		Sender:  c.name,
+		Data:    []byte(version.Get().String()),
+	})
+}
+
+func statsCmd(c *Client, _ []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandStats,
+		Sender:  c.name,
 	})
 }
 
@@ -143,10 +379,41 @@ func cmdQuit(c *Client, _ []string) error {
 
 func cmdHelp(_ *Client, _ []string) error {
 	fmt.Println(`Usage:
-	msg,<receiver>,<message> -- Send a message to a client or group chat
+	msg,<receiver>,<message> -- Send a message to a client or group chat. End a line with \ to continue the message on the next line
+	ephemeral,<receiver>,<ttl>,<message> -- Send a message that expires after e.g. 30s, and is then dropped by the server
+	edit,<receiver> -- Write a message to a client or group chat in $EDITOR, starting from the draft if there is one
+	drafts -- Show the messages that failed to send
+	send-draft,<receiver> -- Try sending the draft to a client or group chat again
+	switch,<conversation> -- Focus on a group chat or a client, and mark its messages as read
+	focus,<conversation> -- Same as switch. Lines that aren't commands are then sent to the focused conversation
+	unread -- Show the number of unread messages in the conversations you're not focused on
+	data,<receiver>,<type>,<hex payload> -- Send binary data with a type tag (0-255) to a client or group chat
 	new-group,<group> -- Create a new group chat
+	new-private-group,<group> -- Create a new group chat, which can only be joined with an invite code
+	invite,<group>,once|<duration> -- Create a single-use invite code, or one valid for e.g. 2h, to a group chat you own
 	join-group,<group> -- Join a group chat
+	join-code,<code> -- Join a group chat with an invite code
 	leave-group,<group> -- Leave a group chat
+	transfer-group,<group>,<member> -- Transfer the ownership of a group chat you own to another member
+	delete-group,<group> -- Delete a group chat you own
+	retention,<group>,<duration>|default -- Set how long the history of a group chat you own is kept
+	announcements,<group>,on|off -- Make a group chat you own read-only for the other members, or writable again
+	members,<group> -- List the members of a group chat
+	pin,<group>,<id> -- Pin a message in a group chat you own, by the #<id> it was delivered with
+	pins,<group> -- Show the pinned messages of a group chat
+	prefs,<preference> -- Set a delivery preference: dnd=<from>-<to>|off, dms-only=on|off or mention-only=<group> <group>...
+	add-contact,<client> -- Add a client to your contacts, which the server keeps for you
+	remove-contact,<client> -- Remove a client from your contacts
+	contacts -- Show your contacts, and which of them are online
+	kick,<client> -- Disconnect a client from the server, for operators
+	broadcast,<message> -- Send a message to all clients, for operators
+	version -- Show the client and server versions
+	stats -- Show the uptime of the server, and how many clients and groups it has
+	latency -- Show the connection quality and the round-trip times to the server
+	alias,<name>,<command> -- Define a shortcut for a command and its first arguments, e.g. alias,g,msg,general makes g,hi send hi to general
+	unalias,<name> -- Remove an alias
+	aliases -- Show your aliases, which are kept in --aliases-file
+	plugins -- Show your plugins, which are kept in --plugins-file
 	quit -- Stop this application
 	help -- Show this help text`)
 	return nil
@@ -155,80 +422,178 @@ func cmdHelp(_ *Client, _ []string) error {
 type Client struct {
 	name string
 	conn *socketchat.Connection
+	// drafts are the messages that failed to send, per receiver
+	drafts        map[string]string
+	conversations *conversations
+	heartbeats    *heartbeats
+	// aliases are expanded before the commands are dispatched
+	aliases *aliases
+	// plugins transform the messages the user writes, and annotate the received ones
+	plugins *plugins
+	// done is closed when the client disconnects
+	done chan struct{}
 }
 
 func NewClient(name string) *Client {
 	return &Client{
-		name: name,
+		name:          name,
+		drafts:        map[string]string{},
+		conversations: newConversations(),
+		heartbeats:    newHeartbeats(),
+		done:          make(chan struct{}),
 	}
 }
 
 func (c *Client) Connect(network, address string) error {
-	var conn net.Conn
-	var err error
+	var config *tls.Config
 	if *secure {
-		b, err := ioutil.ReadFile("ca.crt")
+		var err error
+		config, err = socketchat.ClientTLSConfig("ca.crt", *certFile, *keyFile, *serverIdentity)
 		if err != nil {
 			return err
 		}
-		certpool := x509.NewCertPool()
-		if ok := certpool.AppendCertsFromPEM(b); !ok {
-			return fmt.Errorf("couldn't add ca cert to cert pool")
-		}
-		conn, err = tls.Dial(network, address, &tls.Config{
-			RootCAs:    certpool,
-			MinVersion: tls.VersionTLS13,
-		})
-	} else {
-		conn, err = net.Dial(network, address)
 	}
+	conn, err := socketchat.Dial(network, address, config, c.name, version.Get().String())
 	if err != nil {
 		return err
 	}
-	if conn == nil {
-		return fmt.Errorf("couldn't trust the server for the given root CA")
-	}
-	c.conn = socketchat.NewConnection(conn)
+	c.conn = conn
+	c.conn.SetRateLimit(*rateLimit)
+	return nil
+}
 
-	err = c.conn.Send(&socketchat.Message{
-		Command: socketchat.CommandNewClient,
-		Data:    c.name,
+// requestMembers asks the server for the page of group members starting at offset
+func (c *Client) requestMembers(group string, offset int) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandListMembers,
+		Sender:  c.name,
+		Data:    []byte(fmt.Sprintf("%s,%d", group, offset)),
 	})
-	if err != nil {
-		return fmt.Errorf("failed to join server: %v", err)
-	}
+}
 
-	return nil
+// printMembers prints a page of group members, and requests the next page if there is one
+func (c *Client) printMembers(out *transcript, msg *socketchat.Message) {
+	var next, total int
+	i := strings.Index(msg.Text(), ":")
+	if i == -1 {
+		logger.Warnf("Invalid member list from server: %q", msg.Text())
+		return
+	}
+	if _, err := fmt.Sscanf(msg.Text()[:i], "%d/%d", &next, &total); err != nil {
+		logger.Warnf("Invalid member list from server: %q", msg.Text())
+		return
+	}
+	out.Printf("Members of group %s (%d in total): %s", msg.Receiver, total, msg.Text()[i+1:])
+	if next != 0 {
+		if err := c.requestMembers(msg.Receiver, next); err != nil {
+			logger.Warnf("Failed to request more members of group %s: %v", msg.Receiver, err)
+		}
+	}
 }
 
 func (c *Client) Disconnect() {
-	log.Println("Client shutting down...")
+	logger.Infof("Client shutting down...")
+	close(c.done)
 	c.conn.Close()
 }
 
-func (c *Client) StartStreaming(w io.Writer) {
-	logger := log.New(w, fmt.Sprintf("client-%s ", c.name), log.LstdFlags)
-
+func (c *Client) StartStreaming(out *transcript) {
 	go func() {
 		for {
 			msg, err := c.conn.Receive()
+			if err == socketchat.UnknownCommandError {
+				// The server may be newer than this client
+				logger.Warnf("Ignoring a message with unknown command %d from %s", msg.Command, msg.Sender)
+				continue
+			}
 			if err != nil {
+				select {
+				case <-c.done:
+					// The connection was closed by Disconnect
+					return
+				default:
+				}
 
 				if err == io.EOF {
-					log.Printf("Shutting down due to server EOF")
+					logger.Infof("Shutting down due to server EOF")
 					os.Exit(0)
 				}
 
-				logger.Printf("Error when receiving: %v", err)
+				// The stream can't be trusted after a failed read, e.g. a reset or a partial message
+				logger.Errorf("Lost the connection to the server: %v", err)
+				os.Exit(1)
+			}
+
+			if msg.Command == socketchat.CommandVersion {
+				out.Printf("Server is running version %s", msg.Text())
+				continue
+			}
+			if msg.Command == socketchat.CommandHeartbeat {
+				c.heartbeats.received(msg)
+				continue
+			}
+			if msg.Command == socketchat.CommandError {
+				c.handleError(out, msg.ErrorPayload())
+				continue
+			}
+			if msg.Command == socketchat.CommandChallenge {
+				if err := c.solveChallenge(out, msg); err != nil {
+					logger.Errorf("Failed to solve the registration challenge: %v", err)
+					os.Exit(1)
+				}
+				continue
+			}
+			if msg.Command == socketchat.CommandRead {
+				c.conversations.markRead(msg.Text())
+				continue
+			}
+			if msg.Command == socketchat.CommandStats {
+				out.Printf("Server stats: %s", msg.Text())
+				continue
+			}
+			if msg.Command == socketchat.CommandData {
+				dataType, payload, err := msg.DataPayload()
+				if err != nil {
+					logger.Warnf("Invalid data message from %s: %v", msg.Sender, err)
+					continue
+				}
+				out.Printf("Got data of type %d to %s from %s: %x", dataType, msg.Receiver, msg.Sender, payload)
+				continue
+			}
+			if msg.Command == socketchat.CommandPins {
+				if ttl, text, err := msg.Expiry(); err == nil && ttl != 0 {
+					out.Printf("Pinned in %s from %s, expiring: %s", msg.Receiver, msg.Sender, text)
+					continue
+				}
+				out.Printf("Pinned in %s from %s: %s", msg.Receiver, msg.Sender, msg.Text())
+				continue
+			}
+			if msg.Command == socketchat.CommandContacts {
+				out.Printf("Contact %s is %s", msg.Receiver, msg.Text())
+				continue
+			}
+			if msg.Command == socketchat.CommandListMembers {
+				c.printMembers(out, msg)
 				continue
 			}
 
+			conversation := c.conversations.received(c.name, msg)
 			receiver := msg.Receiver
 			if receiver == c.name || len(receiver) == 0 {
 				receiver = "you"
 			}
 
-			logger.Printf("Got message to %s from %s: %s", receiver, msg.Sender, msg.Data)
+			ttl, text, err := msg.Expiry()
+			if err != nil || ttl == 0 {
+				text = msg.Text()
+				out.Printf("Got message to %s from %s: %s", receiver, msg.Sender, text)
+			} else {
+				c.showExpiring(out, msg.Sender, receiver, conversation, text, ttl)
+			}
+			// The notices of the server aren't annotated, only what the clients wrote
+			if msg.Sender != "server" {
+				c.plugins.annotate(out, msg.Sender, msg.Receiver, text)
+			}
 		}
 	}()
 }
@@ -0,0 +1,28 @@
+package client
+
+import (
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+func addContactCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandAddContact,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func removeContactCmd(c *Client, args []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandRemoveContact,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func contactsCmd(c *Client, _ []string) error {
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandContacts,
+		Sender:  c.name,
+	})
+}
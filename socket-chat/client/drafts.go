@@ -0,0 +1,102 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// defaultEditor is used for composing messages if $EDITOR isn't set
+const defaultEditor = "vi"
+
+// sendText sends a text message. If sending fails, the text is kept as a draft for the receiver, so that
+// it can be sent again with send-draft or edited with edit
+func (c *Client) sendText(receiver, text string) error {
+	err := c.conn.Send(&socketchat.Message{
+		Command:  socketchat.CommandMessage,
+		Sender:   c.name,
+		Receiver: receiver,
+		Data:     []byte(text),
+	})
+	if err != nil {
+		c.drafts[receiver] = text
+		return fmt.Errorf("%v. The message was saved as a draft, see drafts", err)
+	}
+	delete(c.drafts, receiver)
+	return nil
+}
+
+func draftsCmd(c *Client, _ []string) error {
+	if len(c.drafts) == 0 {
+		fmt.Println("No drafts")
+		return nil
+	}
+	receivers := make([]string, 0, len(c.drafts))
+	for receiver := range c.drafts {
+		receivers = append(receivers, receiver)
+	}
+	sort.Strings(receivers)
+	for _, receiver := range receivers {
+		fmt.Printf("Draft to %s:\n%s\n", receiver, c.drafts[receiver])
+	}
+	return nil
+}
+
+func sendDraftCmd(c *Client, args []string) error {
+	text, ok := c.drafts[args[0]]
+	if !ok {
+		return fmt.Errorf("no draft to %s", args[0])
+	}
+	return c.sendText(args[0], text)
+}
+
+func editCmd(c *Client, args []string) error {
+	text, err := editText(c.drafts[args[0]])
+	if err != nil {
+		return err
+	}
+	if text == "" {
+		fmt.Println("Empty message, not sending it")
+		return nil
+	}
+	return c.sendComposed(args[0], text)
+}
+
+// editText lets the user compose a message in $EDITOR, starting from the given text
+func editText(text string) (string, error) {
+	f, err := ioutil.TempFile("", "socket-chat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(text); err != nil {
+		f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+	// $EDITOR may contain arguments, e.g. "code --wait"
+	editorArgs := strings.Fields(editor)
+	cmd := exec.Command(editorArgs[0], append(editorArgs[1:], f.Name())...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("editor %q failed: %v", editor, err)
+	}
+
+	b, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\n"), nil
+}
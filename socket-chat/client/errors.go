@@ -0,0 +1,24 @@
+package client
+
+import (
+	"os"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// handleError shows an error from the server depending on its code. Errors that the server disconnects the client
+// for tell how to connect again, and stop the client
+func (c *Client) handleError(out *transcript, e *socketchat.Error) {
+	switch e.Code {
+	case socketchat.ErrorCodeNameInvalid, socketchat.ErrorCodeNameReserved:
+		out.Printf("The server rejected the name: %s. Connect again with another --name", e.Message)
+		os.Exit(1)
+	case socketchat.ErrorCodeUnauthorized:
+		out.Printf("The server didn't authorize you: %s. Connect again with the certificate of %s, see --cert and --key", e.Message, c.name)
+		os.Exit(1)
+	case socketchat.ErrorCodeForbidden:
+		out.Printf("Permission denied: %s", e.Message)
+	default:
+		out.Printf("Error (%s): %s", e.Code, e.Message)
+	}
+}
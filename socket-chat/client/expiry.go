@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+func ephemeralCmd(c *Client, args []string) error {
+	ttl, err := time.ParseDuration(args[1])
+	if err != nil || ttl <= 0 {
+		return fmt.Errorf("invalid TTL %q, expected a positive duration like 30s", args[1])
+	}
+	text, err := c.plugins.transform(c.name, args[0], args[2])
+	if err != nil {
+		return err
+	}
+	// The TTL marker is kept in the draft if sending fails, so that send-draft sends it as expiring too
+	msg := socketchat.NewExpiringMessage(c.name, args[0], text, ttl)
+	return c.sendText(args[0], msg.Text())
+}
+
+// showExpiring prints an expiring message, and a notice when it expires. A terminal can't take back what it has
+// printed, so the notice tells the user to disregard the message. An unread expiring message is no longer
+// counted as unread when it expires
+func (c *Client) showExpiring(out *transcript, sender, receiver, conversation, text string, ttl time.Duration) {
+	out.Printf("Got message to %s from %s, expiring in %s: %s", receiver, sender, ttl, text)
+	time.AfterFunc(ttl, func() {
+		if conversation != "" {
+			c.conversations.expired(conversation)
+		}
+		out.Printf("The message to %s from %s sent %s ago has expired", receiver, sender, ttl)
+	})
+}
@@ -0,0 +1,101 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// heartbeats measures the round-trip time of heartbeats to the server. There is at most one heartbeat in
+// flight, it's counted as lost if the reply hasn't arrived when the next one is sent
+type heartbeats struct {
+	mux     *sync.Mutex
+	stats   *rtt.Stats
+	seq     uint64
+	sent    time.Time
+	pending bool
+	last    time.Duration
+}
+
+func newHeartbeats() *heartbeats {
+	h := &heartbeats{mux: &sync.Mutex{}, stats: &rtt.Stats{}}
+	h.stats.Start()
+	return h
+}
+
+// sendHeartbeats sends a heartbeat to the server every interval
+func (c *Client) sendHeartbeats(interval time.Duration) {
+	for range time.Tick(interval) {
+		h := c.heartbeats
+		h.mux.Lock()
+		if h.pending {
+			h.stats.PacketLost()
+			logger.Warnf("No heartbeat reply from the server within %s, the connection is %s", interval, h.quality())
+		}
+		h.seq++
+		h.sent = time.Now()
+		h.pending = true
+		data := make([]byte, 8)
+		binary.BigEndian.PutUint64(data, h.seq)
+		h.mux.Unlock()
+
+		if err := c.conn.Send(&socketchat.Message{
+			Command: socketchat.CommandHeartbeat,
+			Sender:  c.name,
+			Data:    data,
+		}); err != nil {
+			logger.Warnf("Failed to send heartbeat: %v", err)
+		}
+	}
+}
+
+// received records the RTT of the heartbeat the server echoed back
+func (h *heartbeats) received(msg *socketchat.Message) {
+	if len(msg.Data) != 8 {
+		logger.Warnf("Invalid heartbeat reply from server: %x", msg.Data)
+		return
+	}
+	seq := binary.BigEndian.Uint64(msg.Data)
+
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	// Replies to heartbeats that were counted as lost are ignored
+	if !h.pending || seq != h.seq {
+		return
+	}
+	h.last = time.Since(h.sent)
+	h.stats.PacketReceived(h.last)
+	h.pending = false
+}
+
+// quality rates the connection by the heartbeat loss and average RTT. The caller must hold mux
+func (h *heartbeats) quality() string {
+	s := h.stats.Calculate()
+	switch {
+	case s.NumPackets == 0:
+		return "unknown"
+	case s.Loss() > 5 || s.AvgRTT > 500*time.Millisecond:
+		return "poor"
+	case s.Loss() > 1 || s.AvgRTT > 150*time.Millisecond:
+		return "fair"
+	}
+	return "good"
+}
+
+func latencyCmd(c *Client, _ []string) error {
+	if *heartbeatInterval == 0 {
+		return fmt.Errorf("heartbeats are disabled, see --heartbeat-interval")
+	}
+	h := c.heartbeats
+	h.mux.Lock()
+	defer h.mux.Unlock()
+	s := h.stats.Calculate()
+	fmt.Printf("Connection quality: %s, last RTT %v\n", h.quality(), h.last)
+	fmt.Printf("%d heartbeats sent, %d received, %.0f%% lost, rtt min/avg/max/sdev = %v/%v/%v/%v, p50/p90/p95/p99 = %v/%v/%v/%v, jitter %v\n",
+		s.NumPackets, s.NumReceived, s.Loss(), s.MinRTT, s.AvgRTT, s.MaxRTT, s.SdevRTT, s.P50RTT, s.P90RTT, s.P95RTT, s.P99RTT, s.Jitter)
+	return nil
+}
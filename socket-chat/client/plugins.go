@@ -0,0 +1,159 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	// hookOutgoing plugins transform the messages the user writes before they're sent
+	hookOutgoing = "outgoing"
+	// hookIncoming plugins annotate the received messages
+	hookIncoming = "incoming"
+
+	// pluginTimeout is how long a plugin may run for a message
+	pluginTimeout = 5 * time.Second
+)
+
+var pluginsFile = flags.String("plugins-file", defaultPluginsFile(), "The file listing the plugins, which are external commands that transform outgoing messages or annotate incoming ones")
+
+// plugin is an external command run for every message. It gets the text on stdin, and the sender and receiver in
+// the SOCKET_CHAT_SENDER and SOCKET_CHAT_RECEIVER environment variables. An outgoing plugin prints the text to send
+// instead, e.g. with issue IDs turned into links. An incoming plugin prints notes about the text, e.g. spelling
+// mistakes, which are shown below the message
+type plugin struct {
+	name string
+	hook string
+	// command may contain arguments, like $EDITOR
+	command []string
+}
+
+// plugins are kept in a file with one plugin per line, as <name>,outgoing|incoming,<command>. They're run in the
+// order of the file, so the text an outgoing plugin prints is what the next one gets
+type plugins struct {
+	outgoing []*plugin
+	incoming []*plugin
+}
+
+// defaultPluginsFile returns the plugins file in the user's config directory, or nothing if there's none
+func defaultPluginsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "socket-chat", "plugins")
+}
+
+// loadPlugins reads the plugins from path, if it's set and exists. Invalid plugins are skipped with a warning
+func loadPlugins(path string) (*plugins, error) {
+	ps := &plugins{}
+	if path == "" {
+		return ps, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return ps, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ",", 3)
+		if len(parts) != 3 || parts[0] == "" || len(strings.Fields(parts[2])) == 0 {
+			logger.Warnf("Skipping plugin %q in %s: expected <name>,outgoing|incoming,<command>", line, path)
+			continue
+		}
+		p := &plugin{name: parts[0], hook: parts[1], command: strings.Fields(parts[2])}
+		switch p.hook {
+		case hookOutgoing:
+			ps.outgoing = append(ps.outgoing, p)
+		case hookIncoming:
+			ps.incoming = append(ps.incoming, p)
+		default:
+			logger.Warnf("Skipping plugin %q in %s: invalid hook %q, expected %s or %s", line, path, p.hook, hookOutgoing, hookIncoming)
+		}
+	}
+	return ps, scanner.Err()
+}
+
+// run runs the plugin with the text, and returns what it printed without the trailing newlines
+func (p *plugin) run(sender, receiver, text string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, p.command[0], p.command[1:]...)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Env = append(os.Environ(), "SOCKET_CHAT_SENDER="+sender, "SOCKET_CHAT_RECEIVER="+receiver)
+	out, err := cmd.Output()
+	if err != nil {
+		// A plugin that rejects a message can tell why on stderr
+		if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) != 0 {
+			return "", fmt.Errorf("plugin %s failed: %s", p.name, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("plugin %s failed: %v", p.name, err)
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// transform runs the text through the outgoing plugins. If one fails or prints nothing, the message isn't sent
+func (ps *plugins) transform(sender, receiver, text string) (string, error) {
+	for _, p := range ps.outgoing {
+		var err error
+		if text, err = p.run(sender, receiver, text); err != nil {
+			return "", err
+		}
+		if text == "" {
+			return "", fmt.Errorf("plugin %s dropped the message", p.name)
+		}
+	}
+	return text, nil
+}
+
+// annotate prints the notes of the incoming plugins about a received message. A failing plugin only gets a warning,
+// as the message has been shown already
+func (ps *plugins) annotate(out *transcript, sender, receiver, text string) {
+	for _, p := range ps.incoming {
+		notes, err := p.run(sender, receiver, text)
+		if err != nil {
+			logger.Warnf("%v", err)
+			continue
+		}
+		for _, note := range strings.Split(notes, "\n") {
+			if strings.TrimSpace(note) != "" {
+				out.Printf("  %s: %s", p.name, note)
+			}
+		}
+	}
+}
+
+// sendComposed sends a message the user wrote, as transformed by the outgoing plugins
+func (c *Client) sendComposed(receiver, text string) error {
+	text, err := c.plugins.transform(c.name, receiver, text)
+	if err != nil {
+		return err
+	}
+	return c.sendText(receiver, text)
+}
+
+func pluginsCmd(c *Client, _ []string) error {
+	all := append(append([]*plugin{}, c.plugins.outgoing...), c.plugins.incoming...)
+	if len(all) == 0 {
+		fmt.Println("No plugins")
+		return nil
+	}
+	for _, p := range all {
+		fmt.Printf("%s (%s) -- %s\n", p.name, p.hook, strings.Join(p.command, " "))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package client
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/rtt"
+)
+
+const (
+	// probesPerServer is how many times the TCP connect time to every server is measured
+	probesPerServer = 3
+	// probeTimeout is how long a probe may take before the server counts as unreachable for it
+	probeTimeout = 2 * time.Second
+)
+
+// serverProbe is the connect times to a server
+type serverProbe struct {
+	address string
+	summary *rtt.Summary
+}
+
+// parseServers returns the addresses of the comma-separated list of servers
+func parseServers(list string) []string {
+	addresses := []string{}
+	for _, address := range strings.Split(list, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// probeServers measures the TCP connect times to the servers at the same time, and returns them from the fastest to
+// the slowest. The ones that fewer probes reached come last
+func probeServers(network string, addresses []string) []*serverProbe {
+	probes := make([]*serverProbe, len(addresses))
+	wg := &sync.WaitGroup{}
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			probes[i] = probeServer(network, address)
+		}(i, address)
+	}
+	wg.Wait()
+
+	sort.SliceStable(probes, func(i, j int) bool {
+		a, b := probes[i].summary, probes[j].summary
+		if a.NumReceived != b.NumReceived {
+			return a.NumReceived > b.NumReceived
+		}
+		return a.P50RTT < b.P50RTT
+	})
+	for _, p := range probes {
+		if p.summary.NumReceived == 0 {
+			logger.Infof("Server %s is unreachable", p.address)
+			continue
+		}
+		logger.Infof("Server %s: connect time min/median/max = %v/%v/%v, %.0f%% failed", p.address,
+			p.summary.MinRTT, p.summary.P50RTT, p.summary.MaxRTT, p.summary.Loss())
+	}
+	return probes
+}
+
+// probeServer opens and closes TCP connections to the server, probesPerServer times one after another
+func probeServer(network, address string) *serverProbe {
+	stats := &rtt.Stats{}
+	stats.Start()
+	for i := 0; i < probesPerServer; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout(network, address, probeTimeout)
+		if err != nil {
+			logger.Debugf("Probing server %s failed: %v", address, err)
+			stats.PacketLost()
+			continue
+		}
+		stats.PacketReceived(time.Since(start))
+		conn.Close()
+	}
+	return &serverProbe{address: address, summary: stats.Calculate()}
+}
+
+// connectFastest connects to the fastest of the servers, or the next fastest if that fails, and so on. A single
+// server isn't probed
+func (c *Client) connectFastest(network string, addresses []string) error {
+	if len(addresses) == 1 {
+		return c.Connect(network, addresses[0])
+	}
+	var err error
+	for _, p := range probeServers(network, addresses) {
+		if err = c.Connect(network, p.address); err == nil {
+			logger.Infof("Connected to server %s", p.address)
+			return nil
+		}
+		logger.Warnf("Failed to connect to server %s: %v", p.address, err)
+	}
+	return err
+}
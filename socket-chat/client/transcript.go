@@ -0,0 +1,35 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// transcript prints the received messages, each with the time it was received in the configured format and time zone
+type transcript struct {
+	w      io.Writer
+	prefix string
+	layout string
+	loc    *time.Location
+}
+
+func newTranscript(w io.Writer, name, layout string, loc *time.Location) *transcript {
+	return &transcript{
+		w:      w,
+		prefix: fmt.Sprintf("client-%s ", name),
+		layout: layout,
+		loc:    loc,
+	}
+}
+
+// Printf prints a line to the transcript, stamped with the current time
+func (t *transcript) Printf(format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(line, "\n") {
+		line += "\n"
+	}
+	// TODO: Use the time the message was sent when the wire format carries it
+	fmt.Fprintf(t.w, "%s%s %s", t.prefix, time.Now().In(t.loc).Format(t.layout), line)
+}
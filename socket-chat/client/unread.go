@@ -0,0 +1,116 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// conversations keeps track of which conversation the user is focused on, and how many messages are unread in
+// the others. A conversation is a group, or the name of the client for direct messages
+type conversations struct {
+	mux    *sync.Mutex
+	focus  string
+	unread map[string]int
+}
+
+func newConversations() *conversations {
+	return &conversations{
+		mux:    &sync.Mutex{},
+		unread: map[string]int{},
+	}
+}
+
+// received counts a message as unread if it's in another conversation than the focused one, and returns the
+// conversation it was counted in, or an empty string. Nothing is unread until the user has focused on a
+// conversation, and notices from the server are never unread
+func (cs *conversations) received(self string, msg *socketchat.Message) string {
+	if msg.Sender == "server" || msg.Sender == self {
+		return ""
+	}
+	conversation := msg.Receiver
+	if conversation == self || len(conversation) == 0 {
+		conversation = msg.Sender
+	}
+
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	if cs.focus != "" && cs.focus != conversation {
+		cs.unread[conversation]++
+		return conversation
+	}
+	return ""
+}
+
+// expired uncounts an unread message that has expired. If the conversation has been read since, there is
+// nothing to uncount, unless new messages have arrived in it
+func (cs *conversations) expired(conversation string) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	if cs.unread[conversation] > 1 {
+		cs.unread[conversation]--
+	} else {
+		delete(cs.unread, conversation)
+	}
+}
+
+// switchTo focuses on a conversation and marks it as read. It returns how many messages were unread in it
+func (cs *conversations) switchTo(conversation string) int {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	cs.focus = conversation
+	n := cs.unread[conversation]
+	delete(cs.unread, conversation)
+	return n
+}
+
+// markRead marks a conversation as read without focusing on it, when another session of the client read it
+func (cs *conversations) markRead(conversation string) {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	delete(cs.unread, conversation)
+}
+
+// focused returns the conversation the user is focused on, or an empty string if there is none
+func (cs *conversations) focused() string {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	return cs.focus
+}
+
+// String returns the focused conversation and the unread counts of the others
+func (cs *conversations) String() string {
+	cs.mux.Lock()
+	defer cs.mux.Unlock()
+	if cs.focus == "" {
+		return "Not focused on a conversation, see switch"
+	}
+	s := fmt.Sprintf("Focused on %s", cs.focus)
+	names := make([]string, 0, len(cs.unread))
+	for name := range cs.unread {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s += fmt.Sprintf("\n%s: %d unread", name, cs.unread[name])
+	}
+	return s
+}
+
+func switchCmd(c *Client, args []string) error {
+	n := c.conversations.switchTo(args[0])
+	fmt.Printf("Switched to %s, %d unread messages\n", args[0], n)
+	// Let the other sessions of this client know that the conversation has been read
+	return c.conn.Send(&socketchat.Message{
+		Command: socketchat.CommandRead,
+		Sender:  c.name,
+		Data:    []byte(args[0]),
+	})
+}
+
+func unreadCmd(c *Client, _ []string) error {
+	fmt.Println(c.conversations)
+	return nil
+}
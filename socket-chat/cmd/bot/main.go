@@ -0,0 +1,13 @@
+// Command bot is the standalone binary of the transcript bot, which is also the chat-bot subcommand of the
+// schoolwork binary
+package main
+
+import (
+	"os"
+
+	"github.com/luxas/random-schoolwork/socket-chat/bot"
+)
+
+func main() {
+	bot.Main(os.Args[1:])
+}
@@ -0,0 +1,13 @@
+// Command client is the standalone binary of the chat client, which is also the chat-client subcommand of the
+// schoolwork binary
+package main
+
+import (
+	"os"
+
+	"github.com/luxas/random-schoolwork/socket-chat/client"
+)
+
+func main() {
+	client.Main(os.Args[1:])
+}
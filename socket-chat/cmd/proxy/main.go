@@ -0,0 +1,13 @@
+// Command proxy is the standalone binary of the debugging proxy, which is also the chat-proxy subcommand of the
+// schoolwork binary
+package main
+
+import (
+	"os"
+
+	"github.com/luxas/random-schoolwork/socket-chat/proxy"
+)
+
+func main() {
+	proxy.Main(os.Args[1:])
+}
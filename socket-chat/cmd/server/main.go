@@ -0,0 +1,13 @@
+// Command server is the standalone binary of the chat server, which is also the chat-server subcommand of the
+// schoolwork binary
+package main
+
+import (
+	"os"
+
+	"github.com/luxas/random-schoolwork/socket-chat/server"
+)
+
+func main() {
+	server.Main(os.Args[1:])
+}
@@ -3,20 +3,31 @@ package socketchat
 import (
 	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	DefaultServerProtocol = "tcp"
 	DefaultServerAddress  = "localhost:6443"
+	DefaultAdminSocket    = "/tmp/socket-chat-admin.sock"
 
 	MaxNameByteSize = 32
 	MaxDataByteSize = 255
 	HeaderSize      = 6
 
 	TimeoutDuration = 1 * time.Minute
+
+	// TrustDomain is the SPIFFE-style trust domain all chat identities live in
+	TrustDomain = "luxas"
 )
 
 var (
@@ -33,13 +44,115 @@ const (
 	CommandMessage
 	CommandLeave
 	CommandError
+	CommandKick
+	CommandBroadcast
+	CommandVersion
+	CommandListMembers
+	// CommandData carries an opaque binary payload for bots, see NewDataMessage
+	CommandData
+	// CommandPin pins a message in a group by its ID
+	CommandPin
+	// CommandPins requests, and carries, the pinned messages of a group
+	CommandPins
+	// CommandPreferences registers the delivery preferences of a client with the server
+	CommandPreferences
+	// CommandTransferChat makes another member the owner of a group
+	CommandTransferChat
+	// CommandDeleteChat deletes a group
+	CommandDeleteChat
+	// CommandNewPrivateChat creates a group that can only be joined with an invite code
+	CommandNewPrivateChat
+	// CommandInvite creates an invite code to a private group
+	CommandInvite
+	// CommandJoinCode joins the group an invite code is for
+	CommandJoinCode
+	// CommandRetention sets how long the history of a group is kept
+	CommandRetention
+	// CommandPurge purges the messages older than the retention right away, and returns the purge statistics
+	CommandPurge
+	// CommandStats requests, and carries, the public statistics of the server
+	CommandStats
+	// CommandExportUser exports all data the server has about a client, for admins
+	CommandExportUser
+	// CommandDeleteUser deletes and anonymizes all data the server has about a client, for admins
+	CommandDeleteUser
+	// CommandHeartbeat is echoed back by the server, so that clients can measure the round-trip time
+	CommandHeartbeat
+	// CommandRead tells the other sessions of a client that it has read a conversation
+	CommandRead
+	// CommandAddContact adds a client to the contacts of the sender
+	CommandAddContact
+	// CommandRemoveContact removes a client from the contacts of the sender
+	CommandRemoveContact
+	// CommandContacts requests, and carries, the contacts of a client with their presence
+	CommandContacts
+	// CommandACL edits and shows the access lists of the server, for admins
+	CommandACL
+	// CommandChallenge carries a registration challenge from the server, and the solution from the client
+	CommandChallenge
+	// CommandAnnouncements makes a group read-only for all members but its owner, or writable for all again
+	CommandAnnouncements
+
+	// commandEnd is one past the last command, new commands go above it and in CommandSpecs
+	commandEnd
 )
 
+// Known returns whether the command is one this version of the protocol knows about
+func (c Command) Known() bool {
+	return c >= CommandNewClient && c < commandEnd
+}
+
 type Message struct {
 	Command  Command
 	Sender   string
 	Receiver string
-	Data     string
+	// Data is the payload of the message. It's text for most commands, but may be binary, e.g. for CommandData
+	Data []byte
+}
+
+// Text returns the Data of the message as a string, for the commands that carry text
+func (m *Message) Text() string {
+	return string(m.Data)
+}
+
+// ttlMarker starts the text of expiring messages, followed by the TTL and a space
+const ttlMarker = "ttl="
+
+// NewExpiringMessage creates a CommandMessage that expires after ttl. The text is prefixed with "ttl=<ttl> ",
+// so clients that don't know about expiring messages still show it
+func NewExpiringMessage(sender, receiver, text string, ttl time.Duration) *Message {
+	return &Message{
+		Command:  CommandMessage,
+		Sender:   sender,
+		Receiver: receiver,
+		Data:     []byte(fmt.Sprintf("%s%s %s", ttlMarker, ttl, text)),
+	}
+}
+
+// Expiry returns the TTL of an expiring message, and the text with the "ttl=<ttl> " marker removed. Messages to
+// groups keep the "#<id> " prefix in front of the marker. The TTL is 0 for messages that don't expire
+func (m *Message) Expiry() (time.Duration, string, error) {
+	text := m.Text()
+	prefix := ""
+	if strings.HasPrefix(text, "#") {
+		if i := strings.Index(text, " "); i != -1 {
+			if _, err := strconv.ParseUint(text[1:i], 10, 64); err == nil {
+				prefix, text = text[:i+1], text[i+1:]
+			}
+		}
+	}
+	if !strings.HasPrefix(text, ttlMarker) {
+		return 0, m.Text(), nil
+	}
+	value, rest := text[len(ttlMarker):], ""
+	if i := strings.Index(value, " "); i != -1 {
+		value, rest = value[:i], value[i+1:]
+	}
+	ttl, err := time.ParseDuration(value)
+	if err != nil || ttl <= 0 {
+		return 0, "", &Error{Code: ErrorCodeInvalidRequest, Message: fmt.Sprintf("invalid TTL %q, expected a positive duration", value)}
+	}
+	return ttl, prefix + rest, nil
 }
 
 var (
@@ -47,37 +160,277 @@ var (
 	MaxDataSizeError      = fmt.Errorf("size of message exceeded: %d", MaxDataByteSize)
 	SendByteMismatchError = fmt.Errorf("could not send all required bytes")
 	ReceiveHeaderError    = fmt.Errorf("could not read header of a message")
+	NoPeerIdentityError   = fmt.Errorf("peer did not present a certificate with an URI identity")
+	SendTimeoutError      = fmt.Errorf("timed out sending message")
+	PartialSendError      = fmt.Errorf("timed out after partially sending a message, the connection is unusable")
+	NoDataTypeError       = fmt.Errorf("data message has no type tag")
+	// UnknownCommandError is returned by ReadMessage together with the message, the stream stays in sync
+	UnknownCommandError = fmt.Errorf("unknown command")
+)
+
+// ErrorCode identifies the kind of error a CommandError message carries, so that clients can act on errors
+// without parsing the text. See Error
+type ErrorCode uint16
+
+const (
+	// ErrorCodeUnknown is used for errors that have no more specific code
+	ErrorCodeUnknown ErrorCode = iota
+	// ErrorCodeInvalidRequest means the data of the command couldn't be parsed, or has invalid values
+	ErrorCodeInvalidRequest
+	// ErrorCodeNotFound means the client, group, message or invite code the command is for doesn't exist
+	ErrorCodeNotFound
+	// ErrorCodeConflict means the command conflicts with the state of the server, e.g. the group already exists
+	ErrorCodeConflict
+	// ErrorCodeLimitExceeded means the command would exceed a limit of the server, e.g. a full group
+	ErrorCodeLimitExceeded
+	// ErrorCodeForbidden means the client isn't allowed to send the command
+	ErrorCodeForbidden
+	// ErrorCodeUnauthorized means the client couldn't be authorized to use its name, e.g. it has no certificate
+	ErrorCodeUnauthorized
+	// ErrorCodeNameInvalid means the name breaks the length or character rules of the server
+	ErrorCodeNameInvalid
+	// ErrorCodeNameReserved means the name is reserved, e.g. "server"
+	ErrorCodeNameReserved
+	// ErrorCodeSenderMismatch means the sender of a message isn't the name the client registered with
+	ErrorCodeSenderMismatch
+	// ErrorCodeUnknownCommand means the server doesn't know the command, e.g. because it runs an older version.
+	// Clients can fall back to what older servers support
+	ErrorCodeUnknownCommand
 )
 
+var errorCodeNames = map[ErrorCode]string{
+	ErrorCodeUnknown:        "unknown",
+	ErrorCodeInvalidRequest: "invalid-request",
+	ErrorCodeNotFound:       "not-found",
+	ErrorCodeConflict:       "conflict",
+	ErrorCodeLimitExceeded:  "limit-exceeded",
+	ErrorCodeForbidden:      "forbidden",
+	ErrorCodeUnauthorized:   "unauthorized",
+	ErrorCodeNameInvalid:    "name-invalid",
+	ErrorCodeNameReserved:   "name-reserved",
+	ErrorCodeSenderMismatch: "sender-mismatch",
+	ErrorCodeUnknownCommand: "unknown-command",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("error-%d", uint16(c))
+}
+
+// Error is an error with a code, as carried by CommandError messages
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// NewErrorMessage creates a CommandError message for err. The data is "<code> <message>" with the code in
+// decimal. Errors that aren't an *Error get ErrorCodeUnknown
+func NewErrorMessage(sender string, err error) *Message {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: ErrorCodeUnknown, Message: err.Error()}
+	}
+	return &Message{
+		Command: CommandError,
+		Sender:  sender,
+		Data:    []byte(fmt.Sprintf("%d %s", e.Code, e.Message)),
+	}
+}
+
+// ErrorPayload returns the error a CommandError message carries. Data without a code, e.g. from older servers,
+// is returned as the message of an ErrorCodeUnknown error
+func (m *Message) ErrorPayload() *Error {
+	text := m.Text()
+	if i := strings.Index(text, " "); i != -1 {
+		if code, err := strconv.ParseUint(text[:i], 10, 16); err == nil {
+			return &Error{Code: ErrorCode(code), Message: text[i+1:]}
+		}
+	}
+	return &Error{Code: ErrorCodeUnknown, Message: text}
+}
+
+// DataType tags the payload of a CommandData message, so that bots know how to decode it. The meaning
+// of the tags is up to the bots, the server only routes the messages
+type DataType byte
+
+// NewDataMessage creates a CommandData message. The first byte of Data is the type tag, followed by the payload,
+// so the payload can be at most MaxDataByteSize-1 bytes
+func NewDataMessage(sender, receiver string, dataType DataType, payload []byte) *Message {
+	return &Message{
+		Command:  CommandData,
+		Sender:   sender,
+		Receiver: receiver,
+		Data:     append([]byte{byte(dataType)}, payload...),
+	}
+}
+
+// DataPayload splits the Data of a CommandData message into its type tag and payload
+func (m *Message) DataPayload() (DataType, []byte, error) {
+	if len(m.Data) == 0 {
+		return 0, nil, NoDataTypeError
+	}
+	return DataType(m.Data[0]), m.Data[1:], nil
+}
+
+// ServerIdentity is the URI SAN the chat server's certificate is issued with
+var ServerIdentity = IdentityURI("server")
+
+// IdentityURI returns a SPIFFE-style URI for the given path elements, e.g. spiffe://luxas/chat/server
+func IdentityURI(path ...string) string {
+	u := url.URL{
+		Scheme: "spiffe",
+		Host:   TrustDomain,
+		Path:   "/chat",
+	}
+	for _, p := range path {
+		u.Path += "/" + p
+	}
+	return u.String()
+}
+
+// ClientIdentity returns the URI identity a client with the given name is issued with
+func ClientIdentity(name string) string {
+	return IdentityURI("client", name)
+}
+
+// HasIdentity returns whether one of the URI SANs of the certificate chain's leaf matches identity
+func HasIdentity(chain []*x509.Certificate, identity string) bool {
+	if len(chain) == 0 {
+		return false
+	}
+	for _, u := range chain[0].URIs {
+		if u.String() == identity {
+			return true
+		}
+	}
+	return false
+}
+
 func NewConnection(c net.Conn) *Connection {
-	return &Connection{c, bufio.NewReader(c)}
+	return &Connection{c: c, r: bufio.NewReader(c), wmux: &sync.Mutex{}}
 }
 
 type Connection struct {
 	c net.Conn
 	r *bufio.Reader
+
+	// wmux makes sure concurrent Send calls don't interleave their messages
+	wmux         *sync.Mutex
+	writeTimeout time.Duration
+	// limiter shapes the outbound bandwidth, it's nil if the bandwidth isn't limited
+	limiter *rateLimiter
 }
 
-func (c *Connection) Send(msg *Message) error {
-	//log.Printf("Connection.Send called!")
-	if len(msg.Sender) > MaxNameByteSize {
-		return MaxNameSizeError
+// SetWriteTimeout makes Send give up after the given duration, so that a peer which doesn't read
+// can't block the sender indefinitely. Zero means no timeout
+func (c *Connection) SetWriteTimeout(d time.Duration) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	c.writeTimeout = d
+}
+
+// SetRateLimit limits the bytes Send writes per second, so that the connection can share a thin link with other
+// services. Send waits for the bandwidth before the write timeout starts. Zero means no limit
+func (c *Connection) SetRateLimit(bytesPerSecond int) {
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+	c.limiter = nil
+	if bytesPerSecond > 0 {
+		c.limiter = newRateLimiter(bytesPerSecond)
+	}
+}
+
+// MarshalBinary encodes the message as a frame on the wire, see PROTOCOL.md
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if len(m.Sender) > MaxNameByteSize {
+		return nil, MaxNameSizeError
+	}
+	if len(m.Receiver) > MaxNameByteSize {
+		return nil, MaxNameSizeError
+	}
+	if len(m.Data) > MaxDataByteSize {
+		return nil, MaxDataSizeError
+	}
+
+	data := make([]byte, 0, HeaderSize+len(m.Sender)+len(m.Receiver)+len(m.Data))
+	data = append(data, MessageStartBytes...)
+	data = append(data, byte(m.Command), byte(len(m.Sender)), byte(len(m.Receiver)), byte(len(m.Data)))
+	data = append(data, m.Sender...)
+	data = append(data, m.Receiver...)
+	data = append(data, m.Data...)
+	return data, nil
+}
+
+// ReadMessage reads and decodes a frame from r. If the command isn't Known, the whole frame is still read, and
+// the message is returned together with UnknownCommandError, so that the receiver can reject it and go on
+func ReadMessage(r io.Reader) (*Message, error) {
+	// Read may return less than asked for, e.g. when a message is split over several TCP segments,
+	// so read the full header and body to keep the stream in sync
+	headerbuf := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, headerbuf); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, ReceiveHeaderError
+		}
+		return nil, err
 	}
-	if len(msg.Receiver) > MaxNameByteSize {
-		return MaxNameSizeError
+	if !bytes.Equal(headerbuf[:2], MessageStartBytes) {
+		return nil, ReceiveHeaderError
 	}
-	if len(msg.Data) > MaxDataByteSize {
-		return MaxDataSizeError
+	senderSize := int(headerbuf[3])
+	receiverSize := int(headerbuf[4])
+	msgSize := int(headerbuf[5])
+
+	databuf := make([]byte, senderSize+receiverSize+msgSize)
+	if _, err := io.ReadFull(r, databuf); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
 	}
 
-	data := MessageStartBytes
-	data = append(data, []byte{byte(msg.Command), byte(len(msg.Sender)), byte(len(msg.Receiver)), byte(len(msg.Data))}...)
-	data = append(data, []byte(msg.Sender)...)
-	data = append(data, []byte(msg.Receiver)...)
-	data = append(data, []byte(msg.Data)...)
-	//log.Println(data)
+	msg := &Message{
+		Command:  Command(headerbuf[2]),
+		Sender:   string(databuf[:senderSize]),
+		Receiver: string(databuf[senderSize : senderSize+receiverSize]),
+		Data:     databuf[senderSize+receiverSize:],
+	}
+	if !msg.Command.Known() {
+		return msg, UnknownCommandError
+	}
+	return msg, nil
+}
 
+func (c *Connection) Send(msg *Message) error {
+	//log.Printf("Connection.Send called!")
+	data, err := msg.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.wmux.Lock()
+	defer c.wmux.Unlock()
+
+	if c.limiter != nil {
+		c.limiter.wait(len(data))
+	}
+	if c.writeTimeout != 0 {
+		if err := c.c.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return err
+		}
+	}
 	n, err := c.c.Write(data)
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		if n == 0 {
+			return SendTimeoutError
+		}
+		return PartialSendError
+	}
 	if err != nil {
 		return err
 	}
@@ -90,38 +443,23 @@ func (c *Connection) Send(msg *Message) error {
 
 func (c *Connection) Receive() (*Message, error) {
 	//log.Printf("Connection.Receive called!")
+	return ReadMessage(c.r)
+}
 
-	headerbuf := make([]byte, HeaderSize)
-	n, err := c.r.Read(headerbuf)
-	if err != nil {
-		return nil, err
+// PeerIdentity returns the first URI SAN of the certificate the peer presented during the TLS handshake
+func (c *Connection) PeerIdentity() (string, error) {
+	tlsConn, ok := c.c.(*tls.Conn)
+	if !ok {
+		return "", NoPeerIdentityError
 	}
-	if n != HeaderSize {
-		return nil, ReceiveHeaderError
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
 	}
-	if !bytes.Equal(headerbuf[:2], MessageStartBytes) {
-		return nil, ReceiveHeaderError
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 || len(certs[0].URIs) == 0 {
+		return "", NoPeerIdentityError
 	}
-	senderSize := headerbuf[3]
-	receiverSize := headerbuf[4]
-	msgSize := headerbuf[5]
-	totalSize := int(senderSize + receiverSize + msgSize)
-
-	databuf := make([]byte, totalSize)
-	n2, err := c.r.Read(databuf)
-	if err != nil {
-		return nil, err
-	}
-	if n2 != totalSize {
-		return nil, ReceiveHeaderError
-	}
-
-	return &Message{
-		Command:  Command(headerbuf[2]),
-		Sender:   string(databuf[:senderSize]),
-		Receiver: string(databuf[senderSize : senderSize+receiverSize]),
-		Data:     string(databuf[senderSize+receiverSize:]),
-	}, nil
+	return certs[0].URIs[0].String(), nil
 }
 
 func (c *Connection) Close() {
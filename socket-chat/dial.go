@@ -0,0 +1,83 @@
+package socketchat
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+)
+
+// ClientTLSConfig returns the TLS config of a client that trusts the servers with certificates issued by the CA in
+// caFile. The client presents the certificate in certFile and keyFile if they're set, and requires the server
+// certificate to carry serverIdentity if it's set
+func ClientTLSConfig(caFile, certFile, keyFile, serverIdentity string) (*tls.Config, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	certpool := x509.NewCertPool()
+	if ok := certpool.AppendCertsFromPEM(b); !ok {
+		return nil, fmt.Errorf("couldn't add ca cert to cert pool")
+	}
+	config := &tls.Config{
+		RootCAs:    certpool,
+		MinVersion: tls.VersionTLS13,
+	}
+	if certFile != "" {
+		cer, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cer}
+	}
+	if serverIdentity != "" {
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				if HasIdentity(chain, serverIdentity) {
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate does not have the identity %s", serverIdentity)
+		}
+	}
+	return config, nil
+}
+
+// Dial connects to the server at address, over TLS if config is set, and joins it as name. The server is told the
+// version of the client, and replies with its own version
+func Dial(network, address string, config *tls.Config, name, clientVersion string) (*Connection, error) {
+	var conn net.Conn
+	var err error
+	if config != nil {
+		conn, err = tls.Dial(network, address, config)
+	} else {
+		conn, err = net.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if conn == nil {
+		return nil, fmt.Errorf("couldn't trust the server for the given root CA")
+	}
+	c := NewConnection(conn)
+
+	err = c.Send(&Message{
+		Command: CommandNewClient,
+		Data:    []byte(name),
+	})
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to join server: %v", err)
+	}
+	err = c.Send(&Message{
+		Command: CommandVersion,
+		Sender:  name,
+		Data:    []byte(clientVersion),
+	})
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("failed to send version to server: %v", err)
+	}
+	return c, nil
+}
@@ -0,0 +1,34 @@
+// gen-spec writes the protocol spec, PROTOCOL.md, from the tables in spec.go. Run it with go generate
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+var outFile = flag.String("o", "", "The file to write the spec to, stdout if empty")
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintf(os.Stderr, "gen-spec: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	b := &strings.Builder{}
+	if err := socketchat.WriteSpec(b); err != nil {
+		return err
+	}
+	if *outFile == "" {
+		_, err := fmt.Print(b.String())
+		return err
+	}
+	return ioutil.WriteFile(*outFile, []byte(b.String()), 0644)
+}
@@ -1,3 +1,12 @@
 module github.com/luxas/random-schoolwork/socket-chat
 
-go 1.14
+go 1.18
+
+require github.com/luxas/random-schoolwork/pkg v0.0.0
+
+require (
+	golang.org/x/crypto v0.0.0-20200320181102-891825fb96df // indirect
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
+)
+
+replace github.com/luxas/random-schoolwork/pkg => ../pkg
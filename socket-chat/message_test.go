@@ -0,0 +1,200 @@
+package socketchat
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+// goldenFrames are the frames of every command, byte for byte: the start bytes 0x00 0xff, the command, the sizes
+// of the sender, receiver and data, and then the sender, receiver and data. They're written out by hand, so that a
+// change of the layout fails here even if MarshalBinary and ReadMessage are changed the same way
+var goldenFrames = []struct {
+	msg Message
+	// frame is hex, with spaces between the start bytes, the command, the sizes and the payload
+	frame string
+}{
+	{Message{Command: CommandNewClient, Data: []byte("foo")}, "00ff 01 000003 666f6f"},
+	{Message{Command: CommandNewChat, Sender: "foo", Data: []byte("g")}, "00ff 02 030001 666f6f67"},
+	{Message{Command: CommandJoinChat, Sender: "foo", Data: []byte("g")}, "00ff 03 030001 666f6f67"},
+	{Message{Command: CommandLeaveChat, Sender: "foo", Data: []byte("g")}, "00ff 04 030001 666f6f67"},
+	{Message{Command: CommandMessage, Sender: "foo", Receiver: "bar", Data: []byte("hi")}, "00ff 05 030302 666f6f6261726869"},
+	{Message{Command: CommandLeave, Sender: "foo"}, "00ff 06 030000 666f6f"},
+	{Message{Command: CommandError, Sender: "server", Receiver: "foo", Data: []byte("not-found: no")}, "00ff 07 06030d 736572766572666f6f6e6f742d666f756e643a206e6f"},
+	{Message{Command: CommandKick, Sender: "admin", Data: []byte("foo")}, "00ff 08 050003 61646d696e666f6f"},
+	{Message{Command: CommandBroadcast, Sender: "admin", Data: []byte("up")}, "00ff 09 050002 61646d696e7570"},
+	{Message{Command: CommandVersion, Sender: "foo", Data: []byte("v1")}, "00ff 0a 030002 666f6f7631"},
+	{Message{Command: CommandListMembers, Sender: "foo", Receiver: "g"}, "00ff 0b 030100 666f6f67"},
+	{Message{Command: CommandData, Sender: "bot", Receiver: "g", Data: []byte("\x01\x00\xff")}, "00ff 0c 030103 626f74670100ff"},
+	{Message{Command: CommandPin, Sender: "foo", Receiver: "g", Data: []byte("7")}, "00ff 0d 030101 666f6f6737"},
+	{Message{Command: CommandPins, Sender: "foo", Receiver: "g"}, "00ff 0e 030100 666f6f67"},
+	{Message{Command: CommandPreferences, Sender: "foo", Data: []byte("mute")}, "00ff 0f 030004 666f6f6d757465"},
+	{Message{Command: CommandTransferChat, Sender: "foo", Receiver: "g", Data: []byte("bar")}, "00ff 10 030103 666f6f67626172"},
+	{Message{Command: CommandDeleteChat, Sender: "foo", Receiver: "g"}, "00ff 11 030100 666f6f67"},
+	{Message{Command: CommandNewPrivateChat, Sender: "foo", Data: []byte("p")}, "00ff 12 030001 666f6f70"},
+	{Message{Command: CommandInvite, Sender: "foo", Receiver: "p"}, "00ff 13 030100 666f6f70"},
+	{Message{Command: CommandJoinCode, Sender: "foo", Data: []byte("c0de")}, "00ff 14 030004 666f6f63306465"},
+	{Message{Command: CommandRetention, Sender: "foo", Receiver: "g", Data: []byte("1h")}, "00ff 15 030102 666f6f673168"},
+	{Message{Command: CommandPurge, Sender: "foo", Receiver: "g"}, "00ff 16 030100 666f6f67"},
+	{Message{Command: CommandStats, Sender: "foo"}, "00ff 17 030000 666f6f"},
+	{Message{Command: CommandExportUser, Sender: "admin", Data: []byte("foo")}, "00ff 18 050003 61646d696e666f6f"},
+	{Message{Command: CommandDeleteUser, Sender: "admin", Data: []byte("foo")}, "00ff 19 050003 61646d696e666f6f"},
+	{Message{Command: CommandHeartbeat, Sender: "foo", Data: []byte("*")}, "00ff 1a 030001 666f6f2a"},
+	{Message{Command: CommandRead, Sender: "foo", Receiver: "bar", Data: []byte("9")}, "00ff 1b 030301 666f6f62617239"},
+	{Message{Command: CommandAddContact, Sender: "foo", Data: []byte("bar")}, "00ff 1c 030003 666f6f626172"},
+	{Message{Command: CommandRemoveContact, Sender: "foo", Data: []byte("bar")}, "00ff 1d 030003 666f6f626172"},
+	{Message{Command: CommandContacts, Sender: "foo"}, "00ff 1e 030000 666f6f"},
+	{Message{Command: CommandACL, Sender: "admin", Data: []byte("show")}, "00ff 1f 050004 61646d696e73686f77"},
+	{Message{Command: CommandChallenge, Sender: "foo", Data: []byte("42")}, "00ff 20 030002 666f6f3432"},
+	{Message{Command: CommandAnnouncements, Sender: "foo", Receiver: "g", Data: []byte("on")}, "00ff 21 030102 666f6f676f6e"},
+}
+
+func decodeGolden(t *testing.T, frame string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(strings.Replace(frame, " ", "", -1))
+	if err != nil {
+		t.Fatalf("invalid golden frame %q: %v", frame, err)
+	}
+	return b
+}
+
+func equalMessages(a, b *Message) bool {
+	return a.Command == b.Command && a.Sender == b.Sender && a.Receiver == b.Receiver && bytes.Equal(a.Data, b.Data)
+}
+
+func TestGoldenFramesCoverAllCommands(t *testing.T) {
+	seen := map[Command]bool{}
+	for _, g := range goldenFrames {
+		seen[g.msg.Command] = true
+	}
+	for c := CommandNewClient; c < commandEnd; c++ {
+		if !seen[c] {
+			t.Errorf("no golden frame for %s", c)
+		}
+	}
+}
+
+func TestMarshalBinary(t *testing.T) {
+	for _, g := range goldenFrames {
+		g := g
+		t.Run(g.msg.Command.String(), func(t *testing.T) {
+			want := decodeGolden(t, g.frame)
+			got, err := g.msg.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("MarshalBinary = %x, want %x", got, want)
+			}
+		})
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	for _, g := range goldenFrames {
+		g := g
+		t.Run(g.msg.Command.String(), func(t *testing.T) {
+			frame := decodeGolden(t, g.frame)
+			// The same frame follows, which must not be read into the first one
+			r := bytes.NewReader(append(frame, frame...))
+			for i := 0; i < 2; i++ {
+				got, err := ReadMessage(r)
+				if err != nil {
+					t.Fatalf("ReadMessage: %v", err)
+				}
+				if !equalMessages(got, &g.msg) {
+					t.Fatalf("ReadMessage = %+v, want %+v", got, g.msg)
+				}
+			}
+			if _, err := ReadMessage(r); err != io.EOF {
+				t.Fatalf("ReadMessage at the end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+func TestReadMessageMalformed(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		err   error
+	}{
+		{"empty", "", io.EOF},
+		{"truncated start", "00", ReceiveHeaderError},
+		{"truncated header", "00ff 05 0303", ReceiveHeaderError},
+		{"header without payload", "00ff 05 030302", io.ErrUnexpectedEOF},
+		{"truncated sender", "00ff 05 030302 666f", io.ErrUnexpectedEOF},
+		{"truncated data", "00ff 05 030302 666f6f62617268", io.ErrUnexpectedEOF},
+		{"wrong start bytes", "00fe 05 030302 666f6f6261726869", ReceiveHeaderError},
+		{"swapped start bytes", "ff00 05 030302 666f6f6261726869", ReceiveHeaderError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := ReadMessage(bytes.NewReader(decodeGolden(t, tt.frame)))
+			if err != tt.err {
+				t.Fatalf("ReadMessage error = %v, want %v", err, tt.err)
+			}
+			if msg != nil {
+				t.Fatalf("ReadMessage = %+v, want no message", msg)
+			}
+		})
+	}
+}
+
+func TestReadMessageUnknownCommand(t *testing.T) {
+	next := goldenFrames[0]
+	for _, frame := range []string{"00ff 00 000002 6869", "00ff fe 000002 6869"} {
+		// The whole frame is read, so that the next one can be
+		r := bytes.NewReader(append(decodeGolden(t, frame), decodeGolden(t, next.frame)...))
+		msg, err := ReadMessage(r)
+		if err != UnknownCommandError {
+			t.Fatalf("ReadMessage(%s) error = %v, want %v", frame, err, UnknownCommandError)
+		}
+		if msg == nil || msg.Command.Known() || string(msg.Data) != "hi" {
+			t.Fatalf("ReadMessage(%s) = %+v, want the unknown command with the data \"hi\"", frame, msg)
+		}
+		if got, err := ReadMessage(r); err != nil || !equalMessages(got, &next.msg) {
+			t.Fatalf("ReadMessage after the unknown command = %+v, %v, want %+v", got, err, next.msg)
+		}
+	}
+}
+
+func TestMarshalBinaryLimits(t *testing.T) {
+	name := strings.Repeat("n", MaxNameByteSize)
+	data := bytes.Repeat([]byte{0xab}, MaxDataByteSize)
+	tests := []struct {
+		name string
+		msg  Message
+		err  error
+	}{
+		{"longest sender", Message{Command: CommandMessage, Sender: name}, nil},
+		{"longest receiver", Message{Command: CommandMessage, Receiver: name}, nil},
+		{"largest data", Message{Command: CommandData, Data: data}, nil},
+		{"oversized sender", Message{Command: CommandMessage, Sender: name + "n"}, MaxNameSizeError},
+		{"oversized receiver", Message{Command: CommandMessage, Receiver: name + "n"}, MaxNameSizeError},
+		{"oversized data", Message{Command: CommandData, Data: append(data, 0xab)}, MaxDataSizeError},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			frame, err := tt.msg.MarshalBinary()
+			if err != tt.err {
+				t.Fatalf("MarshalBinary error = %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			want := HeaderSize + len(tt.msg.Sender) + len(tt.msg.Receiver) + len(tt.msg.Data)
+			if len(frame) != want || int(frame[3]) != len(tt.msg.Sender) || int(frame[4]) != len(tt.msg.Receiver) || int(frame[5]) != len(tt.msg.Data) {
+				t.Fatalf("MarshalBinary = %d bytes with the sizes %x, want %d bytes", len(frame), frame[3:6], want)
+			}
+			got, err := ReadMessage(bytes.NewReader(frame))
+			if err != nil || !equalMessages(got, &tt.msg) {
+				t.Fatalf("ReadMessage = %+v, %v, want %+v", got, err, tt.msg)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+// Package proxy is a debugging proxy that sits between chat clients and the server, and decodes, prints and
+// records the frames passing through in both directions, e.g. to debug changes to the protocol
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+var logger = logging.New(os.Stderr, "proxy")
+
+// flags are the flags of the proxy, separate from the ones of the other programs in the schoolwork binary
+var flags = flag.NewFlagSet("proxy", flag.ExitOnError)
+
+var listenAddress = flags.String("address", "localhost:6442", "What address and port to accept clients on")
+var serverAddress = flags.String("server", socketchat.DefaultServerAddress, "What server address and port to pass the clients through to")
+var tlsFlag = flags.Bool("tls", false, "Terminate TLS: serve the clients with --cert and --key, and connect to the server over TLS, verifying it with ca.crt. Without it, the clients and the server must not use TLS")
+var certFile = flags.String("cert", "server.crt", "The certificate to serve the clients with, issued by the local CA, with --tls")
+var keyFile = flags.String("key", "server.key", "The private key of --cert")
+var upstreamCertFile = flags.String("upstream-cert", "", "Client certificate to present to the server with --tls, e.g. client-<name>.crt")
+var upstreamKeyFile = flags.String("upstream-key", "", "Private key for the client certificate")
+var serverIdentity = flags.String("server-identity", "", fmt.Sprintf("If set, require the server certificate to carry this URI identity, e.g. %s", socketchat.ServerIdentity))
+var recordFile = flags.String("record", "", "Append every frame to this file as a JSON line, for later analysis")
+var quietFlag = flags.Bool("quiet", false, "Don't print the frames, only --record them")
+var versionFlag = version.RegisterFlag(flags)
+
+// Main runs the proxy with the command line arguments, without the program name
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+func run(args []string) error {
+	logger.RegisterFlags(flags)
+	if err := config.Parse(flags, "SOCKET_CHAT_PROXY", args); err != nil {
+		return err
+	}
+	if *versionFlag {
+		version.Print("proxy")
+		return nil
+	}
+	if flags.Arg(0) == "completion" {
+		cmd := completion.NewCommand("proxy", flags, completion.Subcommand())
+		return completion.Generate(os.Stdout, flags.Arg(1), cmd)
+	}
+	if *quietFlag && *recordFile == "" {
+		return fmt.Errorf("--quiet requires --record, or there's no output")
+	}
+
+	p := &proxy{mux: &sync.Mutex{}}
+	if *recordFile != "" {
+		// The frames contain the messages, so the record is only readable by its owner
+		f, err := os.OpenFile(*recordFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		p.record = f
+	}
+
+	ln, err := net.Listen(socketchat.DefaultServerProtocol, *listenAddress)
+	if err != nil {
+		return err
+	}
+	if *tlsFlag {
+		if p.upstreamTLS, err = socketchat.ClientTLSConfig("ca.crt", *upstreamCertFile, *upstreamKeyFile, *serverIdentity); err != nil {
+			return err
+		}
+		cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+		if err != nil {
+			return fmt.Errorf("couldn't load the certificate to serve the clients with, create it with \"server certs create-server\": %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	}
+	defer ln.Close()
+
+	logger.Infof("Passing clients on %s through to %s", *listenAddress, *serverAddress)
+	for id := 1; ; id++ {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go p.handleConn(id, c)
+	}
+}
+
+// proxy passes the connections of the clients through to the server
+type proxy struct {
+	// upstreamTLS is the TLS config towards the server, nil without --tls
+	upstreamTLS *tls.Config
+
+	// mux makes sure the frames of concurrent connections aren't interleaved in the output and the record
+	mux    *sync.Mutex
+	record io.Writer
+}
+
+func (p *proxy) handleConn(id int, client net.Conn) {
+	defer client.Close()
+	d := &net.Dialer{Timeout: socketchat.TimeoutDuration}
+	var server net.Conn
+	var err error
+	if p.upstreamTLS != nil {
+		server, err = tls.DialWithDialer(d, socketchat.DefaultServerProtocol, *serverAddress, p.upstreamTLS)
+	} else {
+		server, err = d.Dial(socketchat.DefaultServerProtocol, *serverAddress)
+	}
+	if err != nil {
+		logger.Warnf("Connection #%d from %s: couldn't connect to the server: %v", id, client.RemoteAddr(), err)
+		return
+	}
+	defer server.Close()
+	logger.Infof("Connection #%d from %s", id, client.RemoteAddr())
+
+	// When either side closes its connection, the other one is closed as well, which ends the other direction
+	done := make(chan struct{}, 2)
+	for _, dir := range []*direction{
+		{id: id, from: "client", src: client, dst: server},
+		{id: id, from: "server", src: server, dst: client},
+	} {
+		go func(dir *direction) {
+			p.pipe(dir)
+			done <- struct{}{}
+		}(dir)
+	}
+	<-done
+	client.Close()
+	server.Close()
+	<-done
+	logger.Infof("Connection #%d from %s closed", id, client.RemoteAddr())
+}
+
+// direction is one direction of a connection
+type direction struct {
+	id       int
+	from     string
+	src, dst net.Conn
+}
+
+func (d *direction) to() string {
+	if d.from == "client" {
+		return "server"
+	}
+	return "client"
+}
+
+// pipe passes the bytes from src through to dst as they arrive, and decodes the frames from a copy of them, so that
+// the proxy doesn't change what the peers see. If a frame can't be decoded, e.g. as the framing changed, the bytes
+// are passed through and printed as they are from then on
+func (p *proxy) pipe(d *direction) {
+	frames := &frameReader{r: bufio.NewReader(io.TeeReader(d.src, d.dst))}
+	for {
+		frames.raw.Reset()
+		msg, err := socketchat.ReadMessage(frames)
+		if err == io.EOF {
+			return
+		}
+		if err == socketchat.ReceiveHeaderError || err == io.ErrUnexpectedEOF {
+			p.output(d, &frame{Raw: frames.raw.Bytes(), Error: err.Error()})
+			p.dumpRaw(d, frames)
+			return
+		}
+		if err != nil && err != socketchat.UnknownCommandError {
+			if !isClosed(err) {
+				logger.Warnf("Connection #%d: failed to pass the %s's frames through: %v", d.id, d.from, err)
+			}
+			return
+		}
+		f := &frame{Command: msg.Command.String(), Sender: msg.Sender, Receiver: msg.Receiver, Data: msg.Data, Raw: frames.raw.Bytes()}
+		if err != nil {
+			f.Error = err.Error()
+		}
+		p.output(d, f)
+	}
+}
+
+// dumpRaw passes the rest of the stream through, and prints it as hex dumps of the chunks it arrives in
+func (p *proxy) dumpRaw(d *direction, frames *frameReader) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := frames.r.Read(buf)
+		if n != 0 {
+			p.output(d, &frame{Raw: buf[:n]})
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isClosed returns whether the error is from reading a connection the other direction closed
+func isClosed(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	return err != nil && err.Error() == "use of closed network connection"
+}
+
+// frameReader records the bytes the frame being decoded consists of
+type frameReader struct {
+	r   *bufio.Reader
+	raw bytes.Buffer
+}
+
+func (f *frameReader) Read(b []byte) (int, error) {
+	n, err := f.r.Read(b)
+	f.raw.Write(b[:n])
+	return n, err
+}
+
+// frame is a decoded frame, or bytes that couldn't be decoded, and a line of the record
+type frame struct {
+	Time       time.Time `json:"time"`
+	Connection int       `json:"connection"`
+	From       string    `json:"from"`
+	// Command is the name of the command, or Command(<value>) for unknown ones. It's empty if the bytes couldn't
+	// be decoded as a frame
+	Command  string `json:"command,omitempty"`
+	Sender   string `json:"sender,omitempty"`
+	Receiver string `json:"receiver,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+	// Raw is the frame as it was on the wire, hex-encoded
+	Raw   hexBytes `json:"raw"`
+	Error string   `json:"error,omitempty"`
+}
+
+type hexBytes []byte
+
+func (h hexBytes) MarshalJSON() ([]byte, error) {
+	return json.Marshal(hex.EncodeToString(h))
+}
+
+// output prints the frame, and appends it to the record
+func (p *proxy) output(d *direction, f *frame) {
+	f.Time, f.Connection, f.From = time.Now(), d.id, d.from
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	if !*quietFlag {
+		prefix := fmt.Sprintf("%s #%d %s -> %s:", f.Time.Format("15:04:05.000000"), d.id, d.from, d.to())
+		switch {
+		case f.Command != "":
+			fmt.Printf("%s %s sender=%q receiver=%q data=%q (%d bytes)", prefix, f.Command, f.Sender, f.Receiver, f.Data, len(f.Raw))
+			if f.Error != "" {
+				fmt.Printf(": %s", f.Error)
+			}
+			fmt.Println()
+		case f.Error != "":
+			fmt.Printf("%s undecodable frame: %s, passing the rest through as it is\n%s", prefix, f.Error, hex.Dump(f.Raw))
+		default:
+			fmt.Printf("%s %d bytes\n%s", prefix, len(f.Raw), hex.Dump(f.Raw))
+		}
+	}
+	if p.record == nil {
+		return
+	}
+	b, err := json.Marshal(f)
+	if err != nil {
+		logger.Errorf("Failed to record a frame: %v", err)
+		return
+	}
+	if _, err := p.record.Write(append(b, '\n')); err != nil {
+		logger.Errorf("Failed to record a frame: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package socketchat
+
+import "time"
+
+// maxFrameByteSize is the size of the largest message on the wire
+const maxFrameByteSize = 6 + 2*MaxNameByteSize + MaxDataByteSize
+
+// rateLimiter is a token bucket that shapes the bytes written per second. It allows bursts of a second's worth
+// of bytes, and at least one full message, so that any message can be sent
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	burst := float64(bytesPerSecond)
+	if burst < maxFrameByteSize {
+		burst = maxFrameByteSize
+	}
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be written
+func (l *rateLimiter) wait(n int) {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	if l.tokens < 0 {
+		// The debt is paid off while sleeping, the tokens are refilled from the time of the next call
+		time.Sleep(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+		l.tokens = 0
+		l.last = time.Now()
+	}
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// aclRejections counts the connections and registrations the access lists rejected
+var aclRejections = expvar.NewInt("acl_rejections")
+
+// The access lists, as they are named in admin edits
+const (
+	aclAllowCIDR = "allow-cidr"
+	aclDenyCIDR  = "deny-cidr"
+	aclAllowName = "allow-name"
+	aclDenyName  = "deny-name"
+)
+
+// accessList decides which addresses may connect and which names may register. A deny entry always wins, and
+// a non-empty allow list only lets the addresses or names on it in. Names are matched case-insensitively
+type accessList struct {
+	mux *sync.Mutex
+	// lists map the list name to its entries, CIDRs are kept in their canonical form
+	lists map[string]map[string]bool
+	// nets are the parsed CIDRs of the allow-cidr and deny-cidr lists
+	nets map[string][]*net.IPNet
+}
+
+// newAccessList creates the access lists from comma-separated entries
+func newAccessList(allowCIDRs, denyCIDRs, allowNames, denyNames string) (*accessList, error) {
+	a := &accessList{
+		mux:   &sync.Mutex{},
+		lists: map[string]map[string]bool{},
+		nets:  map[string][]*net.IPNet{},
+	}
+	for list, entries := range map[string]string{
+		aclAllowCIDR: allowCIDRs,
+		aclDenyCIDR:  denyCIDRs,
+		aclAllowName: allowNames,
+		aclDenyName:  denyNames,
+	} {
+		a.lists[list] = map[string]bool{}
+		for _, entry := range strings.Split(entries, ",") {
+			if entry == "" {
+				continue
+			}
+			if err := a.add(list, entry); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return a, nil
+}
+
+// parseCIDR parses a CIDR, or a single IP address
+func parseCIDR(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address or CIDR %q", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipnet, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, fmt.Errorf("invalid IP address or CIDR %q", entry)
+	}
+	return ipnet, nil
+}
+
+// add adds an entry to a list. The caller must hold mux, or own the access list
+func (a *accessList) add(list, entry string) error {
+	switch list {
+	case aclAllowCIDR, aclDenyCIDR:
+		ipnet, err := parseCIDR(entry)
+		if err != nil {
+			return err
+		}
+		if a.lists[list][ipnet.String()] {
+			return nil
+		}
+		a.lists[list][ipnet.String()] = true
+		a.nets[list] = append(a.nets[list], ipnet)
+	case aclAllowName, aclDenyName:
+		a.lists[list][strings.ToLower(entry)] = true
+	default:
+		return fmt.Errorf("unknown access list %q, expected %s, %s, %s or %s", list, aclAllowCIDR, aclDenyCIDR, aclAllowName, aclDenyName)
+	}
+	return nil
+}
+
+// remove removes an entry from a list, and returns false if it wasn't on it. The caller must hold mux
+func (a *accessList) remove(list, entry string) (bool, error) {
+	switch list {
+	case aclAllowCIDR, aclDenyCIDR:
+		ipnet, err := parseCIDR(entry)
+		if err != nil {
+			return false, err
+		}
+		if !a.lists[list][ipnet.String()] {
+			return false, nil
+		}
+		delete(a.lists[list], ipnet.String())
+		nets := a.nets[list][:0]
+		for _, n := range a.nets[list] {
+			if n.String() != ipnet.String() {
+				nets = append(nets, n)
+			}
+		}
+		a.nets[list] = nets
+	case aclAllowName, aclDenyName:
+		if !a.lists[list][strings.ToLower(entry)] {
+			return false, nil
+		}
+		delete(a.lists[list], strings.ToLower(entry))
+	default:
+		return false, fmt.Errorf("unknown access list %q, expected %s, %s, %s or %s", list, aclAllowCIDR, aclDenyCIDR, aclAllowName, aclDenyName)
+	}
+	return true, nil
+}
+
+// allowsAddr returns whether a client may connect from the address. Addresses that aren't IP addresses, e.g.
+// unix sockets, are allowed
+func (a *accessList) allowsAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	contains := func(list string) bool {
+		for _, n := range a.nets[list] {
+			if n.Contains(tcpAddr.IP) {
+				return true
+			}
+		}
+		return false
+	}
+	if contains(aclDenyCIDR) {
+		return false
+	}
+	return len(a.nets[aclAllowCIDR]) == 0 || contains(aclAllowCIDR)
+}
+
+// allowsName returns whether a client may register with the name
+func (a *accessList) allowsName(name string) bool {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	name = strings.ToLower(name)
+	if a.lists[aclDenyName][name] {
+		return false
+	}
+	return len(a.lists[aclAllowName]) == 0 || a.lists[aclAllowName][name]
+}
+
+// edit applies an edit from the admin API, "<list> add|remove <entry>", or "list" to only show the lists.
+// It returns the lists after the edit
+func (a *accessList) edit(command string) (string, error) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	fields := strings.Fields(command)
+	switch {
+	case len(fields) == 1 && fields[0] == "list":
+	case len(fields) == 3 && fields[1] == "add":
+		if err := a.add(fields[0], fields[2]); err != nil {
+			return "", codedError(socketchat.ErrorCodeInvalidRequest, "%v", err)
+		}
+		logger.Infof("Added %s to the %s access list", fields[2], fields[0])
+	case len(fields) == 3 && fields[1] == "remove":
+		ok, err := a.remove(fields[0], fields[2])
+		if err != nil {
+			return "", codedError(socketchat.ErrorCodeInvalidRequest, "%v", err)
+		}
+		if !ok {
+			return "", codedError(socketchat.ErrorCodeNotFound, "%s is not on the %s access list", fields[2], fields[0])
+		}
+		logger.Infof("Removed %s from the %s access list", fields[2], fields[0])
+	default:
+		return "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid access list edit %q, expected list or <list> add|remove <entry>", command)
+	}
+	return a.String(), nil
+}
+
+// String returns the entries of all lists, one list per line. The caller must hold mux
+func (a *accessList) String() string {
+	lines := []string{}
+	for _, list := range []string{aclAllowCIDR, aclDenyCIDR, aclAllowName, aclDenyName} {
+		entries := make([]string, 0, len(a.lists[list]))
+		for entry := range a.lists[list] {
+			entries = append(entries, entry)
+		}
+		sort.Strings(entries)
+		lines = append(lines, fmt.Sprintf("%s: %s", list, strings.Join(entries, ",")))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+var adminFlags = flag.NewFlagSet("admin", flag.ExitOnError)
+var adminSocketFlag = adminFlags.String("admin-socket", socketchat.DefaultAdminSocket, "What unix socket the server accepts admin commands on")
+
+// adminCommands map the admin subcommand name to the command sent to the server
+var adminCommands = map[string]socketchat.Command{
+	"kick":        socketchat.CommandKick,
+	"broadcast":   socketchat.CommandBroadcast,
+	"purge":       socketchat.CommandPurge,
+	"export-user": socketchat.CommandExportUser,
+	"delete-user": socketchat.CommandDeleteUser,
+	"acl":         socketchat.CommandACL,
+}
+
+// adminCmd sends an admin command to a running server over its admin socket, and prints the result
+func adminCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: server %s", adminUsage)
+	}
+	command, ok := adminCommands[args[0]]
+	if !ok {
+		return fmt.Errorf("unknown admin subcommand %q", args[0])
+	}
+	_ = adminFlags.Parse(args[1:])
+	if adminFlags.NArg() < 1 && command != socketchat.CommandPurge {
+		return fmt.Errorf("usage: server %s", adminUsage)
+	}
+
+	conn, err := net.Dial("unix", *adminSocketFlag)
+	if err != nil {
+		return err
+	}
+	c := socketchat.NewConnection(conn)
+	defer c.Close()
+
+	if err := c.Send(&socketchat.Message{
+		Command: command,
+		Sender:  "admin",
+		Data:    []byte(strings.Join(adminFlags.Args(), " ")),
+	}); err != nil {
+		return err
+	}
+
+	// Long results are split into several messages, the server closes the connection after the last one
+	result := []byte{}
+	for {
+		resp, err := c.Receive()
+		if err == io.EOF && len(result) != 0 {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if resp.Command == socketchat.CommandError {
+			return fmt.Errorf("server returned an error: %v", resp.ErrorPayload())
+		}
+		result = append(result, resp.Data...)
+	}
+	fmt.Println(string(result))
+	return nil
+}
+
+// AdminListener listens for admin commands on a unix socket. Access to it is controlled by the file permissions
+func (s *Server) AdminListener(socketPath string) (net.Listener, error) {
+	// Remove the socket file a previous server instance may have left behind
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+func (s *Server) serveAdmin(ln net.Listener) {
+	defer crashes.Fatal("admin listener")
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			logger.Errorf("Admin listener stopped: %v", err)
+			return
+		}
+		go s.handleAdminConn(socketchat.NewConnection(c))
+	}
+}
+
+func (s *Server) handleAdminConn(c *socketchat.Connection) {
+	defer crashes.Recover("admin connection handler")
+	defer c.Close()
+
+	msg, err := c.Receive()
+	if err == socketchat.UnknownCommandError {
+		logger.Warnf("Admin sent unknown command %d", msg.Command)
+		s.returnErrorToClient(c, codedError(socketchat.ErrorCodeUnknownCommand, "unknown command %d", msg.Command))
+		return
+	}
+	if err != nil {
+		logger.Warnf("error reading admin message: %v", err)
+		return
+	}
+	logger.Infof("Admin message received: %d %q", msg.Command, msg.Text())
+
+	var result string
+	switch msg.Command {
+	case socketchat.CommandKick:
+		err = s.kick(msg.Text())
+		result = fmt.Sprintf("Kicked client %s", msg.Text())
+	case socketchat.CommandBroadcast:
+		err = s.broadcast(msg.Text())
+		result = "Broadcasted message to all clients"
+	case socketchat.CommandPurge:
+		result = purgeStats(s.purge())
+	case socketchat.CommandExportUser:
+		result, err = s.exportUser(msg.Text())
+	case socketchat.CommandDeleteUser:
+		result = s.deleteUser(msg.Text())
+	case socketchat.CommandACL:
+		result, err = s.acl.edit(msg.Text())
+	default:
+		err = codedError(socketchat.ErrorCodeInvalidRequest, "unknown admin command %d", msg.Command)
+	}
+	if err != nil {
+		s.returnErrorToClient(c, err)
+		return
+	}
+
+	if err := sendAdminResult(c, result); err != nil {
+		logger.Warnf("Failed to return result to admin: %v", err)
+	}
+}
+
+// kick notifies the client that it's been kicked, and closes its connection
+func (s *Server) kick(name string) error {
+	if len(s.GetConnections(name)) == 0 {
+		return codedError(socketchat.ErrorCodeNotFound, "client %q not found", name)
+	}
+	_ = s.notifyClients(name, "You have been kicked from the server by an admin")
+	s.dropConnections(name)
+	logger.Infof("Client %s was kicked from the server", name)
+	s.emitWebhook(webhookEventKick, "", name, "")
+	return nil
+}
+
+// broadcast sends a message from the server to all connected clients
+func (s *Server) broadcast(message string) error {
+	s.connsMux.Lock()
+	names := make([]string, 0, len(s.conns))
+	for name := range s.conns {
+		names = append(names, name)
+	}
+	s.connsMux.Unlock()
+
+	for _, name := range names {
+		if err := s.notifyClients(name, message); err != nil {
+			logger.Warnf("Failed to broadcast to client %s: %v", name, err)
+		}
+	}
+	return nil
+}
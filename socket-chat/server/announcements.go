@@ -0,0 +1,57 @@
+package server
+
+import (
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// setGroupAnnouncements makes a group an announcement group or a normal one again, where the data is
+// "<group>,on" or "<group>,off"
+func (s *Server) setGroupAnnouncements(data string) (string, bool, error) {
+	i := strings.LastIndex(data, ",")
+	if i == -1 {
+		return "", false, codedError(socketchat.ErrorCodeInvalidRequest, "invalid announcements request %q, expected <group>,on|off", data)
+	}
+	groupName := data[:i]
+	var announcements bool
+	switch data[i+1:] {
+	case "on":
+		announcements = true
+	case "off":
+		announcements = false
+	default:
+		return "", false, codedError(socketchat.ErrorCodeInvalidRequest, "invalid announcements mode %q, expected on or off", data[i+1:])
+	}
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, err := s.getGroup(groupName)
+	if err != nil {
+		return "", false, err
+	}
+	g.announcements = announcements
+	return groupName, announcements, nil
+}
+
+// authorizeAnnouncement returns an error if the message is a message or data to an announcement group, and the
+// client is neither the owner of the group nor an operator
+func (s *Server) authorizeAnnouncement(client string, clientRole role, msg *socketchat.Message) error {
+	if msg.Command != socketchat.CommandMessage && msg.Command != socketchat.CommandData {
+		return nil
+	}
+	// Like when sending, a client with the name of the receiver takes precedence over a group
+	if clientRole >= roleOperator || len(s.GetConnections(msg.Receiver)) != 0 {
+		return nil
+	}
+
+	s.groupsMux.Lock()
+	g, ok := s.groups[msg.Receiver]
+	readOnly := ok && g.announcements && g.owner != client
+	s.groupsMux.Unlock()
+	if readOnly {
+		return codedError(socketchat.ErrorCodeForbidden, "group %s is for announcements, only its owner can send to it", msg.Receiver)
+	}
+	return nil
+}
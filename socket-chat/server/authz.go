@@ -0,0 +1,118 @@
+package server
+
+import (
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// role decides which commands a client may send, see commandRoles. Every role may do what the roles below it may
+type role int
+
+const (
+	// roleGuest is given to clients without a client certificate, when the server authorizes peers but allows guests
+	roleGuest role = iota
+	// roleUser is given to authorized clients, or all clients if the server doesn't authorize peers
+	roleUser
+	// roleGroupAdmin isn't given to clients, but is what they have for the groups they own
+	roleGroupAdmin
+	// roleOperator is given to authorized clients listed in --operators. Operators administer all groups
+	roleOperator
+)
+
+var roleNames = map[role]string{
+	roleGuest:      "guest",
+	roleUser:       "user",
+	roleGroupAdmin: "group-admin",
+	roleOperator:   "operator",
+}
+
+func (r role) String() string {
+	return roleNames[r]
+}
+
+// commandRoles map the commands clients may send to the lowest role that may send them. Commands not in the
+// map can't be sent by clients
+var commandRoles = map[socketchat.Command]role{
+	socketchat.CommandVersion:        roleGuest,
+	socketchat.CommandMessage:        roleGuest,
+	socketchat.CommandLeave:          roleGuest,
+	socketchat.CommandJoinChat:       roleGuest,
+	socketchat.CommandJoinCode:       roleGuest,
+	socketchat.CommandLeaveChat:      roleGuest,
+	socketchat.CommandListMembers:    roleGuest,
+	socketchat.CommandPins:           roleGuest,
+	socketchat.CommandPreferences:    roleGuest,
+	socketchat.CommandStats:          roleGuest,
+	socketchat.CommandHeartbeat:      roleGuest,
+	socketchat.CommandRead:           roleGuest,
+	socketchat.CommandAddContact:     roleGuest,
+	socketchat.CommandRemoveContact:  roleGuest,
+	socketchat.CommandContacts:       roleGuest,
+	socketchat.CommandData:           roleUser,
+	socketchat.CommandNewChat:        roleUser,
+	socketchat.CommandNewPrivateChat: roleUser,
+	socketchat.CommandPin:            roleGroupAdmin,
+	socketchat.CommandInvite:         roleGroupAdmin,
+	socketchat.CommandTransferChat:   roleGroupAdmin,
+	socketchat.CommandRetention:      roleGroupAdmin,
+	socketchat.CommandAnnouncements:  roleGroupAdmin,
+	socketchat.CommandDeleteChat:     roleGroupAdmin,
+	socketchat.CommandKick:           roleOperator,
+	socketchat.CommandBroadcast:      roleOperator,
+}
+
+// clientRole returns the role of a client when it registers. authorized tells whether the client was authorized by
+// its certificate, which is required for the operator role
+func clientRole(name string, authorized bool) role {
+	if !*authorizePeers {
+		return roleUser
+	}
+	if !authorized {
+		return roleGuest
+	}
+	if tuned().operators[name] {
+		return roleOperator
+	}
+	return roleUser
+}
+
+// authorize returns an error if a client with the given role may not send the message. Group admin commands
+// are allowed for the owner of the group the command is for, and so is sending to announcement groups
+func (s *Server) authorize(client string, clientRole role, msg *socketchat.Message) error {
+	required, ok := commandRoles[msg.Command]
+	if !ok {
+		return codedError(socketchat.ErrorCodeForbidden, "command %d can't be sent by clients", msg.Command)
+	}
+	if err := s.authorizeAnnouncement(client, clientRole, msg); err != nil {
+		return err
+	}
+	if clientRole >= required {
+		return nil
+	}
+	if required == roleGroupAdmin && clientRole >= roleUser {
+		groupName := commandGroup(msg)
+		s.groupsMux.Lock()
+		g, ok := s.groups[groupName]
+		isOwner := ok && g.owner == client
+		s.groupsMux.Unlock()
+		if isOwner {
+			return nil
+		}
+		return codedError(socketchat.ErrorCodeForbidden, "only the owner of group %s can do that", groupName)
+	}
+	return codedError(socketchat.ErrorCodeForbidden, "a %s can't do that, it requires the %s role", clientRole, required)
+}
+
+// commandGroup returns the group a group admin command is for. It's the data of CommandDeleteChat, and the
+// first field of the "<group>,<argument>" data of the other commands
+func commandGroup(msg *socketchat.Message) string {
+	data := msg.Text()
+	if msg.Command == socketchat.CommandDeleteChat {
+		return data
+	}
+	if i := strings.LastIndex(data, ","); i != -1 {
+		return data[:i]
+	}
+	return data
+}
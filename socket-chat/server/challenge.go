@@ -0,0 +1,44 @@
+package server
+
+import (
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// maxPendingMessages is how many messages a client may send before it has solved the registration challenge
+const maxPendingMessages = 10
+
+// challengeClient makes a client solve a registration challenge, if --registration-challenge-bits is set. The
+// messages the client sent before the solution are returned, so that they can be handled once it's registered
+func (s *Server) challengeClient(c *socketchat.Connection, name string) ([]*socketchat.Message, error) {
+	difficulty := *registrationChallengeBits
+	if difficulty == 0 {
+		return nil, nil
+	}
+	msg, challenge, err := socketchat.NewChallenge(serverName, difficulty)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Send(msg); err != nil {
+		return nil, err
+	}
+
+	pending := []*socketchat.Message{}
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if msg.Command != socketchat.CommandChallenge {
+			if len(pending) >= maxPendingMessages {
+				return nil, codedError(socketchat.ErrorCodeLimitExceeded, "at most %d messages can be sent before solving the registration challenge", maxPendingMessages)
+			}
+			pending = append(pending, msg)
+			continue
+		}
+		if !socketchat.VerifyChallenge(challenge, difficulty, msg.Text()) {
+			return nil, codedError(socketchat.ErrorCodeUnauthorized, "wrong solution to the registration challenge")
+		}
+		logger.Debugf("Client %s solved the registration challenge", name)
+		return pending, nil
+	}
+}
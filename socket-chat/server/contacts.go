@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sort"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// maxContacts is how many contacts a client can have
+const maxContacts = 200
+
+// The presence of a contact, as the data of CommandContacts replies
+const (
+	presenceOnline  = "online"
+	presenceOffline = "offline"
+)
+
+// addContact adds a contact to the roster of a client. Contacts don't need to be connected, or to exist yet
+func (s *Server) addContact(name, contact string) error {
+	if err := tuned().names.validate(contact); err != nil {
+		// Name errors are about the name of the client itself, see the client's error handling
+		return codedError(socketchat.ErrorCodeInvalidRequest, "invalid contact: %v", err)
+	}
+	if contact == name {
+		return codedError(socketchat.ErrorCodeInvalidRequest, "you can't add yourself as a contact")
+	}
+
+	s.contactsMux.Lock()
+	defer s.contactsMux.Unlock()
+
+	roster, ok := s.contacts[name]
+	if !ok {
+		roster = map[string]struct{}{}
+		s.contacts[name] = roster
+	}
+	if _, ok := roster[contact]; ok {
+		return codedError(socketchat.ErrorCodeConflict, "%s is already a contact", contact)
+	}
+	if len(roster) >= maxContacts {
+		return codedError(socketchat.ErrorCodeLimitExceeded, "you can have at most %d contacts", maxContacts)
+	}
+	roster[contact] = struct{}{}
+	return nil
+}
+
+// removeContact removes a contact from the roster of a client
+func (s *Server) removeContact(name, contact string) error {
+	s.contactsMux.Lock()
+	defer s.contactsMux.Unlock()
+
+	if _, ok := s.contacts[name][contact]; !ok {
+		return codedError(socketchat.ErrorCodeNotFound, "%s is not a contact", contact)
+	}
+	delete(s.contacts[name], contact)
+	if len(s.contacts[name]) == 0 {
+		delete(s.contacts, name)
+	}
+	return nil
+}
+
+// contactList returns the contacts of a client, sorted by name
+func (s *Server) contactList(name string) []string {
+	s.contactsMux.Lock()
+	defer s.contactsMux.Unlock()
+
+	contacts := make([]string, 0, len(s.contacts[name]))
+	for contact := range s.contacts[name] {
+		contacts = append(contacts, contact)
+	}
+	sort.Strings(contacts)
+	return contacts
+}
+
+// sendContacts sends the contacts of a client with their presence, one message per contact with the contact as
+// the receiver, and returns how many there were
+func (s *Server) sendContacts(c *socketchat.Connection, name string) (int, error) {
+	contacts := s.contactList(name)
+	for _, contact := range contacts {
+		presence := presenceOffline
+		if len(s.GetConnections(contact)) != 0 {
+			presence = presenceOnline
+		}
+		if err := c.Send(&socketchat.Message{
+			Command:  socketchat.CommandContacts,
+			Sender:   serverName,
+			Receiver: contact,
+			Data:     []byte(presence),
+		}); err != nil {
+			return 0, err
+		}
+	}
+	return len(contacts), nil
+}
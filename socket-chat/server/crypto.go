@@ -1,18 +1,45 @@
-package main
+package server
 
 import (
 	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/pem"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"math/big"
 	"net"
+	"net/url"
 	"os"
+	"strings"
+	"sync"
 	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+const (
+	// clockSkew is how much NotBefore is backdated, so peers with slightly lagging clocks accept new certificates
+	clockSkew = 5 * time.Minute
+	// maxSerialGenRetries is how many times a colliding serial number is regenerated before giving up
+	maxSerialGenRetries = 10
+	// serialsFile records the serial numbers issued by the CA, one per line, so that no serial is ever reused
+	serialsFile = "ca.serials"
+)
+
+var (
+	// serialLimit bounds serial numbers to 159 bits, so their positive DER encoding fits in the 20 bytes allowed by RFC 5280
+	serialLimit = new(big.Int).Lsh(big.NewInt(1), 20*8-1)
+
+	// issuedSerialsMux guards serialsFile
+	issuedSerialsMux = &sync.Mutex{}
+
+	// ocspServerURL is put in the certificates issued by the CA, if the OCSP responder is enabled
+	ocspServerURL = ""
 )
 
 type CertUsage int
@@ -23,15 +50,162 @@ const (
 	CertUsageClient
 )
 
+// CreateServerCerts creates the CA unless it already exists, and issues a new server certificate from it
 func CreateServerCerts() error {
-	caCert, caKey, err := genCert("ca", CertUsageCA, nil, nil, nil)
+	if _, err := os.Stat("ca.crt"); os.IsNotExist(err) {
+		if err := CreateCA(); err != nil {
+			return err
+		}
+	}
+	return CreateServerCert(serverSANs)
+}
+
+// serverSANs are the SANs the server's leaf certificate is issued with by default
+var serverSANs = []string{"127.0.0.1", "localhost", socketchat.ServerIdentity}
+
+// CreateCA creates a new self-signed CA. Certificates issued by a previous CA are no longer trusted
+func CreateCA() error {
+	// The new CA starts with a clean serial number record
+	if err := os.Remove(serialsFile); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	_, _, err := genCert("ca", CertUsageCA, nil, nil, nil)
+	return err
+}
+
+// CreateServerCert issues a server certificate with the given SANs from the CA on disk
+func CreateServerCert(sans []string) error {
+	caCert, caKey, err := loadCert("ca")
 	if err != nil {
 		return err
 	}
-	_, _, err = genCert("server", CertUsageServer, caCert, caKey, []string{"127.0.0.1", "localhost"})
+	_, _, err = genCert("server", CertUsageServer, caCert, caKey, sans)
 	return err
 }
 
+// CreateClientCert issues a client certificate for the given name from the CA on disk. The certificate
+// carries the client's URI identity, which the server authorizes the client by
+func CreateClientCert(name string) error {
+	caCert, caKey, err := loadCert("ca")
+	if err != nil {
+		return err
+	}
+	_, _, err = genCert("client-"+name, CertUsageClient, caCert, caKey, []string{socketchat.ClientIdentity(name)})
+	return err
+}
+
+// newSerialNumber returns a random, positive serial number that hasn't been issued before, and records it
+func newSerialNumber() (*big.Int, error) {
+	issuedSerialsMux.Lock()
+	defer issuedSerialsMux.Unlock()
+
+	issued, err := readIssuedSerials()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < maxSerialGenRetries; i++ {
+		serialNum, err := rand.Int(rand.Reader, serialLimit)
+		if err != nil {
+			return nil, err
+		}
+		// Zero is not a valid serial number
+		if serialNum.Sign() == 0 || issued[serialNum.String()] {
+			continue
+		}
+
+		f, err := os.OpenFile(serialsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintln(f, serialNum.String()); err != nil {
+			return nil, err
+		}
+		return serialNum, nil
+	}
+	return nil, fmt.Errorf("couldn't generate an unique serial number in %d tries", maxSerialGenRetries)
+}
+
+// isIssuedSerial returns whether the CA has issued a certificate with the given serial number
+func isIssuedSerial(serial *big.Int) (bool, error) {
+	issuedSerialsMux.Lock()
+	defer issuedSerialsMux.Unlock()
+
+	issued, err := readIssuedSerials()
+	if err != nil {
+		return false, err
+	}
+	return issued[serial.String()], nil
+}
+
+// readIssuedSerials reads serialsFile. The caller must hold issuedSerialsMux
+func readIssuedSerials() (map[string]bool, error) {
+	issued := map[string]bool{}
+	b, err := ioutil.ReadFile(serialsFile)
+	if os.IsNotExist(err) {
+		return issued, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if line != "" {
+			issued[line] = true
+		}
+	}
+	return issued, nil
+}
+
+// subjectKeyID computes the key identifier of a public key per RFC 5280, section 4.2.1.2, method (1)
+func subjectKeyID(pub crypto.PublicKey) ([]byte, error) {
+	pubBytes, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	// Hash only the subjectPublicKey BIT STRING contents, not the algorithm identifier
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(pubBytes, &spki); err != nil {
+		return nil, err
+	}
+	ski := sha1.Sum(spki.PublicKey.Bytes)
+	return ski[:], nil
+}
+
+func loadCert(fileprefix string) (*x509.Certificate, crypto.Signer, error) {
+	certPEM, err := ioutil.ReadFile(fileprefix + ".crt")
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(fileprefix + ".key")
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data found in %s.crt", fileprefix)
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no PEM data found in %s.key", fileprefix)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("key in %s.key can't be used for signing", fileprefix)
+	}
+	return cert, signer, nil
+}
+
 func genCert(fileprefix string, usage CertUsage, caCert *x509.Certificate, caKey crypto.Signer, sans []string) (*x509.Certificate, crypto.Signer, error) {
 	_, key, err := ed25519.GenerateKey(rand.Reader)
 	//key, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -52,29 +226,47 @@ func genCert(fileprefix string, usage CertUsage, caCert *x509.Certificate, caKey
 		StreetAddress: []string{"At the beach"},
 	}
 
-	serialNum, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 16*8)) // the maximum valid serial number is 20 bytes
+	serialNum, err := newSerialNumber()
 	if err != nil {
 		return nil, nil, err
 	}
+	ski, err := subjectKeyID(key.Public())
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
 	cert := &x509.Certificate{
 		SerialNumber:          serialNum,
 		Subject:               name,
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0),
+		NotBefore:             now.Add(-clockSkew),
+		NotAfter:              now.AddDate(1, 0, 0),
 		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		BasicConstraintsValid: true,
+		SubjectKeyId:          ski,
 	}
 
 	for _, san := range sans {
 		if ip := net.ParseIP(san); ip != nil {
 			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else if u, err := url.Parse(san); err == nil && strings.Contains(san, "://") {
+			cert.URIs = append(cert.URIs, u)
 		} else {
 			cert.DNSNames = append(cert.DNSNames, san)
 		}
 	}
 
+	if usage&CertUsageServer != 0 && len(sans) == 0 {
+		return nil, nil, fmt.Errorf("server certificate %s must have at least one SAN", fileprefix)
+	}
+
 	if caCert == nil {
 		caCert = cert
+	} else {
+		// Let clients build the chain through the CA's key identifier
+		cert.AuthorityKeyId = caCert.SubjectKeyId
+		if ocspServerURL != "" {
+			cert.OCSPServer = []string{ocspServerURL}
+		}
 	}
 	if caKey == nil {
 		caKey = key
@@ -115,15 +307,15 @@ func genCert(fileprefix string, usage CertUsage, caCert *x509.Certificate, caKey
 	for _, file := range files {
 		keyOut, err := os.OpenFile(file.filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
-			return nil, nil, fmt.Errorf("Failed to open key.pem for writing: %v", err)
+			return nil, nil, fmt.Errorf("Failed to open %s for writing: %v", file.filename, err)
 		}
 		if err := pem.Encode(keyOut, &pem.Block{Type: file.pemType, Bytes: file.bytes}); err != nil {
-			return nil, nil, fmt.Errorf("Failed to write data to key.pem: %v", err)
+			return nil, nil, fmt.Errorf("Failed to write data to %s: %v", file.filename, err)
 		}
 		if err := keyOut.Close(); err != nil {
-			return nil, nil, fmt.Errorf("Error closing key.pem: %v", err)
+			return nil, nil, fmt.Errorf("Error closing %s: %v", file.filename, err)
 		}
-		log.Printf("Wrote %s\n", file.filename)
+		logger.Infof("Wrote %s", file.filename)
 	}
 	return cert, key, nil
 }
@@ -0,0 +1,153 @@
+//go:build faults
+// +build faults
+
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This file is only built with -tags faults, for testing how the server and clients cope with a bad network
+
+var faultsFlag = serveFlags.String("faults", "", "Comma-separated faults to inject into client connections: latency=<duration>, partial=<probability> and reset=<probability>")
+
+// faultConfig are the faults injected into every accepted connection
+type faultConfig struct {
+	// latency delays every write
+	latency time.Duration
+	// partial is the probability that a write is split in two, with a pause in between
+	partial float64
+	// reset is the probability that a read or write closes the connection instead
+	reset float64
+}
+
+// currentFaults holds the faultConfig in use, the tests change it while connections are open
+var currentFaults atomic.Value
+
+func injected() faultConfig {
+	return currentFaults.Load().(faultConfig)
+}
+
+// setupFaults parses --faults
+func setupFaults() error {
+	faults := faultConfig{}
+	for _, fault := range strings.Split(*faultsFlag, ",") {
+		if fault == "" {
+			continue
+		}
+		i := strings.Index(fault, "=")
+		if i == -1 {
+			return fmt.Errorf("invalid fault %q, expected <fault>=<value>", fault)
+		}
+		key, value := fault[:i], fault[i+1:]
+		var err error
+		switch key {
+		case "latency":
+			faults.latency, err = time.ParseDuration(value)
+		case "partial":
+			faults.partial, err = parseProbability(value)
+		case "reset":
+			faults.reset, err = parseProbability(value)
+		default:
+			return fmt.Errorf("unknown fault %q, expected latency, partial or reset", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value %q for fault %s: %v", value, key, err)
+		}
+	}
+	currentFaults.Store(faults)
+	if *faultsFlag != "" {
+		logger.Warnf("Injecting faults into client connections: %s", *faultsFlag)
+	}
+	return nil
+}
+
+func parseProbability(value string) (float64, error) {
+	p, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if p < 0 || p > 1 {
+		return 0, fmt.Errorf("must be between 0 and 1")
+	}
+	return p, nil
+}
+
+// wrapListener injects the faults into the connections ln accepts. It's below TLS, so the faults hit the
+// encrypted stream like a bad network would
+func wrapListener(ln net.Listener) net.Listener {
+	if *faultsFlag == "" {
+		return ln
+	}
+	return &faultListener{ln}
+}
+
+type faultListener struct {
+	net.Listener
+}
+
+func (l *faultListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &faultConn{Conn: c, rand: rand.New(rand.NewSource(time.Now().UnixNano())), mux: &sync.Mutex{}}, nil
+}
+
+// faultConn is a connection with the faults injected
+type faultConn struct {
+	net.Conn
+	// rand is used by both Read and Write, which may run concurrently
+	rand *rand.Rand
+	mux  *sync.Mutex
+}
+
+func (c *faultConn) chance(p float64) bool {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.rand.Float64() < p
+}
+
+// reset closes the connection with the given probability, and returns whether it did
+func (c *faultConn) reset() bool {
+	if !c.chance(injected().reset) {
+		return false
+	}
+	logger.Warnf("Injecting a reset of the connection from %s", c.RemoteAddr())
+	c.Conn.Close()
+	return true
+}
+
+func (c *faultConn) Read(b []byte) (int, error) {
+	if c.reset() {
+		return 0, fmt.Errorf("injected connection reset")
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *faultConn) Write(b []byte) (int, error) {
+	if c.reset() {
+		return 0, fmt.Errorf("injected connection reset")
+	}
+	faults := injected()
+	time.Sleep(faults.latency)
+	if len(b) < 2 || !c.chance(faults.partial) {
+		return c.Conn.Write(b)
+	}
+	// Split the write, so that the peer gets the data in two reads
+	half := len(b) / 2
+	n, err := c.Conn.Write(b[:half])
+	if err != nil {
+		return n, err
+	}
+	time.Sleep(10 * time.Millisecond)
+	m, err := c.Conn.Write(b[half:])
+	return n + m, err
+}
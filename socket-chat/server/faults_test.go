@@ -0,0 +1,236 @@
+//go:build faults
+// +build faults
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// These tests run a server with faults injected into its connections, and real clients against it. Run them with
+// go test -tags faults ./server
+
+// receiveTimeout bounds every read of the tests, so that a lost message fails the test instead of hanging it
+const receiveTimeout = 5 * time.Second
+
+// startServer starts a plain TCP server with the faults, and returns its address
+func startServer(t *testing.T, spec string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "socket-chat-faults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	*secure = false
+	*adminSocket = filepath.Join(dir, "admin.sock")
+	*faultsFlag = spec
+	if err := loadTunables(); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupFaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port, the server can't tell which one it got
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := ln.Addr().String()
+	ln.Close()
+
+	s := NewServer("tcp", address)
+	if s.acl, err = newAccessList("", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		// The server runs until the test binary exits
+		if err := s.Serve(); err != nil {
+			t.Logf("Server on %s stopped: %v", address, err)
+		}
+	}()
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		if c, err := net.Dial("tcp", address); err == nil {
+			c.Close()
+			return address
+		}
+		if time.Since(start) > receiveTimeout {
+			t.Fatalf("the server on %s didn't start", address)
+		}
+	}
+}
+
+// client is a connection to the server, which is read in the background so that reads can time out
+type client struct {
+	*socketchat.Connection
+	name string
+	msgC chan *socketchat.Message
+	// err is the error that ended the reads, it's set before msgC is closed
+	err error
+}
+
+func (c *client) read() {
+	defer close(c.msgC)
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			c.err = err
+			return
+		}
+		c.msgC <- msg
+	}
+}
+
+// receive returns the next message, or an error if the connection broke or nothing arrived within the timeout
+func (c *client) receive(timeout time.Duration) (*socketchat.Message, error) {
+	select {
+	case msg, ok := <-c.msgC:
+		if !ok {
+			return nil, c.err
+		}
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("nothing received within %s", timeout)
+	}
+}
+
+// connect joins the server as name, and waits until the server has registered it, which it tells by sending its
+// version back
+func connect(address, name string) (*client, error) {
+	conn, err := socketchat.Dial("tcp", address, nil, name, "test")
+	if err != nil {
+		return nil, err
+	}
+	c := &client{Connection: conn, name: name, msgC: make(chan *socketchat.Message, 100)}
+	go c.read()
+	for {
+		msg, err := c.receive(receiveTimeout)
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		if msg.Command == socketchat.CommandVersion {
+			return c, nil
+		}
+	}
+}
+
+// reconnect connects until it succeeds, like a client does after losing its connection
+func reconnect(t *testing.T, address, name string) *client {
+	t.Helper()
+	var err error
+	for start := time.Now(); time.Since(start) < receiveTimeout; time.Sleep(50 * time.Millisecond) {
+		var c *client
+		if c, err = connect(address, name); err == nil {
+			return c
+		}
+	}
+	t.Fatalf("%s couldn't reconnect: %v", name, err)
+	return nil
+}
+
+// exchange sends count messages from one client to the other, and checks that they arrive intact and in order
+func exchange(t *testing.T, from, to *client, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		if err := from.Send(&socketchat.Message{
+			Command:  socketchat.CommandMessage,
+			Sender:   from.name,
+			Receiver: to.name,
+			Data:     []byte(fmt.Sprintf("message %d from %s", i, from.name)),
+		}); err != nil {
+			t.Fatalf("%s failed to send message %d: %v", from.name, i, err)
+		}
+	}
+	for i := 0; i < count; i++ {
+		msg, err := to.receive(receiveTimeout)
+		if err != nil {
+			t.Fatalf("%s didn't get message %d: %v", to.name, i, err)
+		}
+		want := fmt.Sprintf("message %d from %s", i, from.name)
+		if msg.Command != socketchat.CommandMessage || msg.Sender != from.name || msg.Text() != want {
+			t.Fatalf("%s got %s from %s: %q, want %q", to.name, msg.Command, msg.Sender, msg.Text(), want)
+		}
+	}
+}
+
+func TestDeliveryUnderFaults(t *testing.T) {
+	address := startServer(t, "latency=20ms,partial=0.5")
+	alice := reconnect(t, address, "alice")
+	defer alice.Close()
+	bob := reconnect(t, address, "bob")
+	defer bob.Close()
+
+	// Half of the frames arrive in two reads, which must be put back together
+	exchange(t, alice, bob, 20)
+	exchange(t, bob, alice, 20)
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	address := startServer(t, "latency=300ms")
+	alice := reconnect(t, address, "alice")
+	defer alice.Close()
+
+	// The echo of a heartbeat is delayed past a shorter keepalive interval, which the client counts as lost
+	heartbeat := func(seq byte) error {
+		return alice.Send(&socketchat.Message{Command: socketchat.CommandHeartbeat, Sender: "alice", Data: []byte{seq}})
+	}
+	if err := heartbeat(1); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err := alice.receive(100 * time.Millisecond); err == nil {
+		t.Fatalf("got %s within the keepalive interval, despite the latency", msg.Command)
+	}
+
+	// The connection is slow, not dead, so the late echo still arrives, and so do the next ones
+	if err := heartbeat(2); err != nil {
+		t.Fatal(err)
+	}
+	for _, seq := range []byte{1, 2} {
+		msg, err := alice.receive(receiveTimeout)
+		if err != nil {
+			t.Fatalf("heartbeat %d wasn't echoed: %v", seq, err)
+		}
+		if msg.Command != socketchat.CommandHeartbeat || len(msg.Data) != 1 || msg.Data[0] != seq {
+			t.Fatalf("got %s %x, want the echo of heartbeat %d", msg.Command, msg.Data, seq)
+		}
+	}
+}
+
+func TestReconnectAfterReset(t *testing.T) {
+	address := startServer(t, "reset=0")
+	alice := reconnect(t, address, "alice")
+	defer alice.Close()
+	bob := reconnect(t, address, "bob")
+	defer bob.Close()
+	exchange(t, alice, bob, 1)
+
+	// Reset every connection: delivering the message to bob fails, and so does the server's next read from alice
+	currentFaults.Store(faultConfig{reset: 1})
+	if err := alice.Send(&socketchat.Message{Command: socketchat.CommandMessage, Sender: "alice", Receiver: "bob", Data: []byte("lost")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*client{alice, bob} {
+		if msg, err := c.receive(receiveTimeout); err == nil {
+			t.Fatalf("%s got %s from %s after the reset, want the connection to be closed", c.name, msg.Command, msg.Sender)
+		}
+	}
+	currentFaults.Store(faultConfig{})
+
+	// The server dropped the broken sessions, so the clients can join under the same names and chat again
+	alice = reconnect(t, address, "alice")
+	defer alice.Close()
+	bob = reconnect(t, address, "bob")
+	defer bob.Close()
+	exchange(t, alice, bob, 5)
+	exchange(t, bob, alice, 5)
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+const (
+	// groupHistorySize is how many of the latest messages of a group can be pinned
+	groupHistorySize = 100
+	// maxPins is how many messages can be pinned in a group at once
+	maxPins = 10
+)
+
+// newGroup creates a group with the creator as its owner and only member
+func newGroup(creator string) *group {
+	g := &group{owner: creator, members: map[string]struct{}{}}
+	g.add(creator)
+	return g
+}
+
+// group stores its members both as a set for fast lookups, and as a sorted slice so that they can be listed
+// page by page in a stable order. group is not safe for concurrent use, Server.groupsMux guards it
+type group struct {
+	owner string
+	// private groups can only be joined with an invite code
+	private bool
+	// announcements groups are read-only for all members but the owner
+	announcements bool
+	members       map[string]struct{}
+	sorted        []string
+
+	// lastID is the ID of the latest message sent to the group, IDs start at 1
+	lastID  uint64
+	history []groupMessage
+	pins    []groupMessage
+	// retention overrides the server's retention of the history, if non-zero
+	retention time.Duration
+}
+
+// groupMessage is a message sent to a group. data includes the "#<id> " prefix the members received it with
+type groupMessage struct {
+	id     uint64
+	sender string
+	data   string
+	sent   time.Time
+	// expires is when an expiring message is dropped, it's zero for messages that don't expire
+	expires time.Time
+}
+
+// add adds the member to the group, and returns false if it already was a member
+func (g *group) add(name string) bool {
+	if _, ok := g.members[name]; ok {
+		return false
+	}
+	g.members[name] = struct{}{}
+	i := sort.SearchStrings(g.sorted, name)
+	g.sorted = append(g.sorted, "")
+	copy(g.sorted[i+1:], g.sorted[i:])
+	g.sorted[i] = name
+	return true
+}
+
+// remove removes the member from the group, and returns false if it wasn't a member
+func (g *group) remove(name string) bool {
+	if _, ok := g.members[name]; !ok {
+		return false
+	}
+	delete(g.members, name)
+	i := sort.SearchStrings(g.sorted, name)
+	g.sorted = append(g.sorted[:i], g.sorted[i+1:]...)
+	return true
+}
+
+func (g *group) size() int {
+	return len(g.sorted)
+}
+
+// snapshot returns a copy of the member list, so it can be used after the groups lock is released
+func (g *group) snapshot() []string {
+	members := make([]string, len(g.sorted))
+	copy(members, g.sorted)
+	return members
+}
+
+// page returns as many members starting at offset as fit in maxBytes when joined by commas, and
+// the offset of the next page. The next offset is 0 when there are no more members
+func (g *group) page(offset, maxBytes int) ([]string, int) {
+	names := []string{}
+	size := 0
+	i := offset
+	for ; i < len(g.sorted); i++ {
+		// Account for the separating comma
+		if size+len(g.sorted[i])+1 > maxBytes {
+			break
+		}
+		size += len(g.sorted[i]) + 1
+		names = append(names, g.sorted[i])
+	}
+	if i >= len(g.sorted) {
+		return names, 0
+	}
+	return names, i
+}
+
+// record gives the message the next ID of the group, and keeps it in the history so that it can be pinned.
+// A non-zero ttl makes the message expire
+func (g *group) record(sender, data string, ttl time.Duration) groupMessage {
+	g.lastID++
+	msg := groupMessage{
+		id:     g.lastID,
+		sender: sender,
+		data:   fmt.Sprintf("#%d %s", g.lastID, data),
+		sent:   time.Now(),
+	}
+	if ttl != 0 {
+		msg.expires = msg.sent.Add(ttl)
+	}
+	g.history = append(g.history, msg)
+	if len(g.history) > groupHistorySize {
+		g.history = g.history[1:]
+	}
+	return msg
+}
+
+// pin pins the message with the given ID, if it's still in the history
+func (g *group) pin(id uint64) error {
+	for _, p := range g.pins {
+		if p.id == id {
+			return codedError(socketchat.ErrorCodeConflict, "message #%d is already pinned", id)
+		}
+	}
+	if len(g.pins) >= maxPins {
+		return codedError(socketchat.ErrorCodeLimitExceeded, "a group can have at most %d pinned messages", maxPins)
+	}
+	for _, msg := range g.history {
+		if msg.id == id {
+			g.pins = append(g.pins, msg)
+			return nil
+		}
+	}
+	return codedError(socketchat.ErrorCodeNotFound, "message #%d not found, only the latest %d messages within the retention can be pinned", id, groupHistorySize)
+}
+
+// numberGroupMessage gives a message sent to a group the next ID of the group, and prefixes the data with it,
+// so that the members can refer to the message when pinning it. Messages to clients are left as-is. It returns
+// whether the message is to a group
+func (s *Server) numberGroupMessage(msg *socketchat.Message) (bool, error) {
+	ttl, _, err := msg.Expiry()
+	if err != nil {
+		return false, err
+	}
+	if len(s.GetConnections(msg.Receiver)) != 0 {
+		return false, nil
+	}
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, ok := s.groups[msg.Receiver]
+	if !ok {
+		// sendToClient reports the missing receiver
+		return false, nil
+	}
+	if prefixSize := len(fmt.Sprintf("#%d ", g.lastID+1)); len(msg.Data)+prefixSize > socketchat.MaxDataByteSize {
+		return false, codedError(socketchat.ErrorCodeLimitExceeded, "messages to groups can be at most %d bytes", socketchat.MaxDataByteSize-prefixSize)
+	}
+	msg.Data = []byte(g.record(msg.Sender, msg.Text(), ttl).data)
+	return true, nil
+}
+
+// pinMessage pins a message in a group, where the data is "<group>,<id>"
+func (s *Server) pinMessage(data string) (string, error) {
+	i := strings.LastIndex(data, ",")
+	if i == -1 {
+		return "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid pin request %q, expected <group>,<id>", data)
+	}
+	groupName := data[:i]
+	id, err := strconv.ParseUint(strings.TrimPrefix(data[i+1:], "#"), 10, 64)
+	if err != nil {
+		return "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid message ID %q", data[i+1:])
+	}
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, err := s.getGroup(groupName)
+	if err != nil {
+		return "", err
+	}
+	return groupName, g.pin(id)
+}
+
+// getGroup returns the group, or an error if it doesn't exist. The caller must hold groupsMux
+func (s *Server) getGroup(groupName string) (*group, error) {
+	g, ok := s.groups[groupName]
+	if !ok {
+		return nil, codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName)
+	}
+	return g, nil
+}
+
+// transferGroup makes another member the owner of the group, where the data is "<group>,<new owner>"
+func (s *Server) transferGroup(data string) (string, string, error) {
+	i := strings.LastIndex(data, ",")
+	if i == -1 {
+		return "", "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid transfer request %q, expected <group>,<new owner>", data)
+	}
+	groupName, newOwner := data[:i], data[i+1:]
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, err := s.getGroup(groupName)
+	if err != nil {
+		return "", "", err
+	}
+	if _, ok := g.members[newOwner]; !ok {
+		return "", "", codedError(socketchat.ErrorCodeNotFound, "%s is not a member of group %s", newOwner, groupName)
+	}
+	g.owner = newOwner
+	return groupName, newOwner, nil
+}
+
+// deleteGroup deletes the group, and returns its members so that they can be notified. The history and pins
+// of the group go with it
+func (s *Server) deleteGroup(groupName string) ([]string, error) {
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, err := s.getGroup(groupName)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.groups, groupName)
+	s.purgeInvites(groupName)
+	return g.snapshot(), nil
+}
+
+// joinGroup adds the client to a public group
+func (s *Server) joinGroup(client, groupName string) error {
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	return s.addMember(client, groupName, false)
+}
+
+// addMember adds the client to the group, unless it's full. Private groups can only be joined with an
+// invite code. The caller must hold groupsMux
+func (s *Server) addMember(client, groupName string, invited bool) error {
+	g, ok := s.groups[groupName]
+	if !ok {
+		return codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName)
+	}
+	if g.private && !invited {
+		return codedError(socketchat.ErrorCodeForbidden, "group %s is private, it can only be joined with an invite code", groupName)
+	}
+	if g.size() >= tuned().maxGroupMembers {
+		return codedError(socketchat.ErrorCodeLimitExceeded, "group %s is full, it has %d members", groupName, g.size())
+	}
+	g.add(client)
+	return nil
+}
+
+// pinnedMessages returns the pinned messages of a group, in the form they are sent to clients
+func (s *Server) pinnedMessages(groupName string) ([]*socketchat.Message, error) {
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, ok := s.groups[groupName]
+	if !ok {
+		return nil, codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName)
+	}
+	msgs := make([]*socketchat.Message, 0, len(g.pins))
+	now := time.Now()
+	for _, p := range g.pins {
+		// Expired messages may not have been purged yet
+		if expired(p.expires, now) {
+			continue
+		}
+		msgs = append(msgs, &socketchat.Message{
+			Command:  socketchat.CommandPins,
+			Sender:   p.sender,
+			Receiver: groupName,
+			Data:     []byte(p.data),
+		})
+	}
+	return msgs, nil
+}
+
+// sendPins sends the pinned messages of a group to a client, and returns how many there were
+func (s *Server) sendPins(c *socketchat.Connection, groupName string) (int, error) {
+	msgs, err := s.pinnedMessages(groupName)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		if err := c.Send(msg); err != nil {
+			return 0, err
+		}
+	}
+	return len(msgs), nil
+}
+
+// listMembersPage answers a CommandListMembers request, where the data is "<group>,<offset>". The reply's data
+// is "<next offset>/<total members>:<member>,<member>,...". A next offset of 0 means there are no more pages
+func (s *Server) listMembersPage(data string) (*socketchat.Message, error) {
+	groupName := data
+	offset := 0
+	if i := strings.LastIndex(data, ","); i != -1 {
+		groupName = data[:i]
+		var err error
+		offset, err = strconv.Atoi(data[i+1:])
+		if err != nil || offset < 0 {
+			return nil, codedError(socketchat.ErrorCodeInvalidRequest, "invalid offset %q", data[i+1:])
+		}
+	}
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, ok := s.groups[groupName]
+	if !ok {
+		return nil, codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName)
+	}
+	if offset > g.size() {
+		return nil, codedError(socketchat.ErrorCodeInvalidRequest, "offset %d is past the %d members of group %s", offset, g.size(), groupName)
+	}
+
+	// Leave room for the "<next offset>/<total>:" prefix
+	prefixSize := 2*len(strconv.Itoa(g.size())) + 2
+	names, next := g.page(offset, socketchat.MaxDataByteSize-prefixSize)
+	return &socketchat.Message{
+		Command:  socketchat.CommandListMembers,
+		Sender:   serverName,
+		Receiver: groupName,
+		Data:     []byte(fmt.Sprintf("%d/%d:%s", next, g.size(), strings.Join(names, ","))),
+	}, nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// maxInboundWebhookBodySize is how large the JSON body of an inbound webhook may be
+const maxInboundWebhookBodySize = 4096
+
+// inboundMessage is the JSON body of an inbound webhook
+type inboundMessage struct {
+	Group string `json:"group"`
+	Text  string `json:"text"`
+}
+
+// serveInboundWebhooks accepts messages to groups over HTTP, for scripts that don't speak the chat protocol
+func (s *Server) serveInboundWebhooks() {
+	logger.Infof("Accepting inbound webhooks on %s", *inboundWebhookAddress)
+	if err := http.ListenAndServe(*inboundWebhookAddress, http.HandlerFunc(s.handleInboundWebhook)); err != nil {
+		logger.Errorf("Inbound webhook server stopped: %v", err)
+	}
+}
+
+func (s *Server) handleInboundWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	auth := []byte(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare(auth, []byte("Bearer "+*inboundWebhookToken)) != 1 {
+		http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+		return
+	}
+
+	var in inboundMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxInboundWebhookBodySize)).Decode(&in); err != nil {
+		http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.postToGroup(*inboundWebhookSender, in.Group, in.Text); err != nil {
+		http.Error(w, err.Error(), inboundWebhookStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// postToGroup sends a message to a group in the name of sender, who doesn't need to be connected or a member
+func (s *Server) postToGroup(sender, groupName, text string) error {
+	if text == "" {
+		return codedError(socketchat.ErrorCodeInvalidRequest, "the text is empty")
+	}
+	msg := &socketchat.Message{
+		Command:  socketchat.CommandMessage,
+		Sender:   sender,
+		Receiver: groupName,
+		Data:     []byte(text),
+	}
+	toGroup, err := s.numberGroupMessage(msg)
+	if err != nil {
+		return err
+	}
+	if !toGroup {
+		return codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName)
+	}
+	logger.Infof("Posting a message from %s to group %s", sender, groupName)
+	// Members that can't be reached don't make the post fail, like for messages from clients
+	if err := s.sendToClient(msg); err != nil {
+		logger.Warnf("Failed to send message from %s to some members of group %s: %v", sender, groupName, err)
+	}
+	return nil
+}
+
+// inboundWebhookStatus returns the HTTP status for an error from postToGroup
+func inboundWebhookStatus(err error) int {
+	e, ok := err.(*socketchat.Error)
+	if !ok {
+		return http.StatusInternalServerError
+	}
+	switch e.Code {
+	case socketchat.ErrorCodeInvalidRequest:
+		return http.StatusBadRequest
+	case socketchat.ErrorCodeNotFound:
+		return http.StatusNotFound
+	case socketchat.ErrorCodeLimitExceeded:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+const (
+	// inviteCodeBytes is how many random bytes an invite code has, it's hex-encoded when given to clients
+	inviteCodeBytes = 8
+	// maxInviteValidity is how long an invite code can be valid at most. Single-use codes are valid this long
+	maxInviteValidity = 7 * 24 * time.Hour
+)
+
+// invite is a code that lets a client join a private group, see Server.joinWithCode
+type invite struct {
+	group     string
+	expires   time.Time
+	singleUse bool
+}
+
+// createInvite creates an invite code for a group, where the data is "<group>,<validity>". The validity is
+// either "once" for a single-use code, or a duration like "2h" for a code that can be used until it expires
+func (s *Server) createInvite(data string) (string, error) {
+	i := strings.LastIndex(data, ",")
+	if i == -1 {
+		return "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid invite request %q, expected <group>,<validity>", data)
+	}
+	groupName, validity := data[:i], data[i+1:]
+
+	inv := &invite{group: groupName}
+	if validity == "once" {
+		inv.singleUse = true
+		inv.expires = time.Now().Add(maxInviteValidity)
+	} else {
+		d, err := time.ParseDuration(validity)
+		if err != nil || d <= 0 || d > maxInviteValidity {
+			return "", codedError(socketchat.ErrorCodeInvalidRequest, "invalid validity %q, expected once or a duration of at most %s", validity, maxInviteValidity)
+		}
+		inv.expires = time.Now().Add(d)
+	}
+
+	b := make([]byte, inviteCodeBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := hex.EncodeToString(b)
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	if _, err := s.getGroup(groupName); err != nil {
+		return "", err
+	}
+	s.purgeInvites("")
+	s.invites[code] = inv
+	return code, nil
+}
+
+// joinWithCode adds the client to the group the invite code is for, and consumes the code if it's single-use
+func (s *Server) joinWithCode(client, code string) (string, error) {
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	inv, ok := s.invites[code]
+	if !ok || time.Now().After(inv.expires) {
+		return "", codedError(socketchat.ErrorCodeNotFound, "invalid or expired invite code")
+	}
+	if err := s.addMember(client, inv.group, true); err != nil {
+		return "", err
+	}
+	if inv.singleUse {
+		delete(s.invites, code)
+	}
+	return inv.group, nil
+}
+
+// purgeInvites removes the expired invite codes, and all codes for the given group. The caller must hold groupsMux
+func (s *Server) purgeInvites(groupName string) {
+	now := time.Now()
+	for code, inv := range s.invites {
+		if inv.group == groupName || now.After(inv.expires) {
+			delete(s.invites, code)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/luxas/random-schoolwork/pkg/completion"
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/crash"
+	"github.com/luxas/random-schoolwork/pkg/logging"
+	"github.com/luxas/random-schoolwork/pkg/version"
+)
+
+var logger = logging.New(os.Stderr, "server")
+
+// crashes recovers the panics of connection handlers, so that the server keeps serving the other clients, and
+// reports the panics of the background loops before the server exits
+var crashes = crash.NewHandler(logger)
+
+type subcommand struct {
+	fn          func(args []string) error
+	usage       string
+	description string
+}
+
+const (
+	serveUsage      = "serve [flags]"
+	relayUsage      = "relay [flags]"
+	certsUsage      = "certs create-ca|create-server|create-client [flags]"
+	adminUsage      = "admin kick|broadcast|purge|export-user|delete-user|acl [flags] [argument]"
+	versionUsage    = "version"
+	completionUsage = "completion bash|zsh|fish"
+)
+
+// subcommands map the subcommand name to its handler
+var subcommands = map[string]subcommand{
+	"serve":      {serveCmd, serveUsage, "Run the chat server"},
+	"relay":      {relayCmd, relayUsage, "Relay clients to the chat server, queueing their messages while it's unreachable"},
+	"certs":      {certsCmd, certsUsage, "Create the CA, and certificates issued by it"},
+	"admin":      {adminCmd, adminUsage, "Administer a running chat server"},
+	"version":    {versionCmd, versionUsage, "Print the version information"},
+	"completion": {completionCmd, completionUsage, "Print the shell completion script"},
+}
+
+func init() {
+	// Register all flags of serve up front, so they can be completed
+	logger.RegisterFlags(serveFlags)
+	config.RegisterFlag(serveFlags, serveEnvPrefix)
+	logger.RegisterFlags(relayFlags)
+	config.RegisterFlag(relayFlags, relayEnvPrefix)
+	expvar.Publish("recovered_panics", expvar.Func(func() interface{} { return crashes.Count() }))
+}
+
+// Main runs the server with the command line arguments, without the program name, the first being the subcommand
+func Main(args []string) {
+	if err := run(args); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+func run(args []string) error {
+	if len(args) < 1 {
+		usage()
+		return fmt.Errorf("no subcommand given")
+	}
+	if args[0] == "--version" {
+		return versionCmd(nil)
+	}
+	cmd, ok := subcommands[args[0]]
+	if !ok {
+		usage()
+		return fmt.Errorf("unknown subcommand %q", args[0])
+	}
+	return cmd.fn(args[1:])
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	for _, name := range []string{"serve", "relay", "certs", "admin", "version", "completion"} {
+		cmd := subcommands[name]
+		fmt.Fprintf(os.Stderr, "\tserver %s -- %s\n", cmd.usage, cmd.description)
+	}
+}
+
+func versionCmd(_ []string) error {
+	version.Print("server")
+	return nil
+}
+
+func completionCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: server %s", completionUsage)
+	}
+	rootFlags := flag.NewFlagSet("server", flag.ExitOnError)
+	version.RegisterFlag(rootFlags)
+
+	root := completion.NewCommand("server", rootFlags,
+		completion.NewCommand("serve", serveFlags),
+		completion.NewCommand("relay", relayFlags),
+		completion.NewCommand("certs", nil,
+			completion.NewCommand("create-ca", nil),
+			completion.NewCommand("create-server", certsServerFlags),
+			completion.NewCommand("create-client", certsClientFlags),
+		),
+		completion.NewCommand("admin", nil,
+			completion.NewCommand("kick", adminFlags),
+			completion.NewCommand("broadcast", adminFlags),
+			completion.NewCommand("purge", adminFlags),
+			completion.NewCommand("export-user", adminFlags),
+			completion.NewCommand("delete-user", adminFlags),
+			completion.NewCommand("acl", adminFlags),
+		),
+		completion.NewCommand("version", nil),
+		completion.Subcommand(),
+	)
+	return completion.Generate(os.Stdout, args[0], root)
+}
+
+var certsServerFlags = flag.NewFlagSet("certs create-server", flag.ExitOnError)
+var certsServerSANs = certsServerFlags.String("sans", strings.Join(serverSANs, ","), "Comma-separated list of IP, DNS and URI SANs for the server certificate")
+
+var certsClientFlags = flag.NewFlagSet("certs create-client", flag.ExitOnError)
+var certsClientName = certsClientFlags.String("name", "", "The name of the client to issue a certificate for")
+
+func certsCmd(args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: server %s", certsUsage)
+	}
+	switch args[0] {
+	case "create-ca":
+		return CreateCA()
+	case "create-server":
+		_ = certsServerFlags.Parse(args[1:])
+		sans := []string{}
+		for _, san := range strings.Split(*certsServerSANs, ",") {
+			if san != "" {
+				sans = append(sans, san)
+			}
+		}
+		return CreateServerCert(sans)
+	case "create-client":
+		_ = certsClientFlags.Parse(args[1:])
+		if *certsClientName == "" {
+			return fmt.Errorf("--name must be set")
+		}
+		return CreateClientCert(*certsClientName)
+	default:
+		return fmt.Errorf("unknown certs subcommand %q", args[0])
+	}
+}
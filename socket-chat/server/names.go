@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// serverName is the sender of the messages from the server itself, so no client may use it
+const serverName = "server"
+
+// namePolicy is the set of rules client names must follow to register with the server
+type namePolicy struct {
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+	reserved  map[string]bool
+}
+
+// newNamePolicy creates a name policy. reserved is a comma-separated list of names clients can't use, on top of serverName
+func newNamePolicy(minLength, maxLength int, pattern, reserved string) (*namePolicy, error) {
+	if minLength < 1 || maxLength > socketchat.MaxNameByteSize || minLength > maxLength {
+		return nil, fmt.Errorf("name lengths must be within 1-%d, got %d-%d", socketchat.MaxNameByteSize, minLength, maxLength)
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name pattern: %v", err)
+	}
+	p := &namePolicy{
+		minLength: minLength,
+		maxLength: maxLength,
+		pattern:   re,
+		reserved:  map[string]bool{serverName: true},
+	}
+	for _, name := range strings.Split(reserved, ",") {
+		if name != "" {
+			p.reserved[strings.ToLower(name)] = true
+		}
+	}
+	return p, nil
+}
+
+// validate returns an error with an error code if the name breaks the policy
+func (p *namePolicy) validate(name string) error {
+	switch {
+	case len(name) < p.minLength || len(name) > p.maxLength:
+		return codedError(socketchat.ErrorCodeNameInvalid, "name %q must be %d-%d bytes long", name, p.minLength, p.maxLength)
+	case !p.pattern.MatchString(name):
+		return codedError(socketchat.ErrorCodeNameInvalid, "name %q must match %s", name, p.pattern)
+	case p.reserved[strings.ToLower(name)]:
+		return codedError(socketchat.ErrorCodeNameReserved, "name %q is reserved", name)
+	}
+	return nil
+}
+
+// stampSender makes sure the message is sent in the name the client registered with. Messages without a sender
+// get the name stamped, and messages in another name are rejected, so that clients can't impersonate each other
+func stampSender(msg *socketchat.Message, name string) error {
+	if msg.Sender != "" && msg.Sender != name {
+		return codedError(socketchat.ErrorCodeSenderMismatch, "you are registered as %q, not %q", name, msg.Sender)
+	}
+	msg.Sender = name
+	return nil
+}
+
+// codedError creates an error with a code, so that it can be told apart by clients
+func codedError(code socketchat.ErrorCode, format string, args ...interface{}) error {
+	return &socketchat.Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
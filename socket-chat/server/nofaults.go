@@ -0,0 +1,16 @@
+//go:build !faults
+// +build !faults
+
+package server
+
+import "net"
+
+// Faults are only injected when building with -tags faults, see faults.go
+
+func setupFaults() error {
+	return nil
+}
+
+func wrapListener(ln net.Listener) net.Listener {
+	return ln
+}
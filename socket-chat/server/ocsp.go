@@ -0,0 +1,331 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ocspValidity is for how long an OCSP response is valid, i.e. the time between thisUpdate and nextUpdate
+const ocspValidity = 24 * time.Hour
+
+// OCSP response statuses, RFC 6960, section 4.2.1
+const (
+	ocspSuccessful       asn1.Enumerated = 0
+	ocspMalformedRequest asn1.Enumerated = 1
+	ocspInternalError    asn1.Enumerated = 2
+	ocspUnauthorized     asn1.Enumerated = 6
+)
+
+var (
+	oidOCSPBasic  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	oidSHA1       = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256     = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidEd25519    = asn1.ObjectIdentifier{1, 3, 101, 112}
+	ocspHashFuncs = map[string]func() hash.Hash{
+		oidSHA1.String():   sha1.New,
+		oidSHA256.String(): sha256.New,
+	}
+)
+
+// The ASN.1 structures below are the subset of RFC 6960 needed to answer requests about a single CA
+
+type ocspRequest struct {
+	TBSRequest tbsRequest
+}
+
+type tbsRequest struct {
+	Version       int              `asn1:"explicit,tag:0,default:0,optional"`
+	RequestorName pkix.RDNSequence `asn1:"explicit,tag:1,optional"`
+	RequestList   []singleRequest
+}
+
+type singleRequest struct {
+	Cert certID
+}
+
+type certID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	IssuerKeyHash []byte
+	SerialNumber  *big.Int
+}
+
+type ocspResponse struct {
+	Status   asn1.Enumerated
+	Response responseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type responseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type basicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+}
+
+type responseData struct {
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []singleResponse
+}
+
+type singleResponse struct {
+	CertID     certID
+	Good       asn1.Flag   `asn1:"tag:0,optional"`
+	Revoked    revokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag   `asn1:"tag:2,optional"`
+	ThisUpdate time.Time   `asn1:"generalized"`
+	NextUpdate time.Time   `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type revokedInfo struct {
+	RevocationTime time.Time `asn1:"generalized"`
+}
+
+// NewOCSPResponder creates an OCSP responder for the certificates issued by the CA on disk
+func NewOCSPResponder() (*OCSPResponder, error) {
+	caCert, caKey, err := loadCert("ca")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := caKey.(ed25519.PrivateKey); !ok {
+		return nil, fmt.Errorf("OCSP responses can only be signed with an ed25519 CA key")
+	}
+	keyHash, err := subjectKeyID(caCert.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &OCSPResponder{
+		caCert:  caCert,
+		caKey:   caKey,
+		keyHash: keyHash,
+		revoked: map[string]time.Time{},
+		mux:     &sync.Mutex{},
+	}, nil
+}
+
+// OCSPResponder answers OCSP requests for certificates issued by the local CA
+type OCSPResponder struct {
+	caCert *x509.Certificate
+	caKey  crypto.Signer
+	// keyHash is the SHA-1 hash of the CA public key, used as the responder ID
+	keyHash []byte
+
+	revoked map[string]time.Time
+	mux     *sync.Mutex
+}
+
+// Revoke marks the certificate with the given serial number as revoked
+func (o *OCSPResponder) Revoke(serial *big.Int) {
+	o.mux.Lock()
+	defer o.mux.Unlock()
+	o.revoked[serial.String()] = time.Now()
+}
+
+// Response returns a signed OCSP response for the given certificate, e.g. for stapling it in the TLS handshake
+func (o *OCSPResponder) Response(cert *x509.Certificate) ([]byte, error) {
+	id, err := o.certID(cert.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	return o.respond([]certID{id})
+}
+
+// ServeHTTP implements the OCSP HTTP transport of RFC 6960, appendix A, for both GET and POST requests
+func (o *OCSPResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var reqBytes []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		var path string
+		path, err = url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/"))
+		if err == nil {
+			reqBytes, err = base64.StdEncoding.DecodeString(path)
+		}
+	case http.MethodPost:
+		reqBytes, err = ioutil.ReadAll(r.Body)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var resp []byte
+	if err != nil {
+		resp = o.errorResponse(ocspMalformedRequest)
+	} else {
+		resp = o.handleRequest(reqBytes)
+	}
+
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if _, err := w.Write(resp); err != nil {
+		logger.Warnf("Failed to write OCSP response: %v", err)
+	}
+}
+
+func (o *OCSPResponder) handleRequest(reqBytes []byte) []byte {
+	var req ocspRequest
+	if rest, err := asn1.Unmarshal(reqBytes, &req); err != nil || len(rest) != 0 {
+		return o.errorResponse(ocspMalformedRequest)
+	}
+	if len(req.TBSRequest.RequestList) == 0 {
+		return o.errorResponse(ocspMalformedRequest)
+	}
+	ids := []certID{}
+	for _, r := range req.TBSRequest.RequestList {
+		if !o.issuedByCA(r.Cert) {
+			return o.errorResponse(ocspUnauthorized)
+		}
+		ids = append(ids, r.Cert)
+	}
+
+	resp, err := o.respond(ids)
+	if err != nil {
+		logger.Errorf("Failed to create OCSP response: %v", err)
+		return o.errorResponse(ocspInternalError)
+	}
+	return resp
+}
+
+// certID returns the CertID identifying a certificate with the given serial number, issued by the local CA
+func (o *OCSPResponder) certID(serial *big.Int) (certID, error) {
+	nameHash, keyHash, err := o.issuerHashes(sha1.New)
+	if err != nil {
+		return certID{}, err
+	}
+	return certID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{
+			Algorithm:  oidSHA1,
+			Parameters: asn1.RawValue{Tag: asn1.TagNull},
+		},
+		NameHash:      nameHash,
+		IssuerKeyHash: keyHash,
+		SerialNumber:  serial,
+	}, nil
+}
+
+// issuedByCA returns whether the CertID refers to the local CA as the issuer
+func (o *OCSPResponder) issuedByCA(id certID) bool {
+	hashFunc, ok := ocspHashFuncs[id.HashAlgorithm.Algorithm.String()]
+	if !ok {
+		return false
+	}
+	nameHash, keyHash, err := o.issuerHashes(hashFunc)
+	if err != nil {
+		return false
+	}
+	return string(nameHash) == string(id.NameHash) && string(keyHash) == string(id.IssuerKeyHash)
+}
+
+// issuerHashes returns the hashes of the CA's DER-encoded subject name, and its public key bits
+func (o *OCSPResponder) issuerHashes(hashFunc func() hash.Hash) ([]byte, []byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(o.caCert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, nil, err
+	}
+
+	h := hashFunc()
+	h.Write(o.caCert.RawSubject)
+	nameHash := h.Sum(nil)
+
+	h = hashFunc()
+	h.Write(spki.PublicKey.RightAlign())
+	return nameHash, h.Sum(nil), nil
+}
+
+func (o *OCSPResponder) respond(ids []certID) ([]byte, error) {
+	now := time.Now().UTC().Truncate(time.Second)
+	responses := make([]singleResponse, 0, len(ids))
+	for _, id := range ids {
+		responses = append(responses, o.status(id, now))
+	}
+
+	// ResponderID is the [2] EXPLICIT byKey choice, containing the SHA-1 hash of the CA public key
+	keyHash, err := asn1.Marshal(o.keyHash)
+	if err != nil {
+		return nil, err
+	}
+	tbs, err := asn1.Marshal(responseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: keyHash},
+		ProducedAt:  now,
+		Responses:   responses,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ed25519 signs the message itself, not a digest of it
+	signature, err := o.caKey.Sign(rand.Reader, tbs, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	basic, err := asn1.Marshal(basicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidEd25519},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(ocspResponse{
+		Status: ocspSuccessful,
+		Response: responseBytes{
+			ResponseType: oidOCSPBasic,
+			Response:     basic,
+		},
+	})
+}
+
+// status returns the status of a single certificate: revoked, good if it was issued by the CA, otherwise unknown
+func (o *OCSPResponder) status(id certID, now time.Time) singleResponse {
+	single := singleResponse{
+		CertID:     id,
+		ThisUpdate: now,
+		NextUpdate: now.Add(ocspValidity),
+	}
+
+	o.mux.Lock()
+	revokedAt, isRevoked := o.revoked[id.SerialNumber.String()]
+	o.mux.Unlock()
+	isIssued, err := isIssuedSerial(id.SerialNumber)
+	if err != nil {
+		logger.Errorf("Couldn't read the issued serial numbers: %v", err)
+	}
+
+	switch {
+	case isRevoked:
+		single.Revoked = revokedInfo{RevocationTime: revokedAt.UTC().Truncate(time.Second)}
+	case isIssued:
+		single.Good = true
+	default:
+		single.Unknown = true
+	}
+	return single
+}
+
+func (o *OCSPResponder) errorResponse(status asn1.Enumerated) []byte {
+	b, _ := asn1.Marshal(ocspResponse{Status: status})
+	return b
+}
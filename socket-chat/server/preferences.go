@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+const (
+	// maxDeferredMessages is how many messages are kept for a client in do-not-disturb mode. When it's
+	// exceeded, the oldest messages are dropped
+	maxDeferredMessages = 100
+	// deferredCheckInterval is how often the server checks whether deferred messages can be delivered
+	deferredCheckInterval = 1 * time.Minute
+)
+
+// deliveryPrefs are the delivery preferences a client has registered with the server
+type deliveryPrefs struct {
+	// dndFrom and dndTo are the hours do-not-disturb mode is on, in the client's time zone. The range
+	// wraps around midnight if dndFrom > dndTo. DND is off when they are equal
+	dndFrom, dndTo int
+	zone           *time.Location
+	// dmsOnly drops all messages clients send to groups
+	dmsOnly bool
+	// mentionOnly lists the groups from which only messages mentioning the client with @<name> are delivered
+	mentionOnly map[string]bool
+
+	deferred []deferredMessage
+}
+
+// deferredMessage is a message waiting for do-not-disturb mode to end
+type deferredMessage struct {
+	msg    *socketchat.Message
+	queued time.Time
+	// expires is when an expiring message is dropped, it's zero for messages that don't expire
+	expires time.Time
+}
+
+func newDeliveryPrefs() *deliveryPrefs {
+	return &deliveryPrefs{zone: time.UTC, mentionOnly: map[string]bool{}}
+}
+
+// set applies the preferences in data, which are ";"-separated key=value pairs:
+//
+//	dnd=<from>-<to>|off -- hours (0-23) to defer messages during
+//	dms-only=on|off -- whether to drop messages sent to groups
+//	mention-only=<group> <group>... -- groups to only deliver messages mentioning the client from
+//	tz=<offset> -- the client's offset from UTC in seconds, which the DND hours are in
+func (p *deliveryPrefs) set(data string) error {
+	for _, pair := range strings.Split(data, ";") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return codedError(socketchat.ErrorCodeInvalidRequest, "invalid preference %q, expected <key>=<value>", pair)
+		}
+		key, value := kv[0], kv[1]
+		switch key {
+		case "dnd":
+			if value == "off" {
+				p.dndFrom, p.dndTo = 0, 0
+				continue
+			}
+			var from, to int
+			if _, err := fmt.Sscanf(value, "%d-%d", &from, &to); err != nil || from < 0 || from > 23 || to < 0 || to > 23 {
+				return codedError(socketchat.ErrorCodeInvalidRequest, "invalid do-not-disturb hours %q, expected <from>-<to> with hours 0-23", value)
+			}
+			p.dndFrom, p.dndTo = from, to
+		case "dms-only":
+			if value != "on" && value != "off" {
+				return codedError(socketchat.ErrorCodeInvalidRequest, "invalid dms-only value %q, expected on or off", value)
+			}
+			p.dmsOnly = value == "on"
+		case "mention-only":
+			p.mentionOnly = map[string]bool{}
+			for _, group := range strings.Fields(value) {
+				p.mentionOnly[group] = true
+			}
+		case "tz":
+			offset, err := strconv.Atoi(value)
+			if err != nil {
+				return codedError(socketchat.ErrorCodeInvalidRequest, "invalid time zone offset %q", value)
+			}
+			p.zone = time.FixedZone("", offset)
+		default:
+			return codedError(socketchat.ErrorCodeInvalidRequest, "unknown preference %q", key)
+		}
+	}
+	return nil
+}
+
+// inDND returns whether do-not-disturb mode is on at the given time
+func (p *deliveryPrefs) inDND(now time.Time) bool {
+	if p.dndFrom == p.dndTo {
+		return false
+	}
+	hour := now.In(p.zone).Hour()
+	if p.dndFrom < p.dndTo {
+		return hour >= p.dndFrom && hour < p.dndTo
+	}
+	return hour >= p.dndFrom || hour < p.dndTo
+}
+
+// wanted returns whether the client wants the message at all. Notices from the server are always wanted
+func (p *deliveryPrefs) wanted(name string, msg *socketchat.Message, toGroup bool) bool {
+	if !toGroup || msg.Sender == serverName {
+		return true
+	}
+	if p.dmsOnly {
+		return false
+	}
+	if p.mentionOnly[msg.Receiver] {
+		return strings.Contains(msg.Text(), "@"+name)
+	}
+	return true
+}
+
+func (p *deliveryPrefs) String() string {
+	dnd := "off"
+	if p.dndFrom != p.dndTo {
+		dnd = fmt.Sprintf("%d-%d", p.dndFrom, p.dndTo)
+	}
+	dmsOnly := "off"
+	if p.dmsOnly {
+		dmsOnly = "on"
+	}
+	groups := make([]string, 0, len(p.mentionOnly))
+	for group := range p.mentionOnly {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	return fmt.Sprintf("dnd=%s, dms-only=%s, mention-only=%s", dnd, dmsOnly, strings.Join(groups, " "))
+}
+
+// setPreferences registers the delivery preferences of a client, and returns them in a readable form
+func (s *Server) setPreferences(name, data string) (string, error) {
+	s.prefsMux.Lock()
+	defer s.prefsMux.Unlock()
+
+	p, ok := s.prefs[name]
+	if !ok {
+		p = newDeliveryPrefs()
+	}
+	if err := p.set(data); err != nil {
+		return "", err
+	}
+	s.prefs[name] = p
+	return p.String(), nil
+}
+
+// shouldDeliver applies the delivery preferences of the receiver, and returns whether the message should
+// be sent right away. Messages the receiver doesn't want are dropped, and messages arriving during
+// do-not-disturb hours are deferred until deliverDeferred sends them
+func (s *Server) shouldDeliver(receiver string, msg *socketchat.Message, toGroup bool) bool {
+	// Errors and notices from the server to the client alone are replies to what the client just did, or
+	// admin announcements, so they are always delivered
+	if msg.Command == socketchat.CommandError || (msg.Sender == serverName && !toGroup) {
+		return true
+	}
+
+	s.prefsMux.Lock()
+	defer s.prefsMux.Unlock()
+
+	p, ok := s.prefs[receiver]
+	if !ok {
+		return true
+	}
+	if !p.wanted(receiver, msg, toGroup) {
+		logger.Debugf("Dropping message from %s to %s due to the delivery preferences of %s", msg.Sender, msg.Receiver, receiver)
+		return false
+	}
+	if !p.inDND(time.Now()) {
+		return true
+	}
+	if len(p.deferred) >= maxDeferredMessages {
+		logger.Warnf("Too many deferred messages for client %s, dropping the oldest one", receiver)
+		p.deferred = p.deferred[1:]
+	}
+	d := deferredMessage{msg: msg, queued: time.Now()}
+	if ttl, _, err := msg.Expiry(); err == nil && ttl != 0 {
+		d.expires = d.queued.Add(ttl)
+	}
+	p.deferred = append(p.deferred, d)
+	return false
+}
+
+// deliverDeferred periodically sends the messages deferred during do-not-disturb hours, once DND is over
+func (s *Server) deliverDeferred() {
+	defer crashes.Fatal("deferred message delivery")
+	for range time.Tick(deferredCheckInterval) {
+		s.flushDeferred()
+	}
+}
+
+func (s *Server) flushDeferred() {
+	now := time.Now()
+	pending := map[string][]deferredMessage{}
+
+	s.prefsMux.Lock()
+	for name, p := range s.prefs {
+		if len(p.deferred) == 0 || p.inDND(now) {
+			continue
+		}
+		if len(s.GetConnections(name)) == 0 {
+			// Keep the messages until the client connects again
+			continue
+		}
+		pending[name] = p.deferred
+		p.deferred = nil
+	}
+	s.prefsMux.Unlock()
+
+	for name, msgs := range pending {
+		conns := s.GetConnections(name)
+		logger.Infof("Delivering %d deferred messages to %d sessions of client %s", len(msgs), len(conns), name)
+		for _, c := range conns {
+			for _, d := range msgs {
+				// Expired messages may not have been purged yet
+				if expired(d.expires, now) {
+					continue
+				}
+				if err := c.Send(d.msg); err != nil {
+					s.recordSendError(name, c, err)
+					logger.Warnf("Failed to deliver deferred message to client %s: %v", name, err)
+					break
+				}
+			}
+		}
+	}
+}
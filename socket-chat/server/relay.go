@@ -0,0 +1,668 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/version"
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// relayEnvPrefix is the prefix of the environment variables the relay flags can be set with
+const relayEnvPrefix = "SOCKET_CHAT_RELAY"
+
+var relayFlags = flag.NewFlagSet("relay", flag.ExitOnError)
+var relayAddress = relayFlags.String("address", "localhost:6444", "What address and port to accept clients on")
+var relayUpstream = relayFlags.String("upstream", socketchat.DefaultServerAddress, "The address of the chat server to relay the clients to")
+var relaySecure = relayFlags.Bool("secure", true, "Whether to use TLSv1.3 towards the clients, with server.crt and server.key, and towards the upstream server, which must have a certificate issued by ca.crt")
+var relaySpoolFile = relayFlags.String("spool", "relay.spool", "The file the messages are queued in while the upstream server is unreachable, so that they survive restarts")
+var relaySpoolKey = relayFlags.String("spool-key", "relay-spool.key", "The key file the queued messages are encrypted with in the spool, created if it doesn't exist. Without it, the spool can't be read")
+var relaySpoolLimit = relayFlags.Int("spool-limit", 10000, "How many messages may be queued at most, further ones are rejected")
+var relayRetryInterval = relayFlags.Duration("retry-interval", 10*time.Second, "How often to try to reach the upstream server while it's unreachable")
+
+// relaySyncData is the data of the heartbeats the relay sends after the queued messages of a client. The server
+// handles the messages of a connection in order, so its echo means the messages before it have been handled
+var relaySyncData = []byte("relay-sync")
+
+// errUpstreamAuthorizesPeers is returned when the upstream server asks for a client certificate, i.e. runs with
+// --authorize-peers. The relay connects as its clients, and can't present their certificates
+var errUpstreamAuthorizesPeers = fmt.Errorf("the upstream server requires client certificates (--authorize-peers), which the relay can't present for its clients")
+
+func refuseClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return nil, errUpstreamAuthorizesPeers
+}
+
+func relayCmd(args []string) error {
+	if err := config.Parse(relayFlags, relayEnvPrefix, args); err != nil {
+		return err
+	}
+	if *relaySpoolLimit < 1 {
+		return fmt.Errorf("--spool-limit must be at least 1")
+	}
+	if *relayRetryInterval <= 0 {
+		return fmt.Errorf("--retry-interval must be positive")
+	}
+	key, err := loadStorageKey(*relaySpoolKey)
+	if err != nil {
+		return fmt.Errorf("couldn't load the spool key: %v", err)
+	}
+	spool, err := openSpool(*relaySpoolFile, key)
+	if err != nil {
+		return fmt.Errorf("couldn't open the spool: %v", err)
+	}
+	r := &relay{spool: spool, live: map[string]int{}, syncing: map[string]bool{}, mux: &sync.Mutex{}}
+
+	ln, err := net.Listen(socketchat.DefaultServerProtocol, *relayAddress)
+	if err != nil {
+		return err
+	}
+	if *relaySecure {
+		if r.upstreamTLS, err = socketchat.ClientTLSConfig("ca.crt", "", "", socketchat.ServerIdentity); err != nil {
+			return err
+		}
+		r.upstreamTLS.GetClientCertificate = refuseClientCertificate
+		// Probe the server, so that the relay exits right away if the messages couldn't be delivered, rather than
+		// queueing them. If the server is unreachable, dialUpstream finds out when it's back
+		if up, err := r.dialUpstream(); err == nil {
+			up.Close()
+		}
+		cert, err := tls.LoadX509KeyPair("server.crt", "server.key")
+		if err != nil {
+			return fmt.Errorf("couldn't load the certificate to serve the clients with, create it with \"server certs create-server\": %v", err)
+		}
+		ln = tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS13})
+	}
+	defer ln.Close()
+
+	logger.Infof("Relaying clients on %s to %s, with %d queued messages", *relayAddress, *relayUpstream, spool.len())
+	go r.syncLoop()
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		conn := socketchat.NewConnection(c)
+		go func(remote net.Addr) {
+			defer crashes.With("remote", remote).Recover("relay connection handler")
+			r.handleConn(conn)
+		}(c.RemoteAddr())
+	}
+}
+
+// relay is an edge server that passes the frames of its clients through to the upstream server. While the upstream
+// server is unreachable, it queues the messages of the clients in the spool, and delivers them once it's back
+type relay struct {
+	spool *spool
+	// upstreamTLS is the TLS config towards the upstream server, nil with --secure=false
+	upstreamTLS *tls.Config
+
+	// mux guards live and syncing
+	mux *sync.Mutex
+	// live counts the sessions of each client connected to the relay. Their queued messages are delivered by the
+	// sessions, so that they come before the messages the clients send after reconnecting
+	live map[string]int
+	// syncing are the clients whose queued messages are being delivered
+	syncing map[string]bool
+}
+
+// claim marks the queued messages of the client as being delivered, unless they are already, or the client is
+// connected and claimed by the syncLoop
+func (r *relay) claim(name string, session bool) bool {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	if r.syncing[name] || (!session && r.live[name] != 0) {
+		return false
+	}
+	r.syncing[name] = true
+	return true
+}
+
+func (r *relay) release(name string) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	delete(r.syncing, name)
+}
+
+// dialUpstream connects to the upstream server, over TLS with --secure
+func (r *relay) dialUpstream() (*socketchat.Connection, error) {
+	d := &net.Dialer{Timeout: socketchat.TimeoutDuration}
+	var c net.Conn
+	var err error
+	if r.upstreamTLS != nil {
+		c, err = tls.DialWithDialer(d, socketchat.DefaultServerProtocol, *relayUpstream, r.upstreamTLS)
+	} else {
+		c, err = d.Dial(socketchat.DefaultServerProtocol, *relayUpstream)
+	}
+	if err == errUpstreamAuthorizesPeers {
+		// The server was restarted with --authorize-peers, so nothing can be delivered anymore. The queued
+		// messages stay in the spool
+		logger.Fatalf("Can't relay to %s: %v", *relayUpstream, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return socketchat.NewConnection(c), nil
+}
+
+// deliverable returns the queued messages that haven't expired, see socketchat.Message.Expiry
+func deliverable(entries []*spoolEntry) []*socketchat.Message {
+	msgs := []*socketchat.Message{}
+	for _, e := range entries {
+		msg := e.message()
+		if ttl, _, err := msg.Expiry(); err == nil && ttl != 0 && time.Since(e.Queued) > ttl {
+			logger.Infof("Dropping the queued message of %s to %s, it expired while queued", e.Sender, e.Receiver)
+			continue
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// syncLoop delivers the queued messages of the clients that aren't connected to the relay anymore, every
+// --retry-interval
+func (r *relay) syncLoop() {
+	defer crashes.Recover("relay sync loop")
+	for range time.NewTicker(*relayRetryInterval).C {
+		for _, name := range r.spool.senders() {
+			if !r.claim(name, false) {
+				continue
+			}
+			if err := r.syncOffline(name); err != nil {
+				logger.Warnf("Couldn't deliver the queued messages of %s: %v", name, err)
+			}
+			r.release(name)
+		}
+	}
+}
+
+// syncOffline connects to the upstream server as the client, and delivers its queued messages. It solves the
+// registration challenge of the server, if any, in place of the client
+func (r *relay) syncOffline(name string) error {
+	entries := r.spool.pending(name)
+	if len(entries) == 0 {
+		return nil
+	}
+	up, err := r.dialUpstream()
+	if err != nil {
+		return err
+	}
+	defer up.Close()
+	msgs := []*socketchat.Message{
+		{Command: socketchat.CommandNewClient, Data: []byte(name)},
+		{Command: socketchat.CommandVersion, Sender: name, Data: []byte(version.Get().String())},
+	}
+	msgs = append(msgs, deliverable(entries)...)
+	msgs = append(msgs, &socketchat.Message{Command: socketchat.CommandHeartbeat, Sender: name, Data: relaySyncData})
+	for _, msg := range msgs {
+		if err := up.Send(msg); err != nil {
+			return err
+		}
+	}
+
+	var rejected *socketchat.Error
+	for {
+		msg, err := up.Receive()
+		if err == io.EOF && rejected != nil {
+			// The server closes the connection after refusing the name, so the messages can't ever be delivered
+			logger.Warnf("Dropping the %d queued messages of %s, the server refused it: %v", len(entries), name, rejected)
+			return r.spool.remove(entries)
+		}
+		if err != nil {
+			return err
+		}
+		switch msg.Command {
+		case socketchat.CommandChallenge:
+			difficulty, challenge, err := msg.ChallengePayload()
+			if err != nil {
+				return err
+			}
+			nonce, err := socketchat.SolveChallenge(challenge, difficulty)
+			if err != nil {
+				return err
+			}
+			if err := up.Send(&socketchat.Message{Command: socketchat.CommandChallenge, Sender: name, Data: []byte(strconv.FormatUint(nonce, 10))}); err != nil {
+				return err
+			}
+		case socketchat.CommandError:
+			rejected = msg.ErrorPayload()
+			logger.Warnf("The server rejected a queued command of %s: %v", name, rejected)
+		case socketchat.CommandHeartbeat:
+			if !bytes.Equal(msg.Data, relaySyncData) {
+				continue
+			}
+			logger.Infof("Delivered the %d queued messages of %s", len(entries), name)
+			_ = up.Send(&socketchat.Message{Command: socketchat.CommandLeave, Sender: name})
+			return r.spool.remove(entries)
+		}
+	}
+}
+
+// relaySession is a client connected to the relay
+type relaySession struct {
+	r      *relay
+	name   string
+	client *socketchat.Connection
+	// mux guards upstream, version, flushed and left. The frames of the client are handled with it held, so that they
+	// aren't interleaved with its queued messages
+	mux *sync.Mutex
+	// upstream is the connection to the upstream server, or nil while it's unreachable
+	upstream *socketchat.Connection
+	// version is the Version frame of the client, which is sent again when reconnecting
+	version *socketchat.Message
+	// flushed are the queued messages sent on the upstream connection, which are removed from the spool when the
+	// server has handled them
+	flushed []*spoolEntry
+	// left is whether the client sent Leave, after which the server closes the connection
+	left bool
+	// done is closed when the client disconnects
+	done chan struct{}
+}
+
+func (r *relay) handleConn(c *socketchat.Connection) {
+	defer c.Close()
+	msg, err := c.Receive()
+	if err != nil {
+		logger.Warnf("Failed to read the first message of a client: %v", err)
+		return
+	}
+	if msg.Command != socketchat.CommandNewClient {
+		_ = c.Send(socketchat.NewErrorMessage(serverName, codedError(socketchat.ErrorCodeInvalidRequest, "the first message must be NewClient")))
+		return
+	}
+	s := &relaySession{r: r, name: msg.Text(), client: c, mux: &sync.Mutex{}, done: make(chan struct{})}
+	defer close(s.done)
+	r.mux.Lock()
+	r.live[s.name]++
+	r.mux.Unlock()
+	defer func() {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		if r.live[s.name]--; r.live[s.name] == 0 {
+			delete(r.live, s.name)
+		}
+	}()
+	logger.Infof("Client %s connected", s.name)
+
+	if err := s.connect(); err != nil {
+		logger.Warnf("The upstream server is unreachable, queueing the messages of %s: %v", s.name, err)
+		s.notify(fmt.Sprintf("The server is unreachable, the relay queues your messages and delivers them once it's back, trying every %s", *relayRetryInterval))
+		go s.reconnectLoop()
+	}
+	defer s.disconnect()
+
+	for {
+		msg, err := c.Receive()
+		if err != nil && err != socketchat.UnknownCommandError {
+			if err != io.EOF {
+				logger.Warnf("Dropping the connection to client %s after failing to read a message: %v", s.name, err)
+			}
+			return
+		}
+		if err := s.handle(msg); err != nil {
+			logger.Warnf("Client %s: %v", s.name, err)
+			_ = c.Send(socketchat.NewErrorMessage(serverName, err))
+		}
+		if msg.Command == socketchat.CommandLeave {
+			return
+		}
+	}
+}
+
+// notify sends a notice from the relay to the client
+func (s *relaySession) notify(text string) {
+	if err := s.client.Send(&socketchat.Message{Command: socketchat.CommandMessage, Sender: serverName, Receiver: s.name, Data: []byte(text)}); err != nil {
+		logger.Warnf("Failed to notify client %s: %v", s.name, err)
+	}
+}
+
+// handle passes a frame of the client through to the upstream server, or queues it while the server is unreachable
+func (s *relaySession) handle(msg *socketchat.Message) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	switch msg.Command {
+	case socketchat.CommandVersion:
+		s.version = msg
+	case socketchat.CommandLeave:
+		s.left = true
+	}
+	if s.upstream != nil {
+		err := s.upstream.Send(msg)
+		if err == nil {
+			return nil
+		}
+		logger.Warnf("Lost the upstream server of client %s: %v", s.name, err)
+		s.goOffline()
+	}
+
+	switch msg.Command {
+	case socketchat.CommandMessage, socketchat.CommandData:
+		if s.r.spool.len() >= *relaySpoolLimit {
+			return codedError(socketchat.ErrorCodeLimitExceeded, "the relay has queued %d messages already, and can't queue more until the server is back", *relaySpoolLimit)
+		}
+		return s.r.spool.add(newSpoolEntry(msg))
+	case socketchat.CommandHeartbeat:
+		// The relay is still there, and answers for the server
+		return s.client.Send(&socketchat.Message{Command: socketchat.CommandHeartbeat, Sender: serverName, Data: msg.Data})
+	case socketchat.CommandVersion, socketchat.CommandLeave:
+		return nil
+	}
+	return codedError(socketchat.ErrorCodeUnknown, "the server is unreachable, only messages are queued until it's back")
+}
+
+// connect connects to the upstream server as the client, delivers its queued messages, and starts passing the
+// frames of the server through to the client
+func (s *relaySession) connect() error {
+	if !s.r.claim(s.name, true) {
+		return fmt.Errorf("the queued messages of %s are being delivered", s.name)
+	}
+	defer s.r.release(s.name)
+	up, err := s.r.dialUpstream()
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entries := s.r.spool.pending(s.name)
+	msgs := []*socketchat.Message{{Command: socketchat.CommandNewClient, Data: []byte(s.name)}}
+	if s.version != nil {
+		msgs = append(msgs, s.version)
+	}
+	msgs = append(msgs, deliverable(entries)...)
+	if len(entries) != 0 {
+		msgs = append(msgs, &socketchat.Message{Command: socketchat.CommandHeartbeat, Sender: s.name, Data: relaySyncData})
+	}
+	for _, msg := range msgs {
+		if err := up.Send(msg); err != nil {
+			up.Close()
+			return err
+		}
+	}
+	s.upstream, s.flushed = up, entries
+	go s.passThrough(up)
+	return nil
+}
+
+// passThrough passes the frames of the upstream server through to the client, until either disconnects. If the
+// connection to the server is lost, the session queues the messages of the client until the server is back
+func (s *relaySession) passThrough(up *socketchat.Connection) {
+	defer crashes.Recover("relay pass-through")
+	// ended is whether the last frame was an error or a notice from the server, which it sends before closing the
+	// connection when refusing or kicking the client. The connection closing otherwise means the server went away
+	ended := false
+	for {
+		msg, err := up.Receive()
+		if err == io.EOF && ended {
+			logger.Infof("The server closed the session of client %s", s.name)
+			s.client.Close()
+			return
+		}
+		if err != nil && err != socketchat.UnknownCommandError {
+			s.mux.Lock()
+			lost := s.upstream == up && !s.left
+			if lost {
+				s.goOffline()
+			}
+			s.mux.Unlock()
+			if lost {
+				logger.Warnf("Lost the upstream server of client %s: %v", s.name, err)
+			}
+			return
+		}
+		ended = msg.Command == socketchat.CommandError || (msg.Command == socketchat.CommandMessage && msg.Sender == serverName)
+		if msg.Command == socketchat.CommandHeartbeat && bytes.Equal(msg.Data, relaySyncData) {
+			s.synced(up)
+			continue
+		}
+		if err := s.client.Send(msg); err != nil {
+			logger.Warnf("Failed to pass a message through to client %s: %v", s.name, err)
+		}
+	}
+}
+
+// synced removes the queued messages from the spool once the server has handled them
+func (s *relaySession) synced(up *socketchat.Connection) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.upstream != up || len(s.flushed) == 0 {
+		return
+	}
+	if err := s.r.spool.remove(s.flushed); err != nil {
+		logger.Errorf("Couldn't remove the delivered messages of %s from the spool: %v", s.name, err)
+		return
+	}
+	s.notify(fmt.Sprintf("The server is back, delivered %d queued messages", len(s.flushed)))
+	s.flushed = nil
+}
+
+// goOffline closes the connection to the upstream server, and tries to reach it again every --retry-interval. The
+// caller holds s.mux
+func (s *relaySession) goOffline() {
+	s.upstream.Close()
+	s.upstream, s.flushed = nil, nil
+	s.notify("Lost the connection to the server, the relay queues your messages and delivers them once it's back")
+	go s.reconnectLoop()
+}
+
+// reconnectLoop tries to reach the upstream server every --retry-interval, until it's back or the client
+// disconnects
+func (s *relaySession) reconnectLoop() {
+	defer crashes.Recover("relay reconnect loop")
+	ticker := time.NewTicker(*relayRetryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+		err := s.connect()
+		if err == nil {
+			logger.Infof("Reached the upstream server again for client %s", s.name)
+			return
+		}
+		logger.Debugf("The upstream server is still unreachable for client %s: %v", s.name, err)
+	}
+}
+
+// disconnect ends the session of the client with the upstream server, if it's connected
+func (s *relaySession) disconnect() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.upstream != nil {
+		s.upstream.Close()
+		s.upstream = nil
+	}
+	logger.Infof("Client %s disconnected", s.name)
+}
+
+// spoolEntry is a queued frame of a client, a line of the spool file
+type spoolEntry struct {
+	Queued   time.Time          `json:"queued"`
+	Command  socketchat.Command `json:"command"`
+	Sender   string             `json:"sender"`
+	Receiver string             `json:"receiver"`
+	Data     []byte             `json:"data"`
+}
+
+func newSpoolEntry(msg *socketchat.Message) *spoolEntry {
+	return &spoolEntry{Queued: time.Now(), Command: msg.Command, Sender: msg.Sender, Receiver: msg.Receiver, Data: msg.Data}
+}
+
+func (e *spoolEntry) message() *socketchat.Message {
+	return &socketchat.Message{Command: e.Command, Sender: e.Sender, Receiver: e.Receiver, Data: e.Data}
+}
+
+// spool is the durable queue of the relay, a file with a line per queued frame. Frames are appended and synced to
+// disk before the relay takes responsibility for them, and the file is rewritten without the delivered ones. The
+// messages are confidential, so every line is the JSON of the entry encrypted with the key, base64-encoded, and the
+// file is only readable by its owner
+type spool struct {
+	path    string
+	key     *storageKey
+	mux     *sync.Mutex
+	entries []*spoolEntry
+}
+
+func openSpool(path string, key *storageKey) (*spool, error) {
+	s := &spool{path: path, key: key, mux: &sync.Mutex{}}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e, err := s.decode(scanner.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		s.entries = append(s.entries, e)
+	}
+	return s, scanner.Err()
+}
+
+// encode returns the line of the entry in the spool file
+func (s *spool) encode(e *spoolEntry) ([]byte, error) {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.key.seal(b)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+func (s *spool) decode(line []byte) (*spoolEntry, error) {
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.key.open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decrypt a queued message, is --spool-key the key it was encrypted with? %v", err)
+	}
+	e := &spoolEntry{}
+	return e, json.Unmarshal(b, e)
+}
+
+func (s *spool) len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.entries)
+}
+
+// add appends the entry to the spool file, and returns once it's on disk
+func (s *spool) add(e *spoolEntry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	b, err := s.encode(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := f.Write(b); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	s.entries = append(s.entries, e)
+	return nil
+}
+
+// pending returns the queued entries of the client, in the order they were queued
+func (s *spool) pending(sender string) []*spoolEntry {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	entries := []*spoolEntry{}
+	for _, e := range s.entries {
+		if e.Sender == sender {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// senders returns the clients with queued entries
+func (s *spool) senders() []string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	seen := map[string]bool{}
+	senders := []string{}
+	for _, e := range s.entries {
+		if !seen[e.Sender] {
+			seen[e.Sender] = true
+			senders = append(senders, e.Sender)
+		}
+	}
+	return senders
+}
+
+// remove removes the delivered entries, and replaces the spool file with one without them
+func (s *spool) remove(delivered []*spoolEntry) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	done := map[*spoolEntry]bool{}
+	for _, e := range delivered {
+		done[e] = true
+	}
+	entries := []*spoolEntry{}
+	buf := &bytes.Buffer{}
+	for _, e := range s.entries {
+		if done[e] {
+			continue
+		}
+		b, err := s.encode(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(b)
+		entries = append(entries, e)
+	}
+
+	// Write the new file next to the old one, and rename it over it, so that a crash leaves either of them
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(buf.Bytes()); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+	s.entries = entries
+	return nil
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/luxas/random-schoolwork/pkg/config"
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// reloadableFlags are the serve flags that can be changed while the server is running, by changing the
+// environment or config file and sending the server SIGHUP
+var reloadableFlags = []string{
+	"log-level",
+	"log-format",
+	"write-timeout",
+	"slow-consumer-limit",
+	"rate-limit",
+	"max-group-members",
+	"retention",
+	"name-min-length",
+	"name-max-length",
+	"name-pattern",
+	"reserved-names",
+	"operators",
+	"webhooks",
+}
+
+// tunables are the values of the reloadable flags the server uses. They are replaced as a whole when the
+// config is reloaded, so that they can be read without locking
+type tunables struct {
+	writeTimeout      time.Duration
+	slowConsumerLimit int
+	rateLimit         int
+	maxGroupMembers   int
+	retention         time.Duration
+	operators         map[string]bool
+	names             *namePolicy
+	webhooks          []webhook
+}
+
+var currentTunables atomic.Value
+
+// tuned returns the tunables currently in use
+func tuned() *tunables {
+	return currentTunables.Load().(*tunables)
+}
+
+// loadTunables validates the values of the reloadable flags, and puts them in use
+func loadTunables() error {
+	if *rateLimit < 0 {
+		return fmt.Errorf("the rate limit can't be negative, got %d", *rateLimit)
+	}
+	reserved := *reservedNames
+	if *inboundWebhookAddress != "" {
+		// Clients can't pretend to be the sender of inbound webhooks
+		reserved += "," + *inboundWebhookSender
+	}
+	names, err := newNamePolicy(*nameMinLength, *nameMaxLength, *namePattern, reserved)
+	if err != nil {
+		return err
+	}
+	hooks, err := parseWebhooks(*webhooks)
+	if err != nil {
+		return err
+	}
+	t := &tunables{
+		writeTimeout:      *writeTimeout,
+		slowConsumerLimit: *slowConsumerLimit,
+		rateLimit:         *rateLimit,
+		maxGroupMembers:   *maxGroupMembers,
+		retention:         *retentionPeriod,
+		operators:         map[string]bool{},
+		names:             names,
+		webhooks:          hooks,
+	}
+	for _, operator := range strings.Split(*operators, ",") {
+		if operator != "" {
+			t.operators[operator] = true
+		}
+	}
+	currentTunables.Store(t)
+	return nil
+}
+
+// reloadOnSignal reloads the config every time the server gets SIGHUP. args are the command line arguments
+// of serve, whose flags keep their values
+func (s *Server) reloadOnSignal(args []string) {
+	defer crashes.Fatal("config reloader")
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := s.reloadConfig(args); err != nil {
+			logger.Errorf("Failed to reload the config, keeping the current one: %v", err)
+		}
+	}
+}
+
+// reloadConfig sets the reloadable flags from the environment and the config file again, and puts them in use.
+// If any value is invalid, all flags are restored, so that a config is applied either fully or not at all
+func (s *Server) reloadConfig(args []string) error {
+	values, err := config.Reload(serveFlags, serveEnvPrefix, args, reloadableFlags)
+	if err != nil {
+		return err
+	}
+
+	previous := map[string]string{}
+	restore := func() {
+		for name, value := range previous {
+			_ = serveFlags.Set(name, value)
+		}
+	}
+	changed := []string{}
+	for _, name := range reloadableFlags {
+		value, ok := values[name]
+		f := serveFlags.Lookup(name)
+		if !ok || f.Value.String() == value {
+			continue
+		}
+		previous[name] = f.Value.String()
+		if err := serveFlags.Set(name, value); err != nil {
+			restore()
+			return fmt.Errorf("invalid value %q for %s: %v", value, name, err)
+		}
+		changed = append(changed, fmt.Sprintf("%s=%s", name, value))
+	}
+	if err := loadTunables(); err != nil {
+		restore()
+		return err
+	}
+
+	if len(changed) == 0 {
+		logger.Infof("Reloaded the config, nothing changed")
+		return nil
+	}
+	logger.Infof("Reloaded the config, changed %s", strings.Join(changed, ", "))
+
+	// Connected clients get the new write timeout and rate limit too
+	s.connsMux.Lock()
+	conns := []*socketchat.Connection{}
+	for _, ss := range s.conns {
+		conns = append(conns, ss.conns...)
+	}
+	s.connsMux.Unlock()
+	for _, c := range conns {
+		c.SetWriteTimeout(tuned().writeTimeout)
+		c.SetRateLimit(tuned().rateLimit)
+	}
+	return nil
+}
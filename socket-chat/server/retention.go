@@ -0,0 +1,145 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+var (
+	// purgedGroupMessages counts the group messages removed from the history by the retention policy
+	purgedGroupMessages = expvar.NewInt("retention_purged_group_messages")
+	// purgedDeferredMessages counts the messages deferred due to do-not-disturb mode that expired before delivery
+	purgedDeferredMessages = expvar.NewInt("retention_purged_deferred_messages")
+)
+
+// runRetention purges the messages that are older than the retention policy allows every checkInterval
+func (s *Server) runRetention(checkInterval time.Duration) {
+	defer crashes.Fatal("retention loop")
+	for range time.Tick(checkInterval) {
+		groupMsgs, deferredMsgs := s.purge()
+		if groupMsgs != 0 || deferredMsgs != 0 {
+			logger.Infof("Purged %d group messages and %d deferred messages", groupMsgs, deferredMsgs)
+		}
+	}
+}
+
+// purge removes the group messages older than the retention of their group, and the deferred messages older
+// than the retention of the server, and returns how many of each it removed. Pinned messages are kept, unless
+// they have expired. Expired messages are removed regardless of the retention
+func (s *Server) purge() (int, int) {
+	now := time.Now()
+	serverRetention := tuned().retention
+
+	groupMsgs := 0
+	s.groupsMux.Lock()
+	for _, g := range s.groups {
+		var n int
+		g.history, n = dropExpired(g.history, now)
+		groupMsgs += n
+		// Pinned messages are copies of the ones in the history, so they aren't counted again
+		g.pins, _ = dropExpired(g.pins, now)
+
+		retention := g.retention
+		if retention == 0 {
+			retention = serverRetention
+		}
+		if retention == 0 {
+			continue
+		}
+		// The history is in the order the messages were sent
+		i := 0
+		for i < len(g.history) && now.Sub(g.history[i].sent) > retention {
+			i++
+		}
+		g.history = g.history[i:]
+		groupMsgs += i
+	}
+	s.groupsMux.Unlock()
+
+	deferredMsgs := 0
+	s.prefsMux.Lock()
+	for _, p := range s.prefs {
+		kept := p.deferred[:0]
+		for _, d := range p.deferred {
+			if expired(d.expires, now) {
+				deferredMsgs++
+				continue
+			}
+			kept = append(kept, d)
+		}
+		p.deferred = kept
+
+		if serverRetention != 0 {
+			i := 0
+			for i < len(p.deferred) && now.Sub(p.deferred[i].queued) > serverRetention {
+				i++
+			}
+			p.deferred = p.deferred[i:]
+			deferredMsgs += i
+		}
+	}
+	s.prefsMux.Unlock()
+
+	purgedGroupMessages.Add(int64(groupMsgs))
+	purgedDeferredMessages.Add(int64(deferredMsgs))
+	return groupMsgs, deferredMsgs
+}
+
+// expired returns whether a message that expires at the given time has expired. A zero time never expires
+func expired(expires, now time.Time) bool {
+	return !expires.IsZero() && !now.Before(expires)
+}
+
+// dropExpired removes the expired messages, and returns how many it removed
+func dropExpired(msgs []groupMessage, now time.Time) ([]groupMessage, int) {
+	kept := msgs[:0]
+	for _, m := range msgs {
+		if !expired(m.expires, now) {
+			kept = append(kept, m)
+		}
+	}
+	return kept, len(msgs) - len(kept)
+}
+
+// setGroupRetention sets how long the history of a group is kept, where the data is "<group>,<duration>".
+// A duration of "default" makes the group use the retention of the server. Groups can't keep their history
+// for longer than the server does
+func (s *Server) setGroupRetention(data string) (string, time.Duration, error) {
+	i := strings.LastIndex(data, ",")
+	if i == -1 {
+		return "", 0, codedError(socketchat.ErrorCodeInvalidRequest, "invalid retention request %q, expected <group>,<duration>", data)
+	}
+	groupName := data[:i]
+
+	var retention time.Duration
+	if data[i+1:] != "default" {
+		var err error
+		retention, err = time.ParseDuration(data[i+1:])
+		if err != nil || retention <= 0 {
+			return "", 0, codedError(socketchat.ErrorCodeInvalidRequest, "invalid retention %q, expected default or a positive duration", data[i+1:])
+		}
+		if serverRetention := tuned().retention; serverRetention != 0 && retention > serverRetention {
+			return "", 0, codedError(socketchat.ErrorCodeLimitExceeded, "the server keeps messages for at most %s", serverRetention)
+		}
+	}
+
+	s.groupsMux.Lock()
+	defer s.groupsMux.Unlock()
+
+	g, err := s.getGroup(groupName)
+	if err != nil {
+		return "", 0, err
+	}
+	g.retention = retention
+	return groupName, retention, nil
+}
+
+// purgeStats returns a readable summary of a purge, and of the purges since the server started
+func purgeStats(groupMsgs, deferredMsgs int) string {
+	return fmt.Sprintf("Purged %d group messages and %d deferred messages, %d and %d since the server started",
+		groupMsgs, deferredMsgs, purgedGroupMessages.Value(), purgedDeferredMessages.Value())
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// certDaysUntilExpiry exposes how many days the server's current leaf certificate is valid for
+var certDaysUntilExpiry = expvar.NewFloat("cert_days_until_expiry")
+
+// NewCertRotator creates a CertRotator for the leaf certificate stored in <fileprefix>.crt and <fileprefix>.key.
+// The certificate is re-issued from the local CA when it's valid for less than renewBefore. If responder is
+// non-nil, an OCSP response for the certificate is stapled, and refreshed every checkInterval.
+func NewCertRotator(fileprefix string, renewBefore, checkInterval time.Duration, responder *OCSPResponder) (*CertRotator, error) {
+	r := &CertRotator{
+		fileprefix:    fileprefix,
+		renewBefore:   renewBefore,
+		checkInterval: checkInterval,
+		responder:     responder,
+		mux:           &sync.RWMutex{},
+		stop:          make(chan bool, 1),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// CertRotator keeps the server's leaf certificate fresh, and serves it to the live tls.Config
+type CertRotator struct {
+	fileprefix    string
+	renewBefore   time.Duration
+	checkInterval time.Duration
+	responder     *OCSPResponder
+
+	cert *tls.Certificate
+	mux  *sync.RWMutex
+	stop chan bool
+}
+
+// GetCertificate implements tls.Config.GetCertificate, returning the currently valid leaf certificate
+func (r *CertRotator) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return r.cert, nil
+}
+
+// Start checks the certificate expiry every checkInterval in the background, until Stop is called
+func (r *CertRotator) Start() {
+	go func() {
+		defer crashes.Fatal("certificate rotator")
+		ticker := time.NewTicker(r.checkInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+				if err := r.rotateIfNeeded(); err != nil {
+					logger.Errorf("Failed to rotate certificate %s.crt: %v", r.fileprefix, err)
+				}
+				if err := r.staple(); err != nil {
+					logger.Errorf("Failed to staple OCSP response for %s.crt: %v", r.fileprefix, err)
+				}
+			}
+		}
+	}()
+}
+
+// Stop stops the background rotation
+func (r *CertRotator) Stop() {
+	r.stop <- true
+}
+
+// DaysUntilExpiry returns how many days the current certificate still is valid for
+func (r *CertRotator) DaysUntilExpiry() float64 {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+	return time.Until(r.cert.Leaf.NotAfter).Hours() / 24
+}
+
+func (r *CertRotator) rotateIfNeeded() error {
+	days := r.DaysUntilExpiry()
+	certDaysUntilExpiry.Set(days)
+	if days*24 > r.renewBefore.Hours() {
+		return nil
+	}
+
+	logger.Infof("Certificate %s.crt expires in %.1f days, re-issuing it", r.fileprefix, days)
+	caCert, caKey, err := loadCert("ca")
+	if err != nil {
+		return err
+	}
+	if _, _, err := genCert(r.fileprefix, CertUsageServer, caCert, caKey, serverSANs); err != nil {
+		return err
+	}
+	return r.load()
+}
+
+func (r *CertRotator) load() error {
+	cer, err := tls.LoadX509KeyPair(r.fileprefix+".crt", r.fileprefix+".key")
+	if err != nil {
+		return err
+	}
+	// tls.LoadX509KeyPair doesn't keep the parsed leaf around, so parse it here for the expiry checks
+	leaf, err := x509.ParseCertificate(cer.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s.crt: %v", r.fileprefix, err)
+	}
+	cer.Leaf = leaf
+
+	r.mux.Lock()
+	r.cert = &cer
+	r.mux.Unlock()
+
+	certDaysUntilExpiry.Set(r.DaysUntilExpiry())
+	return r.staple()
+}
+
+// staple attaches a fresh OCSP response to the current certificate
+func (r *CertRotator) staple() error {
+	if r.responder == nil {
+		return nil
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	resp, err := r.responder.Response(r.cert.Leaf)
+	if err != nil {
+		return err
+	}
+	// Copy the certificate, as ongoing handshakes may still be using the old one
+	cer := *r.cert
+	cer.OCSPStaple = resp
+	r.cert = &cer
+	return nil
+}
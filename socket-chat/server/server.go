@@ -1,75 +1,208 @@
-package main
+package server
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"expvar"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"sync"
+	"time"
 
+	"github.com/luxas/random-schoolwork/pkg/config"
+	"github.com/luxas/random-schoolwork/pkg/diagnostics"
+	"github.com/luxas/random-schoolwork/pkg/version"
 	socketchat "github.com/luxas/random-schoolwork/socket-chat"
 )
 
-var secure = flag.Bool("secure", true, "Whether to enable TLSv1.3 or not")
-var address = flag.String("address", socketchat.DefaultServerAddress, "What address and port to listen to")
-
-func main() {
-	if err := run(); err != nil {
-		log.Fatal(err)
+// serveEnvPrefix is the prefix of the environment variables the serve flags can be set with
+const serveEnvPrefix = "SOCKET_CHAT_SERVER"
+
+var serveFlags = flag.NewFlagSet("serve", flag.ExitOnError)
+var secure = serveFlags.Bool("secure", true, "Whether to enable TLSv1.3 or not")
+var address = serveFlags.String("address", socketchat.DefaultServerAddress, "What address and port to listen to")
+var adminSocket = serveFlags.String("admin-socket", socketchat.DefaultAdminSocket, "What unix socket to accept admin commands on")
+var authorizePeers = serveFlags.Bool("authorize-peers", false, "Whether to require client certificates, and authorize clients by their URI identity")
+var certRenewBefore = serveFlags.Duration("cert-renew-before", 30*24*time.Hour, "How long before expiry the server certificate is re-issued")
+var certCheckInterval = serveFlags.Duration("cert-check-interval", 1*time.Hour, "How often the server certificate expiry is checked")
+var writeTimeout = serveFlags.Duration("write-timeout", 10*time.Second, "How long sending a message to a client may take before it times out")
+var slowConsumerLimit = serveFlags.Int("slow-consumer-limit", 3, "How many timed out sends a client may have before it's disconnected as a slow consumer")
+var maxSessions = serveFlags.Int("max-sessions", 5, "How many connections a client may have at once, e.g. from a phone and a laptop")
+var rateLimit = serveFlags.Int("rate-limit", 0, "How many bytes per second may be sent to each client, 0 means no limit")
+var maxGroupMembers = serveFlags.Int("max-group-members", 10000, "The maximum number of members a group can have")
+var nameMinLength = serveFlags.Int("name-min-length", 1, "The minimum length of client names")
+var nameMaxLength = serveFlags.Int("name-max-length", socketchat.MaxNameByteSize, "The maximum length of client names")
+var namePattern = serveFlags.String("name-pattern", "^[a-zA-Z0-9_.-]+$", "The regular expression client names must match")
+var reservedNames = serveFlags.String("reserved-names", "admin", "Comma-separated list of names clients can't register with, on top of server")
+var allowGuests = serveFlags.Bool("allow-guests", false, "With --authorize-peers, also accept clients without a client certificate, as guests with limited permissions")
+var operators = serveFlags.String("operators", "", "Comma-separated list of clients that may kick clients, broadcast, and administer all groups. Requires --authorize-peers")
+var retentionPeriod = serveFlags.Duration("retention", 0, "How long group history and deferred messages are kept, 0 keeps them until they are pushed out")
+var retentionCheckInterval = serveFlags.Duration("retention-check-interval", 1*time.Minute, "How often messages older than the retention are purged")
+var metricsAddress = serveFlags.String("metrics-address", "", "If set, serve the server's metrics in the expvar JSON format on this address")
+var debugAddress = diagnostics.RegisterFlag(serveFlags)
+var webhooks = serveFlags.String("webhooks", "", "Comma-separated list of webhooks that get events POSTed as JSON, each <event>[@<group>]=<url>. The events are message, join, connect and kick")
+var inboundWebhookAddress = serveFlags.String("inbound-webhook-address", "", "If set, accept messages to groups as JSON POSTed to this address")
+var inboundWebhookToken = serveFlags.String("inbound-webhook-token", "", "The bearer token inbound webhooks must be authenticated with")
+var inboundWebhookSender = serveFlags.String("inbound-webhook-sender", "bot", "The name messages from inbound webhooks are sent in. Clients can't register with it")
+var allowCIDRs = serveFlags.String("allow-cidrs", "", "Comma-separated list of IP addresses and CIDRs clients may connect from. If empty, all addresses not denied may connect")
+var denyCIDRs = serveFlags.String("deny-cidrs", "", "Comma-separated list of IP addresses and CIDRs clients may not connect from")
+var allowNames = serveFlags.String("allow-names", "", "Comma-separated list of names clients may register with. If empty, all names not denied may register")
+var denyNames = serveFlags.String("deny-names", "", "Comma-separated list of names clients may not register with")
+var registrationChallengeBits = serveFlags.Int("registration-challenge-bits", 0, "If set, clients without an authorized certificate must solve a proof-of-work challenge with this many zero bits to register, e.g. 20")
+var ocspAddress = serveFlags.String("ocsp-address", "", "If set, serve OCSP for the local CA on this address, and staple OCSP responses in the TLS handshake")
+
+func serveCmd(args []string) error {
+	if err := config.Parse(serveFlags, serveEnvPrefix, args); err != nil {
+		return err
 	}
-}
-
-func run() error {
-	flag.Parse()
-	log.Println("Launching server...")
+	if err := loadTunables(); err != nil {
+		return err
+	}
+	if err := setupFaults(); err != nil {
+		return err
+	}
+	if *registrationChallengeBits < 0 || *registrationChallengeBits > socketchat.MaxChallengeBits {
+		return fmt.Errorf("--registration-challenge-bits must be within 0-%d", socketchat.MaxChallengeBits)
+	}
+	if *maxSessions < 1 {
+		return fmt.Errorf("--max-sessions must be at least 1")
+	}
+	if *inboundWebhookAddress != "" && (*inboundWebhookToken == "" || *inboundWebhookSender == "") {
+		return fmt.Errorf("--inbound-webhook-address requires --inbound-webhook-token and --inbound-webhook-sender")
+	}
+	if *operators != "" && !*authorizePeers {
+		logger.Warnf("--operators has no effect without --authorize-peers, as client names can't be trusted")
+	}
+	acl, err := newAccessList(*allowCIDRs, *denyCIDRs, *allowNames, *denyNames)
+	if err != nil {
+		return err
+	}
+	if *debugAddress != "" {
+		if err := diagnostics.Serve(*debugAddress, logger); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Launching server...")
 	s := NewServer(socketchat.DefaultServerProtocol, *address)
+	s.acl = acl
+	go s.reloadOnSignal(args)
 	return s.Serve()
 }
 
 type Server struct {
-	conns  map[string]*socketchat.Connection
-	groups map[string]map[string]bool
-
-	connsMux  *sync.Mutex
-	groupsMux *sync.Mutex
-	errC      chan error
-	lnNetwork string
-	lnAddress string
+	// conns are the sessions of each connected client, see sessions.go
+	conns  map[string]*sessions
+	groups map[string]*group
+	// invites are the invite codes to private groups, guarded by groupsMux
+	invites map[string]*invite
+	// slowSends counts the timed out sends per connection, for the slow-consumer policy
+	slowSends map[*socketchat.Connection]int
+	// prefs are the delivery preferences per client name, they are kept when the client disconnects
+	prefs map[string]*deliveryPrefs
+	// contacts are the rosters per client name, they are kept when the client disconnects
+	contacts map[string]map[string]struct{}
+
+	connsMux    *sync.Mutex
+	groupsMux   *sync.Mutex
+	prefsMux    *sync.Mutex
+	contactsMux *sync.Mutex
+	errC        chan error
+	lnNetwork   string
+	lnAddress   string
+	// started is when the server was created, for the uptime in the stats
+	started time.Time
+	// webhookC queues the events for the webhooks, see emitWebhook
+	webhookC chan webhookDelivery
+	// acl decides which addresses may connect and which names may register, admins can edit it
+	acl *accessList
 }
 
 func NewServer(network, address string) *Server {
 	return &Server{
-		conns:     map[string]*socketchat.Connection{},
-		groups:    map[string]map[string]bool{},
-		connsMux:  &sync.Mutex{},
-		groupsMux: &sync.Mutex{},
-		lnNetwork: network,
-		lnAddress: address,
+		conns:       map[string]*sessions{},
+		groups:      map[string]*group{},
+		invites:     map[string]*invite{},
+		slowSends:   map[*socketchat.Connection]int{},
+		prefs:       map[string]*deliveryPrefs{},
+		connsMux:    &sync.Mutex{},
+		groupsMux:   &sync.Mutex{},
+		prefsMux:    &sync.Mutex{},
+		contacts:    map[string]map[string]struct{}{},
+		contactsMux: &sync.Mutex{},
+		lnNetwork:   network,
+		lnAddress:   address,
+		started:     time.Now(),
+		webhookC:    make(chan webhookDelivery, webhookQueueSize),
 	}
 }
 
 func (s *Server) SecureListener() (net.Listener, error) {
+	if *ocspAddress != "" {
+		ocspServerURL = "http://" + *ocspAddress
+	}
 	if err := CreateServerCerts(); err != nil {
 		return nil, err
 	}
 
-	cer, err := tls.LoadX509KeyPair("server.crt", "server.key")
+	var responder *OCSPResponder
+	if *ocspAddress != "" {
+		var err error
+		responder, err = NewOCSPResponder()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			logger.Infof("Serving OCSP on %s", ocspServerURL)
+			if err := http.ListenAndServe(*ocspAddress, responder); err != nil {
+				logger.Errorf("OCSP responder stopped: %v", err)
+			}
+		}()
+	}
+
+	rotator, err := NewCertRotator("server", *certRenewBefore, *certCheckInterval, responder)
 	if err != nil {
 		return nil, err
 	}
+	rotator.Start()
 
 	config := &tls.Config{
-		Certificates: []tls.Certificate{cer},
-		MinVersion:   tls.VersionTLS13,
+		GetCertificate: rotator.GetCertificate,
+		MinVersion:     tls.VersionTLS13,
+	}
+
+	if *authorizePeers {
+		b, err := ioutil.ReadFile("ca.crt")
+		if err != nil {
+			return nil, err
+		}
+		certpool := x509.NewCertPool()
+		if ok := certpool.AppendCertsFromPEM(b); !ok {
+			return nil, fmt.Errorf("couldn't add ca cert to cert pool")
+		}
+		config.ClientCAs = certpool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if *allowGuests {
+			config.ClientAuth = tls.VerifyClientCertIfGiven
+		}
 	}
 
-	return tls.Listen(s.lnNetwork, s.lnAddress, config)
+	ln, err := net.Listen(s.lnNetwork, s.lnAddress)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(wrapListener(ln), config), nil
 }
 
 func (s *Server) InsecureListener() (net.Listener, error) {
-	return net.Listen(s.lnNetwork, s.lnAddress)
+	ln, err := net.Listen(s.lnNetwork, s.lnAddress)
+	if err != nil {
+		return nil, err
+	}
+	return wrapListener(ln), nil
 }
 
 func (s *Server) Serve() error {
@@ -85,6 +218,28 @@ func (s *Server) Serve() error {
 	}
 	defer ln.Close()
 
+	adminLn, err := s.AdminListener(*adminSocket)
+	if err != nil {
+		return err
+	}
+	defer adminLn.Close()
+	go s.serveAdmin(adminLn)
+	go s.deliverDeferred()
+	go s.runRetention(*retentionCheckInterval)
+	go s.deliverWebhooks()
+	if *inboundWebhookAddress != "" {
+		go s.serveInboundWebhooks()
+	}
+
+	if *metricsAddress != "" {
+		go func() {
+			logger.Infof("Serving metrics on %s", *metricsAddress)
+			if err := http.ListenAndServe(*metricsAddress, expvar.Handler()); err != nil {
+				logger.Errorf("Metrics server stopped: %v", err)
+			}
+		}()
+	}
+
 	for {
 		select {
 		case err := <-s.errC:
@@ -94,9 +249,21 @@ func (s *Server) Serve() error {
 			if err != nil {
 				return err
 			}
-			log.Println("Accepted new connection from a client...")
-
-			go s.handleConn(socketchat.NewConnection(c))
+			if !s.acl.allowsAddr(c.RemoteAddr()) {
+				logger.Warnf("Rejected a connection from %s by the access lists", c.RemoteAddr())
+				aclRejections.Add(1)
+				c.Close()
+				continue
+			}
+			logger.Infof("Accepted new connection from a client...")
+
+			conn := socketchat.NewConnection(c)
+			conn.SetWriteTimeout(tuned().writeTimeout)
+			conn.SetRateLimit(tuned().rateLimit)
+			go func(remote net.Addr) {
+				defer crashes.With("remote", remote).Recover("connection handler")
+				s.handleConn(conn)
+			}(c.RemoteAddr())
 		}
 	}
 }
@@ -105,169 +272,469 @@ func (s *Server) handleConn(c *socketchat.Connection) {
 	defer c.Close()
 
 	namemsg, err := c.Receive()
-	if err != nil || namemsg.Command != socketchat.CommandNewClient {
-		log.Printf("Client could not be initialized: %v", err)
+	if err == nil && namemsg.Command != socketchat.CommandNewClient {
+		err = fmt.Errorf("expected %s, got %s", socketchat.CommandNewClient, namemsg.Command)
+	}
+	if err == io.EOF {
+		// Clients probe the connect time of the servers they can choose from by connecting and closing right away
+		logger.Debugf("Connection closed before the client joined")
+		return
+	}
+	if err != nil {
+		logger.Warnf("Client could not be initialized: %v", err)
+		return
+	}
+	name := namemsg.Text()
+	if err := tuned().names.validate(name); err != nil {
+		logger.Warnf("Client could not register: %v", err)
+		s.returnErrorToClient(c, err)
+		return
+	}
+	if !s.acl.allowsName(name) {
+		logger.Warnf("Client %s was rejected by the access lists", name)
+		aclRejections.Add(1)
+		s.returnErrorToClient(c, codedError(socketchat.ErrorCodeForbidden, "the name %s may not connect to this server", name))
+		return
+	}
+	authorized := false
+	if *authorizePeers {
+		// Authorize the client by the URI identity in its certificate, not the CN
+		identity, err := c.PeerIdentity()
+		if err == socketchat.NoPeerIdentityError && *allowGuests {
+			logger.Infof("Client %s has no certificate, and joins as a guest", name)
+		} else if err != nil || identity != socketchat.ClientIdentity(name) {
+			logger.Warnf("Client %s could not be authorized (identity %q): %v", name, identity, err)
+			s.returnErrorToClient(c, codedError(socketchat.ErrorCodeUnauthorized, "not authorized to use the name %s", name))
+			return
+		} else {
+			authorized = true
+		}
+	}
+	// Clients that can't prove who they are have to prove some work instead, which deters bot floods
+	var pending []*socketchat.Message
+	if !authorized {
+		pending, err = s.challengeClient(c, name)
+		if err != nil {
+			logger.Warnf("Client %s failed the registration challenge: %v", name, err)
+			s.returnErrorToClient(c, err)
+			return
+		}
+	}
+	role := clientRole(name, authorized)
+	if err := s.AddConnection(name, c, authorized); err != nil {
+		logger.Warnf("Client %s could not add a session: %v", name, err)
+		s.returnErrorToClient(c, err)
 		return
 	}
-	name := namemsg.Data
-	s.SetConnection(name, c)
+	// Normally the session is dropped already when the loop returns, but not if handling a message panics
+	defer s.dropConnection(name, c)
+	s.emitWebhook(webhookEventConnect, "", name, "")
 
 	for {
-		msg, err := c.Receive()
+		var msg *socketchat.Message
+		var err error
+		if len(pending) != 0 {
+			msg, pending = pending[0], pending[1:]
+		} else {
+			msg, err = c.Receive()
+		}
+		if err == socketchat.UnknownCommandError {
+			logger.Warnf("Client %s sent unknown command %d", name, msg.Command)
+			s.returnErrorToClient(c, codedError(socketchat.ErrorCodeUnknownCommand, "unknown command %d", msg.Command))
+			continue
+		}
 		if err != nil {
-			if err == io.EOF {
-				log.Printf("Shutting down connection to client %s due to EOF", name)
+			if !s.hasConnection(name, c) {
+				// The client has been kicked, and the connection closed
 				return
 			}
+			// The stream can't be trusted after a failed read, e.g. a reset or a partial message
+			if err == io.EOF {
+				logger.Infof("Shutting down connection to client %s due to EOF", name)
+			} else {
+				logger.Warnf("Dropping connection to client %s after failing to read a message: %v", name, err)
+			}
+			s.dropConnection(name, c)
+			return
+		}
 
-			log.Printf("error reading message: %v", err)
+		if err := stampSender(msg, name); err != nil {
+			logger.Warnf("Client %s tried to send a message as %q", name, msg.Sender)
+			s.returnErrorToClient(c, err)
 			continue
 		}
 
-		log.Printf("Message received from the client: %d %q %q %q", msg.Command, msg.Sender, msg.Receiver, msg.Data)
+		logger.Debugf("Message received from the client: %d %q %q %q", msg.Command, msg.Sender, msg.Receiver, msg.Text())
+
+		if err := s.authorize(name, role, msg); err != nil {
+			logger.Warnf("Client %s (%s) is not allowed to send command %d: %v", name, role, msg.Command, err)
+			s.returnErrorToClient(c, err)
+			continue
+		}
 
 		switch msg.Command {
-		case socketchat.CommandNewChat:
-			groupName := msg.Data
+		case socketchat.CommandNewChat, socketchat.CommandNewPrivateChat:
+			groupName := msg.Text()
 			s.groupsMux.Lock()
 			_, ok := s.groups[groupName]
 			if ok {
 				s.groupsMux.Unlock() // TODO: better
-				s.returnErrorToClient(c, fmt.Errorf("group %s already exists!", groupName))
+				s.returnErrorToClient(c, codedError(socketchat.ErrorCodeConflict, "group %s already exists!", groupName))
 				continue
 			}
-			s.groups[groupName] = map[string]bool{
-				msg.Sender: true,
-			}
+			g := newGroup(msg.Sender)
+			g.private = msg.Command == socketchat.CommandNewPrivateChat
+			s.groups[groupName] = g
 			s.groupsMux.Unlock()
 
 			notifyMsg := fmt.Sprintf("Group %s created by %s!\n", groupName, msg.Sender)
 			_ = s.notifyClients(groupName, notifyMsg)
-			log.Print(notifyMsg)
+			logger.Infof("%s", notifyMsg)
+			s.emitWebhook(webhookEventJoin, groupName, msg.Sender, "")
 
-		case socketchat.CommandJoinChat:
-			groupName := msg.Data
-			s.groupsMux.Lock()
-			_, ok := s.groups[groupName]
-			if !ok {
-				s.groupsMux.Unlock() // TODO: better
-				s.returnErrorToClient(c, fmt.Errorf("group %s doesn't exist!", groupName))
+		case socketchat.CommandJoinChat, socketchat.CommandJoinCode:
+			// Register the sender in the group
+			var groupName string
+			var err error
+			if msg.Command == socketchat.CommandJoinCode {
+				groupName, err = s.joinWithCode(msg.Sender, msg.Text())
+			} else {
+				groupName = msg.Text()
+				err = s.joinGroup(msg.Sender, groupName)
+			}
+			if err != nil {
+				s.returnErrorToClient(c, err)
 				continue
 			}
-			// Register the sender in the group
-			s.groups[groupName][msg.Sender] = true
-			s.groupsMux.Unlock()
 
 			notifyMsg := fmt.Sprintf("Client %s has joined group %s", msg.Sender, groupName)
 			_ = s.notifyClients(groupName, notifyMsg)
-			log.Print(notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+			// Show the new member what has been pinned in the group
+			if _, err := s.sendPins(c, groupName); err != nil {
+				logger.Warnf("Failed to send pinned messages to client %s: %v", name, err)
+			}
+
+		case socketchat.CommandInvite:
+			code, err := s.createInvite(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			_ = s.notifyClients(name, fmt.Sprintf("Invite code: %s", code))
+
+		case socketchat.CommandRetention:
+			groupName, retention, err := s.setGroupRetention(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			notifyMsg := fmt.Sprintf("Client %s set the retention of group %s to %s", name, groupName, retention)
+			if retention == 0 {
+				notifyMsg = fmt.Sprintf("Client %s set the retention of group %s to the server's default", name, groupName)
+			}
+			_ = s.notifyClients(groupName, notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandAnnouncements:
+			groupName, announcements, err := s.setGroupAnnouncements(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			notifyMsg := fmt.Sprintf("Client %s made group %s an announcement group, only the owner can send to it", name, groupName)
+			if !announcements {
+				notifyMsg = fmt.Sprintf("Client %s made group %s writable for all members again", name, groupName)
+			}
+			_ = s.notifyClients(groupName, notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandTransferChat:
+			groupName, newOwner, err := s.transferGroup(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			notifyMsg := fmt.Sprintf("Client %s transferred the ownership of group %s to %s", name, groupName, newOwner)
+			_ = s.notifyClients(groupName, notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandDeleteChat:
+			groupName := msg.Text()
+			members, err := s.deleteGroup(groupName)
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			// The group is gone, so notify the former members one by one
+			notifyMsg := fmt.Sprintf("Group %s was deleted by %s", groupName, name)
+			for _, member := range members {
+				_ = s.notifyClients(member, notifyMsg)
+			}
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandPin:
+			groupName, err := s.pinMessage(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			notifyMsg := fmt.Sprintf("Client %s pinned a message in group %s", name, groupName)
+			_ = s.notifyClients(groupName, notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandPins:
+			n, err := s.sendPins(c, msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			if n == 0 {
+				_ = s.notifyClients(name, fmt.Sprintf("Group %s has no pinned messages", msg.Text()))
+			}
+
+		case socketchat.CommandAddContact:
+			if err := s.addContact(name, msg.Text()); err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			_ = s.notifyClients(name, fmt.Sprintf("Added %s as a contact", msg.Text()))
+
+		case socketchat.CommandRemoveContact:
+			if err := s.removeContact(name, msg.Text()); err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			_ = s.notifyClients(name, fmt.Sprintf("Removed %s from the contacts", msg.Text()))
+
+		case socketchat.CommandContacts:
+			n, err := s.sendContacts(c, name)
+			if err != nil {
+				logger.Warnf("Failed to send contacts to client %s: %v", name, err)
+				continue
+			}
+			if n == 0 {
+				_ = s.notifyClients(name, "You have no contacts")
+			}
 
 		case socketchat.CommandLeaveChat:
-			groupName := msg.Data
+			groupName := msg.Text()
 			s.groupsMux.Lock()
-			_, ok := s.groups[groupName]
+			g, ok := s.groups[groupName]
 			if !ok {
 				s.groupsMux.Unlock() // TODO: better
-				s.returnErrorToClient(c, fmt.Errorf("group %s doesn't exist!", groupName))
+				s.returnErrorToClient(c, codedError(socketchat.ErrorCodeNotFound, "group %s doesn't exist!", groupName))
 				continue
 			}
 			// Remove the sender from the group
-			delete(s.groups[groupName], msg.Sender)
+			g.remove(msg.Sender)
 			s.groupsMux.Unlock()
 
 			notifyMsg := fmt.Sprintf("Client %s has left group %s", msg.Sender, groupName)
 			_ = s.notifyClients(groupName, notifyMsg)
-			log.Print(notifyMsg)
+			logger.Infof("%s", notifyMsg)
+
+		case socketchat.CommandListMembers:
+			reply, err := s.listMembersPage(msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			if err := c.Send(reply); err != nil {
+				logger.Warnf("Failed to send member list to client: %v", err)
+			}
 
 		case socketchat.CommandMessage:
-			if err := s.sendToClient(msg, nil); err != nil {
-				log.Printf("Failed to send message to client: %v", err)
+			text := msg.Text()
+			toGroup, err := s.numberGroupMessage(msg)
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			if toGroup {
+				s.emitWebhook(webhookEventMessage, msg.Receiver, msg.Sender, text)
+			}
+			if err := s.sendToClient(msg); err != nil {
+				logger.Warnf("Failed to send message to client: %v", err)
 				s.returnErrorToClient(c, err)
 				continue
 			}
+			if !toGroup {
+				// Group messages reach the other sessions of the sender as members, direct messages don't
+				s.sendToOtherSessions(name, c, msg)
+			}
+
+		case socketchat.CommandRead:
+			s.sendToOtherSessions(name, c, msg)
+
+		case socketchat.CommandData:
+			if _, _, err := msg.DataPayload(); err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			if err := s.sendToClient(msg); err != nil {
+				logger.Warnf("Failed to send data to client: %v", err)
+				s.returnErrorToClient(c, err)
+				continue
+			}
+
+		case socketchat.CommandPreferences:
+			prefs, err := s.setPreferences(name, msg.Text())
+			if err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			_ = s.notifyClients(name, fmt.Sprintf("Delivery preferences set: %s", prefs))
+			// Deliver what was deferred right away, if do-not-disturb was turned off
+			s.flushDeferred()
+
+		case socketchat.CommandVersion:
+			// The client tells its version right after joining, and expects the server's version back
+			logger.Infof("Client %s is running version %s", name, msg.Text())
+			if err := c.Send(&socketchat.Message{
+				Command: socketchat.CommandVersion,
+				Sender:  serverName,
+				Data:    []byte(version.Get().String()),
+			}); err != nil {
+				logger.Warnf("Failed to send version to client: %v", err)
+			}
+
+		case socketchat.CommandHeartbeat:
+			if err := c.Send(&socketchat.Message{
+				Command: socketchat.CommandHeartbeat,
+				Sender:  serverName,
+				Data:    msg.Data,
+			}); err != nil {
+				logger.Warnf("Failed to echo heartbeat to client: %v", err)
+			}
+
+		case socketchat.CommandStats:
+			if err := c.Send(&socketchat.Message{
+				Command: socketchat.CommandStats,
+				Sender:  serverName,
+				Data:    []byte(s.stats()),
+			}); err != nil {
+				logger.Warnf("Failed to send stats to client: %v", err)
+			}
+
+		case socketchat.CommandKick:
+			if err := s.kick(msg.Text()); err != nil {
+				s.returnErrorToClient(c, err)
+				continue
+			}
+			_ = s.notifyClients(name, fmt.Sprintf("Kicked client %s", msg.Text()))
+
+		case socketchat.CommandBroadcast:
+			_ = s.broadcast(msg.Text())
 
 		case socketchat.CommandLeave:
 			// If we're asked to close the connection, delete the reference and return
 			// TODO: Remove the client from all groups
-			s.DeleteConnection(name)
-			log.Printf("Client %s has left the server :(", msg.Sender)
+			s.dropConnection(name, c)
+			logger.Infof("Client %s has left the server :(", msg.Sender)
 			return
 
 		default:
-			log.Printf("Couldn't understand the message: %q", msg.Command)
+			logger.Warnf("Couldn't understand the message: %q", msg.Command)
 		}
 	}
 }
 
-func (s *Server) sendToClient(msg *socketchat.Message, overrideReceiver *string) error {
-	receiver := msg.Receiver
-	if overrideReceiver != nil {
-		// In the case of sending messages to groups, we want to keep the group name in msg.Receiver
-		receiver = *overrideReceiver
-	}
+// groupSendFailures counts the members a group message couldn't be delivered to, e.g. as they are slow consumers
+var groupSendFailures = expvar.NewInt("group_send_failures")
 
-	if receiverc, ok := s.GetConnection(receiver); ok {
-		// This message was meant for only one client
-		if err := receiverc.Send(msg); err != nil {
-			return fmt.Errorf("error forwarding message: %v", err)
-		}
-
-		return nil // we're done here
+func (s *Server) sendToClient(msg *socketchat.Message) error {
+	if conns := s.GetConnections(msg.Receiver); len(conns) != 0 {
+		// This message was meant for only one client, but it may have several sessions
+		return s.sendToSessions(msg, msg.Receiver, conns, false)
 	}
 
+	// Copy the members, so the groups aren't locked while sending, which may take up to the write timeout per member
 	s.groupsMux.Lock()
-	defer s.groupsMux.Unlock()
-	members, ok := s.groups[receiver]
+	g, ok := s.groups[msg.Receiver]
+	var members []string
+	if ok {
+		members = g.snapshot()
+	}
+	s.groupsMux.Unlock()
 	if !ok {
-		return fmt.Errorf("client %q not found", receiver)
+		return codedError(socketchat.ErrorCodeNotFound, "client %q not found", msg.Receiver)
 	}
 
-	for member := range members {
-		if err := s.sendToClient(msg, &member); err != nil {
-			return err
+	// The message goes straight to the sessions of the members, as a member may have the name of a group, even of
+	// this one. Offline members are skipped. A member that can't be reached, e.g. a slow consumer, shouldn't stop
+	// delivery to the others, and isn't the sender's fault, so it's only logged and counted
+	for _, member := range members {
+		conns := s.GetConnections(member)
+		if len(conns) == 0 {
+			continue
+		}
+		if err := s.sendToSessions(msg, member, conns, true); err != nil {
+			groupSendFailures.Add(1)
+			logger.Warnf("Failed to deliver a message from %s in group %s to %s: %v", msg.Sender, msg.Receiver, member, err)
 		}
 	}
 
 	return nil
 }
 
-func (s *Server) notifyClients(clientOrGroup, message string) error {
-	return s.sendToClient(&socketchat.Message{
-		Command:  socketchat.CommandMessage,
-		Receiver: clientOrGroup,
-		Sender:   "server",
-		Data:     message,
-	}, nil)
+// sendToSessions sends the message to the sessions of the receiver, unless its delivery preferences defer or drop
+// it. The message is delivered if any of the sessions got it
+func (s *Server) sendToSessions(msg *socketchat.Message, receiver string, conns []*socketchat.Connection, toGroup bool) error {
+	if !s.shouldDeliver(receiver, msg, toGroup) {
+		return nil
+	}
+	var firstErr error
+	delivered := false
+	for _, receiverc := range conns {
+		if err := receiverc.Send(msg); err != nil {
+			s.recordSendError(receiver, receiverc, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delivered = true
+	}
+	if !delivered {
+		return fmt.Errorf("error forwarding message: %v", firstErr)
+	}
+	return nil
 }
 
-func (s *Server) returnErrorToClient(conn *socketchat.Connection, err error) {
-	if err := conn.Send(&socketchat.Message{
-		Command: socketchat.CommandError,
-		Sender:  "server",
-		Data:    err.Error(),
-	}); err != nil {
-		log.Printf("Failed to return error to client: %v", err)
+// recordSendError applies the slow-consumer policy: a client whose sends have timed out slowConsumerLimit
+// times is disconnected. A client which timed out in the middle of a message is disconnected right away,
+// as the rest of the stream can't be parsed anymore
+func (s *Server) recordSendError(name string, c *socketchat.Connection, err error) {
+	if err != socketchat.SendTimeoutError && err != socketchat.PartialSendError {
+		return
 	}
-}
 
-func (s *Server) GetConnection(connID string) (*socketchat.Connection, bool) {
 	s.connsMux.Lock()
-	defer s.connsMux.Unlock()
-
-	c, ok := s.conns[connID]
-	return c, ok
+	s.slowSends[c]++
+	n := s.slowSends[c]
+	s.connsMux.Unlock()
+
+	limit := tuned().slowConsumerLimit
+	logger.Warnf("Sending to client %s timed out (%d/%d)", name, n, limit)
+	if err == socketchat.PartialSendError || n >= limit {
+		logger.Warnf("Disconnecting slow consumer %s", name)
+		s.dropConnection(name, c)
+	}
 }
 
-func (s *Server) SetConnection(connID string, conn *socketchat.Connection) {
-	s.connsMux.Lock()
-	defer s.connsMux.Unlock()
-
-	s.conns[connID] = conn
+func (s *Server) notifyClients(clientOrGroup, message string) error {
+	return s.sendToClient(&socketchat.Message{
+		Command:  socketchat.CommandMessage,
+		Receiver: clientOrGroup,
+		Sender:   serverName,
+		Data:     []byte(message),
+	})
 }
 
-func (s *Server) DeleteConnection(connID string) {
-	s.connsMux.Lock()
-	defer s.connsMux.Unlock()
-
-	delete(s.conns, connID)
+func (s *Server) returnErrorToClient(conn *socketchat.Connection, err error) {
+	if err := conn.Send(socketchat.NewErrorMessage(serverName, err)); err != nil {
+		logger.Warnf("Failed to return error to client: %v", err)
+	}
 }
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// connectPipe adds a session for name to the server, and returns the client's end of it
+func connectPipe(t *testing.T, s *Server, name string) net.Conn {
+	t.Helper()
+	serverEnd, clientEnd := net.Pipe()
+	t.Cleanup(func() {
+		serverEnd.Close()
+		clientEnd.Close()
+	})
+	if err := s.AddConnection(name, socketchat.NewConnection(serverEnd), false); err != nil {
+		t.Fatal(err)
+	}
+	return clientEnd
+}
+
+func TestSendToGroupNamedAfterMember(t *testing.T) {
+	if err := loadTunables(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("tcp", "")
+	// The creator of g went offline, and a member name that is also a group name must not be looked up as a group
+	s.groups["g"] = newGroup("g")
+	// A cycle between groups whose members are the other groups
+	s.groups["a"] = newGroup("b")
+	s.groups["b"] = newGroup("a")
+	s.groups["g"].add("bob")
+	bob := connectPipe(t, s, "bob")
+
+	type result struct {
+		msg *socketchat.Message
+		err error
+	}
+	resC := make(chan result, 1)
+	go func() {
+		msg, err := socketchat.ReadMessage(bob)
+		resC <- result{msg, err}
+	}()
+
+	msg := &socketchat.Message{Command: socketchat.CommandMessage, Sender: "alice", Receiver: "g", Data: []byte("hi")}
+	if err := s.sendToClient(msg); err != nil {
+		t.Fatalf("sendToClient(g) = %v, want the offline member to be skipped", err)
+	}
+	res := <-resC
+	if res.err != nil || res.msg.Receiver != "g" || res.msg.Text() != "hi" {
+		t.Fatalf("bob got %+v, %v, want the message to g", res.msg, res.err)
+	}
+
+	for _, group := range []string{"a", "b"} {
+		msg := &socketchat.Message{Command: socketchat.CommandMessage, Sender: "alice", Receiver: group, Data: []byte("hi")}
+		if err := s.sendToClient(msg); err != nil {
+			t.Fatalf("sendToClient(%s) = %v, want the offline member to be skipped", group, err)
+		}
+	}
+}
+
+func TestSendToGroupWithFailingMember(t *testing.T) {
+	if err := loadTunables(); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("tcp", "")
+	g := newGroup("alice")
+	g.add("bob")
+	g.add("carol")
+	s.groups["g"] = g
+	bob := connectPipe(t, s, "bob")
+	// Sending to carol fails, as her end of the connection is gone
+	connectPipe(t, s, "carol").Close()
+
+	readC := make(chan *socketchat.Message, 1)
+	go func() {
+		msg, _ := socketchat.ReadMessage(bob)
+		readC <- msg
+	}()
+
+	failures := groupSendFailures.Value()
+	msg := &socketchat.Message{Command: socketchat.CommandMessage, Sender: "alice", Receiver: "g", Data: []byte("hi")}
+	if err := s.sendToClient(msg); err != nil {
+		t.Fatalf("sendToClient(g) = %v, want no error for the sender, as bob got the message", err)
+	}
+	if got := <-readC; got == nil || got.Text() != "hi" {
+		t.Fatalf("bob got %+v, want the message to g", got)
+	}
+	if n := groupSendFailures.Value() - failures; n != 1 {
+		t.Fatalf("counted %d failed group sends, want 1 for carol", n)
+	}
+}
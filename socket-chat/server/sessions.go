@@ -0,0 +1,102 @@
+package server
+
+import (
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// sessions are the connections of a client, e.g. from a phone and a laptop. Messages to the client are sent to
+// all of them. sessions is not safe for concurrent use, Server.connsMux guards it
+type sessions struct {
+	conns []*socketchat.Connection
+	// authorized tells whether the sessions authorized the name with a client certificate. All sessions of a
+	// client must agree, so that a guest can't add a session to an authorized client
+	authorized bool
+}
+
+// AddConnection adds a session of a client, as long as the client has less than --max-sessions and the session
+// is authorized like the others
+func (s *Server) AddConnection(name string, c *socketchat.Connection, authorized bool) error {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	ss, ok := s.conns[name]
+	if !ok {
+		s.conns[name] = &sessions{conns: []*socketchat.Connection{c}, authorized: authorized}
+		return nil
+	}
+	if ss.authorized != authorized {
+		return codedError(socketchat.ErrorCodeUnauthorized, "client %s is connected with another authorization", name)
+	}
+	if len(ss.conns) >= *maxSessions {
+		return codedError(socketchat.ErrorCodeLimitExceeded, "client %s can have at most %d sessions", name, *maxSessions)
+	}
+	ss.conns = append(ss.conns, c)
+	return nil
+}
+
+// GetConnections returns a copy of the sessions of a client, which is empty if the client isn't connected
+func (s *Server) GetConnections(name string) []*socketchat.Connection {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	ss, ok := s.conns[name]
+	if !ok {
+		return nil
+	}
+	conns := make([]*socketchat.Connection, len(ss.conns))
+	copy(conns, ss.conns)
+	return conns
+}
+
+// hasConnection returns whether the connection is still a session of the client
+func (s *Server) hasConnection(name string, c *socketchat.Connection) bool {
+	for _, conn := range s.GetConnections(name) {
+		if conn == c {
+			return true
+		}
+	}
+	return false
+}
+
+// dropConnection removes the session of the client, if it's still registered, and closes it
+func (s *Server) dropConnection(name string, c *socketchat.Connection) {
+	s.connsMux.Lock()
+	if ss, ok := s.conns[name]; ok {
+		for i, conn := range ss.conns {
+			if conn == c {
+				ss.conns = append(ss.conns[:i], ss.conns[i+1:]...)
+				break
+			}
+		}
+		if len(ss.conns) == 0 {
+			delete(s.conns, name)
+		}
+	}
+	delete(s.slowSends, c)
+	s.connsMux.Unlock()
+
+	c.Close()
+}
+
+// dropConnections closes all sessions of the client, and returns false if it wasn't connected
+func (s *Server) dropConnections(name string) bool {
+	conns := s.GetConnections(name)
+	for _, c := range conns {
+		s.dropConnection(name, c)
+	}
+	return len(conns) != 0
+}
+
+// sendToOtherSessions sends a message to the sessions of a client other than the one it came from, so that
+// all devices see the direct messages the client sent and which conversations it has read
+func (s *Server) sendToOtherSessions(name string, from *socketchat.Connection, msg *socketchat.Message) {
+	for _, c := range s.GetConnections(name) {
+		if c == from {
+			continue
+		}
+		if err := c.Send(msg); err != nil {
+			s.recordSendError(name, c, err)
+			logger.Warnf("Failed to sync a session of client %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// stats returns the public statistics of the server, which any client may ask for
+func (s *Server) stats() string {
+	s.connsMux.Lock()
+	clients, sessions := len(s.conns), 0
+	for _, ss := range s.conns {
+		sessions += len(ss.conns)
+	}
+	s.connsMux.Unlock()
+
+	s.groupsMux.Lock()
+	groups := len(s.groups)
+	s.groupsMux.Unlock()
+
+	uptime := time.Since(s.started).Round(time.Second)
+	return fmt.Sprintf("up for %s, %d connected clients with %d sessions, %d groups", uptime, clients, sessions, groups)
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+const (
+	// storageKeySize is the size of the AES-256 keys the messages are encrypted at rest with
+	storageKeySize    = 32
+	storageKeyPEMType = "AES KEY"
+)
+
+// storageKey encrypts the messages the server writes to disk with AES-256-GCM, so that a leaked file doesn't expose
+// them without the key file. The key file is kept apart from the data, e.g. on a volume that isn't backed up
+type storageKey struct {
+	aead cipher.AEAD
+}
+
+// loadStorageKey reads the key file, or creates it with a new random key if it doesn't exist
+func loadStorageKey(path string) (*storageKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return createStorageKey(path)
+	} else if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != storageKeyPEMType || len(block.Bytes) != storageKeySize {
+		return nil, fmt.Errorf("%s isn't a %d-byte %s", path, storageKeySize, storageKeyPEMType)
+	}
+	return newStorageKey(block.Bytes)
+}
+
+func createStorageKey(path string) (*storageKey, error) {
+	key := make([]byte, storageKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	// O_EXCL, so that a key some messages are already encrypted with is never replaced
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s for writing: %v", path, err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: storageKeyPEMType, Bytes: key}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Failed to write data to %s: %v", path, err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, fmt.Errorf("Error closing %s: %v", path, err)
+	}
+	logger.Infof("Wrote %s", path)
+	return newStorageKey(key)
+}
+
+func newStorageKey(key []byte) (*storageKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &storageKey{aead: aead}, nil
+}
+
+// seal encrypts the plaintext, and returns it after a random nonce
+func (k *storageKey) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts what seal returned, and fails if it was encrypted with another key or tampered with
+func (k *storageKey) open(sealed []byte) ([]byte, error) {
+	if len(sealed) < k.aead.NonceSize() {
+		return nil, fmt.Errorf("the encrypted data is too short")
+	}
+	nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+	return k.aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	socketchat "github.com/luxas/random-schoolwork/socket-chat"
+)
+
+// deletedUser replaces the sender of the messages of deleted users
+const deletedUser = "deleted-user"
+
+// userExport is all data the server has about a client, see Server.exportUser
+type userExport struct {
+	Client    string   `json:"client"`
+	Connected bool     `json:"connected"`
+	Sessions  int      `json:"sessions"`
+	Groups    []string `json:"groups"`
+	// OwnedGroups are the groups the client is the owner of
+	OwnedGroups []string `json:"ownedGroups"`
+	Preferences string   `json:"preferences,omitempty"`
+	Contacts    []string `json:"contacts"`
+	// Sent are the messages the client sent that the server still has, in the group history or pins, or
+	// waiting for other clients in do-not-disturb mode
+	Sent []exportedMessage `json:"sent"`
+	// Deferred are the messages waiting for the client to leave do-not-disturb mode
+	Deferred []exportedMessage `json:"deferred"`
+}
+
+type exportedMessage struct {
+	Sender   string    `json:"sender"`
+	Receiver string    `json:"receiver"`
+	ID       uint64    `json:"id,omitempty"`
+	Text     string    `json:"text"`
+	Time     time.Time `json:"time"`
+}
+
+// exportUser returns all data the server has about a client as JSON
+func (s *Server) exportUser(name string) (string, error) {
+	export := userExport{
+		Client:      name,
+		Groups:      []string{},
+		OwnedGroups: []string{},
+		Sent:        []exportedMessage{},
+		Deferred:    []exportedMessage{},
+	}
+	export.Sessions = len(s.GetConnections(name))
+	export.Connected = export.Sessions != 0
+	export.Contacts = s.contactList(name)
+
+	s.groupsMux.Lock()
+	for groupName, g := range s.groups {
+		if _, ok := g.members[name]; ok {
+			export.Groups = append(export.Groups, groupName)
+		}
+		if g.owner == name {
+			export.OwnedGroups = append(export.OwnedGroups, groupName)
+		}
+		// Pinned messages may have left the history already
+		exported := map[uint64]bool{}
+		for _, msgs := range [][]groupMessage{g.history, g.pins} {
+			for _, m := range msgs {
+				if m.sender != name || exported[m.id] {
+					continue
+				}
+				exported[m.id] = true
+				export.Sent = append(export.Sent, exportedMessage{Sender: name, Receiver: groupName, ID: m.id, Text: m.data, Time: m.sent})
+			}
+		}
+	}
+	s.groupsMux.Unlock()
+
+	s.prefsMux.Lock()
+	for receiver, p := range s.prefs {
+		if receiver == name {
+			export.Preferences = p.String()
+		}
+		for _, d := range p.deferred {
+			if receiver != name && d.msg.Sender != name {
+				continue
+			}
+			m := exportedMessage{Sender: d.msg.Sender, Receiver: d.msg.Receiver, Text: d.msg.Text(), Time: d.queued}
+			if receiver == name {
+				export.Deferred = append(export.Deferred, m)
+			} else {
+				export.Sent = append(export.Sent, m)
+			}
+		}
+	}
+	s.prefsMux.Unlock()
+
+	b, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// deleteUser disconnects a client and deletes its data: it's removed from its groups, the groups it owns are
+// handed over to the first remaining member or deleted if there is none, the messages it sent are anonymized,
+// its preferences, deferred messages and contacts are dropped, and it's removed from the contacts of others.
+// It returns a summary of what was deleted
+func (s *Server) deleteUser(name string) string {
+	if len(s.GetConnections(name)) != 0 {
+		_ = s.notifyClients(name, "Your data has been deleted by an admin")
+		s.dropConnections(name)
+	}
+
+	left, transferred, deleted, anonymized := 0, map[string]string{}, 0, 0
+	s.groupsMux.Lock()
+	for groupName, g := range s.groups {
+		if g.remove(name) {
+			left++
+		}
+		if g.owner == name {
+			if g.size() == 0 {
+				delete(s.groups, groupName)
+				s.purgeInvites(groupName)
+				deleted++
+				continue
+			}
+			g.owner = g.sorted[0]
+			transferred[groupName] = g.owner
+		}
+		// Pinned messages are copies of the ones in the history
+		ids := map[uint64]bool{}
+		for _, msgs := range [][]groupMessage{g.history, g.pins} {
+			for i := range msgs {
+				if msgs[i].sender == name {
+					msgs[i].sender = deletedUser
+					msgs[i].data = fmt.Sprintf("#%d [deleted]", msgs[i].id)
+					ids[msgs[i].id] = true
+				}
+			}
+		}
+		anonymized += len(ids)
+	}
+	s.groupsMux.Unlock()
+
+	dropped := 0
+	s.prefsMux.Lock()
+	if p, ok := s.prefs[name]; ok {
+		dropped += len(p.deferred)
+		delete(s.prefs, name)
+	}
+	for _, p := range s.prefs {
+		kept := p.deferred[:0]
+		for _, d := range p.deferred {
+			if d.msg.Sender == name {
+				dropped++
+				continue
+			}
+			kept = append(kept, d)
+		}
+		p.deferred = kept
+	}
+	s.prefsMux.Unlock()
+
+	s.contactsMux.Lock()
+	contacts := len(s.contacts[name])
+	delete(s.contacts, name)
+	// The name is the data of the deleted client too
+	for _, roster := range s.contacts {
+		delete(roster, name)
+	}
+	s.contactsMux.Unlock()
+
+	for groupName, owner := range transferred {
+		_ = s.notifyClients(groupName, fmt.Sprintf("Client %s is now the owner of group %s", owner, groupName))
+	}
+	logger.Infof("Deleted the data of client %s", name)
+	return fmt.Sprintf("Deleted the data of %s: left %d groups, handed over %d and deleted %d owned groups, anonymized %d messages, dropped %d deferred messages and %d contacts",
+		name, left, len(transferred), deleted, anonymized, dropped, contacts)
+}
+
+// sendAdminResult sends the result of an admin command, split into as many messages as needed
+func sendAdminResult(c *socketchat.Connection, result string) error {
+	data := []byte(result)
+	for len(data) > 0 {
+		n := len(data)
+		if n > socketchat.MaxDataByteSize {
+			n = socketchat.MaxDataByteSize
+		}
+		if err := c.Send(&socketchat.Message{
+			Command: socketchat.CommandMessage,
+			Sender:  serverName,
+			Data:    data[:n],
+		}); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// webhookQueueSize is how many webhook events can wait for delivery, more events are dropped
+	webhookQueueSize = 100
+	// webhookTimeout is how long delivering a webhook event may take
+	webhookTimeout = 5 * time.Second
+)
+
+// The events webhooks can be configured for
+const (
+	webhookEventMessage = "message"
+	webhookEventJoin    = "join"
+	webhookEventConnect = "connect"
+	webhookEventKick    = "kick"
+)
+
+var webhookEvents = map[string]bool{
+	webhookEventMessage: true,
+	webhookEventJoin:    true,
+	webhookEventConnect: true,
+	webhookEventKick:    true,
+}
+
+var (
+	// webhookDeliveries counts the webhook events that were delivered
+	webhookDeliveries = expvar.NewInt("webhook_deliveries")
+	// webhookFailures counts the webhook events that failed or were dropped
+	webhookFailures = expvar.NewInt("webhook_failures")
+)
+
+// webhook POSTs the events of a kind to a URL. For message and join events, group limits it to a single group
+type webhook struct {
+	event string
+	group string
+	url   string
+}
+
+// parseWebhooks parses a comma-separated list of webhooks, each "<event>[@<group>]=<url>"
+func parseWebhooks(spec string) ([]webhook, error) {
+	hooks := []webhook{}
+	for _, entry := range strings.Split(spec, ",") {
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i == -1 {
+			return nil, fmt.Errorf("invalid webhook %q, expected <event>[@<group>]=<url>", entry)
+		}
+		hook := webhook{event: entry[:i], url: entry[i+1:]}
+		if j := strings.Index(hook.event, "@"); j != -1 {
+			hook.event, hook.group = hook.event[:j], hook.event[j+1:]
+		}
+		if !webhookEvents[hook.event] {
+			return nil, fmt.Errorf("invalid webhook event %q, expected message, join, connect or kick", hook.event)
+		}
+		if hook.group != "" && hook.event != webhookEventMessage && hook.event != webhookEventJoin {
+			return nil, fmt.Errorf("webhooks for %s events can't be limited to a group", hook.event)
+		}
+		u, err := url.Parse(hook.url)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid webhook URL %q, expected an http or https URL", hook.url)
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks, nil
+}
+
+// webhookEvent is the JSON body webhooks are POSTed. Text is a readable summary of the event, which makes it
+// possible to use e.g. Slack incoming webhooks directly
+type webhookEvent struct {
+	Event   string    `json:"event"`
+	Group   string    `json:"group,omitempty"`
+	Client  string    `json:"client"`
+	Message string    `json:"message,omitempty"`
+	Text    string    `json:"text"`
+	Time    time.Time `json:"time"`
+}
+
+// webhookDelivery is an event queued for delivery to a URL
+type webhookDelivery struct {
+	url   string
+	event *webhookEvent
+}
+
+// emitWebhook queues an event for delivery to the webhooks configured for it. It never blocks, so that a slow
+// webhook receiver can't hold up the chat
+func (s *Server) emitWebhook(event, group, client, message string) {
+	var e *webhookEvent
+	for _, hook := range tuned().webhooks {
+		if hook.event != event || (hook.group != "" && hook.group != group) {
+			continue
+		}
+		if e == nil {
+			e = &webhookEvent{
+				Event:   event,
+				Group:   group,
+				Client:  client,
+				Message: message,
+				Text:    webhookText(event, group, client, message),
+				Time:    time.Now(),
+			}
+		}
+		select {
+		case s.webhookC <- webhookDelivery{url: hook.url, event: e}:
+		default:
+			logger.Warnf("Too many queued webhook events, dropping the %s event for %s", event, hook.url)
+			webhookFailures.Add(1)
+		}
+	}
+}
+
+// webhookText returns a readable summary of an event
+func webhookText(event, group, client, message string) string {
+	switch event {
+	case webhookEventMessage:
+		return fmt.Sprintf("%s in %s: %s", client, group, message)
+	case webhookEventJoin:
+		return fmt.Sprintf("%s joined %s", client, group)
+	case webhookEventConnect:
+		return fmt.Sprintf("%s connected", client)
+	case webhookEventKick:
+		return fmt.Sprintf("%s was kicked", client)
+	}
+	return event
+}
+
+// deliverWebhooks POSTs the queued webhook events one at a time
+func (s *Server) deliverWebhooks() {
+	defer crashes.Fatal("webhook delivery")
+	client := &http.Client{Timeout: webhookTimeout}
+	for d := range s.webhookC {
+		if err := postWebhook(client, d); err != nil {
+			logger.Warnf("Failed to deliver the %s event to webhook %s: %v", d.event.Event, d.url, err)
+			webhookFailures.Add(1)
+			continue
+		}
+		webhookDeliveries.Add(1)
+	}
+}
+
+func postWebhook(client *http.Client, d webhookDelivery) error {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(d.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return nil
+}
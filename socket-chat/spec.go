@@ -0,0 +1,228 @@
+package socketchat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//go:generate go run ./gen-spec -o PROTOCOL.md
+
+// FrameField describes a field of the frame every message is sent as
+type FrameField struct {
+	Name        string
+	Size        string
+	Description string
+}
+
+// FrameFields are the fields of a frame, in the order they are on the wire
+var FrameFields = []FrameField{
+	{"start", "2", "Always `0x00 0xff`, marks the start of a frame"},
+	{"command", "1", "The command, see the commands below"},
+	{"sender length", "1", fmt.Sprintf("The length of the sender, at most %d", MaxNameByteSize)},
+	{"receiver length", "1", fmt.Sprintf("The length of the receiver, at most %d", MaxNameByteSize)},
+	{"data length", "1", fmt.Sprintf("The length of the data, at most %d", MaxDataByteSize)},
+	{"sender", "sender length", "The name of the client sending the message, or `server`"},
+	{"receiver", "receiver length", "A client or group name, depending on the command"},
+	{"data", "data length", "The payload of the command, text unless the command says otherwise"},
+}
+
+// CommandSpec describes a command for the protocol spec
+type CommandSpec struct {
+	Command Command
+	Name    string
+	// From tells who sends the command: a client, the server, an admin over the admin socket, or several of them
+	From        string
+	Description string
+	// Example is encoded byte for byte in the spec
+	Example Message
+}
+
+// CommandSpecs describe all commands, in the order of their values
+var CommandSpecs = []CommandSpec{
+	{CommandNewClient, "NewClient", "client",
+		"The first message on a connection. The data is the name to register with, the sender is empty",
+		Message{Command: CommandNewClient, Data: []byte("foo")}},
+	{CommandNewChat, "NewChat", "client",
+		"Creates a group with the sender as its owner. The data is the group name",
+		Message{Command: CommandNewChat, Sender: "foo", Data: []byte("g")}},
+	{CommandJoinChat, "JoinChat", "client",
+		"Joins a public group. The data is the group name",
+		Message{Command: CommandJoinChat, Sender: "foo", Data: []byte("g")}},
+	{CommandLeaveChat, "LeaveChat", "client",
+		"Leaves a group. The data is the group name",
+		Message{Command: CommandLeaveChat, Sender: "foo", Data: []byte("g")}},
+	{CommandMessage, "Message", "client, server",
+		"A chat message to the receiver, a client or group. The server prefixes messages to groups with `#<id> `, and sends notices with the sender `server`. Text starting with `ttl=<duration> ` expires after the duration, and is then dropped by the server",
+		Message{Command: CommandMessage, Sender: "foo", Receiver: "bar", Data: []byte("hi")}},
+	{CommandLeave, "Leave", "client",
+		"Disconnects from the server",
+		Message{Command: CommandLeave, Sender: "foo"}},
+	{CommandError, "Error", "server",
+		"An error. The data is `<code> <message>`, where the code is an ErrorCode in decimal. The server replies to commands it doesn't know with the code 10, unknown-command",
+		Message{Command: CommandError, Sender: "server", Data: []byte("2 group g doesn't exist!")}},
+	{CommandKick, "Kick", "client, admin",
+		"Disconnects the client named in the data, for operators and admins",
+		Message{Command: CommandKick, Sender: "op", Data: []byte("foo")}},
+	{CommandBroadcast, "Broadcast", "client, admin",
+		"Sends the data to all clients, for operators and admins",
+		Message{Command: CommandBroadcast, Sender: "op", Data: []byte("restarting")}},
+	{CommandVersion, "Version", "client, server",
+		"The data is the version of the sender. The server replies with its own",
+		Message{Command: CommandVersion, Sender: "foo", Data: []byte("v1.0.0")}},
+	{CommandListMembers, "ListMembers", "client, server",
+		"Requests the members of a group with the data `<group>,<offset>`. The reply has the group as the receiver, and the data `<next offset>/<total>:<member>,<member>,...`, where a next offset of 0 means there are no more pages",
+		Message{Command: CommandListMembers, Sender: "foo", Data: []byte("g,0")}},
+	{CommandData, "Data", "client",
+		"Binary data for bots. The first byte of the data is a type tag, followed by the payload",
+		Message{Command: CommandData, Sender: "foo", Receiver: "bar", Data: []byte{0x01, 0xca, 0xfe}}},
+	{CommandPin, "Pin", "client",
+		"Pins a message in a group. The data is `<group>,<id>`",
+		Message{Command: CommandPin, Sender: "foo", Data: []byte("g,1")}},
+	{CommandPins, "Pins", "client, server",
+		"Requests the pinned messages of the group in the data. The server sends each pinned message with its original sender and the group as the receiver",
+		Message{Command: CommandPins, Sender: "foo", Data: []byte("g")}},
+	{CommandPreferences, "Preferences", "client",
+		"Sets delivery preferences. The data is `;`-separated `<key>=<value>` pairs: `dnd`, `dms-only`, `mention-only` and `tz`",
+		Message{Command: CommandPreferences, Sender: "foo", Data: []byte("dnd=22-7;tz=3600")}},
+	{CommandTransferChat, "TransferChat", "client",
+		"Makes another member the owner of a group. The data is `<group>,<member>`",
+		Message{Command: CommandTransferChat, Sender: "foo", Data: []byte("g,bar")}},
+	{CommandDeleteChat, "DeleteChat", "client",
+		"Deletes a group. The data is the group name",
+		Message{Command: CommandDeleteChat, Sender: "foo", Data: []byte("g")}},
+	{CommandNewPrivateChat, "NewPrivateChat", "client",
+		"Creates a group that can only be joined with an invite code. The data is the group name",
+		Message{Command: CommandNewPrivateChat, Sender: "foo", Data: []byte("p")}},
+	{CommandInvite, "Invite", "client",
+		"Creates an invite code to a private group. The data is `<group>,once` or `<group>,<duration>`",
+		Message{Command: CommandInvite, Sender: "foo", Data: []byte("p,2h")}},
+	{CommandJoinCode, "JoinCode", "client",
+		"Joins the group an invite code is for. The data is the code",
+		Message{Command: CommandJoinCode, Sender: "bar", Data: []byte("0123456789abcdef")}},
+	{CommandRetention, "Retention", "client",
+		"Sets how long the history of a group is kept. The data is `<group>,<duration>` or `<group>,default`",
+		Message{Command: CommandRetention, Sender: "foo", Data: []byte("g,24h")}},
+	{CommandPurge, "Purge", "admin",
+		"Purges the messages older than the retention, and returns the statistics",
+		Message{Command: CommandPurge, Sender: "admin"}},
+	{CommandStats, "Stats", "client, server",
+		"Requests the public statistics of the server. The reply's data is a readable summary",
+		Message{Command: CommandStats, Sender: "foo"}},
+	{CommandExportUser, "ExportUser", "admin",
+		"Exports the data of the client named in the data as JSON, split over several Message replies",
+		Message{Command: CommandExportUser, Sender: "admin", Data: []byte("foo")}},
+	{CommandDeleteUser, "DeleteUser", "admin",
+		"Deletes the data of the client named in the data",
+		Message{Command: CommandDeleteUser, Sender: "admin", Data: []byte("foo")}},
+	{CommandHeartbeat, "Heartbeat", "client, server",
+		"Echoed back by the server with the same data, to measure the round-trip time. The client sends an 8-byte big-endian sequence number",
+		Message{Command: CommandHeartbeat, Sender: "foo", Data: []byte{0, 0, 0, 0, 0, 0, 0, 1}}},
+	{CommandRead, "Read", "client, server",
+		"Marks the conversation in the data, a group or client name, as read. The server forwards it to the other sessions of the sender",
+		Message{Command: CommandRead, Sender: "foo", Data: []byte("g")}},
+	{CommandAddContact, "AddContact", "client",
+		"Adds the client named in the data to the contacts of the sender. The contacts are kept when the sender disconnects",
+		Message{Command: CommandAddContact, Sender: "foo", Data: []byte("bar")}},
+	{CommandRemoveContact, "RemoveContact", "client",
+		"Removes the client named in the data from the contacts of the sender",
+		Message{Command: CommandRemoveContact, Sender: "foo", Data: []byte("bar")}},
+	{CommandContacts, "Contacts", "client, server",
+		"Requests the contacts of the sender. The server replies with one message per contact, with the contact as the receiver and `online` or `offline` as the data",
+		Message{Command: CommandContacts, Sender: "server", Receiver: "bar", Data: []byte("online")}},
+	{CommandACL, "ACL", "admin",
+		"Edits the access lists with the data `<list> add|remove <entry>`, where the list is `allow-cidr`, `deny-cidr`, `allow-name` or `deny-name`, or shows them with `list`. The reply is the lists after the edit",
+		Message{Command: CommandACL, Sender: "admin", Data: []byte("deny-cidr add 203.0.113.0/24")}},
+	{CommandChallenge, "Challenge", "client, server",
+		"A proof-of-work challenge the server may send after NewClient, with the data `<bits> <challenge>`. The client replies with a decimal nonce as the data, such that the SHA-256 hash of the challenge followed by the nonce starts with the given number of zero bits. The server handles the client's other messages once the challenge is solved",
+		Message{Command: CommandChallenge, Sender: "server", Data: []byte("20 8f14e45fceea167a5a36dedd4bea2543")}},
+	{CommandAnnouncements, "Announcements", "client",
+		"Makes a group an announcement group with the data `<group>,on`, where only the owner and operators may send Message and Data, or writable for all members again with `<group>,off`",
+		Message{Command: CommandAnnouncements, Sender: "foo", Data: []byte("g,on")}},
+}
+
+func (c Command) String() string {
+	if i := int(c) - 1; i >= 0 && i < len(CommandSpecs) {
+		return CommandSpecs[i].Name
+	}
+	return fmt.Sprintf("Command(%d)", byte(c))
+}
+
+// VerifySpec checks that CommandSpecs lists the commands in order, and that every example survives being encoded
+// and decoded, so that the spec matches what Connection sends
+func VerifySpec() error {
+	if len(CommandSpecs) != int(commandEnd)-1 {
+		return fmt.Errorf("there are %d commands, but CommandSpecs lists %d", int(commandEnd)-1, len(CommandSpecs))
+	}
+	for i, spec := range CommandSpecs {
+		if int(spec.Command) != i+1 {
+			return fmt.Errorf("command %s has the value %d, but is listed as number %d", spec.Name, spec.Command, i+1)
+		}
+		if spec.Example.Command != spec.Command {
+			return fmt.Errorf("the example of command %s is a %s", spec.Name, spec.Example.Command)
+		}
+		frame, err := spec.Example.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("encoding the example of command %s: %v", spec.Name, err)
+		}
+		decoded, err := ReadMessage(bytes.NewReader(frame))
+		if err != nil {
+			return fmt.Errorf("decoding the example of command %s: %v", spec.Name, err)
+		}
+		// The wire doesn't tell nil data apart from empty data
+		if decoded.Command != spec.Command || decoded.Sender != spec.Example.Sender ||
+			decoded.Receiver != spec.Example.Receiver || !bytes.Equal(decoded.Data, spec.Example.Data) {
+			return fmt.Errorf("the example of command %s decodes to %+v, expected %+v", spec.Name, *decoded, spec.Example)
+		}
+	}
+	return nil
+}
+
+// WriteSpec writes the protocol spec as Markdown, with the frame layout, the commands and an encoded example of each
+func WriteSpec(w io.Writer) error {
+	if err := VerifySpec(); err != nil {
+		return err
+	}
+	b := &strings.Builder{}
+	b.WriteString("# socket-chat protocol\n\n")
+	b.WriteString("<!-- Generated by `go generate` from spec.go, don't edit by hand -->\n\n")
+	b.WriteString("Clients connect to the server over TCP, with TLS 1.3 unless the server runs with `--secure=false`.\n")
+	b.WriteString("Both directions are a stream of frames, and the first frame from a client must be NewClient.\n\n")
+
+	b.WriteString("## Frames\n\n")
+	b.WriteString("| Field | Size (bytes) | Description |\n|---|---|---|\n")
+	for _, f := range FrameFields {
+		fmt.Fprintf(b, "| %s | %s | %s |\n", f.Name, f.Size, f.Description)
+	}
+	fmt.Fprintf(b, "\nA frame is at most %d bytes. Lengths are unsigned bytes, names and text are UTF-8.\n\n", HeaderSize+2*MaxNameByteSize+MaxDataByteSize)
+
+	b.WriteString("## Commands\n\n")
+	b.WriteString("| Value | Command | From | Description |\n|---|---|---|---|\n")
+	for _, spec := range CommandSpecs {
+		fmt.Fprintf(b, "| %d | %s | %s | %s |\n", spec.Command, spec.Name, spec.From, spec.Description)
+	}
+
+	b.WriteString("\n## Examples\n\n")
+	b.WriteString("Every command encoded as a frame, in hex:\n\n")
+	for _, spec := range CommandSpecs {
+		frame, err := spec.Example.MarshalBinary()
+		if err != nil {
+			return err
+		}
+		fields := []string{}
+		if spec.Example.Sender != "" {
+			fields = append(fields, fmt.Sprintf("sender `%s`", spec.Example.Sender))
+		}
+		if spec.Example.Receiver != "" {
+			fields = append(fields, fmt.Sprintf("receiver `%s`", spec.Example.Receiver))
+		}
+		if len(spec.Example.Data) != 0 {
+			fields = append(fields, fmt.Sprintf("data %q", spec.Example.Data))
+		}
+		fmt.Fprintf(b, "- %s, %s:\n  `% x`\n", spec.Name, strings.Join(fields, ", "), frame)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}